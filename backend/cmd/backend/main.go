@@ -1,8 +1,9 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"time"
@@ -13,28 +14,25 @@ import (
 )
 
 func main() {
-	paths := []string{
-		"/etc/backend/config.json",
-		"config.json",
+	flags, err := config.ParseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
 	}
-	var cfg *config.Config
-	var err error
-
-	for _, path := range paths {
-		cfg, err = config.LoadFromFile(path)
-		if err == nil {
-			break
-		}
-	}
-
 	if err != nil {
-		cfg, err = config.LoadFromEnv()
+		os.Exit(2)
 	}
-
+	cfg, err := config.Load(flags)
 	if err != nil {
 		logging.Error("Failed to load a config from any path or env: %v", err)
 		os.Exit(1)
 	}
+	if err := logging.SetFormat(cfg.LogFormat); err != nil {
+		logging.Error("%v", err)
+		os.Exit(1)
+	}
+	// Validated by Load.
+	level, _ := logging.ParseLevel(cfg.LogLevel)
+	logging.SetLevel(level)
 	handler := handlers.NewServiceHandler(cfg.ServiceName)
 
 	mux := http.NewServeMux()
@@ -47,6 +45,8 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 	logging.Info("Starting server on %s", server.Addr)
-	log.Fatal(server.ListenAndServe())
-
+	if err := server.ListenAndServe(); err != nil {
+		logging.Error("Server stopped: %v", err)
+		os.Exit(1)
+	}
 }
@@ -4,14 +4,25 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
 
 	"pkg/logging"
+	"pkg/toml"
 )
 
 type Config struct {
 	Port        int    `json:"port"`
 	ServiceName string `json:"name"`
+	// LogFormat is "text", the default, or "json" for one JSON object per
+	// log line.
+	LogFormat string `json:"logformat"`
+	// LogLevel is the least severe level logged: "debug", "info", the
+	// default, "warn" or "error".
+	LogLevel string `json:"loglevel"`
 }
 
 func LoadFromEnv() (*Config, error) {
@@ -37,20 +48,36 @@ func LoadFromEnv() (*Config, error) {
 	return &cfg, nil
 }
 
+// LoadFromFile reads the config at path, as YAML when it ends in .yaml or
+// .yml, as TOML when it ends in .toml and as JSON otherwise. All of them use
+// the same field names.
 func LoadFromFile(path string) (*Config, error) {
-	file, err := os.Open(path)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to open the config file %s: %w", path, err)
 	}
-	defer file.Close()
 
-	decoder := json.NewDecoder(file)
+	format := "JSON"
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = "YAML"
+		data, err = yaml.YAMLToJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing YAML: %w", err)
+		}
+	case ".toml":
+		format = "TOML"
+		data, err = toml.ToJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing TOML: %w", err)
+		}
+	}
 
 	cfg := &Config{}
 
-	err = decoder.Decode(&cfg)
+	err = json.Unmarshal(data, &cfg)
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing JSON: %w", err)
+		return nil, fmt.Errorf("Error parsing %s: %w", format, err)
 	}
 	logging.Debug("Loaded config from Path %s: %+v", path, cfg)
 	return cfg, nil
@@ -21,6 +21,36 @@ func TestLoadConfigFile_Success(t *testing.T) {
 
 }
 
+func TestLoadConfigFile_YAML(t *testing.T) {
+	cfg, err := LoadFromFile("testdata/valid_config.yaml")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if cfg.Port != 8080 {
+		t.Errorf("Expected port 8080, got: %d", cfg.Port)
+	}
+
+	if cfg.ServiceName != "test" {
+		t.Errorf("Expected service name 'test', got '%s'", cfg.ServiceName)
+	}
+}
+
+func TestLoadConfigFile_TOML(t *testing.T) {
+	cfg, err := LoadFromFile("testdata/valid_config.toml")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if cfg.Port != 8080 {
+		t.Errorf("Expected port 8080, got: %d", cfg.Port)
+	}
+
+	if cfg.ServiceName != "test" {
+		t.Errorf("Expected service name 'test', got '%s'", cfg.ServiceName)
+	}
+}
+
 func TestLoadFileConfig_FileNotFound(t *testing.T) {
 	_, err := LoadFromFile("/no/file.json")
 	if err == nil {
@@ -98,3 +128,98 @@ func TestLoadEnvConfig_BadPort(t *testing.T) {
 		t.Fatalf("Loaded config when no SERVICE_PORT was not an int")
 	}
 }
+
+func TestLoad_Flags(t *testing.T) {
+	flags, err := ParseFlags([]string{"--config", "testdata/valid_config.json", "--port", "9090"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	cfg, err := Load(flags)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if cfg.Port != 9090 {
+		t.Errorf("Expected port 9090, got: %d", cfg.Port)
+	}
+
+	if cfg.ServiceName != "test" {
+		t.Errorf("Expected service name 'test' from the file, got '%s'", cfg.ServiceName)
+	}
+}
+
+func TestLoad_FlagsOnly(t *testing.T) {
+	t.Chdir(t.TempDir())
+	flags, err := ParseFlags([]string{"--port", "8080", "--name", "api"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	cfg, err := Load(flags)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if cfg.Port != 8080 || cfg.ServiceName != "api" {
+		t.Errorf("Expected the config from the flags, got: %+v", cfg)
+	}
+
+	flags, _ = ParseFlags([]string{"--port", "8080"})
+	if _, err := Load(flags); err == nil {
+		t.Error("Expected an error without a name")
+	}
+}
+
+func TestLoad_Logging(t *testing.T) {
+	t.Setenv("LOG_FORMAT", "json")
+	flags, err := ParseFlags([]string{"--config", "testdata/valid_config.json"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	cfg, err := Load(flags)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if cfg.LogFormat != "json" {
+		t.Errorf("Expected log format json from the environment, got '%s'", cfg.LogFormat)
+	}
+
+	flags, _ = ParseFlags([]string{"--config", "testdata/valid_config.json", "--log-format", "xml"})
+	if _, err := Load(flags); err == nil {
+		t.Error("Expected an error for an unknown log format")
+	}
+
+	flags, _ = ParseFlags([]string{"--config", "testdata/valid_config.json", "--log-level", "debug"})
+	if cfg, err := Load(flags); err != nil || cfg.LogLevel != "debug" {
+		t.Errorf("Expected log level debug from the flag, got %+v, %v", cfg, err)
+	}
+	flags, _ = ParseFlags([]string{"--config", "testdata/valid_config.json", "--log-level", "verbose"})
+	if _, err := Load(flags); err == nil {
+		t.Error("Expected an error for an unknown log level")
+	}
+}
+
+func TestLoad_EnvOverridesFile(t *testing.T) {
+	t.Setenv("SERVICE_PORT", "9000")
+	flags, err := ParseFlags([]string{"--config", "testdata/valid_config.json"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	cfg, err := Load(flags)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if cfg.Port != 9000 {
+		t.Errorf("Expected port 9000 from the environment, got: %d", cfg.Port)
+	}
+	if cfg.ServiceName != "test" {
+		t.Errorf("Expected service name 'test' from the file, got '%s'", cfg.ServiceName)
+	}
+
+	flags, _ = ParseFlags([]string{"--config", "testdata/valid_config.json", "--port", "9100"})
+	cfg, err = Load(flags)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if cfg.Port != 9100 {
+		t.Errorf("Expected the flag to win over the environment, got: %d", cfg.Port)
+	}
+}
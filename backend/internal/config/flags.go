@@ -0,0 +1,131 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"pkg/logging"
+)
+
+// DefaultPaths are tried in order for the config file when --config is not
+// given.
+var DefaultPaths = []string{
+	"/etc/backend/config.json",
+	"/etc/backend/config.yaml",
+	"/etc/backend/config.toml",
+	"config.json",
+	"config.yaml",
+	"config.toml",
+}
+
+// Flags are the settings given on the command line. They win over the config
+// file and the environment.
+type Flags struct {
+	// Config is the path of the config file. Empty tries DefaultPaths.
+	Config      string
+	Port        int
+	ServiceName string
+	LogFormat   string
+	LogLevel    string
+}
+
+// ParseFlags reads the command line arguments, without the program name.
+// It returns flag.ErrHelp when asked for the usage.
+func ParseFlags(args []string) (*Flags, error) {
+	f := &Flags{}
+	fs := flag.NewFlagSet("backend", flag.ContinueOnError)
+	fs.StringVar(&f.Config, "config", "", "path of the config file, JSON, YAML (.yaml, .yml) or TOML (.toml)")
+	fs.IntVar(&f.Port, "port", 0, "port to listen on")
+	fs.StringVar(&f.ServiceName, "name", "", "name the service answers with")
+	fs.StringVar(&f.LogFormat, "log-format", "", "format of the log lines, text or json")
+	fs.StringVar(&f.LogLevel, "log-level", "", "least severe level logged, debug, info, warn or error")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		// Report it the way the flag package reports a bad flag.
+		err := fmt.Errorf("unexpected argument %s", fs.Arg(0))
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Apply sets the flags that were given on cfg.
+func (f *Flags) Apply(cfg *Config) {
+	if f.Port != 0 {
+		cfg.Port = f.Port
+	}
+	if f.ServiceName != "" {
+		cfg.ServiceName = f.ServiceName
+	}
+	if f.LogFormat != "" {
+		cfg.LogFormat = f.LogFormat
+	}
+	if f.LogLevel != "" {
+		cfg.LogLevel = f.LogLevel
+	}
+}
+
+// applyEnv sets SERVICE_NAME, SERVICE_PORT, LOG_FORMAT and LOG_LEVEL on
+// cfg, each when it is set.
+func applyEnv(cfg *Config) error {
+	if name, ok := os.LookupEnv("SERVICE_NAME"); ok {
+		cfg.ServiceName = name
+	}
+	if format, ok := os.LookupEnv("LOG_FORMAT"); ok {
+		cfg.LogFormat = format
+	}
+	if level, ok := os.LookupEnv("LOG_LEVEL"); ok {
+		cfg.LogLevel = level
+	}
+	if portStr, ok := os.LookupEnv("SERVICE_PORT"); ok {
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return fmt.Errorf("failed to convert port to an int, %s", portStr)
+		}
+		cfg.Port = port
+	}
+	return nil
+}
+
+// Load reads the config file given with --config, or else the first of
+// DefaultPaths that loads, then lays the environment over it and the flags
+// over that. Each layer only replaces the settings it has, so without a file
+// the environment and flags have to give both the port and the name.
+func Load(f *Flags) (*Config, error) {
+	cfg := &Config{}
+	if f.Config != "" {
+		var err error
+		cfg, err = LoadFromFile(f.Config)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, path := range DefaultPaths {
+			if file, err := LoadFromFile(path); err == nil {
+				cfg = file
+				break
+			}
+		}
+	}
+
+	if err := applyEnv(cfg); err != nil {
+		return nil, err
+	}
+	f.Apply(cfg)
+	if cfg.Port == 0 || cfg.ServiceName == "" {
+		return nil, fmt.Errorf("no port or name, set them in a config file, SERVICE_PORT and SERVICE_NAME or --port and --name")
+	}
+	if !logging.ValidFormat(cfg.LogFormat) {
+		return nil, fmt.Errorf("unknown log format %q, use text or json", cfg.LogFormat)
+	}
+	if _, err := logging.ParseLevel(cfg.LogLevel); err != nil {
+		return nil, err
+	}
+	logging.Debug("Loaded config: %+v", cfg)
+	return cfg, nil
+}
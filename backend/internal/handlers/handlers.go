@@ -15,6 +15,7 @@ type StatusResponse struct {
 	PodIP       string `json:"podip"`
 	ServiceName string `json:"servicename"`
 	StartTime   string `json:"starttime"`
+	Count       int64  `json:"count"`
 }
 
 type PingResponse struct {
@@ -69,6 +70,7 @@ func (s *ServiceHandler) status(w http.ResponseWriter, r *http.Request) {
 		PodIP:       podip,
 		ServiceName: s.ServiceName,
 		StartTime:   s.StartTime,
+		Count:       atomic.LoadInt64(&s.Count),
 	}
 	logging.Debug("Sending status: %v", response)
 	writeJSON(w, http.StatusOK, response)
@@ -72,6 +72,20 @@ func TestStatus_counter(t *testing.T) {
 	assert.Equal(t, int64(0), handler.Count)
 }
 
+func TestStatus_ReportsCount(t *testing.T) {
+	handler := NewServiceHandler("test")
+
+	handler.ping(httptest.NewRecorder(), httptest.NewRequest("GET", "/ping", nil))
+	handler.ping(httptest.NewRecorder(), httptest.NewRequest("GET", "/ping", nil))
+
+	rr := httptest.NewRecorder()
+	handler.status(rr, httptest.NewRequest("GET", "/status", nil))
+
+	var response StatusResponse
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	assert.Equal(t, int64(2), response.Count)
+}
+
 func TestPing(t *testing.T) {
 	handler := NewServiceHandler("test")
 
@@ -90,7 +104,7 @@ func TestPing(t *testing.T) {
 func TestWriteJSON(t *testing.T) {
 	rr := httptest.NewRecorder()
 	data := struct {
-		Foo string `json:foo`
+		Foo string `json:"foo"`
 	}{
 		Foo: "bar",
 	}
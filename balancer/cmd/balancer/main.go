@@ -2,83 +2,1252 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/quic-go/quic-go/http3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+
 	"balancer/internal/config"
 	"balancer/internal/discovery"
 	"balancer/internal/handlers"
+	"balancer/internal/healthcheck"
+	"balancer/internal/proxy"
+	"balancer/internal/strategy"
 	"pkg/logging"
 )
 
 func main() {
-	paths := []string{
-		"/etc/balancer/config.json",
-		"config.json",
+	flags, err := config.ParseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+	if flags.ConfigMap != "" || flags.BalancerConfig != "" {
+		flags.Source, err = kubernetesSource(flags)
+		if err != nil {
+			logging.Error("Failed to read the config from %s%s: %v", flags.ConfigMap, flags.BalancerConfig, err)
+			os.Exit(1)
+		}
+	}
+	cfg, path, err := config.Load(flags)
+	if err != nil {
+		reportStatus(flags.Source, err)
+		logging.Error("Failed to load a config from any path or env, %v", err)
+		os.Exit(1)
+	}
+	setLogging(cfg)
+	stopTracing, err := startTracing(cfg.Tracing)
+	if err != nil {
+		logging.Error("Failed to set up tracing: %v", err)
+		os.Exit(1)
 	}
-	// consider a kubeconf config value for running locally.
-	var cfg *config.Config
-	var err error
 
-	for _, path := range paths {
-		cfg, err = config.LoadFromFile(path)
-		if err == nil {
-			break
+	if logging.Enabled(logging.DEBUG) {
+		if redacted, err := cfg.Redacted(); err == nil {
+			logging.Debug("We loaded the config from main: %v", redacted)
 		}
 	}
 
+	stopCh := make(chan struct{})
+
+	drainTimeout := cfg.DrainTimeout.Duration
+	if drainTimeout == 0 {
+		drainTimeout = config.DefaultDrainTimeout
+	}
+	drainer := proxy.NewDrainer(drainTimeout)
+	source := &backendSource{cfg: cfg, stopCh: stopCh, drainer: drainer, inflight: strategy.NewInflightTracker()}
+	handler, strategyOptions, err := build(cfg, source, strategy.Options{})
+	reportStatus(flags.Source, err)
 	if err != nil {
-		cfg, err = config.LoadFromEnv()
+		logging.Error("Failed to set up the balancer: %v", err)
+		os.Exit(1)
+	}
+	var tcpSNIHandlers map[string]*handlers.BalanceHandler
+	if cfg.Mode == config.ModeTCP {
+		sniBackends := make([]*discovery.BackendList, len(cfg.SNIRoutes))
+		for i, route := range cfg.SNIRoutes {
+			sniBackends[i] = source.get(route.BackendName)
+		}
+		tcpSNIHandlers = sniHandlers(cfg, strategyOptions, sniBackends, source.checkers)
 	}
+	allHandlers := []*handlers.BalanceHandler{handler}
+	for _, sniHandler := range tcpSNIHandlers {
+		allHandlers = append(allHandlers, sniHandler)
+	}
+	source.readyOnSync(allHandlers)
 
+	swap := handlers.NewSwap(handler)
+	switch cfg.Mode {
+	case config.ModeTCP:
+		err = serveTCP(cfg, swap, tcpSNIHandlers, drainer, stopCh)
+	case config.ModeUDP:
+		err = serveUDP(cfg, swap, drainer, stopCh)
+	case config.ModeGRPC:
+		err = serveGRPC(cfg, swap, stopCh)
+	default:
+		err = serveHTTP(cfg, swap, stopCh)
+	}
 	if err != nil {
-		logging.Error("Failed to load a config from any path or env, %v", err)
+		logging.Error("Failed to start the balancer: %v", err)
 		os.Exit(1)
 	}
 
-	logging.Debug("We loaded the config from main: %v\n", cfg)
+	if cfg.HTTP3Port != 0 {
+		tlsConfig, err := listenerTLS(cfg, source)
+		if err != nil {
+			logging.Error("Failed to load the http3 certificate: %v", err)
+			os.Exit(1)
+		}
+		if err := serveHTTP3(cfg, swap, tlsConfig, stopCh); err != nil {
+			logging.Error("Failed to start the http3 server: %v", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.AdminPort != 0 {
+		if err := serveAdmin(cfg, swap.Admin(), stopCh); err != nil {
+			logging.Error("Failed to start the admin server: %v", err)
+			os.Exit(1)
+		}
+	}
 
-	stopCh := make(chan struct{})
+	reloader := &reloader{flags: flags, cfg: cfg, source: source, swap: swap}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			reloader.reload()
+		}
+	}()
+	if flags.Source != nil {
+		if err := flags.Source.Watch(cfg.ReloadDebounce.Duration, reloader.reload, stopCh); err != nil {
+			logging.Warning("Changes to %s are only reloaded on SIGHUP: %v", flags.Source, err)
+		} else {
+			logging.Info("Reloading %s when it changes", flags.Source)
+		}
+	} else if path != "" {
+		if err := config.Watch(path, cfg.ReloadDebounce.Duration, reloader.reload, stopCh); err != nil {
+			logging.Warning("Changes to %s are only reloaded on SIGHUP: %v", path, err)
+		} else {
+			logging.Info("Reloading %s when it changes", path)
+		}
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+	close(stopCh)
+	// Export the spans still buffered before exiting.
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+	if err := stopTracing(ctx); err != nil {
+		logging.Warning("Failed to export the last spans: %v", err)
+	}
+}
 
-	factory, err := discovery.GetBackendFactory("")
+// setLogging applies the log format and level of cfg, which Load has
+// validated.
+func setLogging(cfg *config.Config) {
+	_ = logging.SetFormat(cfg.LogFormat)
+	level, _ := logging.ParseLevel(cfg.LogLevel)
+	logging.SetLevel(level)
+}
+
+// tracingShutdownTimeout bounds the export of the last spans on exit.
+const tracingShutdownTimeout = 5 * time.Second
+
+// startTracing exports the spans of proxied requests over OTLP/HTTP as cfg
+// describes, and sends the W3C traceparent of each on to its backend. It
+// returns the func that flushes and stops the exporter. With cfg nil spans
+// are not recorded and the func does nothing.
+func startTracing(cfg *config.Tracing) (func(context.Context) error, error) {
+	if cfg == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+	var opts []otlptracehttp.Option
+	if cfg.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	}
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
 	if err != nil {
-		logging.Error("Failed to create backend factory: %v", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to create the otlp exporter: %w", err)
+	}
+	ratio := 1.0
+	if cfg.SampleRatio != nil {
+		ratio = *cfg.SampleRatio
 	}
-	backends := discovery.GetBackends(factory, cfg.BackendName)
-	factory.Start(stopCh)
-	// consider using cache.WaitForCacheSync(stopCh, endpointInformer.HasSynced) so you can capture bool out for errors
-	factory.WaitForCacheSync(stopCh)
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the balancer for traces: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logging.Warning("Tracing error: %v", err)
+	}))
+	logging.Info("Tracing requests as %s, sampling %g of new traces", cfg.ServiceName, ratio)
+	return provider.Shutdown, nil
+}
 
-	handler := handlers.NewBalanceHandler(cfg.BackendName, cfg.BackendPort, cfg.LoadbalancerPort, cfg.LoadbalancerMethod, backends)
-	mux := http.NewServeMux()
-	handler.Register(mux)
+// kubernetesSource connects to the ConfigMap named by --configmap or the
+// BalancerConfig named by --balancerconfig, in the balancer's own namespace
+// unless it names one.
+func kubernetesSource(flags *config.Flags) (config.Source, error) {
+	object := flags.ConfigMap + flags.BalancerConfig
+	namespace, name, ok := strings.Cut(object, "/")
+	if !ok {
+		name = namespace
+		var err error
+		namespace, err = discovery.DetectNamespace()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if flags.BalancerConfig != "" {
+		client, err := discovery.NewDynamicClient(flags.Kubeconfig())
+		if err != nil {
+			return nil, err
+		}
+		return config.NewBalancerConfig(client, namespace, name), nil
+	}
+	client, err := discovery.NewClient(flags.Kubeconfig())
+	if err != nil {
+		return nil, err
+	}
+	return config.NewConfigMap(client, namespace, name, flags.ConfigMapKey), nil
+}
+
+// reportStatus records on source whether its config was applied, when it
+// keeps a status.
+func reportStatus(source config.Source, err error) {
+	if reporter, ok := source.(config.StatusReporter); ok {
+		reporter.ReportStatus(err)
+	}
+}
+
+// build creates the handler serving cfg, with its routes and pools, and
+// returns it with the strategy options it was built from. Backend lists come
+// from source, which hands out the same list for a name it has seen, so a
+// reload keeps the discovery and health checks it had, and the handler and
+// its pools count requests in the inflight tracker of source. The affinity
+// table of carry, when set, is given to the handler so a reload does not
+// lose it.
+func build(cfg *config.Config, source *backendSource, carry strategy.Options) (*handlers.BalanceHandler, strategy.Options, error) {
+	backends := source.get(cfg.BackendName)
+	var backupBackends *discovery.BackendList
+	if cfg.BackupBackendName != "" {
+		backupBackends = source.get(cfg.BackupBackendName)
+	}
+	poolBackends := make(map[string]*discovery.BackendList)
+	for _, pool := range cfg.Pools {
+		if poolBackends[pool.BackendName] == nil {
+			poolBackends[pool.BackendName] = source.get(pool.BackendName)
+		}
+	}
+	for _, route := range cfg.Routes {
+		for _, pool := range route.Pools() {
+			if poolBackends[pool.BackendName] == nil {
+				poolBackends[pool.BackendName] = source.get(pool.BackendName)
+			}
+		}
+	}
+	source.start()
+
+	zone := cfg.Zone
+	if cfg.ZoneAware && zone == "" {
+		zone = source.zones().Zone(os.Getenv("NODE_NAME"))
+		if zone == "" {
+			logging.Warning("Zone aware balancing is on but the balancer's zone is unknown, set NODE_NAME or zone")
+		}
+	}
+	if !cfg.ZoneAware {
+		zone = ""
+	}
+	logging.Info("Balancer zone: %q", zone)
+
+	strategyOptions := strategy.Options{
+		Weights:            cfg.BackendWeights,
+		HashKey:            cfg.HashKey,
+		VirtualNodes:       cfg.VirtualNodes,
+		Shards:             cfg.Shards,
+		HashHeader:         cfg.HashHeader,
+		TrustForwardedFor:  cfg.TrustForwardedFor,
+		BackendPort:        cfg.BackendPort,
+		PollInterval:       cfg.PollInterval.Duration,
+		EWMADecay:          cfg.EWMADecay.Duration,
+		SlowStartWindow:    cfg.SlowStartWindow.Duration,
+		Zone:               zone,
+		ZoneMinBackends:    cfg.ZoneMinBackends,
+		SubsetSize:         cfg.SubsetSize,
+		SubsetID:           handlers.GetPodName(),
+		AffinityTTL:        cfg.AffinityTTL.Duration,
+		AffinityMaxEntries: cfg.AffinityMaxEntries,
+		Failover:           backupBackends != nil || cfg.ClusterFailover(),
+		Params:             cfg.StrategyOptions,
+		Inflight:           source.inflight,
+	}
+	handlerOptions := strategyOptions
+	handlerOptions.AffinityTable = carry.AffinityTable
+	handler := handlers.NewBalanceHandler(cfg.BackendName, cfg.BackendPort, cfg.LoadbalancerPort, cfg.LoadbalancerMethod, handlerOptions, backends, backupBackends)
+	handler.Health = source.checkers[cfg.BackendName]
+	handler.BackupHealth = source.checkers[cfg.BackupBackendName]
+	effective, err := cfg.Redacted()
+	if err != nil {
+		return nil, strategy.Options{}, err
+	}
+	handler.EffectiveConfig = effective
+	handler.AccessLog, err = source.accessLog(cfg.AccessLog)
+	if err != nil {
+		return nil, strategy.Options{}, err
+	}
+	proxyOptions := proxy.Options{Protocol: cfg.UpstreamProtocol, Drainer: source.drainer}
+	if t := cfg.UpstreamTransport; t != nil {
+		proxyOptions.Transport = proxy.TransportOptions{
+			MaxIdleConnsPerBackend: t.MaxIdleConnsPerBackend,
+			IdleConnTimeout:        t.IdleConnTimeout.Duration,
+			TLSHandshakeTimeout:    t.TLSHandshakeTimeout.Duration,
+			DisableKeepAlives:      t.DisableKeepAlives,
+		}
+	}
+	proxyOptions.Timeouts = upstreamTimeouts(proxyOptions.Timeouts, cfg.UpstreamTimeouts)
+	if t := cfg.UpstreamTLS; t != nil && t.Secret != "" {
+		var material *proxy.TLSMaterial
+		material, err = source.secretTLS(t.Secret, corev1.ServiceAccountRootCAKey)
+		if err != nil {
+			return nil, strategy.Options{}, fmt.Errorf("failed to load upstream tls: %w", err)
+		}
+		proxyOptions.TLS = material.ClientConfig(t.ServerName)
+	} else if t != nil {
+		proxyOptions.TLS, err = proxy.LoadClientTLS(t.CAFile, t.CertFile, t.KeyFile, t.ServerName)
+		if err != nil {
+			return nil, strategy.Options{}, fmt.Errorf("failed to load upstream tls: %w", err)
+		}
+	}
+	handler.Proxy, err = proxy.NewWithOptions(cfg.BackendPort, proxyOptions)
+	if err != nil {
+		return nil, strategy.Options{}, fmt.Errorf("failed to create the proxy: %w", err)
+	}
+	handler.Headers = headerRules(cfg.Headers)
+	handler.MaxBodySize = cfg.MaxBodySize
+	handler.BufferBody = cfg.BufferBody
+	handler.Retry = retryPolicy(cfg.Retry)
+	if cfg.MaxInflight > 0 {
+		handler.Limit = handlers.NewLimiter(cfg.MaxInflight, cfg.QueueDepth)
+	}
+	handler.QueueTimeout = cfg.QueueTimeout.Duration
+	if o := cfg.OutlierDetection; o != nil {
+		handler.Outliers = strategy.NewOutlierDetector(strategy.OutlierOptions{
+			ConsecutiveFailures: o.ConsecutiveFailures,
+			ErrorRatePercent:    o.ErrorRatePercent,
+			MinRequests:         o.MinRequests,
+			Interval:            o.Interval.Duration,
+			BaseEjectionTime:    o.BaseEjectionTime.Duration,
+			MaxEjectionTime:     o.MaxEjectionTime.Duration,
+		})
+	}
+	for _, route := range cfg.Routes {
+		name := route.Host + route.PathPrefix
+		var routeProxy *proxy.Proxy
+		if route.UpstreamProtocol != "" || route.UpstreamTimeouts != nil {
+			routeProxy, err = proxy.NewWithOptions(cfg.BackendPort, routeProxyOptions(proxyOptions, route))
+			if err != nil {
+				return nil, strategy.Options{}, fmt.Errorf("failed to create the proxy for route %s: %w", name, err)
+			}
+		}
+		var routeLimit *handlers.Limiter
+		if route.MaxInflight > 0 {
+			routeLimit = handlers.NewLimiter(route.MaxInflight, cfg.QueueDepth)
+		}
+		var pool *handlers.BalanceHandler
+		if route.Pool != "" {
+			named := cfg.NamedPool(route.Pool)
+			poolOptions := proxyOptions
+			poolOptions.Timeouts = upstreamTimeouts(poolOptions.Timeouts, named.UpstreamTimeouts)
+			pool, err = poolHandler(cfg, route, named.Pool, strategyOptions, poolOptions, poolBackends, source.checkers)
+			if err != nil {
+				return nil, strategy.Options{}, fmt.Errorf("failed to create pool %s for route %s: %w", route.Pool, name, err)
+			}
+			pool.Retry = handler.Retry
+			logging.Info("Route %s is served by pool %s", name, route.Pool)
+		}
+		var mirror *handlers.Mirror
+		if route.Mirror != nil {
+			pool, err := poolHandler(cfg, route, route.Mirror.Pool, strategyOptions, proxyOptions, poolBackends, source.checkers)
+			if err != nil {
+				return nil, strategy.Options{}, fmt.Errorf("failed to create the mirror for route %s: %w", name, err)
+			}
+			maxInflight := route.Mirror.MaxInflight
+			if maxInflight == 0 {
+				maxInflight = 100
+			}
+			pool.Limit = handlers.NewLimiter(maxInflight, 0)
+			mirror = &handlers.Mirror{Pool: pool, Percent: route.Mirror.Percent}
+			logging.Info("Route %s mirrors %d%% of requests to %s", name, route.Mirror.Percent, route.Mirror.BackendName)
+		}
+		var canary *handlers.Canary
+		if route.Canary != nil {
+			pool, err := poolHandler(cfg, route, route.Canary.Pool, strategyOptions, proxyOptions, poolBackends, source.checkers)
+			if err != nil {
+				return nil, strategy.Options{}, fmt.Errorf("failed to create the canary for route %s: %w", name, err)
+			}
+			pool.Retry = handler.Retry
+			canary = handlers.NewCanary(pool, route.Canary.Percent)
+			logging.Info("Route %s sends %d%% of requests to %s", name, route.Canary.Percent, route.Canary.BackendName)
+		}
+		var blueGreen *handlers.BlueGreen
+		if bg := route.BlueGreen; bg != nil {
+			blue, err := poolHandler(cfg, route, bg.Blue, strategyOptions, proxyOptions, poolBackends, source.checkers)
+			if err != nil {
+				return nil, strategy.Options{}, fmt.Errorf("failed to create the blue pool for route %s: %w", name, err)
+			}
+			green, err := poolHandler(cfg, route, bg.Green, strategyOptions, proxyOptions, poolBackends, source.checkers)
+			if err != nil {
+				return nil, strategy.Options{}, fmt.Errorf("failed to create the green pool for route %s: %w", name, err)
+			}
+			blue.Retry = handler.Retry
+			green.Retry = handler.Retry
+			// The config was validated, so Active is blue or green.
+			blueGreen, _ = handlers.NewBlueGreen(blue, green, bg.Active)
+			logging.Info("Route %s serves from the %s pool", name, bg.Active)
+		}
+		var routeAccessLog *handlers.AccessLog
+		if route.AccessLog != nil && *route.AccessLog && handler.AccessLog == nil {
+			defaults := &config.AccessLog{Format: config.AccessLogCombined, Output: config.AccessLogStdout}
+			if routeAccessLog, err = source.accessLog(defaults); err != nil {
+				return nil, strategy.Options{}, err
+			}
+		}
+		handler.AddRoute(handlers.Route{
+			PathPrefix:         route.PathPrefix,
+			Host:               route.Host,
+			MatchHeaders:       route.MatchHeaders,
+			Pool:               pool,
+			LoadbalancerMethod: route.LoadbalancerMethod,
+			Proxy:              routeProxy,
+			Headers:            headerRules(route.Headers),
+			Rewrite:            pathRewrite(route.PathPrefix, route.Rewrite),
+			MaxBodySize:        route.MaxBodySize,
+			BufferBody:         route.BufferBody,
+			Limit:              routeLimit,
+			Mirror:             mirror,
+			Canary:             canary,
+			BlueGreen:          blueGreen,
+			AccessLog:          routeAccessLog,
+			NoAccessLog:        route.AccessLog != nil && !*route.AccessLog,
+		})
+	}
+	return handler, strategyOptions, nil
+}
+
+// listen binds addr before anything is served, so a port in use or an
+// address the host does not have stops the balancer at start instead of
+// leaving it running without the listener.
+func listen(network, addr string) (net.Listener, error) {
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return listener, nil
+}
+
+func listenPacket(network, addr string) (net.PacketConn, error) {
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s/%s: %w", addr, network, err)
+	}
+	return conn, nil
+}
+
+func serveHTTP(cfg *config.Config, handler http.Handler, stopCh <-chan struct{}) error {
 	server := http.Server{
-		Addr:         fmt.Sprintf(":%d", cfg.LoadbalancerPort),
-		Handler:      mux,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Addr:    cfg.ListenAddr(),
+		Handler: handler,
+	}
+	setServerTimeouts(&server, cfg.ServerTimeouts)
+	listener, err := listen("tcp", server.Addr)
+	if err != nil {
+		return err
 	}
 
 	go func() {
 		logging.Info("Starting server on %s", server.Addr)
-		server.ListenAndServe()
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Error("Server stopped: %v", err)
+		}
 	}()
 
 	go func() {
 		<-stopCh
 		logging.Warning("Stopping server")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, cancel := shutdownContext(cfg)
 		defer cancel()
 		server.Shutdown(ctx)
 	}()
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
-	<-quit
-	close(stopCh)
+	return nil
+}
+
+// serveGRPC accepts HTTP/2 cleartext from clients and forwards each call as
+// its own request, so one client connection is spread across backends. The
+// read and write timeouts are left off because streaming calls can stay open
+// for as long as the client wants.
+func serveGRPC(cfg *config.Config, handler http.Handler, stopCh <-chan struct{}) error {
+	timeouts := cfg.ServerTimeouts.WithDefaults()
+	if timeouts.ReadHeader.Duration == 0 {
+		timeouts.ReadHeader.Duration = config.DefaultReadTimeout
+	}
+	server := http.Server{
+		Addr:              cfg.ListenAddr(),
+		Handler:           handler,
+		ReadHeaderTimeout: timeouts.ReadHeader.Duration,
+		IdleTimeout:       timeouts.Idle.Duration,
+		Protocols:         new(http.Protocols),
+	}
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+	listener, err := listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		logging.Info("Starting grpc server on %s", server.Addr)
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Error("Grpc server stopped: %v", err)
+		}
+	}()
+
+	go func() {
+		<-stopCh
+		logging.Warning("Stopping server")
+		ctx, cancel := shutdownContext(cfg)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	return nil
+}
+
+// listenerTLS returns the TLS config of the HTTP/3 listener, with the
+// certificate of TLSSecret, which rotates with it, or of the files.
+func listenerTLS(cfg *config.Config, source *backendSource) (*tls.Config, error) {
+	if cfg.TLSSecret != "" {
+		material, err := source.secretTLS(cfg.TLSSecret, corev1.TLSCertKey)
+		if err != nil {
+			return nil, err
+		}
+		return material.ServerConfig(), nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// serveHTTP3 answers HTTP/3 over QUIC on its own UDP port. Requests go
+// through the same handler as the main listener, so backends see them over
+// the configured upstream protocol.
+func serveHTTP3(cfg *config.Config, handler http.Handler, tlsConfig *tls.Config, stopCh <-chan struct{}) error {
+	server := http3.Server{
+		Addr:      cfg.HTTP3Addr(),
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	conn, err := listenPacket("udp", server.Addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		logging.Info("Starting http3 server on %s", server.Addr)
+		if err := server.Serve(conn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Error("HTTP/3 server stopped: %v", err)
+		}
+	}()
+
+	go func() {
+		<-stopCh
+		ctx, cancel := shutdownContext(cfg)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	return nil
+}
+
+// backendSource hands out the backend list for each backend name: a static
+// list from the config, one loaded from a file, resolved from DNS or
+// followed in Consul or Docker, or one watched in Kubernetes. The
+// Kubernetes clients are only created once a backend needs them.
+type backendSource struct {
+	cfg      *config.Config
+	stopCh   <-chan struct{}
+	clusters []*kubeCluster
+	// drainer is told about the backends that leave all the lists handed
+	// out, see update.
+	drainer *proxy.Drainer
+	// inflight counts the requests of every handler built from the lists,
+	// and forgets the addresses that leave all of them.
+	inflight *strategy.InflightTracker
+	// lists are the lists handed out by name, so a reload reuses them.
+	// listsMu guards it, since their listeners read it while a reload adds
+	// to it.
+	listsMu sync.Mutex
+	lists   map[string]*discovery.BackendList
+	// checkers probe the backends by name when health checks are on.
+	checkers map[string]*healthcheck.Checker
+	// synced is set once the handlers have been made ready, see
+	// readyOnSync.
+	synced atomic.Bool
+	// secrets hold the TLS material watched in Secrets, so a reload reuses
+	// the watch. secretClient reads them.
+	secrets      map[secretKey]*proxy.TLSMaterial
+	secretClient kubernetes.Interface
+	// accessLogs are the access log outputs opened by name, so a reload
+	// appends to the same file.
+	accessLogs map[string]io.Writer
+}
+
+// secretKey names a Secret, [namespace/]name, with the key it must have.
+type secretKey struct {
+	ref, required string
+}
+
+// kubeCluster is one Kubernetes cluster backends are discovered in.
+type kubeCluster struct {
+	name    string
+	cluster *discovery.Cluster
+	pools   *discovery.Pools
+	options discovery.Options
+}
+
+// get returns the list of the backend name and exports its backend count.
+// With health checks only the backends passing them are in the list.
+func (bs *backendSource) get(name string) *discovery.BackendList {
+	bs.listsMu.Lock()
+	list, ok := bs.lists[name]
+	bs.listsMu.Unlock()
+	if ok {
+		return list
+	}
+	list = bs.list(name)
+	discovery.ObservePool(name, list)
+	if h := bs.cfg.HealthCheckFor(name); h != nil {
+		port := h.Port
+		for _, pool := range bs.cfg.Pools {
+			if port == 0 && pool.BackendName == name {
+				port = pool.BackendPort
+			}
+		}
+		if port == 0 {
+			port = bs.cfg.BackendPort
+		}
+		var passive *healthcheck.PassiveOptions
+		if p := h.Passive; p != nil {
+			passive = &healthcheck.PassiveOptions{
+				ConsecutiveFailures: p.ConsecutiveFailures,
+				ErrorRatePercent:    p.ErrorRatePercent,
+				MinRequests:         p.MinRequests,
+				Window:              p.Interval.Duration,
+				StatusCodes:         p.StatusCodes,
+			}
+		}
+		var onChange func(healthcheck.Event)
+		if h.Webhook != "" {
+			onChange = healthcheck.Webhook(h.Webhook, 0)
+		}
+		checker := healthcheck.New(name, list, healthcheck.Options{
+			Type:               h.Type,
+			Service:            h.Service,
+			Path:               h.Path,
+			Method:             h.Method,
+			Host:               h.Host,
+			Headers:            h.Headers,
+			StatusCodes:        h.StatusCodes,
+			Body:               h.Body,
+			JSONField:          h.JSONField,
+			JSONValue:          h.JSONValue,
+			Port:               port,
+			Interval:           h.Interval.Duration,
+			Jitter:             h.Jitter.Duration,
+			Timeout:            h.Timeout.Duration,
+			UnhealthyThreshold: h.UnhealthyThreshold,
+			HealthyThreshold:   h.HealthyThreshold,
+			FlapWindow:         h.FlapWindow.Duration,
+			RampWindow:         h.RampWindow.Duration,
+			Passive:            passive,
+			OnChange:           onChange,
+		}, bs.stopCh)
+		if bs.checkers == nil {
+			bs.checkers = make(map[string]*healthcheck.Checker)
+		}
+		bs.checkers[name] = checker
+		list = checker.Backends()
+	}
+	list.OnChange(bs.update)
+	bs.listsMu.Lock()
+	if bs.lists == nil {
+		bs.lists = make(map[string]*discovery.BackendList)
+	}
+	bs.lists[name] = list
+	bs.listsMu.Unlock()
+	return list
+}
+
+// update tells the drainer and the inflight tracker about a change to one
+// of the lists handed out. They are shared by every pool, so a backend
+// removed from one list but still held by another is left alone until it
+// leaves that one too. It has the signature of a discovery.BackendList
+// OnChange listener.
+func (bs *backendSource) update(added, removed []discovery.Backend) {
+	var gone []discovery.Backend
+	for _, backend := range removed {
+		if !bs.holds(backend.Address) {
+			gone = append(gone, backend)
+		}
+	}
+	bs.drainer.Update(added, gone)
+	for _, backend := range gone {
+		bs.inflight.Forget(backend)
+	}
+}
+
+// holds reports whether any list handed out has a backend at address.
+func (bs *backendSource) holds(address string) bool {
+	bs.listsMu.Lock()
+	defer bs.listsMu.Unlock()
+	for _, list := range bs.lists {
+		for _, backend := range list.GetAll() {
+			if backend.Address == address {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (bs *backendSource) list(name string) *discovery.BackendList {
+	if addresses, ok := bs.cfg.StaticBackends[name]; ok {
+		logging.Info("Backend %s uses the static addresses %v", name, addresses)
+		return discovery.StaticBackends(addresses)
+	}
+	if path, ok := bs.cfg.FileBackends[name]; ok {
+		list, err := discovery.FileBackends(path, bs.stopCh)
+		if err != nil {
+			logging.Error("Failed to load backend %s: %v", name, err)
+			os.Exit(1)
+		}
+		logging.Info("Backend %s is loaded from %s", name, path)
+		return list
+	}
+	if d := bs.cfg.Docker; d != nil && d.Services[name] != nil {
+		opts := dockerOptions(d, d.Services[name])
+		list, err := discovery.DockerBackends(opts, bs.stopCh)
+		if err != nil {
+			logging.Error("Failed to watch containers for backend %s: %v", name, err)
+			os.Exit(1)
+		}
+		logging.Info("Backend %s follows containers labelled %s on %s", name, opts.Label, opts.Host)
+		return list
+	}
+	if c := bs.cfg.Consul; c != nil && c.Services[name] != nil {
+		opts := consulOptions(c, c.Services[name])
+		logging.Info("Backend %s follows the consul service %s at %s", name, opts.Service, opts.Address)
+		return discovery.ConsulBackends(opts, bs.stopCh)
+	}
+	if d, ok := bs.cfg.DNSBackends[name]; ok {
+		interval := d.Interval.Duration
+		if interval == 0 {
+			interval = 30 * time.Second
+		}
+		logging.Info("Backend %s resolves %s %s records every %s", name, d.Name, d.Type, interval)
+		return discovery.DNSBackends(discovery.DNSOptions{Name: d.Name, SRV: d.Type == config.DNSTypeSRV, Interval: interval}, bs.stopCh)
+	}
+	if bs.clusters == nil {
+		bs.connect()
+	}
+	lists := make([]*discovery.BackendList, 0, len(bs.clusters))
+	for _, kc := range bs.clusters {
+		if selector, ok := bs.cfg.BackendSelectors[name]; ok {
+			// The config was validated, so the selector parses.
+			list, _ := discovery.GetSelectedBackends(kc.cluster, selector, kc.options)
+			logging.Info("Backend %s merges the services matching %s in cluster %s", name, selector, kc.name)
+			lists = append(lists, list)
+			continue
+		}
+		lists = append(lists, kc.pools.Get(name))
+	}
+	if len(lists) == 1 {
+		return lists[0]
+	}
+	return discovery.MergeBackends(lists...)
+}
+
+// secretTLS returns the TLS material of the Secret ref, [namespace/]name in
+// the balancer's own namespace, watching it the first time it is asked for.
+// The Secret must have the required key, and a change that drops it is
+// ignored. ca.crt is taken as the CA, tls.crt and tls.key as the
+// certificate.
+func (bs *backendSource) secretTLS(ref, required string) (*proxy.TLSMaterial, error) {
+	key := secretKey{ref, required}
+	if material, ok := bs.secrets[key]; ok {
+		return material, nil
+	}
+	namespace, name, ok := strings.Cut(ref, "/")
+	if !ok {
+		name = namespace
+		var err error
+		namespace, err = discovery.DetectNamespace()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if bs.secretClient == nil {
+		client, err := discovery.NewClient(bs.cfg.Kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		bs.secretClient = client
+	}
+	material := &proxy.TLSMaterial{}
+	update := func(data map[string][]byte) error {
+		if len(data[required]) == 0 {
+			return fmt.Errorf("no %s", required)
+		}
+		return material.Update(data[corev1.ServiceAccountRootCAKey], data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey])
+	}
+	if err := discovery.WatchSecret(bs.secretClient, namespace, name, update, bs.stopCh); err != nil {
+		return nil, err
+	}
+	if bs.secrets == nil {
+		bs.secrets = make(map[secretKey]*proxy.TLSMaterial)
+	}
+	bs.secrets[key] = material
+	logging.Info("Watching secret %s/%s for certificates", namespace, name)
+	return material, nil
+}
+
+// accessLog returns the access log cfg describes, or nil when cfg is nil.
+func (bs *backendSource) accessLog(cfg *config.AccessLog) (*handlers.AccessLog, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	w, ok := bs.accessLogs[cfg.Output]
+	if !ok {
+		switch cfg.Output {
+		case config.AccessLogStdout:
+			w = os.Stdout
+		case config.AccessLogStderr:
+			w = os.Stderr
+		default:
+			file, err := os.OpenFile(cfg.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open the access log: %w", err)
+			}
+			w = file
+		}
+		if bs.accessLogs == nil {
+			bs.accessLogs = make(map[string]io.Writer)
+		}
+		bs.accessLogs[cfg.Output] = w
+	}
+	return handlers.NewAccessLog(cfg.Format, w), nil
+}
+
+// connect creates a client for every configured cluster, or for the one
+// the balancer runs in.
+func (bs *backendSource) connect() {
+	clusters := bs.cfg.Clusters
+	if len(clusters) == 0 {
+		clusters = []*config.Cluster{{Name: "local", Kubeconfig: bs.cfg.Kubeconfig}}
+	}
+	resync := bs.cfg.InformerResync.Duration
+	if resync == 0 {
+		resync = 3 * time.Minute
+	}
+	for _, c := range clusters {
+		cluster, err := discovery.GetCluster(c.Kubeconfig, bs.cfg.Namespaces, bs.cfg.NamespaceSelector, resync)
+		if err != nil {
+			logging.Error("Failed to connect to cluster %s: %v", c.Name, err)
+			os.Exit(1)
+		}
+		kc := &kubeCluster{name: c.Name, cluster: cluster}
+		kc.options.IncludeNotReady = bs.cfg.IncludeNotReady
+		kc.options.PortName = bs.cfg.BackendPortName
+		kc.options.Debounce = bs.cfg.DiscoveryDebounce.Duration
+		kc.options.ExternalNames = bs.cfg.ExternalNames
+		kc.options.Priority = c.Priority
+		if bs.cfg.ZoneAware {
+			kc.options.Zones = discovery.NewZoneResolver(cluster)
+		}
+		// Pods are always watched, to drop those that start terminating
+		// before their slices say so.
+		kc.options.Pods = discovery.NewPodResolver(cluster, bs.cfg.WeightAnnotation, bs.cfg.WeightAnnotation != "" || bs.cfg.PodMetadata)
+		kc.pools = discovery.NewPools(cluster, kc.options)
+		bs.clusters = append(bs.clusters, kc)
+		logging.Info("Discovering backends in cluster %s with priority %d", c.Name, c.Priority)
+	}
+}
+
+// zones returns the zone resolver of the first cluster, the one the
+// balancer is expected to run in, or nil.
+func (bs *backendSource) zones() *discovery.ZoneResolver {
+	if len(bs.clusters) == 0 {
+		return nil
+	}
+	return bs.clusters[0].options.Zones
+}
+
+// dockerOptions fills in the Docker host from the environment and the
+// refresh interval when the config leaves them out.
+func dockerOptions(d *config.Docker, service *config.DockerService) discovery.DockerOptions {
+	host := d.Host
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = "unix:///var/run/docker.sock"
+	}
+	interval := d.Interval.Duration
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+	return discovery.DockerOptions{
+		Host:     host,
+		Label:    service.Label,
+		Network:  service.Network,
+		Port:     service.Port,
+		Interval: interval,
+	}
+}
+
+// consulOptions fills in the Consul address and token from the environment
+// when the config leaves them out.
+func consulOptions(c *config.Consul, service *config.ConsulService) discovery.ConsulOptions {
+	address := c.Address
+	if address == "" {
+		address = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if address == "" {
+		address = "http://127.0.0.1:8500"
+	}
+	token := c.Token
+	if token == "" {
+		token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	return discovery.ConsulOptions{
+		Address:      address,
+		Token:        token,
+		Datacenter:   c.Datacenter,
+		Service:      service.Service,
+		Tag:          service.Tag,
+		AllowWarning: service.AllowWarning,
+	}
+}
+
+// start starts the Kubernetes informers, if any backend needs them. It
+// returns once the namespaces, pods and nodes have synced, the slices are
+// left to readyOnSync.
+func (bs *backendSource) start() {
+	for _, kc := range bs.clusters {
+		kc.cluster.Start(bs.stopCh)
+	}
+}
+
+// readyOnSync keeps handlers unready until the Kubernetes backends have
+// synced, so the balancer answers 503 instead of balancing over lists that
+// are still filling up. synced is set once they are ready.
+func (bs *backendSource) readyOnSync(targets []*handlers.BalanceHandler) {
+	if len(bs.clusters) == 0 {
+		bs.synced.Store(true)
+		return
+	}
+	for _, handler := range targets {
+		handler.SetReady(false)
+	}
+	debounce := bs.cfg.DiscoveryDebounce.Duration
+	go func() {
+		for _, kc := range bs.clusters {
+			if !kc.cluster.WaitForCacheSync(bs.stopCh) {
+				return
+			}
+		}
+		// Debounced lists are published a debounce after the first slice.
+		time.Sleep(debounce)
+		logging.Info("Discovery has synced, serving traffic")
+		for _, handler := range targets {
+			handler.SetReady(true)
+		}
+		bs.synced.Store(true)
+	}()
+}
+
+// routeProxyOptions applies a route's upstream protocol and timeouts to the
+// global proxy options.
+func routeProxyOptions(proxyOptions proxy.Options, route config.Route) proxy.Options {
+	if route.UpstreamProtocol != "" {
+		proxyOptions.Protocol = route.UpstreamProtocol
+	}
+	proxyOptions.Timeouts = upstreamTimeouts(proxyOptions.Timeouts, route.UpstreamTimeouts)
+	return proxyOptions
+}
+
+// poolHandler builds the handler that serves one of route's pools. Requests
+// are handed to it as they arrived, so it applies the global and route rules
+// itself.
+func poolHandler(cfg *config.Config, route config.Route, pool config.Pool, strategyOptions strategy.Options, proxyOptions proxy.Options, backends map[string]*discovery.BackendList, checkers map[string]*healthcheck.Checker) (*handlers.BalanceHandler, error) {
+	port := pool.BackendPort
+	if port == 0 {
+		port = cfg.BackendPort
+	}
+	method := pool.LoadbalancerMethod
+	if method == "" {
+		method = route.LoadbalancerMethod
+	}
+	if method == "" {
+		method = cfg.LoadbalancerMethod
+	}
+	strategyOptions.BackendPort = port
+	strategyOptions.Failover = cfg.ClusterFailover()
+	h := handlers.NewBalanceHandler(pool.BackendName, port, cfg.LoadbalancerPort, method, strategyOptions, backends[pool.BackendName], nil)
+	h.Health = checkers[pool.BackendName]
+	var err error
+	h.Proxy, err = proxy.NewWithOptions(port, routeProxyOptions(proxyOptions, route))
+	if err != nil {
+		return nil, err
+	}
+	h.Headers = headerRules(cfg.Headers)
+	h.MaxBodySize = cfg.MaxBodySize
+	h.BufferBody = cfg.BufferBody
+	h.AddRoute(handlers.Route{
+		PathPrefix:   route.PathPrefix,
+		Host:         route.Host,
+		MatchHeaders: route.MatchHeaders,
+		Headers:      headerRules(route.Headers),
+		Rewrite:      pathRewrite(route.PathPrefix, route.Rewrite),
+		MaxBodySize:  route.MaxBodySize,
+		BufferBody:   route.BufferBody,
+	})
+	return h, nil
+}
+
+// retryPolicy fills in the defaults for anything the retry config leaves
+// unset.
+func retryPolicy(retry *config.Retry) *proxy.RetryPolicy {
+	if retry == nil {
+		return nil
+	}
+	policy := &proxy.RetryPolicy{
+		Attempts: retry.Attempts,
+		Statuses: retry.StatusCodes,
+	}
+	if policy.Attempts == 0 {
+		policy.Attempts = 1
+	}
+	if len(policy.Statuses) == 0 {
+		policy.Statuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable}
+	}
+	percent := retry.BudgetPercent
+	if percent == 0 {
+		percent = 20
+	}
+	policy.Budget = proxy.NewRetryBudget(percent)
+	return policy
+}
+
+// setServerTimeouts applies the configured client timeouts to server, keeping
+// the defaults for anything left unset.
+func setServerTimeouts(server *http.Server, timeouts *config.ServerTimeouts) {
+	resolved := timeouts.WithDefaults()
+	server.ReadTimeout = resolved.Read.Duration
+	server.WriteTimeout = resolved.Write.Duration
+	server.IdleTimeout = resolved.Idle.Duration
+	server.ReadHeaderTimeout = resolved.ReadHeader.Duration
+}
+
+// shutdownContext bounds the graceful shutdown of a listener.
+func shutdownContext(cfg *config.Config) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cfg.ServerTimeouts.WithDefaults().Shutdown.Duration)
+}
+
+// upstreamTimeouts lays the set fields of timeouts over base, so a route only
+// replaces the timeouts it names.
+func upstreamTimeouts(base proxy.TimeoutOptions, timeouts *config.UpstreamTimeouts) proxy.TimeoutOptions {
+	if timeouts == nil {
+		return base
+	}
+	if timeouts.Connect.Duration > 0 {
+		base.Connect = timeouts.Connect.Duration
+	}
+	if timeouts.ResponseHeader.Duration > 0 {
+		base.ResponseHeader = timeouts.ResponseHeader.Duration
+	}
+	if timeouts.Request.Duration > 0 {
+		base.Request = timeouts.Request.Duration
+	}
+	return base
+}
+
+func headerRules(rules *config.HeaderRules) *proxy.HeaderRules {
+	if rules == nil {
+		return nil
+	}
+	return &proxy.HeaderRules{
+		Request:  proxy.HeaderOps(rules.Request),
+		Response: proxy.HeaderOps(rules.Response),
+	}
+}
+
+// pathRewrite compiles a route's rewrite rules. The regex was checked when
+// the config was loaded.
+func pathRewrite(prefix string, rewrite *config.PathRewrite) *proxy.PathRewrite {
+	if rewrite == nil {
+		return nil
+	}
+	pr := &proxy.PathRewrite{
+		ReplacePrefix: rewrite.ReplacePrefix,
+		Replacement:   rewrite.Replacement,
+	}
+	if rewrite.StripPrefix || rewrite.ReplacePrefix != "" {
+		pr.Prefix = prefix
+	}
+	if rewrite.Regex != "" {
+		pr.Regex = regexp.MustCompile(rewrite.Regex)
+	}
+	return pr
+}
+
+// sniHandlers builds a handler per SNI route, each balancing over its own
+// service with its own strategy.
+func sniHandlers(cfg *config.Config, strategyOptions strategy.Options, backends []*discovery.BackendList, checkers map[string]*healthcheck.Checker) map[string]*handlers.BalanceHandler {
+	strategyOptions.Failover = cfg.ClusterFailover()
+	sniHandlers := make(map[string]*handlers.BalanceHandler, len(cfg.SNIRoutes))
+	for i, route := range cfg.SNIRoutes {
+		port := route.BackendPort
+		if port == 0 {
+			port = cfg.BackendPort
+		}
+		method := route.LoadbalancerMethod
+		if method == "" {
+			method = cfg.LoadbalancerMethod
+		}
+		strategyOptions.BackendPort = port
+		sniHandler := handlers.NewBalanceHandler(route.BackendName, port, cfg.LoadbalancerPort, method, strategyOptions, backends[i], nil)
+		sniHandler.Health = checkers[route.BackendName]
+		sniHandlers[route.ServerName] = sniHandler
+		logging.Info("Server name %s goes to %s with %s", route.ServerName, route.BackendName, method)
+	}
+	return sniHandlers
+}
+
+func serveTCP(cfg *config.Config, handler *handlers.Swap, sniHandlers map[string]*handlers.BalanceHandler, drainer *proxy.Drainer, stopCh <-chan struct{}) error {
+	tcpProxy := proxy.NewTCPProxy(cfg.BackendPort, handler.Acquire)
+	tcpProxy.Drainer = drainer
+	if cfg.UpstreamTimeouts != nil && cfg.UpstreamTimeouts.Connect.Duration > 0 {
+		tcpProxy.DialTimeout = cfg.UpstreamTimeouts.Connect.Duration
+	}
+	if len(sniHandlers) > 0 {
+		tcpProxy.SNI = make(map[string]proxy.TCPPool, len(sniHandlers))
+		for serverName, sniHandler := range sniHandlers {
+			tcpProxy.SNI[serverName] = proxy.TCPPool{BackendPort: sniHandler.BackendPort, Select: sniHandler.Acquire}
+		}
+	}
+	addr := cfg.ListenAddr()
+	listener, err := listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		logging.Info("Starting tcp proxy on %s", addr)
+		if err := tcpProxy.Serve(listener); err != nil {
+			logging.Error("TCP proxy stopped: %v", err)
+		}
+	}()
+
+	go func() {
+		<-stopCh
+		logging.Warning("Stopping tcp proxy")
+		tcpProxy.Close()
+	}()
+	return nil
+}
+
+func serveUDP(cfg *config.Config, handler *handlers.Swap, drainer *proxy.Drainer, stopCh <-chan struct{}) error {
+	udpProxy := proxy.NewUDPProxy(cfg.BackendPort, handler.Acquire, cfg.UDPSessionTimeout.Duration)
+	udpProxy.Drainer = drainer
+	addr := cfg.ListenAddr()
+	conn, err := listenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		logging.Info("Starting udp proxy on %s", addr)
+		if err := udpProxy.Serve(conn); err != nil {
+			logging.Error("UDP proxy stopped: %v", err)
+		}
+	}()
+
+	go func() {
+		<-stopCh
+		logging.Warning("Stopping udp proxy")
+		udpProxy.Close()
+	}()
+	return nil
+}
+
+func serveAdmin(cfg *config.Config, handler http.Handler, stopCh <-chan struct{}) error {
+	server := http.Server{
+		Addr:    cfg.AdminAddr(),
+		Handler: handler,
+	}
+	setServerTimeouts(&server, cfg.ServerTimeouts)
+	listener, err := listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		logging.Info("Starting admin server on %s", server.Addr)
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Error("Admin server stopped: %v", err)
+		}
+	}()
+
+	go func() {
+		<-stopCh
+		ctx, cancel := shutdownContext(cfg)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	return nil
 }
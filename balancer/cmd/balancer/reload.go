@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+
+	"balancer/internal/config"
+	"balancer/internal/handlers"
+	"balancer/internal/strategy"
+	"pkg/logging"
+)
+
+// reloader applies a changed config to the running balancer.
+type reloader struct {
+	mu     sync.Mutex
+	flags  *config.Flags
+	cfg    *config.Config
+	source *backendSource
+	swap   *handlers.Swap
+}
+
+// reload reads the config again and swaps in a handler built from it, so
+// the strategy, timeouts, routes and the rest of the request handling change
+// at once. The listeners stay up and requests in flight finish on the old
+// handler. A config that does not load or build is logged and the running
+// one is kept.
+func (r *reloader) reload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.source.synced.Load() {
+		logging.Warning("Not reloading the config before discovery has synced")
+		return
+	}
+	cfg, _, err := config.Load(r.flags)
+	if err != nil {
+		reportStatus(r.flags.Source, err)
+		logging.Error("Failed to reload the config, keeping the running one: %v", err)
+		return
+	}
+	for _, key := range r.cfg.RestartNeeded(cfg) {
+		logging.Warning("The %s setting changed, restart the balancer to apply it", key)
+	}
+
+	prev := r.swap.Load()
+	var carry strategy.Options
+	if cfg.AffinityTTL == r.cfg.AffinityTTL && cfg.AffinityMaxEntries == r.cfg.AffinityMaxEntries {
+		carry.AffinityTable = prev.Affinity()
+	}
+	// Backends that are new in the config are discovered the way it says.
+	r.source.cfg = cfg
+	handler, _, err := build(cfg, r.source, carry)
+	if err != nil {
+		r.source.cfg = r.cfg
+		reportStatus(r.flags.Source, err)
+		logging.Error("Failed to apply the reloaded config, keeping the running one: %v", err)
+		return
+	}
+	r.swap.Store(handler)
+	prev.Stop()
+	r.cfg = cfg
+	setLogging(cfg)
+	reportStatus(r.flags.Source, nil)
+	logging.Info("Reloaded the config, now balancing %s with %s", cfg.BackendName, cfg.LoadbalancerMethod)
+}
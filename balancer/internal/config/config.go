@@ -2,41 +2,2018 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+
+	"balancer/internal/strategy"
 
 	"pkg/logging"
+	"pkg/toml"
+)
+
+const (
+	StrategyRoundRobin         string = "RoundRobin"
+	StrategyLeastConnections   string = "LeastConnections"
+	StrategyWeightedRoundRobin string = "WeightedRoundRobin"
+	StrategyRandom             string = "Random"
+	StrategyRingHash           string = "RingHash"
+	StrategyIPHash             string = "IPHash"
+	StrategyHeaderHash         string = "HeaderHash"
+	StrategyAdaptive           string = "Adaptive"
+	StrategyWeightedLeastConns string = "WeightedLeastConnections"
+	StrategyPeakEWMA           string = "PeakEWMA"
+	StrategyLeastOutstanding   string = "LeastOutstanding"
+	StrategySharded            string = "Sharded"
 )
 
-const (
-	StrategyRoundRobin string = "RoundRobin"
-)
+const (
+	ModeHTTP string = "http"
+	ModeTCP  string = "tcp"
+	ModeUDP  string = "udp"
+	ModeGRPC string = "grpc"
+)
+
+const (
+	ProtocolHTTP1 string = "http1"
+	ProtocolH2C   string = "h2c"
+	ProtocolH2    string = "h2"
+)
+
+// AllNamespaces in Namespaces watches every namespace.
+const AllNamespaces = "*"
+
+const (
+	DNSTypeA   string = "a"
+	DNSTypeSRV string = "srv"
+)
+
+const (
+	AccessLogCommon   string = "common"
+	AccessLogCombined string = "combined"
+	AccessLogJSON     string = "json"
+)
+
+// Access log outputs, besides a file path.
+const (
+	AccessLogStdout string = "stdout"
+	AccessLogStderr string = "stderr"
+)
+
+const (
+	HealthCheckHTTP string = "http"
+	HealthCheckTCP  string = "tcp"
+	HealthCheckGRPC string = "grpc"
+)
+
+// Consul reads backends from a Consul catalog instead of Kubernetes.
+type Consul struct {
+	// Address is the base URL of the Consul HTTP API. Defaults to
+	// CONSUL_HTTP_ADDR, or http://127.0.0.1:8500.
+	Address string `json:"address"`
+	// Token is sent as the ACL token. Defaults to CONSUL_HTTP_TOKEN.
+	Token      string `json:"token"`
+	Datacenter string `json:"datacenter"`
+	// Services maps backend names to the Consul services they come from.
+	Services map[string]*ConsulService `json:"services"`
+}
+
+// ConsulService is a Consul service that backs a backend name.
+type ConsulService struct {
+	// Service is the name in the Consul catalog. Defaults to the backend
+	// name.
+	Service string `json:"service"`
+	// Tag only keeps instances that have it.
+	Tag string `json:"tag"`
+	// AllowWarning also sends traffic to instances whose checks are warning.
+	// Instances with a critical check never get any.
+	AllowWarning bool `json:"allowwarning"`
+}
+
+// Cluster is a Kubernetes cluster backends are discovered in.
+type Cluster struct {
+	// Name tells the cluster apart in logs.
+	Name string `json:"name"`
+	// Kubeconfig is the path of the cluster's kubeconfig. Empty uses the
+	// in-cluster config of the cluster the balancer runs in.
+	Kubeconfig string `json:"kubeconfig"`
+	// Priority orders the clusters for failover: a cluster's backends only
+	// get traffic while every cluster of a lower priority has none.
+	// Defaults to 0.
+	Priority int `json:"priority"`
+}
+
+// Docker reads backends from the containers on a Docker daemon instead of
+// Kubernetes.
+type Docker struct {
+	// Host is the daemon address, "unix:///path" or "tcp://host:port".
+	// Defaults to DOCKER_HOST, or unix:///var/run/docker.sock.
+	Host string `json:"host"`
+	// Interval is how often containers are listed again, e.g. "10s".
+	// Defaults to 10 seconds.
+	Interval Duration `json:"interval"`
+	// Services maps backend names to the containers that back them.
+	Services map[string]*DockerService `json:"services"`
+}
+
+// DockerService selects the containers behind a backend name.
+type DockerService struct {
+	// Label selects running containers, as "key" or "key=value".
+	Label string `json:"label"`
+	// Network picks the network a container's address comes from. Defaults
+	// to the first one, by name.
+	Network string `json:"network"`
+	// Port is dialed on every container. Defaults to the backend port.
+	Port int `json:"port"`
+}
+
+// DNSBackend resolves a backend from DNS instead of Kubernetes.
+type DNSBackend struct {
+	// Name is the DNS name to resolve, e.g. a headless service.
+	Name string `json:"name"`
+	// Type is "a" to dial the A and AAAA records of Name on the backend
+	// port, or "srv" to take hosts and ports from SRV records. Defaults to
+	// "a".
+	Type string `json:"type"`
+	// Interval is how often Name is resolved again, e.g. "30s". Defaults to
+	// 30 seconds.
+	Interval Duration `json:"interval"`
+}
+
+// UpstreamTLS encrypts traffic to backends. Backend certificates are
+// verified against CAFile. CertFile and KeyFile, when set, are presented to
+// backends that require mutual TLS.
+type UpstreamTLS struct {
+	CAFile   string `json:"cafile"`
+	CertFile string `json:"certfile"`
+	KeyFile  string `json:"keyfile"`
+	// Secret is the [namespace/]name of a Kubernetes Secret to take the CA
+	// from, under ca.crt, and the client certificate and key from, under
+	// tls.crt and tls.key when it has them, instead of the files. It is
+	// watched and the certificates rotate when it changes. The namespace
+	// defaults to the balancer's own.
+	Secret string `json:"secret"`
+	// ServerName is the name expected in backend certificates. Backends
+	// are dialled by pod IP, so this is usually the service DNS name.
+	ServerName string `json:"servername"`
+}
+
+// Route overrides settings for requests whose path starts with PathPrefix,
+// and that match its Host and MatchHeaders when set. Routes with a Host win
+// over those without, then the longest matching prefix wins, then the route
+// matching the most headers.
+type Route struct {
+	// PathPrefix defaults to "/".
+	PathPrefix string `json:"pathprefix"`
+	// Host only matches requests for this host, e.g. "api.example.com", or
+	// for any of its subdomains with "*.example.com". Unset matches every
+	// host.
+	Host string `json:"host"`
+	// MatchHeaders only matches requests with these header values. An empty
+	// value matches any request that has the header.
+	MatchHeaders map[string]string `json:"matchheaders"`
+	// Pool sends the route to the pool of this name in Pools instead of the
+	// global service.
+	Pool string `json:"pool"`
+	// LoadbalancerMethod replaces the global strategy for this route. Unset
+	// uses the global strategy.
+	LoadbalancerMethod string `json:"loadbalancermethod"`
+	// UpstreamProtocol replaces the global upstream protocol for this
+	// route. Unset uses the global protocol.
+	UpstreamProtocol string `json:"upstreamprotocol"`
+	// Headers are applied after the global Headers.
+	Headers *HeaderRules `json:"headers"`
+	// Rewrite changes the path sent to backends.
+	Rewrite *PathRewrite `json:"rewrite"`
+	// MaxBodySize replaces the global limit for this route.
+	MaxBodySize int64 `json:"maxbodysize"`
+	// BufferBody buffers request bodies on this route.
+	BufferBody bool `json:"bufferbody"`
+	// UpstreamTimeouts replace the global upstream timeouts for this route.
+	// Unset fields keep the global values.
+	UpstreamTimeouts *UpstreamTimeouts `json:"upstreamtimeouts"`
+	// MaxInflight caps the requests in flight on this route, on top of the
+	// global MaxInflight. Unset means no limit.
+	MaxInflight int `json:"maxinflight"`
+	// Mirror copies a share of the route's requests to a shadow pool.
+	Mirror *Mirror `json:"mirror"`
+	// Canary sends a share of the route's requests to another pool. The
+	// share can be changed at runtime with POST /admin/canary.
+	Canary *Canary `json:"canary"`
+	// BlueGreen sends the route to one of two pools instead of the global
+	// service. The active pool can be flipped with POST /admin/bluegreen.
+	BlueGreen *BlueGreen `json:"bluegreen"`
+	// AccessLog set to false leaves the route's requests out of the access
+	// log, and set to true logs them even when the global AccessLog is
+	// unset, in its default format.
+	AccessLog *bool `json:"accesslog"`
+}
+
+// AccessLog writes a line for every request in http and grpc mode, with
+// the pod that answered, the time spent on backends, the retries and the
+// bytes sent.
+type AccessLog struct {
+	// Format is "common", the Common Log Format, "combined", which adds the
+	// referer and user agent and is the default, or "json".
+	Format string `json:"format"`
+	// Output is "stdout", the default, "stderr" or the path of a file the
+	// lines are appended to.
+	Output string `json:"output"`
+}
+
+// Tracing exports a span for every request in http and grpc mode to an
+// OTLP collector, and sends the W3C traceparent of the span on to the
+// backend. The exporter also reads the standard OTEL_EXPORTER_OTLP_*
+// variables, which these settings override.
+type Tracing struct {
+	// Endpoint is the URL of the collector's OTLP/HTTP receiver, e.g.
+	// "http://otel-collector:4318". Defaults to https://localhost:4318.
+	Endpoint string `json:"endpoint"`
+	// Headers are sent with every export, e.g. for an API key.
+	Headers map[string]string `json:"headers"`
+	// SampleRatio is the share of new traces that are recorded, from 0 to
+	// 1. Requests that arrive with a traceparent follow its sampling
+	// decision. Defaults to 1.
+	SampleRatio *float64 `json:"sampleratio"`
+	// ServiceName names the balancer in traces. Defaults to "balancer".
+	ServiceName string `json:"servicename"`
+}
+
+// Pools lists the other services the route sends traffic to.
+func (r Route) Pools() []Pool {
+	var pools []Pool
+	if r.Mirror != nil {
+		pools = append(pools, r.Mirror.Pool)
+	}
+	if r.Canary != nil {
+		pools = append(pools, r.Canary.Pool)
+	}
+	if r.BlueGreen != nil {
+		pools = append(pools, r.BlueGreen.Blue, r.BlueGreen.Green)
+	}
+	return pools
+}
+
+// Canary splits a route between its own backends and a second pool, so a
+// new backend version can take Percent of the traffic, e.g. 5 for a 95/5
+// split.
+type Canary struct {
+	Pool
+	Percent int `json:"percent"`
+}
+
+// Names of the BlueGreen pools.
+const (
+	PoolBlue  string = "blue"
+	PoolGreen string = "green"
+)
+
+// BlueGreen holds the two pools a route switches between.
+type BlueGreen struct {
+	Blue  Pool `json:"blue"`
+	Green Pool `json:"green"`
+	// Active is the pool serving at start, "blue" or "green". Defaults to
+	// blue.
+	Active string `json:"active"`
+}
+
+// Pool is another service a route can send traffic to.
+type Pool struct {
+	BackendName string `json:"backendname"`
+	// BackendPort defaults to the global BackendPort.
+	BackendPort int `json:"backendport"`
+	// LoadbalancerMethod defaults to the route's strategy, then the global
+	// one.
+	LoadbalancerMethod string `json:"loadbalancermethod"`
+}
+
+// NamedPool is a service of its own that routes refer to by Name, each
+// balanced with its own settings. Unset settings fall back to the global
+// ones.
+type NamedPool struct {
+	Name string `json:"name"`
+	Pool
+	// HealthCheck probes the pool's backends. Unset uses HealthChecks, then
+	// HealthCheck, like any backend name.
+	HealthCheck *HealthCheck `json:"healthcheck"`
+	// UpstreamTimeouts replace the global upstream timeouts for this pool.
+	// Unset fields keep the global values.
+	UpstreamTimeouts *UpstreamTimeouts `json:"upstreamtimeouts"`
+}
+
+// Mirror sends a copy of Percent of a route's requests to a shadow pool
+// after they have been answered, and throws the shadow responses away.
+// Requests with a body are only mirrored when the body is buffered.
+type Mirror struct {
+	Pool
+	Percent int `json:"percent"`
+	// MaxInflight caps the mirrored requests in flight. Copies over it are
+	// dropped. Defaults to 100.
+	MaxInflight int `json:"maxinflight"`
+}
+
+// PathRewrite changes the path of requests on a route before they are
+// forwarded. The prefix rules run first, then Regex.
+type PathRewrite struct {
+	// StripPrefix removes the route's PathPrefix, so /api/v1/users on a
+	// /api/v1 route reaches the backend as /users.
+	StripPrefix bool `json:"stripprefix"`
+	// ReplacePrefix swaps the route's PathPrefix for this value.
+	ReplacePrefix string `json:"replaceprefix"`
+	// Regex is matched against the path and every match is replaced with
+	// Replacement, which can use $1 or ${name} for capture groups.
+	Regex       string `json:"regex"`
+	Replacement string `json:"replacement"`
+}
+
+// HeaderRules change request headers on the way to the backend and
+// response headers on the way back.
+type HeaderRules struct {
+	Request  HeaderOps `json:"request"`
+	Response HeaderOps `json:"response"`
+}
+
+// HeaderOps remove, then set, then add headers. Values may use
+// ${client_ip}, ${backend_pod}, ${backend_address} and ${request_id}.
+type HeaderOps struct {
+	Add    map[string]string `json:"add"`
+	Set    map[string]string `json:"set"`
+	Remove []string          `json:"remove"`
+}
+
+// UpstreamTransport tunes connection reuse to backends. Unset fields keep
+// the defaults.
+type UpstreamTransport struct {
+	// MaxIdleConnsPerBackend caps idle connections kept per backend.
+	// Defaults to 32.
+	MaxIdleConnsPerBackend int `json:"maxidleconnsperbackend"`
+	// IdleConnTimeout closes idle connections, e.g. "90s".
+	IdleConnTimeout Duration `json:"idleconntimeout"`
+	// TLSHandshakeTimeout bounds the handshake with a backend, e.g. "10s".
+	TLSHandshakeTimeout Duration `json:"tlshandshaketimeout"`
+	// DisableKeepAlives opens a new connection for every request.
+	DisableKeepAlives bool `json:"disablekeepalives"`
+}
+
+// UpstreamTimeouts bound requests to backends. A request that runs out of
+// time is answered with 504. Unset fields keep the defaults.
+type UpstreamTimeouts struct {
+	// Connect bounds dialing a backend, e.g. "5s". Defaults to 5 seconds.
+	Connect Duration `json:"connect"`
+	// ResponseHeader bounds the wait for response headers, e.g. "30s".
+	// Defaults to 30 seconds.
+	ResponseHeader Duration `json:"responseheader"`
+	// Request bounds the whole request including the response body, e.g.
+	// "1m". Unset means no limit.
+	Request Duration `json:"request"`
+}
+
+// ServerTimeouts bound client connections to the balancer in http mode and
+// on the admin API. Unset fields keep the defaults. grpc mode only takes
+// ReadHeader, Idle and Shutdown, since streaming calls stay open for as long
+// as the client wants.
+type ServerTimeouts struct {
+	// Read bounds reading a request, e.g. "15s". Defaults to 15 seconds.
+	Read Duration `json:"read"`
+	// Write bounds writing a response, e.g. "15s". Defaults to 15 seconds.
+	Write Duration `json:"write"`
+	// Idle closes idle keep-alive connections, e.g. "60s". Defaults to 60
+	// seconds.
+	Idle Duration `json:"idle"`
+	// ReadHeader bounds reading the request headers, e.g. "5s". Defaults
+	// to Read in http mode and to 15 seconds in grpc mode.
+	ReadHeader Duration `json:"readheader"`
+	// Shutdown is how long the listeners wait for requests in flight when
+	// the balancer stops, e.g. "10s". Defaults to 10 seconds.
+	Shutdown Duration `json:"shutdown"`
+}
+
+// Defaults of the timeouts left unset.
+const (
+	DefaultReadTimeout     = 15 * time.Second
+	DefaultWriteTimeout    = 15 * time.Second
+	DefaultIdleTimeout     = 60 * time.Second
+	DefaultShutdownTimeout = 10 * time.Second
+	DefaultDrainTimeout    = 30 * time.Second
+)
+
+// WithDefaults returns the timeouts with the defaults in place of those
+// left unset. t may be nil.
+func (t *ServerTimeouts) WithDefaults() ServerTimeouts {
+	var resolved ServerTimeouts
+	if t != nil {
+		resolved = *t
+	}
+	for _, timeout := range []struct {
+		value    *Duration
+		fallback time.Duration
+	}{
+		{&resolved.Read, DefaultReadTimeout},
+		{&resolved.Write, DefaultWriteTimeout},
+		{&resolved.Idle, DefaultIdleTimeout},
+		{&resolved.Shutdown, DefaultShutdownTimeout},
+	} {
+		if timeout.value.Duration == 0 {
+			timeout.value.Duration = timeout.fallback
+		}
+	}
+	return resolved
+}
+
+// Retry sends requests that fail to another backend. Only requests without a
+// body, or with BufferBody set, are retried.
+type Retry struct {
+	// Attempts is how many times a request may be retried. Defaults to 1.
+	Attempts int `json:"attempts"`
+	// StatusCodes are the backend responses that are retried. A backend that
+	// cannot be reached is always retried. Defaults to 502 and 503.
+	StatusCodes []int `json:"statuscodes"`
+	// BudgetPercent caps retries at this percentage of the requests in the
+	// last ten seconds, so retries cannot snowball. Defaults to 20.
+	BudgetPercent int `json:"budgetpercent"`
+}
+
+// OutlierDetection ejects backends that keep failing requests until a
+// backoff runs out. Failures are connection errors, timeouts and 5xx
+// responses. Unset fields keep the defaults.
+type OutlierDetection struct {
+	// ConsecutiveFailures ejects a backend after this many failures in a
+	// row. Defaults to 5.
+	ConsecutiveFailures int `json:"consecutivefailures"`
+	// ErrorRatePercent ejects a backend when this share of its requests in
+	// an Interval fail. Unset turns the check off.
+	ErrorRatePercent int `json:"errorratepercent"`
+	// MinRequests a backend needs in an Interval before its error rate is
+	// judged. Defaults to 20.
+	MinRequests int `json:"minrequests"`
+	// Interval is the window error rates are measured over, e.g. "10s".
+	// Defaults to 10 seconds.
+	Interval Duration `json:"interval"`
+	// BaseEjectionTime is how long the first ejection lasts, e.g. "30s".
+	// Each further ejection doubles it. Defaults to 30 seconds.
+	BaseEjectionTime Duration `json:"baseejectiontime"`
+	// MaxEjectionTime caps an ejection, e.g. "5m". Defaults to 5 minutes.
+	MaxEjectionTime Duration `json:"maxejectiontime"`
+}
+
+// HealthCheck probes every backend and keeps those failing out of rotation
+// until they pass again. Unset fields keep the defaults.
+type HealthCheck struct {
+	// Type is http to request Path, tcp to only open a connection, for
+	// backends that do not speak HTTP, or grpc to call the standard
+	// grpc.health.v1 Check. Defaults to http.
+	Type string `json:"type"`
+	// Service is the service grpc checks ask about. Unset asks about the
+	// server as a whole.
+	Service string `json:"service"`
+	// Path is requested on every backend in http checks. Defaults to
+	// "/healthz".
+	Path string `json:"path"`
+	// Method of http checks. Defaults to GET.
+	Method string `json:"method"`
+	// Host is the Host header of http checks. Defaults to the backend
+	// address.
+	Host string `json:"host"`
+	// Headers are added to http checks.
+	Headers map[string]string `json:"headers"`
+	// StatusCodes are the answers http checks pass on. Defaults to any 2xx
+	// or 3xx status.
+	StatusCodes []int `json:"statuscodes"`
+	// Body, when set, is the body http checks pass on, e.g. "OK", for
+	// services that answer 200 when degraded.
+	Body string `json:"body"`
+	// JSONField is a field of the JSON body that must hold JSONValue, e.g.
+	// "status" or "checks.db" for nested fields.
+	JSONField string `json:"jsonfield"`
+	// JSONValue is what JSONField must hold, e.g. "ok". Numbers and
+	// booleans are written as in JSON, e.g. "true".
+	JSONValue string `json:"jsonvalue"`
+	// Port probes are sent to, for backends whose address or slice names no
+	// port. Defaults to the global BackendPort.
+	Port int `json:"port"`
+	// Interval between two probes, e.g. "5s". Defaults to 5 seconds.
+	Interval Duration `json:"interval"`
+	// Jitter delays every probe by a random time up to this long, e.g. "1s",
+	// so backends are not all probed at once. Unset probes them together.
+	Jitter Duration `json:"jitter"`
+	// Timeout of one probe, e.g. "2s". Defaults to 2 seconds.
+	Timeout Duration `json:"timeout"`
+	// UnhealthyThreshold is how many probes in a row a backend fails before
+	// it is taken out. Defaults to 2.
+	UnhealthyThreshold int `json:"unhealthythreshold"`
+	// HealthyThreshold is how many probes in a row it passes before it is
+	// put back. Defaults to 2.
+	HealthyThreshold int `json:"healthythreshold"`
+	// FlapWindow is how long a backend must stay in after coming back, e.g.
+	// "1m". One taken out again sooner needs twice the passes next time, up
+	// to eight times HealthyThreshold. Defaults to 1 minute.
+	FlapWindow Duration `json:"flapwindow"`
+	// RampWindow eases a backend that came back from no traffic to its
+	// full share over this long, e.g. "30s". Unset puts it back at once.
+	RampWindow Duration `json:"rampwindow"`
+	// Passive also takes backends out on failing requests, until they pass
+	// HealthyThreshold probes. Only in http and grpc mode.
+	Passive *PassiveHealthCheck `json:"passive"`
+	// Webhook is an http or https url sent a JSON event, with the pod,
+	// reason and last error, whenever a backend goes in or out of rotation.
+	Webhook string `json:"webhook"`
+}
+
+// PassiveHealthCheck judges backends by the requests sent to them. Failures
+// are connection errors, timeouts and StatusCodes. Unset fields keep the
+// defaults.
+type PassiveHealthCheck struct {
+	// ConsecutiveFailures takes a backend out after this many failed
+	// requests in a row. Defaults to 5.
+	ConsecutiveFailures int `json:"consecutivefailures"`
+	// ErrorRatePercent takes a backend out when this share of its requests
+	// in an Interval fail. Unset turns the check off.
+	ErrorRatePercent int `json:"errorratepercent"`
+	// MinRequests a backend needs in an Interval before its error rate is
+	// judged. Defaults to 20.
+	MinRequests int `json:"minrequests"`
+	// Interval is the window error rates are measured over, e.g. "10s".
+	// Defaults to 10 seconds.
+	Interval Duration `json:"interval"`
+	// StatusCodes count as failures. Defaults to every 5xx status.
+	StatusCodes []int `json:"statuscodes"`
+}
+
+// SNIRoute sends tls connections that ask for ServerName to another service
+// in tcp mode. The connection is passed through without terminating TLS.
+type SNIRoute struct {
+	// ServerName is a host name, or a wildcard like "*.example.com" that
+	// matches one label.
+	ServerName  string `json:"servername"`
+	BackendName string `json:"backendname"`
+	// BackendPort defaults to the global BackendPort.
+	BackendPort int `json:"backendport"`
+	// LoadbalancerMethod defaults to the global strategy.
+	LoadbalancerMethod string `json:"loadbalancermethod"`
+}
+
+type Config struct {
+	// Version is the schema the config is written in, see CurrentVersion.
+	// Unset is version 1.
+	Version int `json:"version"`
+	// Include lists config files merged under this one, see readIncludes.
+	// Relative paths are from the directory of the file including them.
+	// Only config files can include others.
+	Include     []string `json:"include"`
+	BackendName string   `json:"backendname"`
+	// BackupBackendName is a second service that only receives traffic
+	// while BackendName has no backends.
+	BackupBackendName string `json:"backupbackendname"`
+	BackendPort       int    `json:"backendport"`
+	// BackendPortName takes each Kubernetes backend's port from the
+	// EndpointSlice port of this name, e.g. "http", for services whose pods
+	// listen on different ports. Backends whose slice has no such port use
+	// BackendPort.
+	BackendPortName  string `json:"backendportname"`
+	LoadbalancerPort int    `json:"loadbalancerport"`
+	// ListenAddress is the IP or host name the listeners bind to, without a
+	// port, e.g. "10.0.0.5" or "::1". Defaults to every interface.
+	ListenAddress string `json:"listenaddress"`
+	// AdminAddress is the IP or host name the admin API binds to, e.g.
+	// "127.0.0.1" to keep it off the network. Defaults to ListenAddress.
+	AdminAddress       string `json:"adminaddress"`
+	LoadbalancerMethod string `json:"loadbalancermethod"`
+	// Mode is "http" to proxy HTTP requests, the default, "grpc" to proxy
+	// HTTP/2 cleartext and balance every call, "tcp" to stream raw
+	// connections or "udp" to forward datagrams. In tcp and udp mode /status
+	// is only served on AdminPort.
+	Mode string `json:"mode"`
+	// LogFormat is "text", the default, or "json" for one JSON object per
+	// log line, for log collectors to parse.
+	LogFormat string `json:"logformat"`
+	// LogLevel is the least severe level logged: "debug", "info", the
+	// default, "warn" or "error". debug shows how each backend is picked and
+	// what every endpoint update changed.
+	LogLevel string `json:"loglevel"`
+	// AccessLog turns on a line per request. Routes can opt out, or in when
+	// it is unset.
+	AccessLog *AccessLog `json:"accesslog"`
+	// Tracing turns on OpenTelemetry tracing of proxied requests.
+	Tracing *Tracing `json:"tracing"`
+	// UDPSessionTimeout drops a udp client's backend binding after it has
+	// been idle this long, e.g. "30s". Defaults to 30 seconds.
+	UDPSessionTimeout Duration `json:"udpsessiontimeout"`
+	// UpstreamProtocol is how the balancer talks to backends: "http1", the
+	// default, "h2c" for HTTP/2 without TLS or "h2" for HTTP/2 over
+	// UpstreamTLS. grpc mode defaults to h2c, or h2 with UpstreamTLS.
+	UpstreamProtocol string `json:"upstreamprotocol"`
+	// UpstreamTLS turns on TLS to backends, in http and grpc mode.
+	UpstreamTLS *UpstreamTLS `json:"upstreamtls"`
+	// UpstreamTransport tunes connection reuse to backends.
+	UpstreamTransport *UpstreamTransport `json:"upstreamtransport"`
+	// UpstreamTimeouts bound requests to backends.
+	UpstreamTimeouts *UpstreamTimeouts `json:"upstreamtimeouts"`
+	// ServerTimeouts bound client connections to the balancer.
+	ServerTimeouts *ServerTimeouts `json:"servertimeouts"`
+	// HTTP3Port opens a QUIC listener that serves HTTP/3 next to the main
+	// listener, in http and grpc mode. It needs TLSCertFile and TLSKeyFile.
+	// Requests still reach backends over UpstreamProtocol.
+	HTTP3Port int `json:"http3port"`
+	// TLSCertFile and TLSKeyFile are the PEM certificate and key the HTTP/3
+	// listener presents to clients.
+	TLSCertFile string `json:"tlscertfile"`
+	TLSKeyFile  string `json:"tlskeyfile"`
+	// TLSSecret is the [namespace/]name of a kubernetes.io/tls Secret to
+	// take the HTTP/3 certificate and key from instead of the files. It is
+	// watched and the certificate rotates when it changes. The namespace
+	// defaults to the balancer's own.
+	TLSSecret string `json:"tlssecret"`
+	// AdminPort serves the admin API, which can switch the strategy at
+	// runtime. Unset keeps the admin API off.
+	AdminPort int `json:"adminport"`
+	// BackendWeights maps pod names to weights for weighted strategies.
+	// Pods that are not listed use their weight annotation, or 1.
+	BackendWeights map[string]int `json:"backendweights"`
+	// WeightAnnotation is the pod annotation weights are read from, e.g.
+	// "balancer/weight". Unset turns annotation weights off.
+	WeightAnnotation string `json:"weightannotation"`
+	// PodMetadata carries the labels and annotations of backend pods on
+	// each Kubernetes backend. It is on whenever WeightAnnotation is set.
+	// Pods are watched either way, so the Role needs to list and watch
+	// them.
+	PodMetadata bool `json:"podmetadata"`
+	// Clusters are the Kubernetes clusters every Kubernetes backend is
+	// gathered from, each watching Namespaces. Unset discovers in the
+	// cluster the balancer runs in. Backup backends have priority 1, so
+	// failover between clusters is best kept to priorities 0 and 2 up.
+	Clusters []*Cluster `json:"clusters"`
+	// Kubeconfig is the path of a kubeconfig to discover backends with
+	// while Clusters is unset, to run the balancer outside the cluster.
+	// Unset uses the in-cluster config.
+	Kubeconfig string `json:"kubeconfig"`
+	// Namespaces are where Kubernetes backends are discovered. Defaults to
+	// the NAMESPACE environment variable, or else the balancer's own
+	// namespace from its service account. "*" watches every namespace, which
+	// needs a ClusterRole instead of a Role per namespace. A backend name
+	// of "namespace/name" takes the service from one namespace, a bare name
+	// merges the service from all of them.
+	Namespaces []string `json:"namespaces"`
+	// NamespaceSelector narrows "*" to the namespaces whose labels match
+	// this label selector, e.g. "team=payments". The ClusterRole then also
+	// needs to list and watch namespaces.
+	NamespaceSelector string `json:"namespaceselector"`
+	// ExternalNames lets a backend name a Service of type ExternalName, to
+	// front a system outside the cluster through its service. The Role then
+	// also needs to list and watch services. Hand made EndpointSlices are
+	// always followed, including FQDN ones.
+	ExternalNames bool `json:"externalnames"`
+	// InformerResync is how often the Kubernetes informers replay their
+	// whole cache, e.g. "10m". Defaults to 3 minutes.
+	InformerResync Duration `json:"informerresync"`
+	// DiscoveryDebounce holds back backend list changes for this long after
+	// an EndpointSlice changes, e.g. "250ms", so a rollout updating slices
+	// many times a second replaces the list once per debounce. Unset
+	// applies every change at once.
+	DiscoveryDebounce Duration `json:"discoverydebounce"`
+	// IncludeNotReady also sends traffic to pods that are still warming up
+	// and have not passed their readiness probe. Terminating pods are never
+	// used.
+	IncludeNotReady bool `json:"includenotready"`
+	// BackendSelectors maps backend names to label selectors, e.g.
+	// "app=api,tier=v2". The backend merges every Kubernetes service in the
+	// watched namespaces whose labels match.
+	BackendSelectors map[string]string `json:"backendselectors"`
+	// StaticBackends lists the addresses of backends by backend name, for
+	// running outside Kubernetes. Entries are "host:port", or a host reached
+	// on the backend port. Backends named here, in DNSBackends,
+	// FileBackends, Consul or Docker are not looked up in Kubernetes, and
+	// without any that are no cluster is needed.
+	StaticBackends map[string][]string `json:"staticbackends"`
+	// DNSBackends resolves backends by backend name from DNS, for headless
+	// services or running outside Kubernetes.
+	DNSBackends map[string]*DNSBackend `json:"dnsbackends"`
+	// FileBackends maps backend names to JSON or YAML files listing their
+	// backends, which are reloaded when the files change. Each file holds a
+	// list of {"address": "host:port", "weight": 1, "zone": ""} entries. An
+	// empty file is taken to be mid-write and ignored, write [] for none.
+	FileBackends map[string]string `json:"filebackends"`
+	// Consul reads backends by backend name from a Consul catalog.
+	Consul *Consul `json:"consul"`
+	// Docker reads backends by backend name from labelled containers.
+	Docker *Docker `json:"docker"`
+	// HashKey picks the request attribute hashing strategies key on: "ip",
+	// "header:<name>" or "cookie:<name>". Defaults to the client IP.
+	HashKey string `json:"hashkey"`
+	// VirtualNodes is how many points each backend gets on the hash ring.
+	VirtualNodes int `json:"virtualnodes"`
+	// Shards is how many shards the Sharded strategy splits HashKey into,
+	// one per StatefulSet ordinal. Defaults to one more than the highest
+	// ordinal discovered.
+	Shards int `json:"shards"`
+	// HashHeader is the request header HeaderHash pins on. Defaults to
+	// X-Tenant-ID.
+	HashHeader string `json:"hashheader"`
+	// TrustForwardedFor reads the client IP from X-Forwarded-For. Only enable
+	// it when a trusted proxy in front of the balancer sets that header.
+	TrustForwardedFor bool `json:"trustforwardedfor"`
+	// PollInterval is how often the Adaptive strategy reads backend
+	// counters, e.g. "5s".
+	PollInterval Duration `json:"pollinterval"`
+	// SlowStartWindow ramps newly discovered backends from no traffic to a
+	// full share over this window, e.g. "30s". Unset disables slow start.
+	SlowStartWindow Duration `json:"slowstartwindow"`
+	// EWMADecay is how quickly the PeakEWMA strategy forgets old latency,
+	// e.g. "10s".
+	EWMADecay Duration `json:"ewmadecay"`
+	// StrategyOptions are the options of each strategy, by name, e.g.
+	// {"RingHash": {"virtualnodes": 200, "hashkey": "header:X-User"}}.
+	// The strategy checks its own and they win over the settings above
+	// while it is in use, whether from loadbalancermethod, a route or the
+	// admin API. Every strategy takes slowstartwindow.
+	StrategyOptions map[string]json.RawMessage `json:"strategyoptions"`
+	// ZoneAware keeps traffic in the balancer's zone when enough local
+	// backends exist. The zone comes from Zone, or from the label of the
+	// node named by NODE_NAME.
+	ZoneAware bool `json:"zoneaware"`
+	// Zone overrides the balancer's detected zone.
+	Zone string `json:"zone"`
+	// ZoneMinBackends is the number of local backends needed before traffic
+	// stays in zone. Defaults to 1.
+	ZoneMinBackends int `json:"zoneminbackends"`
+	// SubsetSize limits each balancer replica to a stable subset of this
+	// many backends, chosen from the replica's pod name. Zero uses all.
+	SubsetSize int `json:"subsetsize"`
+	// AffinityTTL keeps a client, identified by HashKey, on the same backend
+	// until it has been idle this long, e.g. "10m". Unset turns it off.
+	AffinityTTL Duration `json:"affinityttl"`
+	// AffinityMaxEntries caps how many clients are remembered. The least
+	// recently used client is forgotten first. Defaults to 10000.
+	AffinityMaxEntries int `json:"affinitymaxentries"`
+	// Headers are rewritten on every proxied request and response.
+	Headers *HeaderRules `json:"headers"`
+	// MaxBodySize rejects request bodies over this many bytes with 413.
+	// Unset means no limit.
+	MaxBodySize int64 `json:"maxbodysize"`
+	// BufferBody reads each request body into memory before forwarding it,
+	// which makes requests safe to retry. By default bodies are streamed.
+	BufferBody bool `json:"bufferbody"`
+	// Retry turns on retries in http and grpc mode.
+	Retry *Retry `json:"retry"`
+	// MaxInflight caps the requests in flight at once in http and grpc mode.
+	// Requests over the limit get 503 with Retry-After. Unset means no limit.
+	MaxInflight int `json:"maxinflight"`
+	// QueueDepth lets this many requests over MaxInflight, or over a
+	// route's MaxInflight, wait for a slot instead of getting 503 at once.
+	// Unset turns queueing off.
+	QueueDepth int `json:"queuedepth"`
+	// QueueTimeout is how long a queued request waits for a slot, e.g.
+	// "500ms". Defaults to 1 second.
+	QueueTimeout Duration `json:"queuetimeout"`
+	// DrainTimeout is how long requests and connections on a backend that
+	// left discovery, in every pool that had it, may keep running before
+	// they are cut, e.g. "30s". New traffic stops at once. Defaults to 30
+	// seconds.
+	DrainTimeout Duration `json:"draintimeout"`
+	// ReloadDebounce is how long the config file has to stay unchanged
+	// before a change to it is reloaded, e.g. "2s", so a file written in
+	// several steps is only read once it is whole. Defaults to 1 second.
+	ReloadDebounce Duration `json:"reloaddebounce"`
+	// OutlierDetection turns on passive ejection of failing backends in
+	// http and grpc mode.
+	OutlierDetection *OutlierDetection `json:"outlierdetection"`
+	// HealthCheck turns on active probes of every backend.
+	HealthCheck *HealthCheck `json:"healthcheck"`
+	// HealthChecks set the health check of backends by backend name, for
+	// pools whose health is read differently. A backend named here uses
+	// its own check instead of HealthCheck.
+	HealthChecks map[string]*HealthCheck `json:"healthchecks"`
+	// Pools are the named services routes can send traffic to, next to
+	// BackendName.
+	Pools []*NamedPool `json:"pools"`
+	// Routes give hosts, path prefixes and headers their own settings or
+	// pool.
+	Routes []Route `json:"routes"`
+	// SNIRoutes pick a service by TLS server name in tcp mode.
+	SNIRoutes []SNIRoute `json:"sniroutes"`
+}
+
+// validate checks the whole config and returns every problem it finds,
+// joined, so they can all be fixed at once.
+func (c *Config) validate() error {
+	var errs []error
+	strategies := strategy.Names()
+	valid := false
+	for _, s := range strategies {
+		if c.LoadbalancerMethod == s {
+			valid = true
+			break
+		}
+	}
+
+	if !valid {
+		errs = append(errs, fmt.Errorf("invalid strategy, set one of %v", strategies))
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.StrategyOptions)) {
+		if !slices.Contains(strategies, name) {
+			errs = append(errs, fmt.Errorf("strategyoptions for unknown strategy %s, set one of %v", name, strategies))
+			continue
+		}
+		if err := strategy.ApplyOptions(name, c.StrategyOptions[name], &strategy.Options{}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	switch c.Mode {
+	case "":
+		c.Mode = ModeHTTP
+	case ModeHTTP, ModeGRPC, ModeTCP, ModeUDP:
+	default:
+		errs = append(errs, fmt.Errorf("invalid mode %s, set one of %v", c.Mode, []string{ModeHTTP, ModeGRPC, ModeTCP, ModeUDP}))
+	}
+	if !logging.ValidFormat(c.LogFormat) {
+		errs = append(errs, fmt.Errorf("invalid log format %s, set one of %v", c.LogFormat, []string{logging.FormatText, logging.FormatJSON}))
+	}
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, err)
+	}
+	if c.AccessLog != nil {
+		errs = append(errs, c.AccessLog.validate())
+	}
+	if c.Tracing != nil {
+		errs = append(errs, c.Tracing.validate())
+	}
+
+	if c.UpstreamProtocol == "" && c.Mode == ModeGRPC {
+		c.UpstreamProtocol = ProtocolH2C
+		if c.UpstreamTLS != nil {
+			c.UpstreamProtocol = ProtocolH2
+		}
+	}
+	errs = append(errs, c.validateProtocol(c.UpstreamProtocol))
+	if c.Mode == ModeGRPC && c.UpstreamProtocol != ProtocolH2C && c.UpstreamProtocol != ProtocolH2 {
+		errs = append(errs, fmt.Errorf("grpc mode needs an http/2 upstream protocol, got %s", c.UpstreamProtocol))
+	}
+	errs = append(errs, c.validateUpstreamTLS())
+	errs = append(errs, c.UpstreamTransport.validate())
+	errs = append(errs, c.UpstreamTimeouts.validate())
+	errs = append(errs, c.ServerTimeouts.validate())
+	errs = append(errs, c.validateNamespaces())
+	errs = append(errs, c.validateClusters())
+	errs = append(errs, c.validateStaticBackends())
+	errs = append(errs, c.validateDNSBackends())
+	errs = append(errs, c.Consul.validate())
+	errs = append(errs, c.Docker.validate())
+	errs = append(errs, c.validateBackendSources())
+
+	errs = append(errs, c.validateListeners())
+	if c.HTTP3Port != 0 {
+		if c.Mode != ModeHTTP && c.Mode != ModeGRPC {
+			errs = append(errs, fmt.Errorf("http3 is not supported in %s mode", c.Mode))
+		}
+		if c.TLSSecret == "" && (c.TLSCertFile == "" || c.TLSKeyFile == "") {
+			errs = append(errs, fmt.Errorf("http3 needs tlscertfile and tlskeyfile, or tlssecret"))
+		}
+	}
+
+	if c.TLSSecret != "" {
+		if c.TLSCertFile != "" || c.TLSKeyFile != "" {
+			errs = append(errs, fmt.Errorf("tlssecret and tlscertfile or tlskeyfile can not be used together"))
+		}
+		if !validSecretName(c.TLSSecret) {
+			errs = append(errs, fmt.Errorf("invalid tlssecret %q, use [namespace/]name", c.TLSSecret))
+		}
+	}
+
+	if c.UDPSessionTimeout.Duration < 0 {
+		errs = append(errs, fmt.Errorf("udp session timeout must not be negative, got %s", c.UDPSessionTimeout))
+	}
+
+	if (c.Mode == ModeTCP || c.Mode == ModeUDP) && len(c.Routes) > 0 {
+		errs = append(errs, fmt.Errorf("routes are not supported in %s mode", c.Mode))
+	}
+
+	errs = append(errs, c.validatePools(strategies))
+	errs = append(errs, c.validateRoutes(strategies))
+
+	if c.MaxBodySize < 0 {
+		errs = append(errs, fmt.Errorf("max body size must not be negative, got %d", c.MaxBodySize))
+	}
+
+	errs = append(errs, c.Headers.validate())
+
+	if c.Retry != nil && c.Mode != ModeHTTP && c.Mode != ModeGRPC {
+		errs = append(errs, fmt.Errorf("retries are not supported in %s mode", c.Mode))
+	}
+	errs = append(errs, c.Retry.validate())
+	if c.MaxInflight < 0 {
+		errs = append(errs, fmt.Errorf("max inflight must not be negative, got %d", c.MaxInflight))
+	}
+	if c.MaxInflight > 0 && c.Mode != ModeHTTP && c.Mode != ModeGRPC {
+		errs = append(errs, fmt.Errorf("max inflight is not supported in %s mode", c.Mode))
+	}
+	if c.QueueDepth < 0 {
+		errs = append(errs, fmt.Errorf("queue depth must not be negative, got %d", c.QueueDepth))
+	}
+	if c.QueueTimeout.Duration < 0 {
+		errs = append(errs, fmt.Errorf("queue timeout must not be negative, got %s", c.QueueTimeout))
+	}
+	if c.QueueDepth > 0 && !c.limited() {
+		errs = append(errs, fmt.Errorf("queue depth needs maxinflight on the config or a route"))
+	}
+	if c.DrainTimeout.Duration < 0 {
+		errs = append(errs, fmt.Errorf("drain timeout must not be negative, got %s", c.DrainTimeout))
+	}
+	if c.ReloadDebounce.Duration < 0 {
+		errs = append(errs, fmt.Errorf("reload debounce must not be negative, got %s", c.ReloadDebounce))
+	}
+	if c.InformerResync.Duration < 0 {
+		errs = append(errs, fmt.Errorf("informer resync must not be negative, got %s", c.InformerResync))
+	}
+	if c.DiscoveryDebounce.Duration < 0 {
+		errs = append(errs, fmt.Errorf("discovery debounce must not be negative, got %s", c.DiscoveryDebounce))
+	}
+	if c.OutlierDetection != nil && c.Mode != ModeHTTP && c.Mode != ModeGRPC {
+		errs = append(errs, fmt.Errorf("outlier detection is not supported in %s mode", c.Mode))
+	}
+	errs = append(errs, c.OutlierDetection.validate())
+	errs = append(errs, c.validateHealthChecks())
+
+	errs = append(errs, c.validateSNIRoutes(strategies))
+
+	if !validHashKey(c.HashKey) {
+		errs = append(errs, fmt.Errorf("invalid hash key %q, use ip, header:<name> or cookie:<name>", c.HashKey))
+	}
+
+	if c.PollInterval.Duration < 0 {
+		errs = append(errs, fmt.Errorf("poll interval must not be negative, got %s", c.PollInterval))
+	}
+
+	if c.EWMADecay.Duration < 0 {
+		errs = append(errs, fmt.Errorf("ewma decay must not be negative, got %s", c.EWMADecay))
+	}
+
+	if c.SlowStartWindow.Duration < 0 {
+		errs = append(errs, fmt.Errorf("slow start window must not be negative, got %s", c.SlowStartWindow))
+	}
+
+	if c.BackupBackendName != "" && c.BackupBackendName == c.BackendName {
+		errs = append(errs, fmt.Errorf("backup backend %s must differ from the primary backend", c.BackupBackendName))
+	}
+
+	if c.AffinityTTL.Duration < 0 {
+		errs = append(errs, fmt.Errorf("affinity ttl must not be negative, got %s", c.AffinityTTL))
+	}
+
+	if c.AffinityMaxEntries < 0 {
+		errs = append(errs, fmt.Errorf("affinity max entries must not be negative, got %d", c.AffinityMaxEntries))
+	}
+
+	if c.SubsetSize < 0 {
+		errs = append(errs, fmt.Errorf("subset size must not be negative, got %d", c.SubsetSize))
+	}
+
+	if c.ZoneMinBackends < 0 {
+		errs = append(errs, fmt.Errorf("zone min backends must not be negative, got %d", c.ZoneMinBackends))
+	}
+
+	if c.VirtualNodes < 0 {
+		errs = append(errs, fmt.Errorf("virtual nodes must not be negative, got %d", c.VirtualNodes))
+	}
+	if c.Shards < 0 {
+		errs = append(errs, fmt.Errorf("shards must not be negative, got %d", c.Shards))
+	}
+
+	for _, pod := range slices.Sorted(maps.Keys(c.BackendWeights)) {
+		if weight := c.BackendWeights[pod]; weight < 1 {
+			errs = append(errs, fmt.Errorf("weight for %s must be at least 1, got %d", pod, weight))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Config) validateRoutes(strategies []string) error {
+	var errs []error
+	seen := make(map[string]bool, len(c.Routes))
+	for i := range c.Routes {
+		route := &c.Routes[i]
+		if route.PathPrefix == "" {
+			route.PathPrefix = "/"
+		}
+		if !strings.HasPrefix(route.PathPrefix, "/") {
+			errs = append(errs, fmt.Errorf("route path prefix %q must start with /", route.PathPrefix))
+		}
+		route.Host = strings.ToLower(route.Host)
+		if !validRouteHost(route.Host) {
+			errs = append(errs, fmt.Errorf("route %s: invalid host %q, use a host name or *.<domain>", route.PathPrefix, route.Host))
+		}
+		name := route.Host + route.PathPrefix
+		headers := make([]string, 0, len(route.MatchHeaders))
+		for _, header := range slices.Sorted(maps.Keys(route.MatchHeaders)) {
+			value := route.MatchHeaders[header]
+			if !validHeaderName(header) {
+				errs = append(errs, fmt.Errorf("route %s: invalid match header name %q", name, header))
+			}
+			headers = append(headers, http.CanonicalHeaderKey(header)+"="+value)
+		}
+		slices.Sort(headers)
+		key := name + " " + strings.Join(headers, ",")
+		if seen[key] {
+			errs = append(errs, fmt.Errorf("route %s is defined more than once with the same matchers", name))
+		}
+		seen[key] = true
+
+		if route.Pool != "" && c.NamedPool(route.Pool) == nil {
+			errs = append(errs, fmt.Errorf("route %s: no pool named %s", name, route.Pool))
+		}
+		if route.Pool != "" && route.BlueGreen != nil {
+			errs = append(errs, fmt.Errorf("route %s: pool and bluegreen cannot be used together", name))
+		}
+		if err := c.validateProtocol(route.UpstreamProtocol); err != nil {
+			errs = append(errs, fmt.Errorf("route %s: %w", name, err))
+		}
+		if err := route.Headers.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("route %s: %w", name, err))
+		}
+		if err := route.Rewrite.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("route %s: %w", name, err))
+		}
+		if route.MaxBodySize < 0 {
+			errs = append(errs, fmt.Errorf("route %s: max body size must not be negative, got %d", name, route.MaxBodySize))
+		}
+		if err := route.UpstreamTimeouts.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("route %s: %w", name, err))
+		}
+		if route.MaxInflight < 0 {
+			errs = append(errs, fmt.Errorf("route %s: max inflight must not be negative, got %d", name, route.MaxInflight))
+		}
+		if err := route.Mirror.validate(strategies); err != nil {
+			errs = append(errs, fmt.Errorf("route %s: %w", name, err))
+		}
+		if err := route.Canary.validate(strategies); err != nil {
+			errs = append(errs, fmt.Errorf("route %s: %w", name, err))
+		}
+		if route.BlueGreen != nil && route.Canary != nil {
+			errs = append(errs, fmt.Errorf("route %s: canary and bluegreen cannot be used together", name))
+		}
+		if err := route.BlueGreen.validate(strategies); err != nil {
+			errs = append(errs, fmt.Errorf("route %s: %w", name, err))
+		}
+
+		if route.LoadbalancerMethod != "" && !slices.Contains(strategies, route.LoadbalancerMethod) {
+			errs = append(errs, fmt.Errorf("invalid strategy for route %s, set one of %v", name, strategies))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validRouteHost reports whether host is empty, a host name or a wildcard
+// of the form *.<domain>.
+func validRouteHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	host = strings.TrimPrefix(host, "*.")
+	if host == "" || strings.HasPrefix(host, ".") || strings.HasSuffix(host, ".") || strings.Contains(host, "..") {
+		return false
+	}
+	for _, r := range host {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// ClusterFailover reports whether the clusters have more than one priority,
+// so backends have to be failed over between them.
+func (c *Config) ClusterFailover() bool {
+	for _, cluster := range c.Clusters {
+		if cluster.Priority != c.Clusters[0].Priority {
+			return true
+		}
+	}
+	return false
+}
+
+// restartSettings are the settings a reload cannot apply, because they
+// shape the listeners or the discovery that is already running.
+var restartSettings = []struct {
+	key string
+	get func(c *Config) any
+}{
+	{"mode", func(c *Config) any { return c.Mode }},
+	{"loadbalancerport", func(c *Config) any { return c.LoadbalancerPort }},
+	{"adminport", func(c *Config) any { return c.AdminPort }},
+	{"http3port", func(c *Config) any { return c.HTTP3Port }},
+	{"listenaddress", func(c *Config) any { return c.ListenAddress }},
+	{"adminaddress", func(c *Config) any { return c.AdminAddress }},
+	{"tlscertfile", func(c *Config) any { return c.TLSCertFile }},
+	{"tlskeyfile", func(c *Config) any { return c.TLSKeyFile }},
+	{"tlssecret", func(c *Config) any { return c.TLSSecret }},
+	{"servertimeouts", func(c *Config) any { return c.ServerTimeouts }},
+	{"udpsessiontimeout", func(c *Config) any { return c.UDPSessionTimeout }},
+	{"draintimeout", func(c *Config) any { return c.DrainTimeout }},
+	{"reloaddebounce", func(c *Config) any { return c.ReloadDebounce }},
+	{"sniroutes", func(c *Config) any { return c.SNIRoutes }},
+	{"tracing", func(c *Config) any { return c.Tracing }},
+	{"clusters", func(c *Config) any { return c.Clusters }},
+	{"kubeconfig", func(c *Config) any { return c.Kubeconfig }},
+	{"namespaces", func(c *Config) any { return c.Namespaces }},
+	{"namespaceselector", func(c *Config) any { return c.NamespaceSelector }},
+	{"externalnames", func(c *Config) any { return c.ExternalNames }},
+	{"informerresync", func(c *Config) any { return c.InformerResync }},
+	{"discoverydebounce", func(c *Config) any { return c.DiscoveryDebounce }},
+	{"includenotready", func(c *Config) any { return c.IncludeNotReady }},
+	{"backendportname", func(c *Config) any { return c.BackendPortName }},
+	{"weightannotation", func(c *Config) any { return c.WeightAnnotation }},
+	{"podmetadata", func(c *Config) any { return c.PodMetadata }},
+	{"backendselectors", func(c *Config) any { return c.BackendSelectors }},
+	{"staticbackends", func(c *Config) any { return c.StaticBackends }},
+	{"dnsbackends", func(c *Config) any { return c.DNSBackends }},
+	{"filebackends", func(c *Config) any { return c.FileBackends }},
+	{"consul", func(c *Config) any { return c.Consul }},
+	{"docker", func(c *Config) any { return c.Docker }},
+	{"healthcheck", func(c *Config) any { return c.HealthCheck }},
+	{"healthchecks", func(c *Config) any { return c.HealthChecks }},
+	{"pools.healthcheck", func(c *Config) any {
+		checks := make(map[string]*HealthCheck)
+		for _, pool := range c.Pools {
+			if pool != nil && pool.HealthCheck != nil {
+				checks[pool.BackendName] = pool.HealthCheck
+			}
+		}
+		return checks
+	}},
+}
+
+// RestartNeeded lists the settings that differ in next and only take effect
+// when the balancer restarts. Backends that next names for the first time
+// are discovered with its settings either way.
+func (c *Config) RestartNeeded(next *Config) []string {
+	var keys []string
+	for _, setting := range restartSettings {
+		if !reflect.DeepEqual(setting.get(c), setting.get(next)) {
+			keys = append(keys, setting.key)
+		}
+	}
+	return keys
+}
+
+// limited reports whether any in-flight limit is set.
+func (c *Config) limited() bool {
+	if c.MaxInflight > 0 {
+		return true
+	}
+	for _, route := range c.Routes {
+		if route.MaxInflight > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// validSecretName reports whether name is a Secret's name with an optional
+// namespace in front, namespace/name.
+func validSecretName(name string) bool {
+	namespace, name, ok := strings.Cut(name, "/")
+	if !ok {
+		name = namespace
+	} else if namespace == "" {
+		return false
+	}
+	return name != "" && !strings.Contains(name, "/")
+}
+
+func validHashKey(key string) bool {
+	if key == "" || key == "ip" {
+		return true
+	}
+	for _, prefix := range []string{"header:", "cookie:"} {
+		if strings.HasPrefix(key, prefix) && len(key) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pr *PathRewrite) validate() error {
+	if pr == nil {
+		return nil
+	}
+	if pr.StripPrefix && pr.ReplacePrefix != "" {
+		return fmt.Errorf("set stripprefix or replaceprefix, not both")
+	}
+	if pr.ReplacePrefix != "" && !strings.HasPrefix(pr.ReplacePrefix, "/") {
+		return fmt.Errorf("replaceprefix %q must start with /", pr.ReplacePrefix)
+	}
+	if pr.Regex == "" {
+		if pr.Replacement != "" {
+			return fmt.Errorf("replacement needs a regex")
+		}
+		return nil
+	}
+	if _, err := regexp.Compile(pr.Regex); err != nil {
+		return fmt.Errorf("invalid rewrite regex: %w", err)
+	}
+	return nil
+}
+
+func (h *HeaderRules) validate() error {
+	if h == nil {
+		return nil
+	}
+	for _, ops := range []HeaderOps{h.Request, h.Response} {
+		for name := range ops.Add {
+			if !validHeaderName(name) {
+				return fmt.Errorf("invalid header name %q", name)
+			}
+		}
+		for name := range ops.Set {
+			if !validHeaderName(name) {
+				return fmt.Errorf("invalid header name %q", name)
+			}
+		}
+		for _, name := range ops.Remove {
+			if !validHeaderName(name) {
+				return fmt.Errorf("invalid header name %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// validHeaderName reports whether name is a non-empty HTTP token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Config) validateSNIRoutes(strategies []string) error {
+	var errs []error
+	if len(c.SNIRoutes) > 0 && c.Mode != ModeTCP {
+		errs = append(errs, fmt.Errorf("sni routes need tcp mode, got %s", c.Mode))
+	}
+	seen := make(map[string]bool, len(c.SNIRoutes))
+	for i, route := range c.SNIRoutes {
+		name := strings.ToLower(route.ServerName)
+		if name == "" || strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+			errs = append(errs, fmt.Errorf("sni route server name %q must be a host name or *.domain", route.ServerName))
+		}
+		if seen[name] {
+			errs = append(errs, fmt.Errorf("sni route %s is defined more than once", route.ServerName))
+		}
+		seen[name] = true
+		c.SNIRoutes[i].ServerName = name
+
+		if route.BackendName == "" {
+			errs = append(errs, fmt.Errorf("sni route %s needs a backendname", route.ServerName))
+		}
+		if route.BackendPort < 0 {
+			errs = append(errs, fmt.Errorf("sni route %s backend port must not be negative, got %d", route.ServerName, route.BackendPort))
+		}
+		if route.LoadbalancerMethod != "" && !slices.Contains(strategies, route.LoadbalancerMethod) {
+			errs = append(errs, fmt.Errorf("invalid strategy for sni route %s, set one of %v", route.ServerName, strategies))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Config) validateClusters() error {
+	var errs []error
+	if c.Kubeconfig != "" && len(c.Clusters) > 0 {
+		errs = append(errs, fmt.Errorf("kubeconfig is only used without clusters, set it on the cluster instead"))
+	}
+	names := make(map[string]bool, len(c.Clusters))
+	inCluster := false
+	for _, cluster := range c.Clusters {
+		if cluster == nil || cluster.Name == "" {
+			errs = append(errs, fmt.Errorf("every cluster needs a name"))
+			continue
+		}
+		if names[cluster.Name] {
+			errs = append(errs, fmt.Errorf("cluster %s is listed more than once", cluster.Name))
+		}
+		names[cluster.Name] = true
+		if cluster.Priority < 0 {
+			errs = append(errs, fmt.Errorf("cluster %s priority must not be negative, got %d", cluster.Name, cluster.Priority))
+		}
+		if cluster.Kubeconfig == "" {
+			if inCluster {
+				errs = append(errs, fmt.Errorf("only one cluster may leave kubeconfig empty for the in-cluster config"))
+			}
+			inCluster = true
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Config) validateNamespaces() error {
+	var errs []error
+	seen := make(map[string]bool, len(c.Namespaces))
+	for _, namespace := range c.Namespaces {
+		if namespace == "" {
+			errs = append(errs, fmt.Errorf("namespaces must not contain an empty name"))
+		}
+		if seen[namespace] {
+			errs = append(errs, fmt.Errorf("namespace %s is listed more than once", namespace))
+		}
+		seen[namespace] = true
+	}
+	all := seen[AllNamespaces]
+	if all && len(c.Namespaces) > 1 {
+		errs = append(errs, fmt.Errorf("namespace %s already covers every namespace, list it alone", AllNamespaces))
+	}
+	if c.NamespaceSelector != "" {
+		if !all {
+			errs = append(errs, fmt.Errorf("a namespace selector needs namespaces set to [%q]", AllNamespaces))
+		}
+		if _, err := labels.Parse(c.NamespaceSelector); err != nil {
+			errs = append(errs, fmt.Errorf("invalid namespace selector %q: %w", c.NamespaceSelector, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Config) validateStaticBackends() error {
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(c.StaticBackends)) {
+		addresses := c.StaticBackends[name]
+		if len(addresses) == 0 {
+			errs = append(errs, fmt.Errorf("static backend %s has no addresses", name))
+		}
+		for _, address := range addresses {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				// A bare host is dialed on the backend port.
+				host, port = address, ""
+			}
+			if host == "" || strings.ContainsAny(host, "[]") {
+				errs = append(errs, fmt.Errorf("static backend %s has an invalid address %q", name, address))
+				continue
+			}
+			if port == "" {
+				continue
+			}
+			if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				errs = append(errs, fmt.Errorf("static backend %s has an invalid port in %q", name, address))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (d *Docker) validate() error {
+	if d == nil {
+		return nil
+	}
+	if d.Host != "" {
+		u, err := url.Parse(d.Host)
+		if err != nil || (u.Scheme != "unix" && u.Scheme != "tcp") {
+			return fmt.Errorf("docker host %q must be a unix:// or tcp:// address", d.Host)
+		}
+	}
+	if d.Interval.Duration < 0 {
+		return fmt.Errorf("docker interval must not be negative, got %s", d.Interval)
+	}
+	if len(d.Services) == 0 {
+		return fmt.Errorf("docker needs at least one service")
+	}
+	for name, service := range d.Services {
+		if service == nil || service.Label == "" {
+			return fmt.Errorf("docker service %s needs a label", name)
+		}
+		if service.Port < 0 || service.Port > 65535 {
+			return fmt.Errorf("docker service %s has an invalid port %d", name, service.Port)
+		}
+	}
+	return nil
+}
+
+// validateBackendSources checks that every backend name outside
+// Kubernetes comes from one place only.
+func (c *Config) validateBackendSources() error {
+	var errs []error
+	sources := make(map[string]string)
+	add := func(source string, names []string) {
+		for _, name := range names {
+			if other, ok := sources[name]; ok {
+				errs = append(errs, fmt.Errorf("backend %s cannot come from both %s and %s", name, other, source))
+				continue
+			}
+			sources[name] = source
+		}
+	}
+	selectors := slices.Sorted(maps.Keys(c.BackendSelectors))
+	for _, name := range selectors {
+		if selector := c.BackendSelectors[name]; selector == "" {
+			errs = append(errs, fmt.Errorf("backend %s has an invalid selector %q", name, selector))
+		} else if _, err := labels.Parse(selector); err != nil {
+			errs = append(errs, fmt.Errorf("backend %s has an invalid selector %q", name, selector))
+		}
+	}
+	add("backendselectors", selectors)
+	add("staticbackends", slices.Sorted(maps.Keys(c.StaticBackends)))
+	add("dnsbackends", slices.Sorted(maps.Keys(c.DNSBackends)))
+	files := slices.Sorted(maps.Keys(c.FileBackends))
+	for _, name := range files {
+		if c.FileBackends[name] == "" {
+			errs = append(errs, fmt.Errorf("file backend %s needs a path", name))
+		}
+	}
+	add("filebackends", files)
+	if c.Consul != nil {
+		add("consul", slices.Sorted(maps.Keys(c.Consul.Services)))
+	}
+	if c.Docker != nil {
+		add("docker", slices.Sorted(maps.Keys(c.Docker.Services)))
+	}
+	return errors.Join(errs...)
+}
 
-type Config struct {
-	BackendName        string `json:"backendname"`
-	BackendPort        int    `json:"backendport"`
-	LoadbalancerPort   int    `json:"loadbalancerport"`
-	LoadbalancerMethod string `json:"loadbalancermethod"`
+func (c *Config) validateDNSBackends() error {
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(c.DNSBackends)) {
+		backend := c.DNSBackends[name]
+		if backend == nil || backend.Name == "" {
+			errs = append(errs, fmt.Errorf("dns backend %s needs a name", name))
+			continue
+		}
+		switch backend.Type {
+		case "":
+			backend.Type = DNSTypeA
+		case DNSTypeA, DNSTypeSRV:
+		default:
+			errs = append(errs, fmt.Errorf("invalid type %s for dns backend %s, set one of %v", backend.Type, name, []string{DNSTypeA, DNSTypeSRV}))
+		}
+		if backend.Interval.Duration < 0 {
+			errs = append(errs, fmt.Errorf("dns backend %s interval must not be negative, got %s", name, backend.Interval))
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func (c *Config) validate() error {
-	strategies := []string{StrategyRoundRobin}
-	valid := false
-	for _, s := range strategies {
-		if c.LoadbalancerMethod == s {
-			valid = true
-			break
+func (cs *Consul) validate() error {
+	if cs == nil {
+		return nil
+	}
+	if cs.Address != "" {
+		u, err := url.Parse(cs.Address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("consul address %q must be an http or https url", cs.Address)
 		}
 	}
+	if len(cs.Services) == 0 {
+		return fmt.Errorf("consul needs at least one service")
+	}
+	for name, service := range cs.Services {
+		if service == nil {
+			cs.Services[name] = &ConsulService{}
+			service = cs.Services[name]
+		}
+		if service.Service == "" {
+			service.Service = name
+		}
+	}
+	return nil
+}
 
-	if !valid {
-		return fmt.Errorf("invalid strategy, set one of %v", strategies)
+// validateProtocol checks that protocol is a known upstream protocol that
+// fits the UpstreamTLS setting. Empty means the default.
+func (c *Config) validateProtocol(protocol string) error {
+	switch protocol {
+	case "", ProtocolHTTP1:
+		return nil
+	case ProtocolH2C:
+		if c.UpstreamTLS != nil {
+			return fmt.Errorf("upstream protocol h2c cannot be used with upstream tls, use h2")
+		}
+		return nil
+	case ProtocolH2:
+		if c.UpstreamTLS == nil {
+			return fmt.Errorf("upstream protocol h2 needs upstream tls")
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid upstream protocol %s, set one of %v", protocol, []string{ProtocolHTTP1, ProtocolH2C, ProtocolH2})
+}
+
+func (t *UpstreamTransport) validate() error {
+	if t == nil {
+		return nil
+	}
+	if t.MaxIdleConnsPerBackend < 0 {
+		return fmt.Errorf("max idle connections per backend must not be negative, got %d", t.MaxIdleConnsPerBackend)
+	}
+	if t.IdleConnTimeout.Duration < 0 {
+		return fmt.Errorf("idle connection timeout must not be negative, got %s", t.IdleConnTimeout)
+	}
+	if t.TLSHandshakeTimeout.Duration < 0 {
+		return fmt.Errorf("tls handshake timeout must not be negative, got %s", t.TLSHandshakeTimeout)
+	}
+	return nil
+}
+
+func (t *UpstreamTimeouts) validate() error {
+	if t == nil {
+		return nil
+	}
+	if t.Connect.Duration < 0 {
+		return fmt.Errorf("upstream connect timeout must not be negative, got %s", t.Connect)
+	}
+	if t.ResponseHeader.Duration < 0 {
+		return fmt.Errorf("upstream response header timeout must not be negative, got %s", t.ResponseHeader)
+	}
+	if t.Request.Duration < 0 {
+		return fmt.Errorf("upstream request timeout must not be negative, got %s", t.Request)
+	}
+	return nil
+}
+
+func (r *Retry) validate() error {
+	if r == nil {
+		return nil
+	}
+	if r.Attempts < 0 {
+		return fmt.Errorf("retry attempts must not be negative, got %d", r.Attempts)
+	}
+	for _, code := range r.StatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid retry status code %d", code)
+		}
+	}
+	if r.BudgetPercent < 0 || r.BudgetPercent > 100 {
+		return fmt.Errorf("retry budget percent must be between 0 and 100, got %d", r.BudgetPercent)
+	}
+	return nil
+}
+
+func (p *Pool) validate(strategies []string) error {
+	if p.BackendName == "" {
+		return fmt.Errorf("pool needs a backendname")
+	}
+	if p.BackendPort < 0 {
+		return fmt.Errorf("pool %s: backend port must not be negative, got %d", p.BackendName, p.BackendPort)
+	}
+	if p.LoadbalancerMethod != "" && !slices.Contains(strategies, p.LoadbalancerMethod) {
+		return fmt.Errorf("pool %s: invalid strategy, set one of %v", p.BackendName, strategies)
+	}
+	return nil
+}
+
+func (m *Mirror) validate(strategies []string) error {
+	if m == nil {
+		return nil
+	}
+	if err := m.Pool.validate(strategies); err != nil {
+		return fmt.Errorf("mirror: %w", err)
+	}
+	if m.Percent < 0 || m.Percent > 100 {
+		return fmt.Errorf("mirror percent must be between 0 and 100, got %d", m.Percent)
+	}
+	if m.MaxInflight < 0 {
+		return fmt.Errorf("mirror max inflight must not be negative, got %d", m.MaxInflight)
+	}
+	return nil
+}
+
+func (c *Canary) validate(strategies []string) error {
+	if c == nil {
+		return nil
+	}
+	if err := c.Pool.validate(strategies); err != nil {
+		return fmt.Errorf("canary: %w", err)
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("canary percent must be between 0 and 100, got %d", c.Percent)
+	}
+	return nil
+}
+
+func (bg *BlueGreen) validate(strategies []string) error {
+	if bg == nil {
+		return nil
+	}
+	if err := bg.Blue.validate(strategies); err != nil {
+		return fmt.Errorf("blue: %w", err)
+	}
+	if err := bg.Green.validate(strategies); err != nil {
+		return fmt.Errorf("green: %w", err)
+	}
+	if bg.Active == "" {
+		bg.Active = PoolBlue
+	}
+	if bg.Active != PoolBlue && bg.Active != PoolGreen {
+		return fmt.Errorf("active pool must be %s or %s, got %s", PoolBlue, PoolGreen, bg.Active)
+	}
+	return nil
+}
+
+func (o *OutlierDetection) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.ConsecutiveFailures < 0 {
+		return fmt.Errorf("outlier consecutive failures must not be negative, got %d", o.ConsecutiveFailures)
+	}
+	if o.ErrorRatePercent < 0 || o.ErrorRatePercent > 100 {
+		return fmt.Errorf("outlier error rate percent must be between 0 and 100, got %d", o.ErrorRatePercent)
+	}
+	if o.MinRequests < 0 {
+		return fmt.Errorf("outlier min requests must not be negative, got %d", o.MinRequests)
+	}
+	if o.Interval.Duration < 0 || o.BaseEjectionTime.Duration < 0 || o.MaxEjectionTime.Duration < 0 {
+		return fmt.Errorf("outlier durations must not be negative")
+	}
+	if o.MaxEjectionTime.Duration > 0 && o.MaxEjectionTime.Duration < o.BaseEjectionTime.Duration {
+		return fmt.Errorf("outlier max ejection time %s is shorter than the base ejection time %s", o.MaxEjectionTime, o.BaseEjectionTime)
+	}
+	return nil
+}
+
+func (c *Config) validatePools(strategies []string) error {
+	var errs []error
+	seen := make(map[string]bool, len(c.Pools))
+	for _, pool := range c.Pools {
+		if pool == nil {
+			errs = append(errs, fmt.Errorf("pools must not have empty entries"))
+			continue
+		}
+		if pool.Name == "" {
+			errs = append(errs, fmt.Errorf("pool of backend %s needs a name", pool.BackendName))
+		}
+		if seen[pool.Name] {
+			errs = append(errs, fmt.Errorf("pool %s is defined more than once", pool.Name))
+		}
+		seen[pool.Name] = true
+		if err := pool.Pool.validate(strategies); err != nil {
+			errs = append(errs, fmt.Errorf("pool %s: %w", pool.Name, err))
+		}
+		if err := pool.UpstreamTimeouts.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("pool %s: %w", pool.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// NamedPool returns the pool called name, nil when there is none.
+func (c *Config) NamedPool(name string) *NamedPool {
+	for _, pool := range c.Pools {
+		if pool != nil && pool.Name == name {
+			return pool
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateHealthChecks() error {
+	var errs []error
+	checks := map[string]*HealthCheck{"": c.HealthCheck}
+	for _, name := range slices.Sorted(maps.Keys(c.HealthChecks)) {
+		check := c.HealthChecks[name]
+		if check == nil {
+			errs = append(errs, fmt.Errorf("health check of backend %s is empty", name))
+			continue
+		}
+		checks[name] = check
+	}
+	// Backends are checked once by name, so a pool's check is the check of
+	// its backend name.
+	for _, pool := range c.Pools {
+		if pool == nil || pool.HealthCheck == nil {
+			continue
+		}
+		if _, ok := checks[pool.BackendName]; ok {
+			errs = append(errs, fmt.Errorf("pool %s: backend %s already has a health check", pool.Name, pool.BackendName))
+			continue
+		}
+		checks[pool.BackendName] = pool.HealthCheck
+	}
+	passive := false
+	for _, name := range slices.Sorted(maps.Keys(checks)) {
+		check := checks[name]
+		if check == nil {
+			continue
+		}
+		passive = passive || check.Passive != nil
+		if err := check.validate(); err != nil {
+			if name != "" {
+				err = fmt.Errorf("backend %s: %w", name, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	if passive && c.Mode != ModeHTTP && c.Mode != ModeGRPC {
+		errs = append(errs, fmt.Errorf("passive health checks are not supported in %s mode", c.Mode))
+	}
+	return errors.Join(errs...)
+}
+
+// HealthCheckFor returns the health check of the backend name, nil when
+// its backends are not checked.
+func (c *Config) HealthCheckFor(name string) *HealthCheck {
+	if check, ok := c.HealthChecks[name]; ok {
+		return check
+	}
+	for _, pool := range c.Pools {
+		if pool.BackendName == name && pool.HealthCheck != nil {
+			return pool.HealthCheck
+		}
+	}
+	return c.HealthCheck
+}
+
+func (h *HealthCheck) validate() error {
+	if h == nil {
+		return nil
+	}
+	switch h.Type {
+	case "":
+		h.Type = HealthCheckHTTP
+	case HealthCheckHTTP, HealthCheckTCP, HealthCheckGRPC:
+	default:
+		return fmt.Errorf("invalid health check type %s, set one of %v", h.Type, []string{HealthCheckHTTP, HealthCheckTCP, HealthCheckGRPC})
+	}
+	if h.Path != "" && !strings.HasPrefix(h.Path, "/") {
+		return fmt.Errorf("health check path must start with /, got %q", h.Path)
+	}
+	for _, code := range h.StatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid health check status code %d", code)
+		}
+	}
+	if (h.Body != "" || h.JSONField != "") && h.Type != HealthCheckHTTP {
+		return fmt.Errorf("health check body matching needs the http type, got %s", h.Type)
+	}
+	if h.JSONValue != "" && h.JSONField == "" {
+		return fmt.Errorf("health check json value needs a json field")
+	}
+	if h.Webhook != "" {
+		u, err := url.Parse(h.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("health check webhook %q must be an http or https url", redactQuery(redactURL(h.Webhook)))
+		}
+	}
+	if h.Port < 0 || h.Port > 65535 {
+		return fmt.Errorf("health check port must be between 0 and 65535, got %d", h.Port)
+	}
+	if h.Interval.Duration < 0 || h.Jitter.Duration < 0 || h.Timeout.Duration < 0 || h.FlapWindow.Duration < 0 || h.RampWindow.Duration < 0 {
+		return fmt.Errorf("health check durations must not be negative")
+	}
+	if h.UnhealthyThreshold < 0 || h.HealthyThreshold < 0 {
+		return fmt.Errorf("health check thresholds must not be negative")
+	}
+	if h.Interval.Duration > 0 && h.Jitter.Duration+h.Timeout.Duration > h.Interval.Duration {
+		return fmt.Errorf("health check jitter %s and timeout %s must fit in the interval %s", h.Jitter, h.Timeout, h.Interval)
+	}
+	return h.Passive.validate()
+}
+
+func (p *PassiveHealthCheck) validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.ConsecutiveFailures < 0 {
+		return fmt.Errorf("passive health check consecutive failures must not be negative, got %d", p.ConsecutiveFailures)
+	}
+	if p.ErrorRatePercent < 0 || p.ErrorRatePercent > 100 {
+		return fmt.Errorf("passive health check error rate percent must be between 0 and 100, got %d", p.ErrorRatePercent)
+	}
+	if p.MinRequests < 0 {
+		return fmt.Errorf("passive health check min requests must not be negative, got %d", p.MinRequests)
+	}
+	if p.Interval.Duration < 0 {
+		return fmt.Errorf("passive health check interval must not be negative, got %s", p.Interval)
+	}
+	for _, code := range p.StatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid passive health check status code %d", code)
+		}
+	}
+	return nil
+}
+
+func (t *ServerTimeouts) validate() error {
+	if t == nil {
+		return nil
+	}
+	if t.Read.Duration < 0 {
+		return fmt.Errorf("server read timeout must not be negative, got %s", t.Read)
+	}
+	if t.Write.Duration < 0 {
+		return fmt.Errorf("server write timeout must not be negative, got %s", t.Write)
+	}
+	if t.Idle.Duration < 0 {
+		return fmt.Errorf("server idle timeout must not be negative, got %s", t.Idle)
+	}
+	if t.ReadHeader.Duration < 0 {
+		return fmt.Errorf("server read header timeout must not be negative, got %s", t.ReadHeader)
+	}
+	if t.Shutdown.Duration < 0 {
+		return fmt.Errorf("server shutdown timeout must not be negative, got %s", t.Shutdown)
+	}
+	return nil
+}
+
+// listener is a port the balancer binds.
+type listener struct {
+	name, network, address string
+	port                   int
+}
+
+// listeners returns the ports the balancer binds with the address and
+// network of each, leaving out those that are off.
+func (c *Config) listeners() []listener {
+	network := "tcp"
+	if c.Mode == ModeUDP {
+		network = "udp"
+	}
+	admin := c.AdminAddress
+	if admin == "" {
+		admin = c.ListenAddress
+	}
+	var listeners []listener
+	for _, l := range []listener{
+		{"loadbalancer port", network, c.ListenAddress, c.LoadbalancerPort},
+		{"admin port", "tcp", admin, c.AdminPort},
+		{"http3 port", "udp", c.ListenAddress, c.HTTP3Port},
+	} {
+		if l.port != 0 {
+			listeners = append(listeners, l)
+		}
+	}
+	return listeners
+}
+
+// ListenAddr returns the address the main listener binds, host:port.
+func (c *Config) ListenAddr() string {
+	return net.JoinHostPort(c.ListenAddress, strconv.Itoa(c.LoadbalancerPort))
+}
+
+// HTTP3Addr returns the address the HTTP/3 listener binds, host:port.
+func (c *Config) HTTP3Addr() string {
+	return net.JoinHostPort(c.ListenAddress, strconv.Itoa(c.HTTP3Port))
+}
+
+// AdminAddr returns the address the admin API binds, host:port.
+func (c *Config) AdminAddr() string {
+	address := c.AdminAddress
+	if address == "" {
+		address = c.ListenAddress
+	}
+	return net.JoinHostPort(address, strconv.Itoa(c.AdminPort))
+}
+
+// validateListeners checks the bind addresses and that the ports are valid
+// and do not collide. Ports on different networks, such as http3 over udp
+// next to the loadbalancer port over tcp, can share a number, and so can
+// ports on different addresses.
+func (c *Config) validateListeners() error {
+	var errs []error
+	for _, address := range []struct{ key, value string }{
+		{"listenaddress", c.ListenAddress},
+		{"adminaddress", c.AdminAddress},
+	} {
+		if address.value != "" && !validBindAddress(address.value) {
+			errs = append(errs, fmt.Errorf("invalid %s %q, use an IP or host name without a port", address.key, address.value))
+		}
+	}
+	for _, port := range []struct {
+		name string
+		port int
+	}{
+		{"loadbalancer port", c.LoadbalancerPort},
+		{"admin port", c.AdminPort},
+		{"http3 port", c.HTTP3Port},
+		{"backend port", c.BackendPort},
+	} {
+		if port.port < 0 || port.port > 65535 {
+			errs = append(errs, fmt.Errorf("%s must be between 1 and 65535, got %d", port.name, port.port))
+		}
+	}
+	listeners := c.listeners()
+	for i, l := range listeners {
+		for _, other := range listeners[:i] {
+			if l.port != other.port || l.network != other.network {
+				continue
+			}
+			// An address and every interface overlap, two addresses do
+			// not.
+			if l.address == other.address || l.address == "" || other.address == "" {
+				errs = append(errs, fmt.Errorf("%s %d is already the %s, use another port", l.name, l.port, other.name))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validBindAddress reports whether address is an IP or a host name, without
+// a port.
+func validBindAddress(address string) bool {
+	if net.ParseIP(address) != nil {
+		return true
+	}
+	if len(address) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(address, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (a *AccessLog) validate() error {
+	switch a.Format {
+	case "":
+		a.Format = AccessLogCombined
+	case AccessLogCommon, AccessLogCombined, AccessLogJSON:
+	default:
+		return fmt.Errorf("invalid access log format %s, set one of %v", a.Format, []string{AccessLogCommon, AccessLogCombined, AccessLogJSON})
+	}
+	if a.Output == "" {
+		a.Output = AccessLogStdout
+	}
+	return nil
+}
+
+func (t *Tracing) validate() error {
+	var errs []error
+	if t.Endpoint != "" {
+		if u, err := url.Parse(t.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("tracing endpoint %s must be an http or https URL", redactURL(t.Endpoint)))
+		}
+	}
+	if t.SampleRatio != nil && (*t.SampleRatio < 0 || *t.SampleRatio > 1) {
+		errs = append(errs, fmt.Errorf("tracing sample ratio must be between 0 and 1, got %v", *t.SampleRatio))
+	}
+	if t.ServiceName == "" {
+		t.ServiceName = "balancer"
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Config) validateUpstreamTLS() error {
+	if c.UpstreamTLS == nil {
+		return nil
+	}
+	if c.Mode != ModeHTTP && c.Mode != ModeGRPC {
+		return fmt.Errorf("upstream tls is not supported in %s mode", c.Mode)
+	}
+	if c.UpstreamTLS.Secret != "" {
+		if c.UpstreamTLS.CAFile != "" || c.UpstreamTLS.CertFile != "" || c.UpstreamTLS.KeyFile != "" {
+			return fmt.Errorf("upstream tls secret and files can not be used together")
+		}
+		if !validSecretName(c.UpstreamTLS.Secret) {
+			return fmt.Errorf("invalid upstream tls secret %q, use [namespace/]name", c.UpstreamTLS.Secret)
+		}
+		return nil
+	}
+	if c.UpstreamTLS.CAFile == "" {
+		return fmt.Errorf("upstream tls needs a cafile or a secret")
+	}
+	if (c.UpstreamTLS.CertFile == "") != (c.UpstreamTLS.KeyFile == "") {
+		return fmt.Errorf("upstream tls needs both certfile and keyfile, or neither")
 	}
 	return nil
 }
 
 func LoadFromEnv() (*Config, error) {
+	cfg, err := readEnv()
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	logging.Debug("Loaded configuration from environment: %+v", cfg)
+	return cfg, nil
+}
+
+// readEnv reads the config from the environment without validating it.
+func readEnv() (*Config, error) {
 	backendName, ok := os.LookupEnv("BACKEND_NAME")
 	if !ok {
 		return nil, fmt.Errorf("could not load backend name from environment `BACKEND_NAME`")
@@ -72,36 +2049,101 @@ func LoadFromEnv() (*Config, error) {
 		LoadbalancerPort:   loadbalancerPort,
 		LoadbalancerMethod: loadbalancerMethod,
 	}
+	// STATIC_BACKENDS is an optional comma separated list of addresses for
+	// the backend, to run without Kubernetes.
+	if static, ok := os.LookupEnv("STATIC_BACKENDS"); ok {
+		addresses := strings.Split(static, ",")
+		for i := range addresses {
+			addresses[i] = strings.TrimSpace(addresses[i])
+		}
+		cfg.StaticBackends = map[string][]string{backendName: addresses}
+	}
+	return &cfg, nil
+}
+
+// LoadFromFile reads the config at path, as YAML when it ends in .yaml or
+// .yml, as TOML when it ends in .toml and as JSON otherwise. All of them use
+// the same field names.
+func LoadFromFile(path string) (*Config, error) {
+	cfg, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
 
 	err = cfg.validate()
 	if err != nil {
 		return nil, err
 	}
-	logging.Debug("Loaded configuration from environment: %+v", cfg)
-	return &cfg, nil
+
+	logging.Debug("Loaded config from %s: %+v", path, cfg)
+	return cfg, nil
 }
 
-func LoadFromFile(path string) (*Config, error) {
-	file, err := os.Open(path)
+// readFile reads the config at path, with the files it includes, without
+// validating it.
+func readFile(path string) (*Config, error) {
+	data, format, _, err := readIncludes(path, nil)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to open the config file %s: %w", path, err)
+		return nil, err
 	}
-	defer file.Close()
+	return decode(format, data)
+}
 
-	decoder := json.NewDecoder(file)
+// parse reads a config named name, a file path or a ConfigMap key, whose
+// extension picks the format like LoadFromFile. Includes are not followed.
+func parse(name string, data []byte) (*Config, error) {
+	data, format, err := toJSON(name, data)
+	if err != nil {
+		return nil, err
+	}
+	return decode(format, data)
+}
 
-	cfg := &Config{}
+// toJSON converts data to JSON from the format the extension of name picks,
+// and returns it with the name of that format.
+func toJSON(name string, data []byte) ([]byte, string, error) {
+	var err error
+	format := "JSON"
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		format = "YAML"
+		data, err = yaml.YAMLToJSON(data)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error parsing YAML: %w", err)
+		}
+	case ".toml":
+		format = "TOML"
+		data, err = toml.ToJSON(data)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error parsing TOML: %w", err)
+		}
+	}
+	return data, format, nil
+}
 
-	err = decoder.Decode(&cfg)
+// decode reads the config from JSON converted from format, migrating it
+// from older versions of the schema.
+func decode(format string, data []byte) (*Config, error) {
+	doc, err := object(data)
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing JSON: %w", err)
+		return nil, fmt.Errorf("Error parsing %s: %w", format, err)
 	}
-
-	err = cfg.validate()
+	warnings, err := migrate(doc)
 	if err != nil {
 		return nil, err
 	}
+	for _, warning := range warnings {
+		logging.Warning("%s", warning)
+	}
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", format, err)
+	}
 
-	logging.Debug("Loaded config from json: %+v", cfg)
+	cfg := &Config{}
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", format, err)
+	}
 	return cfg, nil
 }
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"pkg/logging"
+)
+
+// configMapKeys are tried in order for the config when no key is given.
+var configMapKeys = []string{"config.json", "config.yaml", "config.yml", "config.toml"}
+
+// configMapTimeout bounds reading the ConfigMap from the API server.
+const configMapTimeout = 10 * time.Second
+
+// Source is a Kubernetes object or a URL the config is read from instead of
+// a file, and watched for changes.
+type Source interface {
+	fmt.Stringer
+	load() (*Config, error)
+	// Watch calls reload whenever the config changes, once it has been left
+	// alone for debounce, until stopCh is closed. Zero debounce uses the
+	// default.
+	Watch(debounce time.Duration, reload func(), stopCh <-chan struct{}) error
+}
+
+// StatusReporter is a Source that records in its object whether the config
+// it holds was applied.
+type StatusReporter interface {
+	// ReportStatus records that the config last loaded was applied, or
+	// was not because of err.
+	ReportStatus(err error)
+}
+
+// ConfigMap is a Kubernetes ConfigMap the config is read from through the
+// API, so it needs neither a volume mount nor a restart to change. Reading
+// it needs the Role to get, list and watch configmaps.
+type ConfigMap struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	// key holds the config. Its extension picks the format like
+	// LoadFromFile. Empty takes the first of configMapKeys in the
+	// ConfigMap, or its only key.
+	key string
+}
+
+// NewConfigMap returns the ConfigMap name in namespace, with the config
+// under key.
+func NewConfigMap(client kubernetes.Interface, namespace, name, key string) *ConfigMap {
+	return &ConfigMap{client: client, namespace: namespace, name: name, key: key}
+}
+
+// String returns namespace/name.
+func (cm *ConfigMap) String() string {
+	return cm.namespace + "/" + cm.name
+}
+
+// read fetches the ConfigMap and returns the key the config was taken from
+// with its content.
+func (cm *ConfigMap) read() (string, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), configMapTimeout)
+	defer cancel()
+	object, err := cm.client.CoreV1().ConfigMaps(cm.namespace).Get(ctx, cm.name, metav1.GetOptions{})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read configmap %s: %w", cm, err)
+	}
+	return cm.config(object)
+}
+
+// config returns the key of object holding the config and its content.
+func (cm *ConfigMap) config(object *corev1.ConfigMap) (string, []byte, error) {
+	value := func(key string) ([]byte, bool) {
+		if data, ok := object.Data[key]; ok {
+			return []byte(data), true
+		}
+		data, ok := object.BinaryData[key]
+		return data, ok
+	}
+	if cm.key != "" {
+		data, ok := value(cm.key)
+		if !ok {
+			return "", nil, fmt.Errorf("configmap %s has no key %s", cm, cm.key)
+		}
+		return cm.key, data, nil
+	}
+	for _, key := range configMapKeys {
+		if data, ok := value(key); ok {
+			return key, data, nil
+		}
+	}
+	if len(object.Data)+len(object.BinaryData) == 1 {
+		for key, data := range object.Data {
+			return key, []byte(data), nil
+		}
+		for key, data := range object.BinaryData {
+			return key, data, nil
+		}
+	}
+	return "", nil, fmt.Errorf("configmap %s has none of the keys %v, set the key with --configmap-key", cm, configMapKeys)
+}
+
+// load reads the config from the ConfigMap.
+func (cm *ConfigMap) load() (*Config, error) {
+	key, data, err := cm.read()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parse(key, data)
+	if err != nil {
+		return nil, fmt.Errorf("configmap %s key %s: %w", cm, key, err)
+	}
+	if len(cfg.Include) > 0 {
+		return nil, fmt.Errorf("configmap %s key %s: only config files can include others", cm, key)
+	}
+	return cfg, nil
+}
+
+// Watch implements Source. Updates that leave the config as it was, such as
+// to other keys or labels, are ignored.
+func (cm *ConfigMap) Watch(debounce time.Duration, reload func(), stopCh <-chan struct{}) error {
+	if debounce == 0 {
+		debounce = defaultReloadDebounce
+	}
+	_, last, err := cm.read()
+	if err != nil {
+		return err
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(cm.client, 0,
+		informers.WithNamespace(cm.namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", cm.name).String()
+		}))
+	informer := factory.Core().V1().ConfigMaps()
+	changed := make(chan struct{}, 1)
+	notify := func(any) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(_, object any) { notify(object) },
+		DeleteFunc: notify,
+	})
+	factory.Start(stopCh)
+
+	go func() {
+		timer := time.NewTimer(debounce)
+		timer.Stop()
+		defer timer.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-changed:
+				timer.Reset(debounce)
+			case <-timer.C:
+				object, err := informer.Lister().ConfigMaps(cm.namespace).Get(cm.name)
+				if err != nil {
+					logging.Warning("Failed to read configmap %s after it changed, keeping the running config: %v", cm, err)
+					continue
+				}
+				_, data, err := cm.config(object)
+				if err != nil {
+					logging.Warning("Failed to read the config after configmap %s changed: %v", cm, err)
+					continue
+				}
+				if bytes.Equal(data, last) {
+					continue
+				}
+				last = data
+				logging.Info("Configmap %s changed, reloading the config", cm)
+				reload()
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+
+	"pkg/logging"
+)
+
+// BalancerConfigResource is the BalancerConfig custom resource defined in
+// k8s/balancer-crd.yaml. Its spec holds a config with the same fields as a
+// config file.
+var BalancerConfigResource = schema.GroupVersionResource{
+	Group:    "go-balancer.io",
+	Version:  "v1alpha1",
+	Resource: "balancerconfigs",
+}
+
+// States a BalancerConfig's status reports.
+const (
+	StateApplied string = "Applied"
+	StateInvalid string = "Invalid"
+)
+
+// BalancerConfig is a BalancerConfig resource the config is read from. Its
+// status tells whether the balancer applied the spec, so kubectl shows a
+// rejected change. Reading it needs the Role to get, list and watch
+// balancerconfigs and to update balancerconfigs/status.
+type BalancerConfig struct {
+	client    dynamic.Interface
+	namespace string
+	name      string
+	// generation is that of the spec last loaded.
+	generation atomic.Int64
+}
+
+// NewBalancerConfig returns the BalancerConfig name in namespace.
+func NewBalancerConfig(client dynamic.Interface, namespace, name string) *BalancerConfig {
+	return &BalancerConfig{client: client, namespace: namespace, name: name}
+}
+
+// String returns namespace/name.
+func (bc *BalancerConfig) String() string {
+	return bc.namespace + "/" + bc.name
+}
+
+func (bc *BalancerConfig) get() (*unstructured.Unstructured, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), configMapTimeout)
+	defer cancel()
+	object, err := bc.client.Resource(BalancerConfigResource).Namespace(bc.namespace).Get(ctx, bc.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read balancerconfig %s: %w", bc, err)
+	}
+	return object, nil
+}
+
+// load reads the config from the spec.
+func (bc *BalancerConfig) load() (*Config, error) {
+	object, err := bc.get()
+	if err != nil {
+		return nil, err
+	}
+	bc.generation.Store(object.GetGeneration())
+	spec, ok, err := unstructured.NestedMap(object.Object, "spec")
+	if err != nil || !ok {
+		return nil, fmt.Errorf("balancerconfig %s has no spec", bc)
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, fmt.Errorf("balancerconfig %s: %w", bc, err)
+	}
+	cfg, err := parse("spec.json", data)
+	if err != nil {
+		return nil, fmt.Errorf("balancerconfig %s: %w", bc, err)
+	}
+	if len(cfg.Include) > 0 {
+		return nil, fmt.Errorf("balancerconfig %s: only config files can include others", bc)
+	}
+	return cfg, nil
+}
+
+// Watch implements Source. Only changes to the spec, which bump the
+// generation, reload the config, so the status written by ReportStatus does
+// not.
+func (bc *BalancerConfig) Watch(debounce time.Duration, reload func(), stopCh <-chan struct{}) error {
+	if debounce == 0 {
+		debounce = defaultReloadDebounce
+	}
+	object, err := bc.get()
+	if err != nil {
+		return err
+	}
+	last := object.GetGeneration()
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(bc.client, 0, bc.namespace, func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", bc.name).String()
+	})
+	informer := factory.ForResource(BalancerConfigResource)
+	changed := make(chan struct{}, 1)
+	notify := func(any) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(_, object any) { notify(object) },
+		DeleteFunc: notify,
+	})
+	factory.Start(stopCh)
+
+	go func() {
+		timer := time.NewTimer(debounce)
+		timer.Stop()
+		defer timer.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-changed:
+				timer.Reset(debounce)
+			case <-timer.C:
+				object, err := informer.Lister().ByNamespace(bc.namespace).Get(bc.name)
+				if err != nil {
+					logging.Warning("Failed to read balancerconfig %s after it changed, keeping the running config: %v", bc, err)
+					continue
+				}
+				accessor, err := meta.Accessor(object)
+				if err != nil || accessor.GetGeneration() == last {
+					continue
+				}
+				last = accessor.GetGeneration()
+				logging.Info("Balancerconfig %s changed, reloading the config", bc)
+				reload()
+			}
+		}
+	}()
+	return nil
+}
+
+// ReportStatus implements StatusReporter. The status holds the generation
+// of the spec it is about, to tell a stale status from a current one.
+func (bc *BalancerConfig) ReportStatus(err error) {
+	object, getErr := bc.get()
+	if getErr != nil {
+		logging.Warning("Failed to report the status of balancerconfig %s: %v", bc, getErr)
+		return
+	}
+	status := map[string]any{
+		"observedGeneration": bc.generation.Load(),
+		"state":              StateApplied,
+		"message":            "",
+		"lastUpdateTime":     time.Now().UTC().Format(time.RFC3339),
+	}
+	if err != nil {
+		status["state"] = StateInvalid
+		status["message"] = err.Error()
+	}
+	object.Object["status"] = status
+	ctx, cancel := context.WithTimeout(context.Background(), configMapTimeout)
+	defer cancel()
+	if _, err := bc.client.Resource(BalancerConfigResource).Namespace(bc.namespace).UpdateStatus(ctx, object, metav1.UpdateOptions{}); err != nil {
+		logging.Warning("Failed to report the status of balancerconfig %s: %v", bc, err)
+	}
+}
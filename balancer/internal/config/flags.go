@@ -0,0 +1,301 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"pkg/logging"
+)
+
+// DefaultPaths are tried in order for the config file when --config is not
+// given.
+var DefaultPaths = []string{
+	"/etc/balancer/config.json",
+	"/etc/balancer/config.yaml",
+	"/etc/balancer/config.toml",
+	"config.json",
+	"config.yaml",
+	"config.toml",
+}
+
+// namedFlags are the common settings, with a flag of their own. Everything
+// else can be given with --set. Those with an env variable can be set with it
+// too.
+var namedFlags = []struct {
+	name, key, usage, env string
+	number                bool
+}{
+	{"port", "loadbalancerport", "port the balancer listens on", "LOADBALANCER_PORT", true},
+	{"backend-name", "backendname", "service to balance", "BACKEND_NAME", false},
+	{"backend-port", "backendport", "port backends listen on", "BACKEND_PORT", true},
+	{"backup-backend-name", "backupbackendname", "service used while the backend has no backends", "", false},
+	{"strategy", "loadbalancermethod", "load balancing strategy", "LOADBALANCER_METHOD", false},
+	{"mode", "mode", "http, grpc, tcp or udp", "", false},
+	{"log-format", "logformat", "format of the log lines, text or json", "LOG_FORMAT", false},
+	{"log-level", "loglevel", "least severe level logged, debug, info, warn or error", "LOG_LEVEL", false},
+	{"admin-port", "adminport", "port of the admin API", "", true},
+	{"listen-address", "listenaddress", "IP or host name the listeners bind to, every interface by default", "", false},
+	{"kubeconfig", "kubeconfig", "kubeconfig to discover backends with, to run outside the cluster", "", false},
+}
+
+// envPrefix starts the env variables that set any config key, with
+// underscores between nested keys, e.g. BALANCER_CONFIG_RETRY_ATTEMPTS=3.
+// Values are read as YAML, like those of --set.
+const envPrefix = "BALANCER_CONFIG_"
+
+// Flags are the settings given on the command line. They win over the config
+// file and the environment.
+type Flags struct {
+	// Config is the path of the config file. Empty tries DefaultPaths.
+	Config string
+	// ConfigMap is the [namespace/]name of a ConfigMap to read the config
+	// from instead of a file, with ConfigMapKey the key holding it.
+	ConfigMap    string
+	ConfigMapKey string
+	// BalancerConfig is the [namespace/]name of a BalancerConfig resource
+	// to read the config from instead of a file.
+	BalancerConfig string
+	// ConfigURL is an https URL to read the config from instead of a file,
+	// polled every ConfigURLInterval, with the bearer token in
+	// ConfigURLTokenFile if it is set.
+	ConfigURL          string
+	ConfigURLTokenFile string
+	ConfigURLInterval  time.Duration
+	// Source reads the ConfigMap, BalancerConfig or ConfigURL for Load.
+	Source    Source
+	overrides []override
+}
+
+// override sets the config key, dotted for nested keys, to a JSON value.
+type override struct {
+	key   string
+	value json.RawMessage
+}
+
+// ParseFlags reads the command line arguments, without the program name.
+// It returns flag.ErrHelp when asked for the usage.
+func ParseFlags(args []string) (*Flags, error) {
+	f := &Flags{}
+	fs := flag.NewFlagSet("balancer", flag.ContinueOnError)
+	fs.StringVar(&f.Config, "config", "", "path of the config file, JSON, YAML (.yaml, .yml) or TOML (.toml)")
+	fs.StringVar(&f.ConfigMap, "configmap", "", "[namespace/]name of a ConfigMap to read and watch the config from, instead of a file. The namespace defaults to the balancer's own")
+	fs.StringVar(&f.ConfigMapKey, "configmap-key", "", "key of the ConfigMap holding the config. Defaults to config.json, config.yaml, config.yml or config.toml, or the only key")
+	fs.StringVar(&f.BalancerConfig, "balancerconfig", "", "[namespace/]name of a BalancerConfig resource to read and watch the config from, instead of a file. The namespace defaults to the balancer's own")
+	fs.StringVar(&f.ConfigURL, "config-url", "", "https URL to read and poll the config from, instead of a file. The format is taken from the path extension or the Content-Type")
+	fs.StringVar(&f.ConfigURLTokenFile, "config-url-token-file", "", "file holding a bearer token to send with --config-url requests")
+	fs.DurationVar(&f.ConfigURLInterval, "config-url-interval", DefaultRemoteInterval, "how often --config-url is polled for changes")
+	for _, named := range namedFlags {
+		fs.Func(named.name, named.usage, func(value string) error {
+			data, err := namedValue(value, named.number)
+			if err != nil {
+				return err
+			}
+			f.overrides = append(f.overrides, override{named.key, data})
+			return nil
+		})
+	}
+	fs.Func("set", "set any config key as key=value, with dots for nested keys, e.g. retry.attempts=3. Values are read as YAML. May be repeated", func(arg string) error {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("%s is not key=value", arg)
+		}
+		data, err := yaml.YAMLToJSON([]byte(value))
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+		f.overrides = append(f.overrides, override{key, data})
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	sources := 0
+	for _, source := range []string{f.Config, f.ConfigMap, f.BalancerConfig, f.ConfigURL} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		err := fmt.Errorf("only one of --config, --configmap, --balancerconfig and --config-url can be used")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if f.ConfigURL != "" {
+		remote, err := NewRemote(f.ConfigURL, f.ConfigURLTokenFile, f.ConfigURLInterval)
+		if err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+		f.Source = remote
+	}
+	if fs.NArg() > 0 {
+		// Report it the way the flag package reports a bad flag.
+		err := fmt.Errorf("unexpected argument %s", fs.Arg(0))
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Kubeconfig returns the path given with --kubeconfig or --set, or "".
+func (f *Flags) Kubeconfig() string {
+	var path string
+	for _, o := range f.overrides {
+		if o.key == "kubeconfig" {
+			// A value that is not a string fails validation later.
+			_ = json.Unmarshal(o.value, &path)
+		}
+	}
+	return path
+}
+
+// namedValue encodes the value of a named setting as JSON.
+func namedValue(value string, number bool) (json.RawMessage, error) {
+	if !number {
+		return json.Marshal(value)
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a number", value)
+	}
+	return json.RawMessage(strconv.Itoa(n)), nil
+}
+
+// Apply sets the flags on cfg, in the order they were given.
+func (f *Flags) Apply(cfg *Config) error {
+	return apply(cfg, f.overrides, "flag")
+}
+
+// apply sets overrides on cfg in order. Overrides of nested keys keep the
+// other fields of the table they are in. what names where they came from in
+// errors.
+func apply(cfg *Config, overrides []override, what string) error {
+	for _, o := range overrides {
+		keys := strings.Split(flatKey(o.key), ".")
+		doc := o.value
+		for i := len(keys) - 1; i >= 0; i-- {
+			doc, _ = json.Marshal(map[string]json.RawMessage{keys[i]: doc})
+		}
+		decoder := json.NewDecoder(bytes.NewReader(doc))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cfg); err != nil {
+			return fmt.Errorf("invalid %s for %s: %w", what, o.key, err)
+		}
+	}
+	return nil
+}
+
+// applyEnv sets the settings given in env variables on cfg: the named ones,
+// then those starting with envPrefix in name order. STATIC_BACKENDS, a comma
+// separated list of addresses, sets the static backends of the backend name
+// the file and env settle on.
+func applyEnv(cfg *Config) error {
+	var overrides []override
+	for _, named := range namedFlags {
+		value, ok := os.LookupEnv(named.env)
+		if named.env == "" || !ok {
+			continue
+		}
+		data, err := namedValue(value, named.number)
+		if err != nil {
+			return fmt.Errorf("invalid env variable %s: %w", named.env, err)
+		}
+		overrides = append(overrides, override{named.key, data})
+	}
+	var names []string
+	for _, variable := range os.Environ() {
+		if name, _, _ := strings.Cut(variable, "="); strings.HasPrefix(name, envPrefix) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		data, err := yaml.YAMLToJSON([]byte(os.Getenv(name)))
+		if err != nil {
+			return fmt.Errorf("invalid env variable %s: %w", name, err)
+		}
+		key := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(name, envPrefix), "_", "."))
+		overrides = append(overrides, override{key, data})
+	}
+	if err := apply(cfg, overrides, "env variable"); err != nil {
+		return err
+	}
+
+	if static, ok := os.LookupEnv("STATIC_BACKENDS"); ok {
+		addresses := strings.Split(static, ",")
+		for i := range addresses {
+			addresses[i] = strings.TrimSpace(addresses[i])
+		}
+		if cfg.StaticBackends == nil {
+			cfg.StaticBackends = make(map[string][]string)
+		}
+		cfg.StaticBackends[cfg.BackendName] = addresses
+	}
+	return nil
+}
+
+// Load reads the config from the ConfigMap given with --configmap, the
+// BalancerConfig given with --balancerconfig or the URL given with
+// --config-url, through Source, or the file
+// given with --config, or else the first of DefaultPaths that loads,
+// then lays the env variables over it and the flags over those, and
+// validates the result. Each layer only replaces the settings it names, so
+// without a file the env and flags make the whole config. The path of the
+// file read is returned with the config, or "" when there was none.
+func Load(f *Flags) (*Config, string, error) {
+	cfg := &Config{}
+	path := f.Config
+	if f.ConfigMap != "" || f.BalancerConfig != "" || f.ConfigURL != "" {
+		if f.Source == nil {
+			return nil, "", fmt.Errorf("the config needs a kubernetes client to be read from %s%s", f.ConfigMap, f.BalancerConfig)
+		}
+		var err error
+		cfg, err = f.Source.load()
+		if err != nil {
+			return nil, "", err
+		}
+	} else if path != "" {
+		var err error
+		cfg, err = readFile(path)
+		if err != nil {
+			return nil, "", err
+		}
+	} else {
+		for _, candidate := range DefaultPaths {
+			if file, err := readFile(candidate); err == nil {
+				cfg, path = file, candidate
+				break
+			}
+		}
+	}
+
+	if err := applyEnv(cfg); err != nil {
+		return nil, "", err
+	}
+	if err := f.Apply(cfg); err != nil {
+		return nil, "", err
+	}
+	err := cfg.validate()
+	if cfg.LoadbalancerPort == 0 {
+		err = errors.Join(fmt.Errorf("no loadbalancer port, set loadbalancerport in a config file, LOADBALANCER_PORT or --port"), err)
+	}
+	if cfg.BackendName == "" {
+		err = errors.Join(fmt.Errorf("no backend name, set backendname in a config file, BACKEND_NAME or --backend-name"), err)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	logging.Debug("Loaded config: %+v", cfg)
+	return cfg, path, nil
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// readIncludes reads the config file at path as JSON, with the files it
+// includes merged in, and returns it with the format of path and every file
+// read, path first. chain holds the files including path, to catch cycles.
+//
+// The included files are merged in the order they are listed, each after
+// the files it includes itself, and the including file last. Tables merge
+// key by key, lists are joined in that order, so routes and pools can be
+// split over files, and any other value is taken from the last file setting
+// it.
+func readIncludes(path string, chain []string) ([]byte, string, []string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("Failed to open the config file %s: %w", path, err)
+	}
+	for i, including := range chain {
+		if including == abs {
+			return nil, "", nil, fmt.Errorf("config files include each other: %s", strings.Join(append(chain[i:], abs), " -> "))
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("Failed to open the config file %s: %w", path, err)
+	}
+	data, format, err := toJSON(path, data)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("%s: %w", path, err)
+	}
+	files := []string{path}
+	var header struct {
+		Include []string `json:"include"`
+	}
+	// A file that does not parse is left for decode to report.
+	if json.Unmarshal(data, &header) != nil || len(header.Include) == 0 {
+		return data, format, files, nil
+	}
+
+	merged := map[string]any{}
+	chain = append(slices.Clip(chain), abs)
+	for _, include := range header.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		included, includedFormat, includedFiles, err := readIncludes(include, chain)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		files = append(files, includedFiles...)
+		doc, err := object(included)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("Error parsing %s %s: %w", includedFormat, include, err)
+		}
+		merge(merged, doc)
+	}
+	doc, err := object(data)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("Error parsing %s %s: %w", format, path, err)
+	}
+	merge(merged, doc)
+	// Only the top file's includes are kept, the others are merged in.
+	merged["include"] = header.Include
+	data, err = json.Marshal(merged)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return data, format, files, nil
+}
+
+// object decodes a JSON object, keeping numbers as they were written so
+// large ones survive being encoded again.
+func object(data []byte) (map[string]any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc map[string]any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// merge lays src over dst the way readIncludes describes.
+func merge(dst, src map[string]any) {
+	for key, value := range src {
+		switch value := value.(type) {
+		case map[string]any:
+			if table, ok := dst[key].(map[string]any); ok {
+				merge(table, value)
+				continue
+			}
+		case []any:
+			if list, ok := dst[key].([]any); ok {
+				dst[key] = append(list, value...)
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
+
+// configFiles returns the config file at path and every file it includes.
+func configFiles(path string) ([]string, error) {
+	_, _, files, err := readIncludes(path, nil)
+	return files, err
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+)
+
+// Redacted stands in for the secrets taken out by Redacted.
+const Redacted = "REDACTED"
+
+// secretHeaders carry credentials, so their values are redacted wherever
+// the config sets them.
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "X-Auth-Token"}
+
+// Redacted returns a copy of the config that is safe to show, with tokens,
+// passwords in URLs and the values of credential headers replaced by
+// Redacted. The config itself is left as it is.
+func (c *Config) Redacted() (*Config, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy the config: %w", err)
+	}
+	redacted := &Config{}
+	if err := json.Unmarshal(data, redacted); err != nil {
+		return nil, fmt.Errorf("failed to copy the config: %w", err)
+	}
+
+	if consul := redacted.Consul; consul != nil {
+		if consul.Token != "" {
+			consul.Token = Redacted
+		}
+		consul.Address = redactURL(consul.Address)
+	}
+	if docker := redacted.Docker; docker != nil {
+		docker.Host = redactURL(docker.Host)
+	}
+	if tracing := redacted.Tracing; tracing != nil {
+		tracing.Endpoint = redactURL(tracing.Endpoint)
+		for name := range tracing.Headers {
+			tracing.Headers[name] = Redacted
+		}
+	}
+	redactHeaderRules(redacted.Headers)
+	for _, route := range redacted.Routes {
+		redactHeaderRules(route.Headers)
+	}
+	checks := []*HealthCheck{redacted.HealthCheck}
+	for _, check := range redacted.HealthChecks {
+		checks = append(checks, check)
+	}
+	for _, pool := range redacted.Pools {
+		if pool != nil {
+			checks = append(checks, pool.HealthCheck)
+		}
+	}
+	for _, check := range checks {
+		if check != nil {
+			redactHeaders(check.Headers)
+			check.Webhook = redactQuery(redactURL(check.Webhook))
+		}
+	}
+	return redacted, nil
+}
+
+func redactHeaderRules(rules *HeaderRules) {
+	if rules == nil {
+		return
+	}
+	for _, ops := range []HeaderOps{rules.Request, rules.Response} {
+		redactHeaders(ops.Add)
+		redactHeaders(ops.Set)
+	}
+}
+
+func redactHeaders(headers map[string]string) {
+	for name := range headers {
+		if slices.Contains(secretHeaders, http.CanonicalHeaderKey(name)) {
+			headers[name] = Redacted
+		}
+	}
+}
+
+// redactQuery replaces the values of the query of a URL, where webhooks
+// often take their token.
+func redactQuery(address string) string {
+	u, err := url.Parse(address)
+	if err != nil || u.RawQuery == "" {
+		return address
+	}
+	query := u.Query()
+	for name := range query {
+		query[name] = []string{Redacted}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// redactURL replaces the password of a URL, if it has one.
+func redactURL(address string) string {
+	u, err := url.Parse(address)
+	if err != nil || u.User == nil {
+		return address
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), Redacted)
+	}
+	return u.String()
+}
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg/logging"
+)
+
+const (
+	// DefaultRemoteInterval is how often a Remote is polled for changes.
+	DefaultRemoteInterval = 30 * time.Second
+	// remoteTimeout bounds each request for a Remote config.
+	remoteTimeout = 10 * time.Second
+	// maxRemoteSize is the largest config a Remote is read up to.
+	maxRemoteSize = 10 << 20
+)
+
+// Remote is a config served over HTTPS, so a control plane can hand the same
+// config to a fleet of balancers from one place. It is polled for changes
+// with the ETag of the last response, so an unchanged config costs the
+// server a 304. The format is taken from the extension of the URL path, or
+// else from the Content-Type, and defaults to JSON.
+type Remote struct {
+	url *url.URL
+	// tokenFile holds a token sent as "Authorization: Bearer <token>". It is
+	// read on each request, so the token can rotate. Empty sends none.
+	tokenFile string
+	interval  time.Duration
+	client    *http.Client
+
+	mu   sync.Mutex
+	etag string
+	// name and data are the config of the last 200 response, name giving
+	// its format like a file name.
+	name string
+	data []byte
+}
+
+// NewRemote returns the config at rawURL, which must be https, polled every
+// interval. Zero interval uses DefaultRemoteInterval.
+func NewRemote(rawURL, tokenFile string, interval time.Duration) (*Remote, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config url: %w", err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("config url %s must be https://host/path", redactURL(rawURL))
+	}
+	if interval < 0 {
+		return nil, fmt.Errorf("config url interval must not be negative, got %s", interval)
+	}
+	if interval == 0 {
+		interval = DefaultRemoteInterval
+	}
+	return &Remote{
+		url:       u,
+		tokenFile: tokenFile,
+		interval:  interval,
+		client:    &http.Client{Timeout: remoteTimeout},
+	}, nil
+}
+
+// String returns the URL, without a password it may hold.
+func (r *Remote) String() string {
+	return redactURL(r.url.String())
+}
+
+// fetch requests the config, sending the ETag of the last response, and
+// returns whether it changed since. A 304 keeps the last config.
+func (r *Remote) fetch() (bool, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, r.url.String(), nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to request %s: %w", r, err)
+	}
+	if r.tokenFile != "" {
+		token, err := os.ReadFile(r.tokenFile)
+		if err != nil {
+			return false, fmt.Errorf("failed to read the token for %s: %w", r, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	r.mu.Lock()
+	if r.etag != "" && r.data != nil {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+	r.mu.Unlock()
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to request %s: %w", r, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to request %s: %s", r, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteSize+1))
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", r, err)
+	}
+	if len(data) > maxRemoteSize {
+		return false, fmt.Errorf("config at %s is larger than %d bytes", r, maxRemoteSize)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := !bytes.Equal(data, r.data)
+	r.etag, r.name, r.data = resp.Header.Get("ETag"), r.formatName(resp.Header.Get("Content-Type")), data
+	return changed, nil
+}
+
+// formatName returns a file name whose extension picks the format of the
+// config, from the URL path or else contentType.
+func (r *Remote) formatName(contentType string) string {
+	switch strings.ToLower(path.Ext(r.url.Path)) {
+	case ".json", ".yaml", ".yml", ".toml":
+		return path.Base(r.url.Path)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasSuffix(mediaType, "yaml"):
+		return "config.yaml"
+	case strings.HasSuffix(mediaType, "toml"):
+		return "config.toml"
+	}
+	return "config.json"
+}
+
+// load reads the config from the URL.
+func (r *Remote) load() (*Config, error) {
+	if _, err := r.fetch(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	name, data := r.name, r.data
+	r.mu.Unlock()
+	cfg, err := parse(name, data)
+	if err != nil {
+		return nil, fmt.Errorf("config at %s: %w", r, err)
+	}
+	if len(cfg.Include) > 0 {
+		return nil, fmt.Errorf("config at %s: only config files can include others", r)
+	}
+	return cfg, nil
+}
+
+// Watch implements Source by polling the URL every interval. The interval
+// already spaces out changes, so debounce is not used. A failed poll is
+// logged and the running config is kept.
+func (r *Remote) Watch(_ time.Duration, reload func(), stopCh <-chan struct{}) error {
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				changed, err := r.fetch()
+				if err != nil {
+					logging.Warning("Failed to poll %s, keeping the running config: %v", r, err)
+					continue
+				}
+				if changed {
+					logging.Info("Config at %s changed, reloading the config", r)
+					reload()
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// CurrentVersion is the newest config schema, set with "version".
+//
+// Version 1, the schema of configs without a version, has every listener,
+// admin and backend setting at the top. Version 2 groups them into tables:
+//
+//	version: 2
+//	listener:
+//	  port: 8080
+//	  tls:
+//	    secret: balancer-tls
+//	admin:
+//	  port: 9090
+//	backend:
+//	  name: web
+//	  port: 80
+//	strategy:
+//	  method: RingHash
+//
+// Version 1 configs are migrated when they are read, with a warning for each
+// field that moved. Files that include others share one version.
+const CurrentVersion = 2
+
+// moved maps the top-level fields of version 1 to where version 2 keeps
+// them, as dotted paths.
+var moved = []struct{ field, path string }{
+	{"loadbalancerport", "listener.port"},
+	{"listenaddress", "listener.address"},
+	{"http3port", "listener.http3port"},
+	{"tlscertfile", "listener.tls.certfile"},
+	{"tlskeyfile", "listener.tls.keyfile"},
+	{"tlssecret", "listener.tls.secret"},
+	{"adminport", "admin.port"},
+	{"adminaddress", "admin.address"},
+	{"backendname", "backend.name"},
+	{"backupbackendname", "backend.backup"},
+	{"backendport", "backend.port"},
+	{"backendportname", "backend.portname"},
+	{"loadbalancermethod", "strategy.method"},
+	{"strategyoptions", "strategy.options"},
+}
+
+// versionTables are the tables version 2 adds.
+var versionTables = []string{"listener", "admin", "backend", "strategy"}
+
+// migrate rewrites the config document doc, of any version, into the fields
+// of Config, and returns a warning for each deprecated field it uses.
+func migrate(doc map[string]any) ([]string, error) {
+	version, err := schemaVersion(doc["version"])
+	if err != nil {
+		return nil, err
+	}
+	if version == 1 {
+		var errs []error
+		for _, table := range versionTables {
+			if _, ok := doc[table]; ok {
+				errs = append(errs, fmt.Errorf("%s is a table of version %d, set version: %d", table, CurrentVersion, CurrentVersion))
+			}
+		}
+		if len(errs) > 0 {
+			return nil, errors.Join(errs...)
+		}
+		var warnings []string
+		for _, m := range moved {
+			if _, ok := doc[m.field]; ok {
+				warnings = append(warnings, fmt.Sprintf("Config field %s is deprecated, set %s with version %d", m.field, m.path, CurrentVersion))
+			}
+		}
+		return warnings, nil
+	}
+
+	var errs []error
+	for _, m := range moved {
+		if _, ok := doc[m.field]; ok {
+			errs = append(errs, fmt.Errorf("%s is not a field of version %d, set %s", m.field, version, m.path))
+		}
+		if value, ok := take(doc, strings.Split(m.path, ".")); ok {
+			doc[m.field] = value
+		}
+	}
+	// Anything left in the tables is not a field.
+	for _, table := range versionTables {
+		value, ok := doc[table]
+		if !ok {
+			continue
+		}
+		if _, ok := value.(map[string]any); !ok {
+			errs = append(errs, fmt.Errorf("%s must be a table", table))
+		}
+		for _, path := range leftover(table, value) {
+			errs = append(errs, fmt.Errorf("unknown field %s", path))
+		}
+		delete(doc, table)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// schemaVersion reads the version field. Unset is version 1.
+func schemaVersion(value any) (int, error) {
+	if value == nil {
+		return 1, nil
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("version must be a number, got %v", value)
+	}
+	version, err := number.Int64()
+	if err != nil || version < 1 || version > CurrentVersion {
+		return 0, fmt.Errorf("unsupported config version %s, use 1 to %d", number, CurrentVersion)
+	}
+	return int(version), nil
+}
+
+// take removes the value at path from doc and returns it.
+func take(doc map[string]any, path []string) (any, bool) {
+	for _, key := range path[:len(path)-1] {
+		table, ok := doc[key].(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		doc = table
+	}
+	value, ok := doc[path[len(path)-1]]
+	delete(doc, path[len(path)-1])
+	return value, ok
+}
+
+// leftover returns the dotted paths of the values left under path once
+// take has moved the known ones out.
+func leftover(path string, value any) []string {
+	table, ok := value.(map[string]any)
+	if !ok {
+		return []string{path}
+	}
+	var paths []string
+	for _, key := range slices.Sorted(maps.Keys(table)) {
+		paths = append(paths, leftover(path+"."+key, table[key])...)
+	}
+	return paths
+}
+
+// flatKey returns the Config field a dotted key of version 2 sets, so
+// overrides can use either version. Other keys are returned as they are.
+func flatKey(key string) string {
+	for _, m := range moved {
+		if key == m.path {
+			return m.field
+		}
+		if rest, ok := strings.CutPrefix(key, m.path+"."); ok {
+			return m.field + "." + rest
+		}
+	}
+	return key
+}
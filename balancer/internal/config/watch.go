@@ -0,0 +1,119 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"pkg/logging"
+)
+
+const defaultReloadDebounce = time.Second
+
+// Watch calls reload whenever the config file at path, or a file it
+// includes, changes, once it has been left alone for debounce, until stopCh
+// is closed. Zero debounce uses the default. Saves that leave the content as
+// it was are ignored, so the running config is not rebuilt for nothing.
+func Watch(path string, debounce time.Duration, reload func(), stopCh <-chan struct{}) error {
+	if debounce == 0 {
+		debounce = defaultReloadDebounce
+	}
+	path = filepath.Clean(path)
+	files, err := configFiles(path)
+	if err != nil {
+		return err
+	}
+	last, err := readAll(files)
+	if err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %w", path, err)
+	}
+	// Editors and ConfigMap mounts replace the file, or the symlink it is
+	// reached through, rather than writing to it, which only the directory
+	// sees.
+	watched := map[string]bool{}
+	watch := func(files []string) error {
+		for _, file := range files {
+			dir := filepath.Dir(file)
+			if watched[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				return fmt.Errorf("failed to watch %s: %w", file, err)
+			}
+			watched[dir] = true
+		}
+		return nil
+	}
+	if err := watch(files); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		timer := time.NewTimer(debounce)
+		timer.Stop()
+		defer timer.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !event.Has(fsnotify.Chmod) {
+					timer.Reset(debounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logging.Warning("Error watching %s: %v", path, err)
+			case <-timer.C:
+				// The includes may have changed too.
+				if current, err := configFiles(path); err == nil {
+					files = current
+				}
+				if err := watch(files); err != nil {
+					logging.Warning("Changes to some files included by %s are not reloaded: %v", path, err)
+				}
+				data, err := readAll(files)
+				if err != nil {
+					logging.Warning("Failed to read %s after it changed: %v", path, err)
+					continue
+				}
+				if bytes.Equal(data, last) {
+					continue
+				}
+				last = data
+				logging.Info("Config file %s changed, reloading it", path)
+				reload()
+			}
+		}
+	}()
+	return nil
+}
+
+// readAll returns the content of files, each after its path, to compare
+// with a later read.
+func readAll(files []string) ([]byte, error) {
+	var all bytes.Buffer
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		fmt.Fprintf(&all, "%s\n%d\n", file, len(data))
+		all.Write(data)
+	}
+	return all.Bytes(), nil
+}
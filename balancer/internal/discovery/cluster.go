@@ -0,0 +1,157 @@
+package discovery
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+
+	"pkg/logging"
+)
+
+// AllNamespaces in the namespace list watches every namespace.
+const AllNamespaces = "*"
+
+// Cluster holds the informer factories discovery watches Kubernetes
+// through: one per namespace, or a single one for every namespace.
+type Cluster struct {
+	client kubernetes.Interface
+	resync time.Duration
+	// factories is keyed by namespace, with metav1.NamespaceAll for all.
+	factories map[string]informers.SharedInformerFactory
+	// early factories hold what slices are judged by, namespaces, pods and
+	// nodes, and sync before any slice informer starts.
+	early []informers.SharedInformerFactory
+	// namespaces and selector narrow a watch of every namespace down to
+	// the namespaces whose labels match.
+	namespaces listersv1.NamespaceLister
+	selector   labels.Selector
+}
+
+// serviceAccountNamespace holds the namespace of the pod's service account
+// when running in a cluster.
+var serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// GetCluster connects to Kubernetes and prepares to watch namespaces. With
+// no namespaces it watches the one named by the NAMESPACE environment
+// variable, or else the pod's own as read from its service account.
+// namespaceSelector, a label selector, is only allowed when watching
+// AllNamespaces. Informers resync every resync, and never when it is 0.
+func GetCluster(kubeconfPath string, namespaces []string, namespaceSelector string, resync time.Duration) (*Cluster, error) {
+	client, err := NewClient(kubeconfPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load kubeconf: %w", err)
+	}
+
+	if len(namespaces) == 0 {
+		namespace, err := DetectNamespace()
+		if err != nil {
+			return nil, err
+		}
+		namespaces = []string{namespace}
+	}
+	return newCluster(client, namespaces, namespaceSelector, resync)
+}
+
+// DetectNamespace returns the namespace to watch when none is configured.
+func DetectNamespace() (string, error) {
+	if namespace := os.Getenv("NAMESPACE"); namespace != "" {
+		return namespace, nil
+	}
+	data, err := os.ReadFile(serviceAccountNamespace)
+	if err != nil {
+		return "", fmt.Errorf("no namespace configured, NAMESPACE is unset and the service account namespace is unreadable: %w", err)
+	}
+	namespace := strings.TrimSpace(string(data))
+	if namespace == "" {
+		return "", fmt.Errorf("no namespace configured, NAMESPACE is unset and %s is empty", serviceAccountNamespace)
+	}
+	logging.Debug("Watching namespace %s from the service account", namespace)
+	return namespace, nil
+}
+
+func newCluster(client kubernetes.Interface, namespaces []string, namespaceSelector string, resync time.Duration) (*Cluster, error) {
+	cluster := &Cluster{client: client, resync: resync, factories: make(map[string]informers.SharedInformerFactory, len(namespaces))}
+	for _, namespace := range namespaces {
+		if namespace == AllNamespaces {
+			namespace = metav1.NamespaceAll
+		}
+		cluster.factories[namespace] = cluster.newFactory(namespace)
+	}
+	if namespaceSelector != "" {
+		if _, ok := cluster.factories[metav1.NamespaceAll]; !ok || len(cluster.factories) != 1 {
+			return nil, fmt.Errorf("a namespace selector needs every namespace to be watched")
+		}
+		selector, err := labels.Parse(namespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespace selector %q: %w", namespaceSelector, err)
+		}
+		namespaceInformer := cluster.earlyFactory(metav1.NamespaceAll).Core().V1().Namespaces()
+		countWatchErrors(namespaceInformer.Informer())
+		cluster.namespaces = namespaceInformer.Lister()
+		cluster.selector = selector
+	}
+	logging.Debug("Informers created for namespaces %v, will watch for service pods to populate", namespaces)
+	return cluster, nil
+}
+
+func (c *Cluster) newFactory(namespace string) informers.SharedInformerFactory {
+	return informers.NewSharedInformerFactoryWithOptions(c.client, c.resync, informers.WithNamespace(namespace))
+}
+
+// earlyFactory returns a new factory for namespace that Start syncs before
+// the slice informers.
+func (c *Cluster) earlyFactory(namespace string) informers.SharedInformerFactory {
+	factory := c.newFactory(namespace)
+	c.early = append(c.early, factory)
+	return factory
+}
+
+// Start starts every informer registered so far.
+func (c *Cluster) Start(stopCh <-chan struct{}) {
+	for _, factory := range c.early {
+		factory.Start(stopCh)
+	}
+	for _, factory := range c.early {
+		factory.WaitForCacheSync(stopCh)
+	}
+	for _, factory := range c.factories {
+		factory.Start(stopCh)
+	}
+}
+
+// WaitForCacheSync blocks until every started informer has synced, and
+// reports false if stopCh closed first.
+func (c *Cluster) WaitForCacheSync(stopCh <-chan struct{}) bool {
+	for _, factory := range c.factories {
+		for informer, synced := range factory.WaitForCacheSync(stopCh) {
+			if !synced {
+				logging.Warning("Informer for %v did not sync", informer)
+				return false
+			}
+		}
+	}
+	synced("kubernetes")
+	return true
+}
+
+// watches reports whether objects in namespace are in scope. Namespaces
+// that start or stop matching the selector are picked up on the next
+// resync.
+func (c *Cluster) watches(namespace string) bool {
+	if c.selector == nil {
+		return true
+	}
+	ns, err := c.namespaces.Get(namespace)
+	if err != nil {
+		logging.Debug("Unable to look up namespace %s: %v", namespace, err)
+		return false
+	}
+	return c.selector.Matches(labels.Set(ns.Labels))
+}
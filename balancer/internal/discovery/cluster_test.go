@@ -0,0 +1,211 @@
+package discovery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func namespacedSlice(namespace, name, service, address string) *discoveryv1.EndpointSlice {
+	slice := endpointSlice(name, service, endpoint(address, name, true))
+	slice.Namespace = namespace
+	return slice
+}
+
+func startCluster(t *testing.T, cluster *Cluster) {
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	cluster.Start(stopCh)
+	cluster.WaitForCacheSync(stopCh)
+}
+
+func TestGetBackends_Namespaces(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		namespacedSlice("a", "api-1", "api", "10.0.0.1"),
+		namespacedSlice("b", "api-1", "api", "10.0.1.1"),
+		namespacedSlice("c", "api-1", "api", "10.0.2.1"),
+	)
+	cluster, err := newCluster(client, []string{"a", "b"}, "", 0)
+	assert.NoError(t, err)
+	merged := GetBackends(cluster, "api", Options{})
+	pinned := GetBackends(cluster, "b/api", Options{})
+	startCluster(t, cluster)
+
+	assert.Eventually(t, func() bool { return len(merged.GetAll()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.1.1"}, addresses(merged))
+	assert.Equal(t, []string{"10.0.1.1"}, addresses(pinned))
+}
+
+func TestGetBackends_NamespaceSelector(t *testing.T) {
+	objects := []runtime.Object{
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "a", Labels: map[string]string{"team": "payments"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "b"}},
+		namespacedSlice("a", "api-1", "api", "10.0.0.1"),
+		namespacedSlice("b", "api-1", "api", "10.0.1.1"),
+	}
+	client := fake.NewSimpleClientset(objects...)
+	cluster, err := newCluster(client, []string{AllNamespaces}, "team=payments", 0)
+	assert.NoError(t, err)
+	backends := GetBackends(cluster, "api", Options{})
+	startCluster(t, cluster)
+
+	assert.Eventually(t, func() bool { return len(backends.GetAll()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"10.0.0.1"}, addresses(backends))
+
+	_, err = newCluster(client, []string{"a"}, "team=payments", 0)
+	assert.Error(t, err)
+}
+
+func TestPools(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		namespacedSlice("a", "api-1", "api", "10.0.0.1"),
+		namespacedSlice("a", "web-1", "web", "10.0.1.1"),
+		namespacedSlice("b", "api-1", "api", "10.0.2.1"),
+		namespacedSlice("a", "db-1", "db", "10.0.3.1"),
+	)
+	cluster, err := newCluster(client, []string{AllNamespaces}, "", 0)
+	assert.NoError(t, err)
+	pools := NewPools(cluster, Options{})
+	api := pools.Get("api")
+	web := pools.Get("web")
+	pinned := pools.Get("b/api")
+	assert.Same(t, api, pools.Get("api"))
+	startCluster(t, cluster)
+
+	assert.Eventually(t, func() bool {
+		return len(api.GetAll()) == 2 && len(web.GetAll()) == 1 && len(pinned.GetAll()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.2.1"}, addresses(api))
+	assert.Equal(t, []string{"10.0.1.1"}, addresses(web))
+	assert.Equal(t, []string{"10.0.2.1"}, addresses(pinned))
+
+	// A pool asked for once the informers run starts from their caches.
+	db := pools.Get("db")
+	assert.Eventually(t, func() bool { return len(db.GetAll()) == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestDetectNamespace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "namespace")
+	saved := serviceAccountNamespace
+	serviceAccountNamespace = path
+	t.Cleanup(func() { serviceAccountNamespace = saved })
+
+	t.Setenv("NAMESPACE", "")
+	_, err := DetectNamespace()
+	assert.Error(t, err)
+
+	assert.NoError(t, os.WriteFile(path, []byte("payments\n"), 0o644))
+	namespace, err := DetectNamespace()
+	assert.NoError(t, err)
+	assert.Equal(t, "payments", namespace)
+
+	t.Setenv("NAMESPACE", "override")
+	namespace, err = DetectNamespace()
+	assert.NoError(t, err)
+	assert.Equal(t, "override", namespace)
+}
+
+func TestPools_PodMetadata(t *testing.T) {
+	zone := "eu-west-1a"
+	slice := namespacedSlice("a", "api-1", "api", "10.0.0.1")
+	slice.Endpoints[0].Zone = &zone
+	client := fake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "a",
+			Name:        "api-1",
+			Labels:      map[string]string{"version": "v2"},
+			Annotations: map[string]string{"balancer/weight": "3"},
+		}},
+		slice,
+	)
+	cluster, err := newCluster(client, []string{"a"}, "", 0)
+	assert.NoError(t, err)
+	pods := NewPodResolver(cluster, "balancer/weight", true)
+	api := NewPools(cluster, Options{Pods: pods}).Get("api")
+	startCluster(t, cluster)
+
+	assert.Eventually(t, func() bool { return len(api.GetAll()) == 1 }, time.Second, 10*time.Millisecond)
+	backend := api.GetAll()[0]
+	assert.Equal(t, "a", backend.Namespace)
+	assert.Equal(t, zone, backend.Zone)
+	assert.Equal(t, 3, backend.Weight)
+	assert.Equal(t, map[string]string{"version": "v2"}, backend.Labels)
+	assert.Equal(t, "3", backend.Annotations["balancer/weight"])
+}
+
+func TestPools_PodChanges(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "a",
+		Name:        "api-1",
+		Annotations: map[string]string{"balancer/weight": "3"},
+	}}
+	client := fake.NewSimpleClientset(pod, namespacedSlice("a", "api-1", "api", "10.0.0.1"))
+	cluster, err := newCluster(client, []string{"a"}, "", 0)
+	assert.NoError(t, err)
+	api := NewPools(cluster, Options{Pods: NewPodResolver(cluster, "balancer/weight", false)}).Get("api")
+	startCluster(t, cluster)
+	assert.Eventually(t, func() bool { return len(api.GetAll()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, api.GetAll()[0].Labels)
+
+	// The slice is left as it is, only the pod changes.
+	pods := client.CoreV1().Pods("a")
+	pod = pod.DeepCopy()
+	pod.Annotations["balancer/weight"] = "5"
+	_, err = pods.Update(context.Background(), pod, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		backends := api.GetAll()
+		return len(backends) == 1 && backends[0].Weight == 5
+	}, time.Second, 10*time.Millisecond)
+
+	deleted := metav1.Now()
+	pod = pod.DeepCopy()
+	pod.DeletionTimestamp = &deleted
+	_, err = pods.Update(context.Background(), pod, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(api.GetAll()) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestPools_NodeZone(t *testing.T) {
+	node := "node-1"
+	slice := namespacedSlice("a", "api-1", "api", "10.0.0.1")
+	slice.Endpoints[0].NodeName = &node
+	client := fake.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: node, Labels: map[string]string{ZoneLabel: "eu-west-1c"}}},
+		slice,
+	)
+	cluster, err := newCluster(client, []string{"a"}, "", 0)
+	assert.NoError(t, err)
+	api := NewPools(cluster, Options{Zones: NewZoneResolver(cluster)}).Get("api")
+	startCluster(t, cluster)
+
+	assert.Eventually(t, func() bool { return len(api.GetAll()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "eu-west-1c", api.GetAll()[0].Zone)
+}
+
+func TestPools_ExternalName(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "legacy"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeExternalName, ExternalName: "legacy.example.com"},
+	})
+	cluster, err := newCluster(client, []string{"a"}, "", 0)
+	assert.NoError(t, err)
+	legacy := NewPools(cluster, Options{ExternalNames: true}).Get("legacy")
+	startCluster(t, cluster)
+
+	assert.Eventually(t, func() bool { return len(legacy.GetAll()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"legacy.example.com"}, addresses(legacy))
+
+	err = client.CoreV1().Services("a").Delete(context.Background(), "legacy", metav1.DeleteOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(legacy.GetAll()) == 0 }, time.Second, 10*time.Millisecond)
+}
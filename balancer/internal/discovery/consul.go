@@ -0,0 +1,196 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"pkg/logging"
+)
+
+const (
+	// consulWait is how long a blocking query waits for the service to
+	// change before Consul answers anyway.
+	consulWait          = 5 * time.Minute
+	consulRetryInterval = 5 * time.Second
+)
+
+// ConsulOptions say which Consul service to watch and where.
+type ConsulOptions struct {
+	// Address is the base URL of the Consul HTTP API, e.g.
+	// "http://127.0.0.1:8500".
+	Address    string
+	Token      string
+	Datacenter string
+	Service    string
+	// Tag only keeps instances that have it.
+	Tag string
+	// AllowWarning keeps instances with warning checks. Instances with a
+	// critical check are always dropped.
+	AllowWarning bool
+	// Client defaults to a client whose timeout outlasts a blocking query.
+	Client *http.Client
+}
+
+// consulEntry is the part of a /v1/health/service entry discovery reads.
+type consulEntry struct {
+	Node struct {
+		Node    string
+		Address string
+	}
+	Service struct {
+		ID      string
+		Address string
+		Port    int
+		Weights struct {
+			Passing int
+			Warning int
+		}
+	}
+	Checks []struct {
+		Status string
+	}
+}
+
+// consulWatch keeps a BackendList in step with a Consul service using
+// blocking queries.
+type consulWatch struct {
+	opts  ConsulOptions
+	list  *BackendList
+	index uint64
+}
+
+// ConsulBackends reads the healthy instances of opts.Service and returns a
+// list of them, which follows the service until stopCh is closed. While
+// Consul cannot be reached the list keeps the last instances it had.
+func ConsulBackends(opts ConsulOptions, stopCh <-chan struct{}) *BackendList {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: consulWait + time.Minute}
+	}
+	watch := &consulWatch{opts: opts, list: NewBackendList()}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	if err := watch.refresh(ctx, 0); err != nil {
+		logging.Error("Failed to read service %s from consul: %v", opts.Service, err)
+		watchError("consul")
+	}
+	go watch.run(ctx)
+	return watch.list
+}
+
+func (cw *consulWatch) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := cw.refresh(ctx, consulWait)
+		if err == nil && cw.index != 0 {
+			continue
+		}
+		// Without an index the query cannot block, so pace it like a retry.
+		if err != nil && ctx.Err() == nil {
+			logging.Warning("Failed to read service %s from consul, retrying in %s: %v", cw.opts.Service, consulRetryInterval, err)
+			watchError("consul")
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(consulRetryInterval):
+		}
+	}
+}
+
+// refresh asks Consul for the service, waiting up to wait for it to change
+// since the last answer, and replaces the list when it did.
+func (cw *consulWatch) refresh(ctx context.Context, wait time.Duration) error {
+	query := url.Values{}
+	if cw.opts.Datacenter != "" {
+		query.Set("dc", cw.opts.Datacenter)
+	}
+	if cw.opts.Tag != "" {
+		query.Set("tag", cw.opts.Tag)
+	}
+	if wait > 0 && cw.index > 0 {
+		query.Set("index", strconv.FormatUint(cw.index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(wait.Seconds())))
+	}
+	endpoint := fmt.Sprintf("%s/v1/health/service/%s?%s", strings.TrimSuffix(cw.opts.Address, "/"), url.PathEscape(cw.opts.Service), query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if cw.opts.Token != "" {
+		req.Header.Set("X-Consul-Token", cw.opts.Token)
+	}
+	resp, err := cw.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul answered %s", resp.Status)
+	}
+
+	index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil || index < cw.index {
+		// Consul asks clients to start over when the index goes backwards.
+		index = 0
+	}
+	if index != 0 && index == cw.index {
+		synced("consul")
+		return nil
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return fmt.Errorf("failed to decode the consul answer: %w", err)
+	}
+	cw.index = index
+	event("consul", "update")
+	backends := consulBackends(entries, cw.opts.AllowWarning)
+	cw.list.Replace(backends)
+	logging.Debug("Consul service %s has %d healthy instances", cw.opts.Service, len(backends))
+	return nil
+}
+
+// consulBackends returns the instances in entries whose checks allow
+// traffic, weighted by the weight Consul gives their health.
+func consulBackends(entries []consulEntry, allowWarning bool) []Backend {
+	var backends []Backend
+	for _, entry := range entries {
+		status := "passing"
+		for _, check := range entry.Checks {
+			if check.Status == "critical" {
+				status = "critical"
+				break
+			}
+			if check.Status == "warning" {
+				status = "warning"
+			}
+		}
+		weight := entry.Service.Weights.Passing
+		switch {
+		case status == "critical":
+			continue
+		case status == "warning" && !allowWarning:
+			continue
+		case status == "warning":
+			weight = entry.Service.Weights.Warning
+		}
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		backends = append(backends, Backend{
+			Address:  net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)),
+			PodName:  entry.Service.ID,
+			NodeName: entry.Node.Node,
+			Weight:   weight,
+		})
+	}
+	return backends
+}
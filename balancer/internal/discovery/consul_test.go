@@ -0,0 +1,73 @@
+package discovery
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const consulHealth = `[
+	{"Node": {"Node": "node-1", "Address": "10.0.0.1"},
+	 "Service": {"ID": "web-1", "Address": "", "Port": 8080, "Weights": {"Passing": 3, "Warning": 1}},
+	 "Checks": [{"Status": "passing"}]},
+	{"Node": {"Node": "node-2", "Address": "10.0.0.2"},
+	 "Service": {"ID": "web-2", "Address": "10.1.0.2", "Port": 8081, "Weights": {"Passing": 3, "Warning": 1}},
+	 "Checks": [{"Status": "passing"}, {"Status": "warning"}]},
+	{"Node": {"Node": "node-3", "Address": "10.0.0.3"},
+	 "Service": {"ID": "web-3", "Address": "", "Port": 8080, "Weights": {"Passing": 3, "Warning": 1}},
+	 "Checks": [{"Status": "warning"}, {"Status": "critical"}]}
+]`
+
+func TestConsulWatch_Refresh(t *testing.T) {
+	requests := 0
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/v1/health/service/web", r.URL.Path)
+		assert.Equal(t, "dc1", r.URL.Query().Get("dc"))
+		assert.Equal(t, "secret", r.Header.Get("X-Consul-Token"))
+		if requests == 2 {
+			assert.Equal(t, "7", r.URL.Query().Get("index"))
+		}
+		w.Header().Set("X-Consul-Index", "7")
+		io.WriteString(w, consulHealth)
+	}))
+	t.Cleanup(consul.Close)
+
+	watch := &consulWatch{
+		opts: ConsulOptions{Address: consul.URL + "/", Token: "secret", Datacenter: "dc1", Service: "web", Client: consul.Client()},
+		list: NewBackendList(),
+	}
+	assert.NoError(t, watch.refresh(context.Background(), 0))
+	backends := watch.list.GetAll()
+	assert.Equal(t, []string{"10.0.0.1:8080"}, addresses(watch.list))
+	assert.Equal(t, "web-1", backends[0].PodName)
+	assert.Equal(t, 3, backends[0].Weight)
+
+	watch.opts.AllowWarning = true
+	// The index has not moved, so the list is left alone.
+	assert.NoError(t, watch.refresh(context.Background(), time.Minute))
+	assert.Equal(t, []string{"10.0.0.1:8080"}, addresses(watch.list))
+
+	watch.index = 0
+	assert.NoError(t, watch.refresh(context.Background(), 0))
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.1.0.2:8081"}, addresses(watch.list))
+	assert.Equal(t, 1, watch.list.GetAll()[1].Weight)
+}
+
+func TestConsulWatch_ErrorKeepsBackends(t *testing.T) {
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no leader", http.StatusInternalServerError)
+	}))
+	t.Cleanup(consul.Close)
+
+	watch := &consulWatch{opts: ConsulOptions{Address: consul.URL, Service: "web", Client: consul.Client()}, list: NewBackendList()}
+	watch.list.Replace([]Backend{{Address: "10.0.0.1:8080"}})
+
+	assert.Error(t, watch.refresh(context.Background(), 0))
+	assert.Len(t, watch.list.GetAll(), 1)
+}
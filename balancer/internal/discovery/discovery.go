@@ -2,12 +2,16 @@ package discovery
 
 import (
 	"fmt"
-	"os"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
-	corev1 "k8s.io/api/core/v1"
-	"k8s.io/client-go/informers"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
@@ -16,21 +20,12 @@ import (
 	"pkg/logging"
 )
 
-func createClient(kubeconfigPath string) (kubernetes.Interface, error) {
-	var kubeconf *rest.Config
-
-	if kubeconfigPath != "" {
-		conf, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
-		if err != nil {
-			return nil, fmt.Errorf("unable to load kubeconf from %s: %v", kubeconfigPath, err)
-		}
-		kubeconf = conf
-	} else {
-		conf, err := rest.InClusterConfig()
-		if err != nil {
-			return nil, fmt.Errorf("unable to load in-cluster config: %v", err)
-		}
-		kubeconf = conf
+// NewClient connects to Kubernetes with the kubeconfig at kubeconfigPath,
+// or with the in-cluster config when it is empty.
+func NewClient(kubeconfigPath string) (kubernetes.Interface, error) {
+	kubeconf, err := restConfig(kubeconfigPath)
+	if err != nil {
+		return nil, err
 	}
 
 	client, err := kubernetes.NewForConfig(kubeconf)
@@ -42,100 +37,312 @@ func createClient(kubeconfigPath string) (kubernetes.Interface, error) {
 	return client, nil
 }
 
+// NewDynamicClient is NewClient for custom resources, which have no typed
+// client.
+func NewDynamicClient(kubeconfigPath string) (dynamic.Interface, error) {
+	kubeconf, err := restConfig(kubeconfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := dynamic.NewForConfig(kubeconf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create a dynamic client: %v", err)
+	}
+	return client, nil
+}
+
+// restConfig loads the kubeconfig at kubeconfigPath, or the in-cluster
+// config when it is empty.
+func restConfig(kubeconfigPath string) (*rest.Config, error) {
+	if kubeconfigPath != "" {
+		conf, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load kubeconf from %s: %v", kubeconfigPath, err)
+		}
+		return conf, nil
+	}
+	conf, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load in-cluster config: %v", err)
+	}
+	return conf, nil
+}
+
 type Backend struct {
+	// Address identifies the backend. Discovered backends have a bare IP,
+	// or host name when outside the cluster, that is dialed on the
+	// configured backend port, static backends may carry their own port.
 	Address string
+	// Port, when set, is dialed instead of the configured backend port.
+	// Discovery takes it from the slice port named by Options.PortName.
+	Port    int
 	PodName string
+	// Namespace, NodeName and Zone place a discovered backend. Zone is the
+	// topology.kubernetes.io/zone of the endpoint, see endpointZone.
+	Namespace string
+	NodeName  string
+	Zone      string
+	// Labels and Annotations are those of the backend's pod, filled in when
+	// pods are watched. They are shared with the pod cache, so read only.
+	Labels      map[string]string
+	Annotations map[string]string
+	// Ordinal is the StatefulSet ordinal of the backend's pod, the 2 of
+	// "db-2", when HasOrdinal is set.
+	Ordinal    int
+	HasOrdinal bool
+	// Weight comes from the pod's weight annotation. 0 means unset.
+	Weight int
+	// Priority orders pools for failover. 0 is the primary pool and higher
+	// values are only used while every lower priority is empty.
+	Priority int
 }
 
 type BackendList struct {
-	mu       sync.RWMutex
-	backends []Backend
+	mu        sync.RWMutex
+	backends  []Backend
+	listeners []func(added, removed []Backend)
+	replaced  []func()
 }
 
 func NewBackendList() *BackendList {
 	return &BackendList{}
 }
 
+// Replace swaps in a new set of backends and tells the OnChange listeners
+// which addresses came and went. Backends are kept sorted by address with
+// each address once, so an update that only adds or removes some leaves
+// the order of the rest, and with it round robin positions, alone. An
+// update that changes nothing is dropped.
 func (bl *BackendList) Replace(backends []Backend) {
+	backends = sortedUnique(backends)
 	bl.mu.Lock()
-	defer bl.mu.Unlock()
+	old := bl.backends
+	if reflect.DeepEqual(old, backends) {
+		bl.mu.Unlock()
+		return
+	}
 	bl.backends = backends
+	listeners := bl.listeners
+	replaced := bl.replaced
+	bl.mu.Unlock()
+
+	for _, fn := range replaced {
+		fn()
+	}
+	if len(listeners) == 0 {
+		return
+	}
+	added, removed := diff(old, backends)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	for _, listener := range listeners {
+		listener(added, removed)
+	}
 }
 
-func (bl *BackendList) GetAll() []Backend {
-	bl.mu.RLock()
-	defer bl.mu.RUnlock()
-	result := make([]Backend, len(bl.backends))
-	copy(result, bl.backends)
-	return result
+// OnChange registers fn to be called after every Replace that adds or
+// removes a backend address.
+func (bl *BackendList) OnChange(fn func(added, removed []Backend)) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.listeners = append(bl.listeners, fn)
 }
 
-func reconcile(endpoints *corev1.Endpoints, backendList *BackendList, serviceName string) {
-	name := endpoints.Name
-	if name != serviceName {
-		return
+// OnReplace registers fn to be called after every Replace that changes
+// anything, including backends that only changed fields. Lists built from
+// this one use it to follow it.
+func (bl *BackendList) OnReplace(fn func()) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.replaced = append(bl.replaced, fn)
+}
+
+// sortedUnique returns a copy of backends sorted by address, keeping the
+// first backend of each address.
+func sortedUnique(backends []Backend) []Backend {
+	if len(backends) == 0 {
+		return nil
 	}
-	logging.Debug("Detected an update for service %s, updating now", serviceName)
-	var backends []Backend
-	for _, subnet := range endpoints.Subsets {
-		for _, address := range subnet.Addresses {
-			ip := address.IP
-			podName := address.TargetRef.Name
-			logging.Debug("Adding pod %s", podName)
-			backends = append(backends, Backend{
-				Address: ip,
-				PodName: podName,
-			})
+	sorted := make([]Backend, len(backends))
+	copy(sorted, backends)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Address < sorted[j].Address })
+	unique := sorted[:1]
+	for _, backend := range sorted[1:] {
+		if backend.Address != unique[len(unique)-1].Address {
+			unique = append(unique, backend)
 		}
 	}
-	backendList.Replace(backends)
-	logging.Debug("Service pods updated")
+	return unique
 }
 
-func GetBackendFactory(kubeconfPath string) (informers.SharedInformerFactory, error) {
-	client, err := createClient(kubeconfPath)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to load kubeconf: %w", err)
+// diff returns the backends in next whose address is not in old, and those
+// in old whose address is not in next.
+func diff(old, next []Backend) (added, removed []Backend) {
+	oldAddresses := make(map[string]bool, len(old))
+	for _, backend := range old {
+		oldAddresses[backend.Address] = true
+	}
+	nextAddresses := make(map[string]bool, len(next))
+	for _, backend := range next {
+		nextAddresses[backend.Address] = true
+		if !oldAddresses[backend.Address] {
+			added = append(added, backend)
+		}
+	}
+	for _, backend := range old {
+		if !nextAddresses[backend.Address] {
+			removed = append(removed, backend)
+		}
+	}
+	return added, removed
+}
+
+func (b Backend) String() string {
+	return fmt.Sprintf("%s (%s)", b.PodName, b.Address)
+}
+
+// HostPort returns where to dial the backend: Address as is when it has a
+// port, otherwise Address on the backend's own Port or else on port.
+func (b Backend) HostPort(port int) string {
+	if _, _, err := net.SplitHostPort(b.Address); err == nil {
+		return b.Address
+	}
+	if b.Port != 0 {
+		port = b.Port
+	}
+	return net.JoinHostPort(b.Address, strconv.Itoa(port))
+}
+
+// MergeBackends returns a list of the backends of every list, kept up to
+// date as they change. It is how one backend is gathered from several
+// clusters, each marking its backends with its own Priority. An address in
+// more than one list is taken from the first.
+func MergeBackends(lists ...*BackendList) *BackendList {
+	merged := NewBackendList()
+	var mu sync.Mutex
+	update := func() {
+		// Replaces of the lists can run at once, and the merge must not
+		// publish an older view over a newer one.
+		mu.Lock()
+		defer mu.Unlock()
+		var backends []Backend
+		for _, list := range lists {
+			backends = append(backends, list.GetAll()...)
+		}
+		merged.Replace(backends)
+	}
+	for _, list := range lists {
+		list.OnReplace(update)
 	}
+	update()
+	return merged
+}
 
-	namespace, ok := os.LookupEnv("NAMESPACE")
-	if !ok {
-		return nil, fmt.Errorf("Namespace not set in environment")
+// WithPriority sets Priority on every backend in the slice and returns it.
+func WithPriority(backends []Backend, priority int) []Backend {
+	for i := range backends {
+		backends[i].Priority = priority
 	}
+	return backends
+}
 
-	factory := informers.NewSharedInformerFactoryWithOptions(client, 3*time.Minute, informers.WithNamespace(namespace))
-	logging.Debug("Informer created, will watch for service pods to populate")
-	return factory, nil
+func (bl *BackendList) GetAll() []Backend {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	result := make([]Backend, len(bl.backends))
+	copy(result, bl.backends)
+	return result
 }
 
-func GetBackends(factory informers.SharedInformerFactory, serviceName string) *BackendList {
-	endpointInformer := factory.Core().V1().Endpoints().Informer()
+// Options holds the optional lookups discovery uses to fill in extra
+// Backend fields. Any of them may be nil.
+type Options struct {
+	Zones *ZoneResolver
+	Pods  *PodResolver
+	// IncludeNotReady keeps endpoints that are not ready yet, such as pods
+	// still warming up. Terminating endpoints are always dropped.
+	IncludeNotReady bool
+	// PortName picks the named port of each EndpointSlice as the backends'
+	// Port, so pods of one service may listen on different ports. Slices
+	// without the port leave Port unset.
+	PortName string
+	// Debounce holds back list changes for this long after a slice changes,
+	// so a burst of slice updates replaces the list once. 0 publishes every
+	// update at once.
+	Debounce time.Duration
+	// ExternalNames makes a Service of type ExternalName a backend of its
+	// external name. Pools then watch services as well as their slices.
+	ExternalNames bool
+	// Priority is set on every backend discovered, to fail over between
+	// clusters.
+	Priority int
+}
+
+// GetBackends watches the EndpointSlices of serviceName and keeps the
+// returned list up to date. serviceName may be "namespace/name" to take the
+// service from one namespace, otherwise the service is merged from every
+// namespace cluster watches.
+func GetBackends(cluster *Cluster, serviceName string, opts Options) *BackendList {
+	backendList := NewBackendList()
+	watchSlices(cluster, newServiceSlices(serviceName, backendList, opts))
+	return backendList
+}
 
+// GetSelectedBackends watches the EndpointSlices of every service whose
+// labels match selector, e.g. "app=api,tier=v2", in the namespaces cluster
+// watches, and keeps the returned list up to date.
+func GetSelectedBackends(cluster *Cluster, selector string, opts Options) (*BackendList, error) {
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector %q: %w", selector, err)
+	}
 	backendList := NewBackendList()
+	watchSlices(cluster, newSelectedSlices(parsed, backendList, opts))
+	return backendList, nil
+}
 
-	endpointInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+// watchSlices feeds slices the EndpointSlice events of every namespace
+// cluster watches.
+func watchSlices(cluster *Cluster, slices *serviceSlices) {
+	slices.inScope = cluster.watches
+	handler := cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			endpoints, ok := obj.(*corev1.Endpoints)
+			slice, ok := obj.(*discoveryv1.EndpointSlice)
 			if !ok {
 				return
 			}
-			reconcile(endpoints, backendList, serviceName)
+			event("kubernetes", "add")
+			slices.update(slice)
 		},
 		UpdateFunc: func(old, obj interface{}) {
-			endpoints, ok := obj.(*corev1.Endpoints)
+			slice, ok := obj.(*discoveryv1.EndpointSlice)
 			if !ok {
 				return
 			}
-			reconcile(endpoints, backendList, serviceName)
+			event("kubernetes", "update")
+			slices.update(slice)
 		},
 		DeleteFunc: func(obj interface{}) {
-			endpoints, ok := obj.(*corev1.Endpoints)
+			// A delete missed while the watch was down arrives as a tombstone.
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			slice, ok := obj.(*discoveryv1.EndpointSlice)
 			if !ok {
 				return
 			}
-			reconcile(endpoints, backendList, serviceName)
+			event("kubernetes", "delete")
+			slices.remove(slice)
 		},
-	})
-
-	return backendList
+	}
+	for _, factory := range cluster.factories {
+		informer := factory.Discovery().V1().EndpointSlices().Informer()
+		countWatchErrors(informer)
+		informer.AddEventHandler(handler)
+	}
+	if slices.opts.Pods != nil {
+		slices.opts.Pods.onChange(slices.updatePod)
+	}
 }
@@ -0,0 +1,71 @@
+package discovery
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendList_ReplaceSortsAndDedupes(t *testing.T) {
+	list := NewBackendList()
+	list.Replace([]Backend{
+		{Address: "10.0.0.3", PodName: "c"},
+		{Address: "10.0.0.1", PodName: "a"},
+		{Address: "10.0.0.3", PodName: "c-again"},
+	})
+
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.3"}, addresses(list))
+	assert.Equal(t, "c", list.GetAll()[1].PodName)
+}
+
+func TestBackendList_ReplaceSkipsNoChange(t *testing.T) {
+	list := NewBackendList()
+	var changes int
+	list.OnChange(func(added, removed []Backend) { changes++ })
+
+	list.Replace([]Backend{{Address: "10.0.0.2"}, {Address: "10.0.0.1"}})
+	list.Replace([]Backend{{Address: "10.0.0.1"}, {Address: "10.0.0.2"}})
+	assert.Equal(t, 1, changes)
+
+	// A backend that changes without moving is updated, but nothing came or
+	// went.
+	list.Replace([]Backend{{Address: "10.0.0.1", Weight: 5}, {Address: "10.0.0.2"}})
+	assert.Equal(t, 1, changes)
+	assert.Equal(t, 5, list.GetAll()[0].Weight)
+
+	// The rest keep their order around an added backend.
+	list.Replace([]Backend{{Address: "10.0.0.2"}, {Address: "10.0.0.3"}, {Address: "10.0.0.1", Weight: 5}})
+	assert.Equal(t, 2, changes)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, addresses(list))
+}
+
+func TestMergeBackends(t *testing.T) {
+	primary, secondary := NewBackendList(), NewBackendList()
+	primary.Replace([]Backend{{Address: "10.0.0.1"}})
+	merged := MergeBackends(primary, secondary)
+	assert.Equal(t, []string{"10.0.0.1"}, addresses(merged))
+
+	secondary.Replace([]Backend{{Address: "10.1.0.1", Priority: 1}, {Address: "10.0.0.1", Priority: 1}})
+	assert.Equal(t, []string{"10.0.0.1", "10.1.0.1"}, addresses(merged))
+	assert.Equal(t, 0, merged.GetAll()[0].Priority)
+
+	// Changes that keep every address still reach the merged list.
+	primary.Replace([]Backend{{Address: "10.0.0.1", Weight: 3}})
+	assert.Equal(t, 3, merged.GetAll()[0].Weight)
+
+	primary.Replace(nil)
+	assert.Equal(t, 1, merged.GetAll()[0].Priority)
+}
+
+func TestObservePool(t *testing.T) {
+	list := NewBackendList()
+	list.Replace([]Backend{{Address: "10.0.0.1"}})
+	ObservePool("observed", list)
+	assert.Equal(t, 1.0, poolBackends.With("observed").Get())
+
+	list.Replace([]Backend{{Address: "10.0.0.1"}, {Address: "10.0.0.2"}})
+	assert.Equal(t, 2.0, poolBackends.With("observed").Get())
+
+	list.Replace(nil)
+	assert.Equal(t, 0.0, poolBackends.With("observed").Get())
+}
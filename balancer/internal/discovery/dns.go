@@ -0,0 +1,112 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"pkg/logging"
+)
+
+const dnsLookupTimeout = 10 * time.Second
+
+// Resolver is the part of net.Resolver DNS discovery uses.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSOptions say what DNS discovery resolves and how often.
+type DNSOptions struct {
+	// Name is the DNS name to resolve, e.g. a headless service.
+	Name string
+	// SRV reads hosts and ports from SRV records. Otherwise the A and AAAA
+	// records of Name are dialed on the backend port.
+	SRV bool
+	// Interval is how often Name is resolved again.
+	Interval time.Duration
+	// Resolver defaults to net.DefaultResolver.
+	Resolver Resolver
+}
+
+// dnsWatch keeps a BackendList in step with the records of a DNS name.
+type dnsWatch struct {
+	opts DNSOptions
+	list *BackendList
+}
+
+// DNSBackends resolves opts.Name and returns a list of its records, which
+// is resolved again every opts.Interval until stopCh is closed. A failed
+// lookup keeps the backends of the last one that worked.
+func DNSBackends(opts DNSOptions, stopCh <-chan struct{}) *BackendList {
+	if opts.Resolver == nil {
+		opts.Resolver = net.DefaultResolver
+	}
+	watch := &dnsWatch{opts: opts, list: NewBackendList()}
+	watch.refresh()
+	go every(opts.Interval, stopCh, watch.refresh)
+	return watch.list
+}
+
+// every calls fn each interval until stopCh is closed.
+func every(interval time.Duration, stopCh <-chan struct{}, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+func (dw *dnsWatch) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	backends, err := dw.lookup(ctx)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		// The name has no records, e.g. a headless service without ready pods.
+		backends, err = nil, nil
+	}
+	if err != nil {
+		logging.Warning("Failed to resolve %s, keeping its last backends: %v", dw.opts.Name, err)
+		watchError("dns")
+		return
+	}
+	event("dns", "update")
+	sort.Slice(backends, func(i, j int) bool { return backends[i].Address < backends[j].Address })
+	dw.list.Replace(backends)
+	logging.Debug("Resolved %s to %d backends", dw.opts.Name, len(backends))
+}
+
+func (dw *dnsWatch) lookup(ctx context.Context) ([]Backend, error) {
+	if dw.opts.SRV {
+		_, records, err := dw.opts.Resolver.LookupSRV(ctx, "", "", dw.opts.Name)
+		if err != nil {
+			return nil, err
+		}
+		backends := make([]Backend, 0, len(records))
+		for _, record := range records {
+			address := net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+			backends = append(backends, Backend{Address: address, PodName: address, Weight: int(record.Weight)})
+		}
+		return backends, nil
+	}
+	addrs, err := dw.opts.Resolver.LookupIPAddr(ctx, dw.opts.Name)
+	if err != nil {
+		return nil, err
+	}
+	backends := make([]Backend, 0, len(addrs))
+	for _, addr := range addrs {
+		address := addr.IP.String()
+		backends = append(backends, Backend{Address: address, PodName: address})
+	}
+	return backends, nil
+}
@@ -0,0 +1,55 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeResolver struct {
+	ips     []net.IPAddr
+	records []*net.SRV
+	err     error
+}
+
+func (fr *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return fr.ips, fr.err
+}
+
+func (fr *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return name, fr.records, fr.err
+}
+
+func TestDNSWatch_A(t *testing.T) {
+	resolver := &fakeResolver{ips: []net.IPAddr{{IP: net.ParseIP("10.0.0.2")}, {IP: net.ParseIP("10.0.0.1")}}}
+	watch := &dnsWatch{opts: DNSOptions{Name: "backend.local", Resolver: resolver}, list: NewBackendList()}
+
+	watch.refresh()
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, addresses(watch.list))
+
+	// A failed lookup keeps what the list had.
+	resolver.err = errors.New("server misbehaving")
+	watch.refresh()
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, addresses(watch.list))
+
+	// A name without records empties it.
+	resolver.err = &net.DNSError{Err: "no such host", Name: "backend.local", IsNotFound: true}
+	watch.refresh()
+	assert.Empty(t, watch.list.GetAll())
+}
+
+func TestDNSWatch_SRV(t *testing.T) {
+	resolver := &fakeResolver{records: []*net.SRV{
+		{Target: "backend-1.local.", Port: 8081, Weight: 10},
+		{Target: "backend-0.local.", Port: 8080, Weight: 5},
+	}}
+	watch := &dnsWatch{opts: DNSOptions{Name: "_http._tcp.backend.local", SRV: true, Resolver: resolver}, list: NewBackendList()}
+
+	watch.refresh()
+	backends := watch.list.GetAll()
+	assert.Equal(t, []string{"backend-0.local:8080", "backend-1.local:8081"}, addresses(watch.list))
+	assert.Equal(t, 5, backends[0].Weight)
+}
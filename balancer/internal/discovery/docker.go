@@ -0,0 +1,178 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"pkg/logging"
+)
+
+const dockerRequestTimeout = 10 * time.Second
+
+// DockerOptions say which containers on a Docker daemon are backends.
+type DockerOptions struct {
+	// Host is the daemon address, "unix:///var/run/docker.sock" or
+	// "tcp://host:port".
+	Host string
+	// Label selects the containers, as "key" or "key=value".
+	Label string
+	// Network picks which of a container's networks its address comes from.
+	// Empty takes the first network with an address.
+	Network string
+	// Port is dialed on every container. Zero uses the backend port.
+	Port int
+	// Interval is how often the containers are listed again.
+	Interval time.Duration
+}
+
+// dockerContainer is the part of a /containers/json entry discovery reads.
+type dockerContainer struct {
+	ID              string `json:"Id"`
+	Names           []string
+	Status          string
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string
+			GlobalIPv6Address string
+		}
+	}
+}
+
+// dockerWatch keeps a BackendList in step with the matching containers.
+type dockerWatch struct {
+	opts    DockerOptions
+	list    *BackendList
+	client  *http.Client
+	baseURL string
+}
+
+// DockerBackends lists the running containers carrying opts.Label and
+// returns a list of them, which is refreshed every opts.Interval until
+// stopCh is closed. Containers whose health check is failing or still
+// starting are left out.
+func DockerBackends(opts DockerOptions, stopCh <-chan struct{}) (*BackendList, error) {
+	client, baseURL, err := dockerClient(opts.Host)
+	if err != nil {
+		return nil, err
+	}
+	watch := &dockerWatch{opts: opts, list: NewBackendList(), client: client, baseURL: baseURL}
+	if err := watch.load(); err != nil {
+		logging.Error("Failed to list containers labelled %s: %v", opts.Label, err)
+		watchError("docker")
+	}
+	go every(opts.Interval, stopCh, watch.refresh)
+	return watch.list, nil
+}
+
+// dockerClient returns a client for the daemon at host and the base URL to
+// send its requests to.
+func dockerClient(host string) (*http.Client, string, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid docker host %q: %w", host, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		// The host is ignored once dialing goes to the socket.
+		return &http.Client{Transport: transport, Timeout: dockerRequestTimeout}, "http://docker", nil
+	case "tcp", "http":
+		return &http.Client{Timeout: dockerRequestTimeout}, "http://" + u.Host, nil
+	}
+	return nil, "", fmt.Errorf("unsupported docker host %q, use unix:// or tcp://", host)
+}
+
+func (dw *dockerWatch) refresh() {
+	if err := dw.load(); err != nil {
+		logging.Warning("Failed to list containers labelled %s, keeping the last backends: %v", dw.opts.Label, err)
+		watchError("docker")
+	}
+}
+
+func (dw *dockerWatch) load() error {
+	filters, err := json.Marshal(map[string][]string{
+		"label":  {dw.opts.Label},
+		"status": {"running"},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := dw.client.Get(dw.baseURL + "/containers/json?filters=" + url.QueryEscape(string(filters)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker answered %s", resp.Status)
+	}
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return fmt.Errorf("failed to decode the docker answer: %w", err)
+	}
+	event("docker", "update")
+	backends := dockerBackends(containers, dw.opts)
+	dw.list.Replace(backends)
+	logging.Debug("Found %d containers labelled %s", len(backends), dw.opts.Label)
+	return nil
+}
+
+// dockerBackends returns the containers that can take traffic.
+func dockerBackends(containers []dockerContainer, opts DockerOptions) []Backend {
+	var backends []Backend
+	for _, container := range containers {
+		if strings.Contains(container.Status, "(unhealthy)") || strings.Contains(container.Status, "(health: starting)") {
+			continue
+		}
+		name := container.ID
+		if len(container.Names) > 0 {
+			name = strings.TrimPrefix(container.Names[0], "/")
+		}
+		address := containerAddress(container, opts.Network)
+		if address == "" {
+			logging.Warning("Container %s has no address on network %q, skipping it", name, opts.Network)
+			continue
+		}
+		if opts.Port != 0 {
+			address = net.JoinHostPort(address, strconv.Itoa(opts.Port))
+		}
+		backends = append(backends, Backend{Address: address, PodName: name})
+	}
+	return backends
+}
+
+// containerAddress returns the IP of container on network. When network is
+// empty it takes the first network, by name, that gives the container one.
+func containerAddress(container dockerContainer, network string) string {
+	networks := container.NetworkSettings.Networks
+	if network != "" {
+		if networks[network].IPAddress != "" {
+			return networks[network].IPAddress
+		}
+		return networks[network].GlobalIPv6Address
+	}
+	names := make([]string, 0, len(networks))
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if networks[name].IPAddress != "" {
+			return networks[name].IPAddress
+		}
+	}
+	return ""
+}
@@ -0,0 +1,64 @@
+package discovery
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const dockerContainers = `[
+	{"Id": "a1", "Names": ["/web-1"], "Status": "Up 2 minutes (healthy)",
+	 "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.2"}, "app": {"IPAddress": "172.20.0.2"}}}},
+	{"Id": "b2", "Names": ["/web-2"], "Status": "Up 3 seconds (health: starting)",
+	 "NetworkSettings": {"Networks": {"app": {"IPAddress": "172.20.0.3"}}}},
+	{"Id": "c3", "Names": ["/web-3"], "Status": "Up 5 minutes",
+	 "NetworkSettings": {"Networks": {"app": {"IPAddress": "172.20.0.4"}}}}
+]`
+
+func TestDockerWatch_Load(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	daemon := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/containers/json", r.URL.Path)
+		var filters map[string][]string
+		assert.NoError(t, json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters))
+		assert.Equal(t, []string{"app=web"}, filters["label"])
+		io.WriteString(w, dockerContainers)
+	}))
+	daemon.Listener = listener
+	daemon.Start()
+	t.Cleanup(daemon.Close)
+
+	client, baseURL, err := dockerClient("unix://" + socket)
+	assert.NoError(t, err)
+	watch := &dockerWatch{opts: DockerOptions{Label: "app=web", Network: "app", Port: 8080}, list: NewBackendList(), client: client, baseURL: baseURL}
+
+	assert.NoError(t, watch.load())
+	assert.Equal(t, []string{"172.20.0.2:8080", "172.20.0.4:8080"}, addresses(watch.list))
+	assert.Equal(t, "web-1", watch.list.GetAll()[0].PodName)
+}
+
+func TestContainerAddress_FirstNetwork(t *testing.T) {
+	var containers []dockerContainer
+	assert.NoError(t, json.Unmarshal([]byte(dockerContainers), &containers))
+
+	assert.Equal(t, "172.20.0.2", containerAddress(containers[0], ""))
+	assert.Equal(t, "172.17.0.2", containerAddress(containers[0], "bridge"))
+	assert.Empty(t, containerAddress(containers[2], "bridge"))
+}
+
+func TestDockerClient_Host(t *testing.T) {
+	_, baseURL, err := dockerClient("tcp://127.0.0.1:2375")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:2375", baseURL)
+
+	_, _, err = dockerClient("npipe:////./pipe/docker_engine")
+	assert.Error(t, err)
+}
@@ -0,0 +1,111 @@
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"sigs.k8s.io/yaml"
+
+	"pkg/logging"
+)
+
+// FileBackend is one entry of a backends file.
+type FileBackend struct {
+	// Address is "host:port", or a host reached on the backend port.
+	Address string `json:"address"`
+	Weight  int    `json:"weight"`
+	Zone    string `json:"zone"`
+}
+
+// fileWatch keeps a BackendList in step with a backends file.
+type fileWatch struct {
+	path string
+	list *BackendList
+}
+
+// FileBackends loads the backends listed in the JSON or YAML file at path
+// and reloads them whenever the file changes, until stopCh is closed. A
+// file that cannot be read or parsed on reload keeps the last backends.
+func FileBackends(path string, stopCh <-chan struct{}) (*BackendList, error) {
+	watch := &fileWatch{path: filepath.Clean(path), list: NewBackendList()}
+	if err := watch.load(); err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch %s: %w", path, err)
+	}
+	// Editors and ConfigMap mounts replace the file rather than writing to
+	// it, which only the directory sees.
+	if err := watcher.Add(filepath.Dir(watch.path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch %s: %w", path, err)
+	}
+	go watch.run(watcher, stopCh)
+	return watch.list, nil
+}
+
+func (fw *fileWatch) run(watcher *fsnotify.Watcher, stopCh <-chan struct{}) {
+	defer watcher.Close()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Chmod) {
+				continue
+			}
+			// Any other change in the directory may be a ConfigMap swapping
+			// its data, and a load that changes nothing is harmless.
+			if err := fw.load(); err != nil {
+				logging.Warning("Failed to reload %s, keeping its last backends: %v", fw.path, err)
+				watchError("file")
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logging.Warning("Error watching %s: %v", fw.path, err)
+			watchError("file")
+		}
+	}
+}
+
+func (fw *fileWatch) load() error {
+	data, err := os.ReadFile(fw.path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", fw.path, err)
+	}
+	// A file caught halfway through being written is empty, so no backends
+	// has to be spelled "[]".
+	if len(bytes.TrimSpace(data)) == 0 {
+		return fmt.Errorf("%s is empty", fw.path)
+	}
+	var entries []FileBackend
+	// YAML is a superset of JSON, so this reads both.
+	if err := yaml.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", fw.path, err)
+	}
+	backends := make([]Backend, 0, len(entries))
+	for i, entry := range entries {
+		if entry.Address == "" {
+			return fmt.Errorf("backend %d in %s has no address", i, fw.path)
+		}
+		backends = append(backends, Backend{
+			Address: entry.Address,
+			PodName: entry.Address,
+			Zone:    entry.Zone,
+			Weight:  entry.Weight,
+		})
+	}
+	event("file", "update")
+	fw.list.Replace(backends)
+	logging.Debug("Loaded %d backends from %s", len(backends), fw.path)
+	return nil
+}
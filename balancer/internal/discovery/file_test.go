@@ -0,0 +1,58 @@
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileBackends_Reloads(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "backends.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("- address: 10.0.0.1:8080\n  weight: 2\n"), 0o600))
+
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	list, err := FileBackends(path, stopCh)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:8080"}, addresses(list))
+	assert.Equal(t, 2, list.GetAll()[0].Weight)
+
+	// Replace the file the way editors and ConfigMaps do.
+	next := filepath.Join(dir, "backends.json.tmp")
+	assert.NoError(t, os.WriteFile(next, []byte(`[{"address": "10.0.0.1:8080"}, {"address": "10.0.0.2:8080"}]`), 0o600))
+	assert.NoError(t, os.Rename(next, path))
+	assert.Eventually(t, func() bool { return len(list.GetAll()) == 2 }, 2*time.Second, 10*time.Millisecond)
+
+	// A broken file keeps the last backends.
+	assert.NoError(t, os.WriteFile(path, []byte("- address: [\n"), 0o600))
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, list.GetAll(), 2)
+}
+
+func TestFileBackends_Missing(t *testing.T) {
+	_, err := FileBackends(filepath.Join(t.TempDir(), "backends.yaml"), make(chan struct{}))
+	assert.Error(t, err)
+}
+
+func TestFileBackends_EmptyMidWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`[{"address": "10.0.0.1:8080"}]`), 0o600))
+
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	list, err := FileBackends(path, stopCh)
+	assert.NoError(t, err)
+
+	// A writer that truncates before writing leaves the file empty for a
+	// moment, which is not the same as listing no backends.
+	assert.NoError(t, os.Truncate(path, 0))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"10.0.0.1:8080"}, addresses(list))
+
+	assert.NoError(t, os.WriteFile(path, []byte("[]\n"), 0o600))
+	assert.Eventually(t, func() bool { return len(list.GetAll()) == 0 }, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,63 @@
+package discovery
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+
+	"balancer/internal/metrics"
+
+	"pkg/logging"
+)
+
+// Discovery metrics are labelled by source: kubernetes, dns, consul, docker
+// or file.
+var (
+	eventsTotal = metrics.Default.Counter("balancer_discovery_events_total",
+		"Endpoint updates processed by discovery.", "source", "event")
+	watchErrorsTotal = metrics.Default.Counter("balancer_discovery_watch_errors_total",
+		"Errors watching or refreshing a discovery source.", "source")
+	lastSync = metrics.Default.Gauge("balancer_discovery_last_sync_timestamp_seconds",
+		"When a discovery source last synced or delivered an update, as a Unix time.", "source")
+	poolBackends = metrics.Default.Gauge("balancer_discovery_backends",
+		"Backends currently discovered for each pool.", "pool")
+)
+
+// synced records that source is up to date as of now.
+func synced(source string) {
+	lastSync.With(source).Set(float64(time.Now().Unix()))
+}
+
+// event counts an update from source and marks it synced.
+func event(source, kind string) {
+	eventsTotal.With(source, kind).Inc()
+	synced(source)
+}
+
+// watchError counts a failed watch or refresh of source.
+func watchError(source string) {
+	watchErrorsTotal.With(source).Inc()
+}
+
+// countWatchErrors makes informer count its watch errors before handing
+// them to client-go's default handling, which logs them and backs off.
+func countWatchErrors(informer cache.SharedIndexInformer) {
+	err := informer.SetWatchErrorHandlerWithContext(func(ctx context.Context, r *cache.Reflector, err error) {
+		watchError("kubernetes")
+		cache.DefaultWatchErrorHandler(ctx, r, err)
+	})
+	if err != nil {
+		logging.Debug("Unable to count watch errors: %v", err)
+	}
+}
+
+// ObservePool keeps the number of backends in list as the backend count of
+// pool.
+func ObservePool(pool string, list *BackendList) {
+	gauge := poolBackends.With(pool)
+	gauge.Set(float64(len(list.GetAll())))
+	list.OnChange(func(added, removed []Backend) {
+		gauge.Set(float64(len(list.GetAll())))
+	})
+}
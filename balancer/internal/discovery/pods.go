@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	"maps"
+	"strconv"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"pkg/logging"
+)
+
+// PodResolver reads per-pod settings and metadata from pods through a Pod
+// informer, and tells discovery when a pod starts terminating or its labels
+// or annotations change, so its slices are judged again without waiting
+// for the endpoints controller. The balancer's Role needs to list and watch
+// pods.
+type PodResolver struct {
+	pods             map[string]listersv1.PodLister
+	weightAnnotation string
+	// metadata carries the labels and annotations of pods on their
+	// backends.
+	metadata bool
+
+	mu       sync.Mutex
+	watchers []func(pod *corev1.Pod)
+}
+
+// NewPodResolver registers a Pod informer for every namespace cluster
+// watches. Call it before cluster.Start. weightAnnotation names the
+// annotation holding a pod's weight, e.g. "balancer/weight", and metadata
+// carries pod labels and annotations on backends.
+func NewPodResolver(cluster *Cluster, weightAnnotation string, metadata bool) *PodResolver {
+	pr := &PodResolver{
+		pods:             make(map[string]listersv1.PodLister, len(cluster.factories)),
+		weightAnnotation: weightAnnotation,
+		metadata:         metadata,
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, obj interface{}) {
+			before, ok := old.(*corev1.Pod)
+			if !ok {
+				return
+			}
+			pod, ok := obj.(*corev1.Pod)
+			if !ok || !changed(before, pod) {
+				return
+			}
+			event("kubernetes", "pod")
+			pr.notify(pod)
+		},
+	}
+	for namespace := range cluster.factories {
+		// Pods sync before slices, so the first slices find their pods.
+		pods := cluster.earlyFactory(namespace).Core().V1().Pods()
+		countWatchErrors(pods.Informer())
+		pods.Informer().AddEventHandler(handler)
+		pr.pods[namespace] = pods.Lister()
+	}
+	return pr
+}
+
+// changed reports whether pod changed in a way that changes its backend:
+// it started terminating, or its labels or annotations, which hold its
+// weight, changed. Status updates and resyncs are left out.
+func changed(before, pod *corev1.Pod) bool {
+	return (before.DeletionTimestamp == nil) != (pod.DeletionTimestamp == nil) ||
+		!maps.Equal(before.Labels, pod.Labels) ||
+		!maps.Equal(before.Annotations, pod.Annotations)
+}
+
+// onChange calls watcher with every pod that changes its backend.
+func (pr *PodResolver) onChange(watcher func(pod *corev1.Pod)) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.watchers = append(pr.watchers, watcher)
+}
+
+func (pr *PodResolver) notify(pod *corev1.Pod) {
+	pr.mu.Lock()
+	watchers := pr.watchers
+	pr.mu.Unlock()
+	for _, watcher := range watchers {
+		watcher(pod)
+	}
+}
+
+// pod returns the named pod from the informer cache, or nil when it is
+// unknown or the resolver is nil. The pod is shared and must not be changed.
+func (pr *PodResolver) pod(namespace, name string) *corev1.Pod {
+	if pr == nil || name == "" {
+		return nil
+	}
+	lister, ok := pr.pods[namespace]
+	if !ok {
+		lister, ok = pr.pods[metav1.NamespaceAll]
+	}
+	if !ok {
+		return nil
+	}
+	pod, err := lister.Pods(namespace).Get(name)
+	if err != nil {
+		logging.Debug("Unable to look up pod %s/%s: %v", namespace, name, err)
+		return nil
+	}
+	return pod
+}
+
+// Weight returns the weight annotated on the pod, or 0 when it has none. A
+// nil resolver always returns 0.
+func (pr *PodResolver) Weight(namespace, name string) int {
+	pod := pr.pod(namespace, name)
+	if pod == nil {
+		return 0
+	}
+	value, ok := pod.Annotations[pr.weightAnnotation]
+	if !ok {
+		return 0
+	}
+	weight, err := strconv.Atoi(value)
+	if err != nil || weight < 1 {
+		logging.Warning("Ignoring invalid %s annotation %q on pod %s", pr.weightAnnotation, value, name)
+		return 0
+	}
+	return weight
+}
@@ -0,0 +1,178 @@
+package discovery
+
+import (
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Pools keeps a BackendList per service from one set of informers. A
+// single event handler hands each EndpointSlice only to the services it
+// belongs to, however many pools there are.
+type Pools struct {
+	cluster *Cluster
+	opts    Options
+
+	mu sync.Mutex
+	// services is keyed by the bare service name slices are labelled with.
+	services map[string][]*serviceSlices
+	// lists is keyed by the name the pool was asked for, which may be
+	// "namespace/name".
+	lists map[string]*BackendList
+}
+
+// NewPools registers the pools' event handler on cluster. Pools asked for
+// with Get before cluster.Start are filled by the first sync, later ones from
+// the informer caches. With opts.ExternalNames services are watched too.
+func NewPools(cluster *Cluster, opts Options) *Pools {
+	pools := &Pools{
+		cluster:  cluster,
+		opts:     opts,
+		services: make(map[string][]*serviceSlices),
+		lists:    make(map[string]*BackendList),
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			slice, ok := obj.(*discoveryv1.EndpointSlice)
+			if !ok {
+				return
+			}
+			event("kubernetes", "add")
+			for _, slices := range pools.servicesOf(slice.Labels[discoveryv1.LabelServiceName]) {
+				slices.update(slice)
+			}
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			slice, ok := obj.(*discoveryv1.EndpointSlice)
+			if !ok {
+				return
+			}
+			event("kubernetes", "update")
+			for _, slices := range pools.servicesOf(slice.Labels[discoveryv1.LabelServiceName]) {
+				slices.update(slice)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			slice, ok := obj.(*discoveryv1.EndpointSlice)
+			if !ok {
+				return
+			}
+			event("kubernetes", "delete")
+			for _, slices := range pools.servicesOf(slice.Labels[discoveryv1.LabelServiceName]) {
+				slices.remove(slice)
+			}
+		},
+	}
+	for _, factory := range cluster.factories {
+		informer := factory.Discovery().V1().EndpointSlices().Informer()
+		countWatchErrors(informer)
+		informer.AddEventHandler(handler)
+	}
+	if opts.ExternalNames {
+		pools.watchServices(cluster)
+	}
+	if opts.Pods != nil {
+		opts.Pods.onChange(pools.updatePod)
+	}
+	return pools
+}
+
+// updatePod hands a changed pod to every pool, as pods do not carry the
+// name of their service.
+func (p *Pools) updatePod(pod *corev1.Pod) {
+	p.mu.Lock()
+	var all []*serviceSlices
+	for _, services := range p.services {
+		all = append(all, services...)
+	}
+	p.mu.Unlock()
+	for _, slices := range all {
+		slices.updatePod(pod)
+	}
+}
+
+// watchServices follows the services of the pools, for those of type
+// ExternalName.
+func (p *Pools) watchServices(cluster *Cluster) {
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			service, ok := obj.(*corev1.Service)
+			if !ok {
+				return
+			}
+			for _, slices := range p.servicesOf(service.Name) {
+				slices.updateService(service)
+			}
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			service, ok := obj.(*corev1.Service)
+			if !ok {
+				return
+			}
+			for _, slices := range p.servicesOf(service.Name) {
+				slices.updateService(service)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			service, ok := obj.(*corev1.Service)
+			if !ok {
+				return
+			}
+			for _, slices := range p.servicesOf(service.Name) {
+				slices.removeService(service)
+			}
+		},
+	}
+	for _, factory := range cluster.factories {
+		informer := factory.Core().V1().Services().Informer()
+		countWatchErrors(informer)
+		informer.AddEventHandler(handler)
+	}
+}
+
+// Get returns the list of serviceName, which may be "namespace/name" like
+// for GetBackends. Asking for the same name again returns the same list.
+func (p *Pools) Get(serviceName string) *BackendList {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if list, ok := p.lists[serviceName]; ok {
+		return list
+	}
+	list := NewBackendList()
+	slices := newServiceSlices(serviceName, list, p.opts)
+	slices.inScope = p.cluster.watches
+	p.services[slices.serviceName] = append(p.services[slices.serviceName], slices)
+	p.lists[serviceName] = list
+	// A pool asked for after cluster.Start, on a config reload, catches up
+	// from what the informers already hold.
+	for _, factory := range p.cluster.factories {
+		for _, obj := range factory.Discovery().V1().EndpointSlices().Informer().GetStore().List() {
+			if slice, ok := obj.(*discoveryv1.EndpointSlice); ok {
+				slices.update(slice)
+			}
+		}
+		if p.opts.ExternalNames {
+			for _, obj := range factory.Core().V1().Services().Informer().GetStore().List() {
+				if service, ok := obj.(*corev1.Service); ok {
+					slices.updateService(service)
+				}
+			}
+		}
+	}
+	return list
+}
+
+// servicesOf returns the services of the pools named serviceName.
+func (p *Pools) servicesOf(serviceName string) []*serviceSlices {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.services[serviceName]
+}
@@ -0,0 +1,63 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"pkg/logging"
+)
+
+// secretTimeout bounds the first read of a Secret.
+const secretTimeout = 10 * time.Second
+
+// WatchSecret calls update with the data of the Secret name in namespace,
+// and again each time the data changes until stopCh is closed. The error of
+// the first read or update is returned. Later errors are logged and the
+// Secret is read again on its next change, so update should keep what it
+// had when it fails. Watching needs the Role to get, list and watch
+// secrets.
+func WatchSecret(client kubernetes.Interface, namespace, name string, update func(data map[string][]byte) error, stopCh <-chan struct{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+	defer cancel()
+	secret, err := client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to read secret %s/%s: %w", namespace, name, err)
+	}
+	if err := update(secret.Data); err != nil {
+		return fmt.Errorf("secret %s/%s: %w", namespace, name, err)
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+	last := secret.Data
+	changed := func(object any) {
+		secret, ok := object.(*corev1.Secret)
+		if !ok || reflect.DeepEqual(secret.Data, last) {
+			return
+		}
+		if err := update(secret.Data); err != nil {
+			logging.Warning("Failed to apply the change to secret %s/%s, keeping the previous one: %v", namespace, name, err)
+			return
+		}
+		last = secret.Data
+		logging.Info("Secret %s/%s changed, rotated its certificates", namespace, name)
+	}
+	factory.Core().V1().Secrets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    changed,
+		UpdateFunc: func(_, object any) { changed(object) },
+	})
+	factory.Start(stopCh)
+	return nil
+}
@@ -0,0 +1,55 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWatchSecret(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "balancer-tls", Namespace: "default"},
+		Data:       map[string][]byte{"tls.crt": []byte("first")},
+	}
+	client := fake.NewSimpleClientset(secret)
+	updates := make(chan string, 10)
+	update := func(data map[string][]byte) error {
+		if string(data["tls.crt"]) == "bad" {
+			return errors.New("bad certificate")
+		}
+		updates <- string(data["tls.crt"])
+		return nil
+	}
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	assert.NoError(t, WatchSecret(client, "default", "balancer-tls", update, stopCh))
+	assert.Equal(t, "first", <-updates)
+
+	set := func(value string) {
+		secret = secret.DeepCopy()
+		secret.Data["tls.crt"] = []byte(value)
+		_, err := client.CoreV1().Secrets("default").Update(context.Background(), secret, metav1.UpdateOptions{})
+		assert.NoError(t, err)
+	}
+	set("bad")
+	set("second")
+	select {
+	case value := <-updates:
+		assert.Equal(t, "second", value)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected an update after the secret changed")
+	}
+
+	assert.Error(t, WatchSecret(client, "default", "missing", update, stopCh))
+	secret.Name = "invalid"
+	secret.Data["tls.crt"] = []byte("bad")
+	_, err := client.CoreV1().Secrets("default").Create(context.Background(), secret, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.Error(t, WatchSecret(client, "default", "invalid", update, stopCh))
+}
@@ -0,0 +1,370 @@
+package discovery
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"pkg/logging"
+)
+
+// serviceSlices merges the EndpointSlices of one service into its
+// BackendList. A service has a slice per 100 endpoints by default, and
+// every change touches only some of them, so each slice's backends are kept
+// and the list is rebuilt from all of them.
+type serviceSlices struct {
+	serviceName string
+	// selector, when set, takes the slices of every service whose labels
+	// match instead of the one named serviceName.
+	selector labels.Selector
+	// namespace pins the service to one namespace when set.
+	namespace string
+	list      *BackendList
+	opts      Options
+	// inScope, when set, reports whether a namespace is watched.
+	inScope func(namespace string) bool
+
+	mu sync.Mutex
+	// slices is keyed by namespace/name, as slice names are only unique
+	// within a namespace.
+	slices map[string][]Backend
+	// raw holds the slices behind slices, to judge them again when one of
+	// their pods changes.
+	raw map[string]*discoveryv1.EndpointSlice
+	// pending publishes the slices once opts.Debounce has passed.
+	pending *time.Timer
+}
+
+// newServiceSlices merges the slices of serviceName, which may be given as
+// "namespace/name".
+func newServiceSlices(serviceName string, list *BackendList, opts Options) *serviceSlices {
+	ss := &serviceSlices{
+		serviceName: serviceName,
+		list:        list,
+		opts:        opts,
+		slices:      make(map[string][]Backend),
+		raw:         make(map[string]*discoveryv1.EndpointSlice),
+	}
+	if namespace, name, ok := strings.Cut(serviceName, "/"); ok {
+		ss.namespace, ss.serviceName = namespace, name
+	}
+	return ss
+}
+
+// newSelectedSlices merges the slices of every service matching selector.
+// EndpointSlices carry the labels of their service.
+func newSelectedSlices(selector labels.Selector, list *BackendList, opts Options) *serviceSlices {
+	return &serviceSlices{
+		serviceName: selector.String(),
+		selector:    selector,
+		list:        list,
+		opts:        opts,
+		slices:      make(map[string][]Backend),
+		raw:         make(map[string]*discoveryv1.EndpointSlice),
+	}
+}
+
+func (ss *serviceSlices) owns(slice *discoveryv1.EndpointSlice) bool {
+	if ss.namespace != "" && slice.Namespace != ss.namespace {
+		return false
+	}
+	if ss.selector != nil {
+		return ss.selector.Matches(labels.Set(slice.Labels))
+	}
+	return slice.Labels[discoveryv1.LabelServiceName] == ss.serviceName
+}
+
+// update stores the backends of slice, if it belongs to the service. A
+// slice that stopped belonging, because its labels changed or its
+// namespace left the watch, is dropped instead.
+func (ss *serviceSlices) update(slice *discoveryv1.EndpointSlice) {
+	key := slice.Namespace + "/" + slice.Name
+	owned := ss.owns(slice) && (ss.inScope == nil || ss.inScope(slice.Namespace))
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if !owned {
+		if _, ok := ss.slices[key]; ok {
+			delete(ss.slices, key)
+			delete(ss.raw, key)
+			ss.changed()
+		}
+		return
+	}
+	logging.Debug("Detected an update to slice %s of service %s, updating now", key, ss.serviceName)
+	ss.slices[key] = sliceBackends(slice, ss.opts)
+	ss.raw[key] = slice
+	ss.changed()
+}
+
+// updatePod judges the slices holding pod again.
+func (ss *serviceSlices) updatePod(pod *corev1.Pod) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	updated := false
+	for key, slice := range ss.raw {
+		if slice.Namespace != pod.Namespace || !holds(slice, pod.Name) {
+			continue
+		}
+		logging.Debug("Pod %s/%s of slice %s changed, updating now", pod.Namespace, pod.Name, key)
+		ss.slices[key] = sliceBackends(slice, ss.opts)
+		updated = true
+	}
+	if updated {
+		ss.changed()
+	}
+}
+
+// holds reports whether an endpoint of slice is the pod called name.
+func holds(slice *discoveryv1.EndpointSlice, name string) bool {
+	for _, endpoint := range slice.Endpoints {
+		if endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod" && endpoint.TargetRef.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// remove drops the backends of a deleted slice.
+func (ss *serviceSlices) remove(slice *discoveryv1.EndpointSlice) {
+	if !ss.owns(slice) {
+		return
+	}
+	key := slice.Namespace + "/" + slice.Name
+	logging.Debug("Slice %s of service %s was deleted, updating now", key, ss.serviceName)
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.slices, key)
+	delete(ss.raw, key)
+	ss.changed()
+}
+
+// externalKey is where an ExternalName service is kept among the slices.
+// Slice names cannot hold a '#', so it never collides with one.
+func externalKey(service *corev1.Service) string {
+	return service.Namespace + "/" + service.Name + "#externalname"
+}
+
+// updateService stands the external name of an ExternalName service in for
+// the slices such a service does not have. A service that stopped being
+// ExternalName is dropped.
+func (ss *serviceSlices) updateService(service *corev1.Service) {
+	key := externalKey(service)
+	owned := (ss.namespace == "" || service.Namespace == ss.namespace) &&
+		service.Name == ss.serviceName &&
+		(ss.inScope == nil || ss.inScope(service.Namespace))
+	external := service.Spec.Type == corev1.ServiceTypeExternalName && service.Spec.ExternalName != ""
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if !owned || !external {
+		if _, ok := ss.slices[key]; ok {
+			delete(ss.slices, key)
+			ss.changed()
+		}
+		return
+	}
+	logging.Debug("Service %s/%s points at %s", service.Namespace, service.Name, service.Spec.ExternalName)
+	ss.slices[key] = []Backend{{
+		Address:   service.Spec.ExternalName,
+		PodName:   service.Spec.ExternalName,
+		Namespace: service.Namespace,
+		Priority:  ss.opts.Priority,
+	}}
+	ss.changed()
+}
+
+// removeService drops the external name of a deleted service.
+func (ss *serviceSlices) removeService(service *corev1.Service) {
+	key := externalKey(service)
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _, ok := ss.slices[key]; ok {
+		delete(ss.slices, key)
+		ss.changed()
+	}
+}
+
+// changed publishes the slices, or with opts.Debounce set, publishes them
+// once the debounce has passed after the first of a burst of changes, so a
+// rollout replaces the list at most once per debounce. ss.mu must be held.
+func (ss *serviceSlices) changed() {
+	if ss.opts.Debounce <= 0 {
+		ss.publish()
+		return
+	}
+	if ss.pending != nil {
+		return
+	}
+	ss.pending = time.AfterFunc(ss.opts.Debounce, func() {
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		ss.pending = nil
+		ss.publish()
+	})
+}
+
+// publish replaces the list with the backends of every slice, in slice name
+// order. An endpoint moving between slices can briefly be in both, and
+// Replace keeps the copy from the first slice. ss.mu must be held.
+func (ss *serviceSlices) publish() {
+	names := make([]string, 0, len(ss.slices))
+	for name := range ss.slices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var backends []Backend
+	for _, name := range names {
+		backends = append(backends, ss.slices[name]...)
+	}
+	if !logging.Enabled(logging.DEBUG) {
+		ss.list.Replace(backends)
+		return
+	}
+	old := ss.list.GetAll()
+	ss.list.Replace(backends)
+	current := ss.list.GetAll()
+	added, removed := diff(old, current)
+	logging.Logger().Debug("Reconciled endpoints", "service", ss.serviceName, "slices", names,
+		"backends", len(current), "added", addressesOf(added), "removed", addressesOf(removed))
+}
+
+// addressesOf returns the address of each backend, for logging.
+func addressesOf(backends []Backend) []string {
+	addresses := make([]string, len(backends))
+	for i, backend := range backends {
+		addresses[i] = backend.Address
+	}
+	return addresses
+}
+
+// usable reports whether an endpoint with conditions should get traffic.
+// Nil conditions mean the endpoint is ready and not terminating.
+func usable(conditions discoveryv1.EndpointConditions, opts Options) bool {
+	if conditions.Terminating != nil && *conditions.Terminating {
+		return false
+	}
+	if conditions.Ready == nil || *conditions.Ready {
+		return true
+	}
+	return opts.IncludeNotReady
+}
+
+// sliceBackends returns the usable endpoints of slice. Only the first address
+// of an endpoint is used, as the API asks of consumers. FQDN slices, which
+// only hand made slices have, give host names that are resolved when dialed.
+func sliceBackends(slice *discoveryv1.EndpointSlice, opts Options) []Backend {
+	port := slicePort(slice, opts.PortName)
+	var backends []Backend
+	for _, endpoint := range slice.Endpoints {
+		if len(endpoint.Addresses) == 0 {
+			continue
+		}
+		if !usable(endpoint.Conditions, opts) {
+			logging.Debug("Skipping endpoint %s of slice %s/%s, it is not ready or terminating", endpoint.Addresses[0], slice.Namespace, slice.Name)
+			continue
+		}
+		var podName string
+		if endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod" {
+			podName = endpoint.TargetRef.Name
+		}
+		var nodeName string
+		if endpoint.NodeName != nil {
+			nodeName = *endpoint.NodeName
+		}
+		// A deleted pod can stay in its slice until the endpoints controller
+		// catches up, so it is dropped as soon as the pod cache knows.
+		pod := opts.Pods.pod(slice.Namespace, podName)
+		if pod != nil && pod.DeletionTimestamp != nil {
+			logging.Debug("Skipping pod %s, it is being deleted", podName)
+			continue
+		}
+		zone := endpointZone(endpoint, nodeName, opts)
+		weight := opts.Pods.Weight(slice.Namespace, podName)
+		logging.Debug("Adding pod %s in zone %q with weight %d", podName, zone, weight)
+		backend := Backend{
+			Address:   endpoint.Addresses[0],
+			Port:      port,
+			PodName:   podName,
+			Namespace: slice.Namespace,
+			NodeName:  nodeName,
+			Zone:      zone,
+			Weight:    weight,
+			Priority:  opts.Priority,
+		}
+		if podName == "" {
+			// Endpoints outside the cluster have no pod, so like static
+			// backends they are named by their address.
+			backend.PodName = backend.Address
+		}
+		backend.Ordinal, backend.HasOrdinal = statefulSetOrdinal(endpoint, podName, pod)
+		if pod != nil && opts.Pods.metadata {
+			backend.Labels = pod.Labels
+			backend.Annotations = pod.Annotations
+		}
+		backends = append(backends, backend)
+	}
+	return backends
+}
+
+// endpointZone returns the zone of endpoint: the one the slice gives it, or
+// else its node's topology.kubernetes.io/zone label when nodes are watched,
+// or else the only zone its topology hints send traffic from.
+func endpointZone(endpoint discoveryv1.Endpoint, nodeName string, opts Options) string {
+	if endpoint.Zone != nil && *endpoint.Zone != "" {
+		return *endpoint.Zone
+	}
+	if zone := opts.Zones.Zone(nodeName); zone != "" {
+		return zone
+	}
+	if endpoint.Hints != nil && len(endpoint.Hints.ForZones) == 1 {
+		return endpoint.Hints.ForZones[0].Name
+	}
+	return ""
+}
+
+// statefulSetOrdinal returns the ordinal of a StatefulSet pod, from its pod
+// index label or else the number its name ends in. Without the pod cache,
+// an endpoint whose hostname is its pod name, as a StatefulSet's headless
+// service gives it, counts as a StatefulSet pod.
+func statefulSetOrdinal(endpoint discoveryv1.Endpoint, podName string, pod *corev1.Pod) (int, bool) {
+	if pod != nil {
+		if index, ok := pod.Labels[appsv1.PodIndexLabel]; ok {
+			ordinal, err := strconv.Atoi(index)
+			return ordinal, err == nil && ordinal >= 0
+		}
+		owner := metav1.GetControllerOf(pod)
+		if owner == nil || owner.Kind != "StatefulSet" {
+			return 0, false
+		}
+	} else if endpoint.Hostname == nil || *endpoint.Hostname != podName {
+		return 0, false
+	}
+	i := strings.LastIndex(podName, "-")
+	if i < 0 {
+		return 0, false
+	}
+	ordinal, err := strconv.Atoi(podName[i+1:])
+	return ordinal, err == nil && ordinal >= 0
+}
+
+// slicePort returns the number of the slice port called name, or 0 when
+// name is empty or the slice has no such port.
+func slicePort(slice *discoveryv1.EndpointSlice, name string) int {
+	if name == "" {
+		return 0
+	}
+	for _, port := range slice.Ports {
+		if port.Name != nil && *port.Name == name && port.Port != nil {
+			return int(*port.Port)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,213 @@
+package discovery
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func endpointSlice(name, service string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+	}
+}
+
+func endpoint(address, pod string, ready bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses:  []string{address},
+		Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		TargetRef:  &corev1.ObjectReference{Kind: "Pod", Name: pod},
+	}
+}
+
+func addresses(list *BackendList) []string {
+	var result []string
+	for _, backend := range list.GetAll() {
+		result = append(result, backend.Address)
+	}
+	return result
+}
+
+func TestServiceSlices_MergesSlices(t *testing.T) {
+	list := NewBackendList()
+	slices := newServiceSlices("backend", list, Options{})
+
+	slices.update(endpointSlice("backend-b", "backend", endpoint("10.0.0.3", "pod-3", true)))
+	slices.update(endpointSlice("backend-a", "backend",
+		endpoint("10.0.0.1", "pod-1", true),
+		endpoint("10.0.0.2", "pod-2", false),
+	))
+	slices.update(endpointSlice("other-a", "other", endpoint("10.0.1.1", "other-1", true)))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.3"}, addresses(list))
+	assert.Equal(t, "pod-1", list.GetAll()[0].PodName)
+
+	// An endpoint moving between slices is only listed once.
+	slices.update(endpointSlice("backend-b", "backend",
+		endpoint("10.0.0.3", "pod-3", true),
+		endpoint("10.0.0.1", "pod-1", true),
+	))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.3"}, addresses(list))
+
+	slices.remove(endpointSlice("backend-a", "backend"))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.3"}, addresses(list))
+}
+
+func TestServiceSlices_Debounce(t *testing.T) {
+	list := NewBackendList()
+	var replaced int
+	list.OnChange(func(added, removed []Backend) { replaced++ })
+	slices := newServiceSlices("backend", list, Options{Debounce: 50 * time.Millisecond})
+
+	for i := 0; i < 10; i++ {
+		slices.update(endpointSlice(fmt.Sprintf("backend-%d", i), "backend", endpoint(fmt.Sprintf("10.0.0.%d", i), "pod", true)))
+	}
+	assert.Empty(t, list.GetAll())
+
+	assert.Eventually(t, func() bool { return len(list.GetAll()) == 10 }, time.Second, 10*time.Millisecond)
+	slices.mu.Lock()
+	defer slices.mu.Unlock()
+	assert.Equal(t, 1, replaced)
+}
+
+func TestSliceBackends_SkipsDeletedPods(t *testing.T) {
+	pods := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	deleted := metav1.Now()
+	pods.Add(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod-1"}})
+	pods.Add(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod-2", DeletionTimestamp: &deleted}})
+	resolver := &PodResolver{pods: map[string]listersv1.PodLister{"": listersv1.NewPodLister(pods)}}
+	slice := endpointSlice("backend-a", "backend",
+		endpoint("10.0.0.1", "pod-1", true),
+		endpoint("10.0.0.2", "pod-2", true),
+	)
+
+	backends := sliceBackends(slice, Options{Pods: resolver})
+	assert.Len(t, backends, 1)
+	assert.Equal(t, "pod-1", backends[0].PodName)
+}
+
+func TestStatefulSetOrdinal(t *testing.T) {
+	hostname := "db-2"
+	headless := endpoint("10.0.0.2", "db-2", true)
+	headless.Hostname = &hostname
+	ordinal, ok := statefulSetOrdinal(headless, "db-2", nil)
+	assert.True(t, ok)
+	assert.Equal(t, 2, ordinal)
+
+	_, ok = statefulSetOrdinal(endpoint("10.0.0.3", "web-12345", true), "web-12345", nil)
+	assert.False(t, ok)
+
+	owned := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:            "db-7",
+		OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "db", Controller: &[]bool{true}[0]}},
+	}}
+	ordinal, ok = statefulSetOrdinal(endpoint("10.0.0.7", "db-7", true), "db-7", owned)
+	assert.True(t, ok)
+	assert.Equal(t, 7, ordinal)
+
+	indexed := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "db-x", Labels: map[string]string{"apps.kubernetes.io/pod-index": "4"}}}
+	ordinal, ok = statefulSetOrdinal(endpoint("10.0.0.4", "db-x", true), "db-x", indexed)
+	assert.True(t, ok)
+	assert.Equal(t, 4, ordinal)
+
+	deployment := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-12345"}}
+	_, ok = statefulSetOrdinal(endpoint("10.0.0.5", "web-12345", true), "web-12345", deployment)
+	assert.False(t, ok)
+}
+
+func TestSliceBackends_FQDN(t *testing.T) {
+	slice := endpointSlice("backend-a", "backend", discoveryv1.Endpoint{Addresses: []string{"legacy.example.com"}})
+	slice.AddressType = discoveryv1.AddressTypeFQDN
+
+	backends := sliceBackends(slice, Options{})
+	assert.Len(t, backends, 1)
+	assert.Equal(t, "legacy.example.com", backends[0].Address)
+	assert.Equal(t, "legacy.example.com", backends[0].PodName)
+}
+
+func TestSliceBackends_Conditions(t *testing.T) {
+	terminating := endpoint("10.0.0.3", "pod-3", false)
+	stopping := true
+	terminating.Conditions.Terminating = &stopping
+	unset := endpoint("10.0.0.4", "pod-4", true)
+	unset.Conditions = discoveryv1.EndpointConditions{}
+	slice := endpointSlice("backend-a", "backend",
+		endpoint("10.0.0.1", "pod-1", true),
+		endpoint("10.0.0.2", "pod-2", false),
+		terminating,
+		unset,
+	)
+
+	list := NewBackendList()
+	list.Replace(sliceBackends(slice, Options{}))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.4"}, addresses(list))
+
+	list.Replace(sliceBackends(slice, Options{IncludeNotReady: true}))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.4"}, addresses(list))
+}
+
+func TestSelectedSlices_MatchesLabels(t *testing.T) {
+	list := NewBackendList()
+	selector, err := labels.Parse("app=api,tier=v2")
+	assert.NoError(t, err)
+	slices := newSelectedSlices(selector, list, Options{})
+
+	v2 := endpointSlice("api-v2-a", "api-v2", endpoint("10.0.0.1", "pod-1", true))
+	v2.Labels["app"], v2.Labels["tier"] = "api", "v2"
+	canary := endpointSlice("api-canary-a", "api-canary", endpoint("10.0.0.2", "pod-2", true))
+	canary.Labels["app"], canary.Labels["tier"] = "api", "v2"
+	v1 := endpointSlice("api-v1-a", "api-v1", endpoint("10.0.0.3", "pod-3", true))
+	v1.Labels["app"], v1.Labels["tier"] = "api", "v1"
+	slices.update(v2)
+	slices.update(canary)
+	slices.update(v1)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, addresses(list))
+
+	// A service relabelled out of the selector leaves the list.
+	canary.Labels["tier"] = "v3"
+	slices.update(canary)
+	assert.Equal(t, []string{"10.0.0.1"}, addresses(list))
+}
+
+func TestSliceBackends_NamedPort(t *testing.T) {
+	http, metrics := "http", "metrics"
+	httpPort, metricsPort := int32(8081), int32(9090)
+	slice := endpointSlice("api-1", "api", endpoint("10.0.0.1", "api-1", true))
+	slice.Ports = []discoveryv1.EndpointPort{
+		{Name: &metrics, Port: &metricsPort},
+		{Name: &http, Port: &httpPort},
+	}
+
+	backends := sliceBackends(slice, Options{PortName: "http"})
+	assert.Equal(t, 8081, backends[0].Port)
+	assert.Equal(t, "10.0.0.1:8081", backends[0].HostPort(8080))
+
+	assert.Equal(t, 0, sliceBackends(slice, Options{})[0].Port)
+	assert.Equal(t, 0, sliceBackends(slice, Options{PortName: "grpc"})[0].Port)
+}
+
+func TestEndpointZone(t *testing.T) {
+	zone := "eu-west-1a"
+	withZone := endpoint("10.0.0.1", "api-1", true)
+	withZone.Zone = &zone
+	assert.Equal(t, "eu-west-1a", endpointZone(withZone, "node-1", Options{}))
+
+	hinted := endpoint("10.0.0.2", "api-2", true)
+	hinted.Hints = &discoveryv1.EndpointHints{ForZones: []discoveryv1.ForZone{{Name: "eu-west-1b"}}}
+	assert.Equal(t, "eu-west-1b", endpointZone(hinted, "node-2", Options{}))
+
+	hinted.Hints.ForZones = append(hinted.Hints.ForZones, discoveryv1.ForZone{Name: "eu-west-1c"})
+	assert.Equal(t, "", endpointZone(hinted, "node-2", Options{}))
+}
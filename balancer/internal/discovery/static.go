@@ -0,0 +1,18 @@
+package discovery
+
+import "pkg/logging"
+
+// StaticBackends returns a list holding addresses, for running outside
+// Kubernetes. Entries are host:port, or a host reached on the backend port.
+// Each backend's PodName is its address, so weights can name it. The list
+// never changes.
+func StaticBackends(addresses []string) *BackendList {
+	backends := make([]Backend, 0, len(addresses))
+	for _, address := range addresses {
+		backends = append(backends, Backend{Address: address, PodName: address})
+	}
+	logging.Debug("Using %d static backends", len(backends))
+	backendList := NewBackendList()
+	backendList.Replace(backends)
+	return backendList
+}
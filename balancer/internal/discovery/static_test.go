@@ -0,0 +1,23 @@
+package discovery
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticBackends(t *testing.T) {
+	list := StaticBackends([]string{"127.0.0.1:8081", "127.0.0.1:8082"})
+
+	backends := list.GetAll()
+	assert.Len(t, backends, 2)
+	assert.Equal(t, "127.0.0.1:8082", backends[1].PodName)
+}
+
+func TestBackend_HostPort(t *testing.T) {
+	assert.Equal(t, "10.0.0.1:8080", Backend{Address: "10.0.0.1"}.HostPort(8080))
+	assert.Equal(t, "[fe80::1]:8080", Backend{Address: "fe80::1"}.HostPort(8080))
+	assert.Equal(t, "backend.local:9000", Backend{Address: "backend.local:9000"}.HostPort(8080))
+	assert.Equal(t, "[::1]:9000", Backend{Address: "[::1]:9000"}.HostPort(8080))
+	assert.Equal(t, "10.0.0.1:9000", Backend{Address: "10.0.0.1", Port: 9000}.HostPort(8080))
+}
@@ -0,0 +1,41 @@
+package discovery
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+
+	"pkg/logging"
+)
+
+// ZoneLabel is the well known node label carrying the node's zone.
+const ZoneLabel = "topology.kubernetes.io/zone"
+
+// ZoneResolver looks up the zone of a node from a Node informer. Nodes are
+// cluster scoped, so the balancer's service account needs a ClusterRole
+// that can list and watch them.
+type ZoneResolver struct {
+	nodes listersv1.NodeLister
+}
+
+// NewZoneResolver registers a Node informer on cluster. Call it before
+// cluster.Start, which syncs nodes before the first slices are read.
+func NewZoneResolver(cluster *Cluster) *ZoneResolver {
+	nodes := cluster.earlyFactory(metav1.NamespaceAll).Core().V1().Nodes()
+	// Asking for the informer registers it with the factory.
+	countWatchErrors(nodes.Informer())
+	return &ZoneResolver{nodes: nodes.Lister()}
+}
+
+// Zone returns the zone label of nodeName, or "" when it is unknown. A nil
+// resolver always returns "".
+func (zr *ZoneResolver) Zone(nodeName string) string {
+	if zr == nil || nodeName == "" {
+		return ""
+	}
+	node, err := zr.nodes.Get(nodeName)
+	if err != nil {
+		logging.Debug("Unable to look up node %s: %v", nodeName, err)
+		return ""
+	}
+	return node.Labels[ZoneLabel]
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"balancer/internal/discovery"
+	"pkg/logging"
+)
+
+// Access log formats.
+const (
+	// AccessLogCommon is the Common Log Format.
+	AccessLogCommon = "common"
+	// AccessLogCombined is the Common Log Format with the referer and user
+	// agent.
+	AccessLogCombined = "combined"
+	// AccessLogJSON writes one JSON object per request.
+	AccessLogJSON = "json"
+)
+
+// clfTime is the layout of timestamps in the Common Log Format.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLog writes a line for every request the balancer proxies. Common and
+// combined lines end with the pod that answered, the time spent waiting on
+// backends and the number of retries, in that order:
+//
+//	10.0.0.9 - - [14/Oct/2026:10:00:00 +0000] "GET /api HTTP/1.1" 200 512 "api-0" 12ms 0
+type AccessLog struct {
+	format string
+	mu     sync.Mutex
+	w      io.Writer
+}
+
+// NewAccessLog returns an access log writing lines in format, one of
+// AccessLogCommon, AccessLogCombined or AccessLogJSON, to w.
+func NewAccessLog(format string, w io.Writer) *AccessLog {
+	return &AccessLog{format: format, w: w}
+}
+
+// accessWriter records the response to a request, and where it went, for
+// the access log and the request's span.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	// backend is the last backend tried, attempts how many were.
+	backend  discovery.Backend
+	attempts int
+	// upstream is the time spent in attempts.
+	upstream time.Duration
+}
+
+func (aw *accessWriter) WriteHeader(code int) {
+	// Informational responses come before the final one.
+	if aw.status == 0 && code >= http.StatusOK {
+		aw.status = code
+	}
+	aw.ResponseWriter.WriteHeader(code)
+}
+
+func (aw *accessWriter) Write(b []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err := aw.ResponseWriter.Write(b)
+	aw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the flusher and hijacker of
+// the connection, for streamed responses and websockets.
+func (aw *accessWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+// observe records an attempt on backend, if w is recording for the access
+// log.
+func observe(w http.ResponseWriter, backend discovery.Backend, latency time.Duration) {
+	if aw, ok := w.(*accessWriter); ok {
+		aw.backend = backend
+		aw.attempts++
+		aw.upstream += latency
+	}
+}
+
+// accessEntry is a line of the access log in AccessLogJSON.
+type accessEntry struct {
+	Time          string  `json:"time"`
+	RemoteAddr    string  `json:"remote_addr"`
+	User          string  `json:"user,omitempty"`
+	Method        string  `json:"method"`
+	Host          string  `json:"host"`
+	URI           string  `json:"uri"`
+	Proto         string  `json:"proto"`
+	Status        int     `json:"status"`
+	BytesSent     int64   `json:"bytes_sent"`
+	BytesReceived int64   `json:"bytes_received"`
+	Referer       string  `json:"referer,omitempty"`
+	UserAgent     string  `json:"user_agent,omitempty"`
+	Backend       string  `json:"backend,omitempty"`
+	Pod           string  `json:"pod,omitempty"`
+	DurationMS    float64 `json:"duration_ms"`
+	UpstreamMS    float64 `json:"upstream_ms"`
+	Retries       int     `json:"retries"`
+}
+
+// log writes the line of r, answered through aw, which arrived at start.
+func (al *AccessLog) log(r *http.Request, aw *accessWriter, start time.Time) {
+	client := clientAddress(r)
+	user := ""
+	if name, _, ok := r.BasicAuth(); ok {
+		user = name
+	}
+	retries := max(aw.attempts-1, 0)
+	var line []byte
+	if al.format == AccessLogJSON {
+		received := r.ContentLength
+		if received < 0 {
+			received = 0
+		}
+		var err error
+		line, err = json.Marshal(accessEntry{
+			Time:          start.Format(time.RFC3339Nano),
+			RemoteAddr:    client,
+			User:          user,
+			Method:        r.Method,
+			Host:          r.Host,
+			URI:           r.RequestURI,
+			Proto:         r.Proto,
+			Status:        aw.status,
+			BytesSent:     aw.bytes,
+			BytesReceived: received,
+			Referer:       r.Referer(),
+			UserAgent:     r.UserAgent(),
+			Backend:       aw.backend.Address,
+			Pod:           aw.backend.PodName,
+			DurationMS:    milliseconds(time.Since(start)),
+			UpstreamMS:    milliseconds(aw.upstream),
+			Retries:       retries,
+		})
+		if err != nil {
+			logging.Error("Failed to encode the access log entry: %v", err)
+			return
+		}
+	} else {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s - %s [%s] %s %d %s", client, orDash(user), start.Format(clfTime),
+			quote(r.Method+" "+r.RequestURI+" "+r.Proto), aw.status, clfBytes(aw.bytes))
+		if al.format == AccessLogCombined {
+			fmt.Fprintf(&b, " %s %s", quote(r.Referer()), quote(r.UserAgent()))
+		}
+		fmt.Fprintf(&b, " %s %dms %d", quote(aw.backend.PodName), aw.upstream.Milliseconds(), retries)
+		line = []byte(b.String())
+	}
+	line = append(line, '\n')
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if _, err := al.w.Write(line); err != nil {
+		logging.Warning("Failed to write the access log: %v", err)
+	}
+}
+
+// clientAddress returns the IP of the client that sent r.
+func clientAddress(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// orDash returns s, or "-" for a field that is not there.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	quoted := strconv.Quote(s)
+	return quoted[1 : len(quoted)-1]
+}
+
+// quote returns s as a quoted field, escaping what a client could use to
+// forge a line, or "-" when it is empty.
+func quote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// clfBytes returns a body size the Common Log Format way, "-" for none.
+func clfBytes(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
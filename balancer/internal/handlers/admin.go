@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"balancer/internal/metrics"
+
+	"pkg/logging"
+)
+
+// StrategyRequest is the body accepted by POST /admin/strategy.
+type StrategyRequest struct {
+	LoadbalancerMethod string `json:"loadbalancermethod"`
+}
+
+// StrategyResponse reports the strategy currently in use.
+type StrategyResponse struct {
+	LoadbalancerMethod string `json:"loadbalancermethod"`
+}
+
+// CanaryRequest is the body accepted by POST /admin/canary.
+type CanaryRequest struct {
+	PathPrefix string `json:"pathprefix"`
+	// Host picks the route of that host, empty for a route without one.
+	Host    string `json:"host,omitempty"`
+	Percent int    `json:"percent"`
+}
+
+// CanaryResponse reports the canary share of a route.
+type CanaryResponse struct {
+	PathPrefix  string `json:"pathprefix"`
+	Host        string `json:"host,omitempty"`
+	BackendName string `json:"backendname"`
+	Percent     int    `json:"percent"`
+}
+
+// BlueGreenRequest is the body accepted by POST /admin/bluegreen.
+type BlueGreenRequest struct {
+	PathPrefix string `json:"pathprefix"`
+	// Host picks the route of that host, empty for a route without one.
+	Host   string `json:"host,omitempty"`
+	Active string `json:"active"`
+}
+
+// BlueGreenResponse reports which pool of a route is serving.
+type BlueGreenResponse struct {
+	PathPrefix string `json:"pathprefix"`
+	Host       string `json:"host,omitempty"`
+	Active     string `json:"active"`
+	Blue       string `json:"blue"`
+	Green      string `json:"green"`
+}
+
+// RegisterAdmin adds the admin endpoints to mux. They should be served on a
+// separate port that is not exposed to clients. /status, /ready, /metrics
+// and /backends are included because the tcp mode has no other place to
+// serve them. /config is only served here.
+func (bh *BalanceHandler) RegisterAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("GET /status", bh.status)
+	mux.HandleFunc("GET /ready", bh.ready)
+	mux.Handle("GET /metrics", metrics.Default)
+	mux.HandleFunc("GET /backends", bh.backends)
+	mux.HandleFunc("GET /admin/strategy", bh.getStrategy)
+	mux.HandleFunc("POST /admin/strategy", bh.setStrategy)
+	mux.HandleFunc("GET /admin/canary", bh.getCanaries)
+	mux.HandleFunc("POST /admin/canary", bh.setCanary)
+	mux.HandleFunc("GET /admin/bluegreen", bh.getBlueGreen)
+	mux.HandleFunc("POST /admin/bluegreen", bh.setBlueGreen)
+	mux.HandleFunc("GET /config", bh.config)
+}
+
+// config answers with EffectiveConfig, so operators can see what the running
+// balancer loaded.
+func (bh *BalanceHandler) config(w http.ResponseWriter, r *http.Request) {
+	if bh.EffectiveConfig == nil {
+		http.Error(w, "no config to show", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, bh.EffectiveConfig)
+}
+
+func (bh *BalanceHandler) getStrategy(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, StrategyResponse{LoadbalancerMethod: bh.LoadbalancerMethod()})
+}
+
+func (bh *BalanceHandler) setStrategy(w http.ResponseWriter, r *http.Request) {
+	var req StrategyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := bh.SetStrategy(req.LoadbalancerMethod); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, StrategyResponse{LoadbalancerMethod: bh.LoadbalancerMethod()})
+}
+
+func (bh *BalanceHandler) getCanaries(w http.ResponseWriter, r *http.Request) {
+	canaries := []CanaryResponse{}
+	for _, route := range bh.Routes {
+		if route.Canary != nil {
+			canaries = append(canaries, canaryResponse(route))
+		}
+	}
+	writeJSON(w, http.StatusOK, canaries)
+}
+
+func (bh *BalanceHandler) setCanary(w http.ResponseWriter, r *http.Request) {
+	var req CanaryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	route := bh.route(req.Host, req.PathPrefix)
+	if route == nil || route.Canary == nil {
+		http.Error(w, fmt.Sprintf("no canary on route %s", req.PathPrefix), http.StatusNotFound)
+		return
+	}
+	if err := route.Canary.SetPercent(req.Percent); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logging.Info("Route %s sends %d%% of requests to %s", route.PathPrefix, req.Percent, route.Canary.Pool.BackendName)
+	writeJSON(w, http.StatusOK, canaryResponse(*route))
+}
+
+func canaryResponse(route Route) CanaryResponse {
+	return CanaryResponse{
+		PathPrefix:  route.PathPrefix,
+		Host:        route.Host,
+		BackendName: route.Canary.Pool.BackendName,
+		Percent:     route.Canary.Percent(),
+	}
+}
+
+func (bh *BalanceHandler) getBlueGreen(w http.ResponseWriter, r *http.Request) {
+	switches := []BlueGreenResponse{}
+	for _, route := range bh.Routes {
+		if route.BlueGreen != nil {
+			switches = append(switches, blueGreenResponse(route))
+		}
+	}
+	writeJSON(w, http.StatusOK, switches)
+}
+
+func (bh *BalanceHandler) setBlueGreen(w http.ResponseWriter, r *http.Request) {
+	var req BlueGreenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	route := bh.route(req.Host, req.PathPrefix)
+	if route == nil || route.BlueGreen == nil {
+		http.Error(w, fmt.Sprintf("no blue/green pools on route %s", req.PathPrefix), http.StatusNotFound)
+		return
+	}
+	previous := route.BlueGreen.Active()
+	if err := route.BlueGreen.SetActive(req.Active); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logging.Info("Route %s switched from %s to %s", route.PathPrefix, previous, req.Active)
+	writeJSON(w, http.StatusOK, blueGreenResponse(*route))
+}
+
+func blueGreenResponse(route Route) BlueGreenResponse {
+	return BlueGreenResponse{
+		PathPrefix: route.PathPrefix,
+		Host:       route.Host,
+		Active:     route.BlueGreen.Active(),
+		Blue:       route.BlueGreen.Blue.BackendName,
+		Green:      route.BlueGreen.Green.BackendName,
+	}
+}
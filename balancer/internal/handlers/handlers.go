@@ -1,16 +1,24 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
-	"sync"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"balancer/internal/discovery"
+	"balancer/internal/healthcheck"
+	"balancer/internal/metrics"
+	"balancer/internal/proxy"
 	"balancer/internal/strategy"
 
 	"pkg/logging"
@@ -23,8 +31,106 @@ type StatusResponse struct {
 	BackendPort        int    `json:"backendport"`
 	LoadbalancerPort   int    `json:"loadbalancerport"`
 	LoadbalancerMethod string `json:"loadbalancermethod"`
-	ConnectedHosts     int    `json:"connectedhosts"`
-	StartTime          string `json:"starttime"`
+	// ConnectedHosts counts the backends with a request or connection open
+	// to them right now.
+	ConnectedHosts int    `json:"connectedhosts"`
+	StartTime      string `json:"starttime"`
+	// Inflight and QueueLength count the requests holding and waiting for
+	// an in-flight slot, summed over the handler's and routes' limits.
+	Inflight    int `json:"inflight"`
+	QueueLength int `json:"queuelength"`
+	// Backends breaks the traffic down by backend, sorted by address. It
+	// lists the backends discovered now and any sent traffic before that
+	// the tracker has not forgotten, including those of route pools.
+	Backends []BackendTraffic `json:"backends"`
+}
+
+// BackendTraffic is the traffic one backend in /status has had.
+type BackendTraffic struct {
+	Address string `json:"address"`
+	PodName string `json:"podname,omitempty"`
+	// Connections are the requests, or in tcp and udp mode the connections
+	// and sessions, open to the backend now.
+	Connections int `json:"connections"`
+	// Requests counts those sent to the backend since the balancer started.
+	Requests uint64 `json:"requests"`
+}
+
+// Route sends the requests it matches through their own strategy. A route
+// without a LoadbalancerMethod follows the handler's current strategy, and
+// one without a Proxy uses the handler's.
+type Route struct {
+	PathPrefix string
+	// Host narrows the route to requests for this host, or for any of its
+	// subdomains when it starts with "*.". Empty matches every host.
+	Host string
+	// MatchHeaders narrows the route to requests with these header values.
+	// An empty value only needs the header to be there.
+	MatchHeaders map[string]string
+	// Pool serves the route's requests instead of the handler's backends.
+	Pool               *BalanceHandler
+	LoadbalancerMethod string
+	Strategy           strategy.Strategy
+	Proxy              *proxy.Proxy
+	// Headers are applied after the handler's Headers.
+	Headers *proxy.HeaderRules
+	// Rewrite changes the path sent to backends. Strategies still see the
+	// original path.
+	Rewrite *proxy.PathRewrite
+	// MaxBodySize replaces the handler's limit when set.
+	MaxBodySize int64
+	// BufferBody buffers request bodies on this route even when the
+	// handler streams them.
+	BufferBody bool
+	// Limit caps the requests in flight on this route, on top of the
+	// handler's Limit.
+	Limit *Limiter
+	// Mirror copies a share of the route's requests to a shadow pool.
+	Mirror *Mirror
+	// Canary sends a share of the route's requests to another pool.
+	Canary *Canary
+	// BlueGreen sends the route's requests to the active one of two pools
+	// instead of the handler's backends.
+	BlueGreen *BlueGreen
+	// AccessLog logs the route's requests instead of the handler's
+	// AccessLog, and NoAccessLog leaves them out of it.
+	AccessLog   *AccessLog
+	NoAccessLog bool
+}
+
+// activeStrategy pairs a strategy with the method name it was built from so
+// both can be swapped together.
+type activeStrategy struct {
+	method   string
+	strategy strategy.Strategy
+}
+
+// BackendStatus is one backend in /backends.
+type BackendStatus struct {
+	Address  string `json:"address"`
+	PodName  string `json:"podname"`
+	Zone     string `json:"zone,omitempty"`
+	Priority int    `json:"priority"`
+	// Healthy is false while health checks keep the backend out.
+	Healthy bool `json:"healthy"`
+	// LastCheck is when the last health check came back, in RFC 3339.
+	LastCheck           string `json:"lastcheck,omitempty"`
+	ConsecutiveFailures int    `json:"consecutivefailures"`
+	LastError           string `json:"lasterror,omitempty"`
+	// Ejected is true while outlier detection keeps the backend out.
+	Ejected bool `json:"ejected"`
+	// InRotation is true when the strategy may pick the backend.
+	InRotation bool `json:"inrotation"`
+	// Latency is how long the backend took to answer over the last minute.
+	// Unset when it answered nothing.
+	Latency *Latency `json:"latency,omitempty"`
+}
+
+// Latency holds the median and tail latency of a backend in milliseconds.
+type Latency struct {
+	P50 float64 `json:"p50ms"`
+	P95 float64 `json:"p95ms"`
+	P99 float64 `json:"p99ms"`
 }
 
 type NextResponse struct {
@@ -32,49 +138,343 @@ type NextResponse struct {
 }
 
 type BalanceHandler struct {
-	BackendName        string
-	BackendPort        int
-	LoadbalancerPort   int
-	LoadbalancerMethod string
-	StartTime          string
-	Backends           *discovery.BackendList
-	Requests           int
-	Strategy           strategy.Strategy
-	Proxy              *httputil.ReverseProxy
-	mu                 sync.RWMutex
+	BackendName      string
+	BackendPort      int
+	LoadbalancerPort int
+	StartTime        string
+	Backends         *discovery.BackendList
+	BackupBackends   *discovery.BackendList
+	// Routes are kept most specific first so the first match wins, see
+	// AddRoute.
+	Routes []Route
+	Proxy  *proxy.Proxy
+	// Headers are applied to every proxied request and response.
+	Headers *proxy.HeaderRules
+	// MaxBodySize limits request bodies in bytes. Zero means no limit.
+	MaxBodySize int64
+	// BufferBody reads request bodies fully before forwarding them.
+	BufferBody bool
+	// Retry sends failed requests to another backend. Nil turns retries off.
+	Retry *proxy.RetryPolicy
+	// Outliers ejects backends that keep failing. Nil turns ejection off.
+	Outliers *strategy.OutlierDetector
+	// Health and BackupHealth probe the backends behind Backends and
+	// BackupBackends, and are told how requests to them went for passive
+	// checks. Nil when health checks are off.
+	Health       *healthcheck.Checker
+	BackupHealth *healthcheck.Checker
+	// Limit caps the requests in flight across the handler. Nil means no
+	// limit.
+	Limit *Limiter
+	// QueueTimeout is how long a request may wait for a slot in Limit and
+	// its route's Limit together. Defaults to one second.
+	QueueTimeout time.Duration
+	// EffectiveConfig is the config the handler was built from, with the
+	// settings of every source applied, served as JSON by GET /config on
+	// the admin port. It must hold no secrets. Nil answers 404.
+	EffectiveConfig any
+	// AccessLog gets a line for every proxied request when set.
+	AccessLog *AccessLog
+
+	strategyOptions strategy.Options
+	active          atomic.Pointer[activeStrategy]
+	// notReady is set while discovery has yet to sync, see SetReady.
+	notReady atomic.Bool
 }
 
+// ErrNotReady is returned for traffic that arrives before discovery has
+// synced.
+var ErrNotReady = errors.New("backends are still being discovered")
+
 func NewBalanceHandler(
 	backendName string,
 	backendPort int,
 	loadbalancerPort int,
 	loadbalancerMethod string,
+	strategyOptions strategy.Options,
 	backends *discovery.BackendList,
+	backupBackends *discovery.BackendList,
 ) *BalanceHandler {
+	// One affinity table is shared by every strategy the handler builds, so
+	// sticky clients stay put when the strategy is switched at runtime.
+	if strategyOptions.AffinityTTL > 0 && strategyOptions.AffinityTable == nil {
+		strategyOptions.AffinityTable = strategy.NewAffinityTable(strategyOptions.AffinityTTL, strategyOptions.AffinityMaxEntries)
+	}
+	if strategyOptions.Inflight == nil {
+		strategyOptions.Inflight = strategy.NewInflightTracker()
+	}
 	bh := &BalanceHandler{
-		BackendName:        backendName,
-		BackendPort:        backendPort,
-		LoadbalancerPort:   loadbalancerPort,
-		LoadbalancerMethod: loadbalancerMethod,
-		StartTime:          time.Now().Format(time.RFC3339),
-		Backends:           backends,
-		Strategy:           strategy.NewStrategy(loadbalancerMethod),
-	}
-	bh.createProxy()
+		BackendName:      backendName,
+		BackendPort:      backendPort,
+		LoadbalancerPort: loadbalancerPort,
+		StartTime:        time.Now().Format(time.RFC3339),
+		Backends:         backends,
+		BackupBackends:   backupBackends,
+		strategyOptions:  strategyOptions,
+	}
+	bh.active.Store(&activeStrategy{
+		method:   loadbalancerMethod,
+		strategy: strategy.NewStrategy(loadbalancerMethod, strategyOptions),
+	})
+	bh.Proxy = proxy.New(backendPort)
 	return bh
 }
 
-func (bh *BalanceHandler) selectBackend(requests int) discovery.Backend {
-	return bh.Strategy.Next(bh.Backends.GetAll(), requests)
+// SetReady marks whether discovery has synced. A handler starts ready. While
+// it is not, /ready answers 503 and so does every request it would proxy,
+// rather than balancing over a list that is still filling up.
+func (bh *BalanceHandler) SetReady(ready bool) {
+	bh.notReady.Store(!ready)
+}
+
+// Ready reports whether the handler takes traffic, see SetReady.
+func (bh *BalanceHandler) Ready() bool {
+	return !bh.notReady.Load()
+}
+
+// Inflight returns the tracker counting outstanding requests per backend.
+func (bh *BalanceHandler) Inflight() *strategy.InflightTracker {
+	return bh.strategyOptions.Inflight
+}
+
+// Affinity returns the table of sticky clients shared by the handler's
+// strategies, or nil when affinity is off.
+func (bh *BalanceHandler) Affinity() *strategy.AffinityTable {
+	return bh.strategyOptions.AffinityTable
+}
+
+// Strategy returns the strategy currently used for requests that do not
+// match a route with its own method.
+func (bh *BalanceHandler) Strategy() strategy.Strategy {
+	return bh.active.Load().strategy
+}
+
+// LoadbalancerMethod returns the name of the current strategy.
+func (bh *BalanceHandler) LoadbalancerMethod() string {
+	return bh.active.Load().method
+}
+
+// SetStrategy atomically replaces the current strategy with a fresh one
+// built from method. Requests already in flight finish against the old
+// strategy. Affinity entries carry over because the table is shared.
+func (bh *BalanceHandler) SetStrategy(method string) error {
+	if !slices.Contains(strategy.Names(), method) {
+		return fmt.Errorf("unknown strategy %s, set one of %v", method, strategy.Names())
+	}
+	old := bh.active.Swap(&activeStrategy{
+		method:   method,
+		strategy: strategy.NewStrategy(method, bh.strategyOptions),
+	})
+	if stopper, ok := old.strategy.(strategy.Stopper); ok {
+		stopper.Stop()
+	}
+	logging.Info("Switched strategy from %s to %s", old.method, method)
+	return nil
+}
+
+// Stop stops the background work of the handler's strategies, those of its
+// routes and of their pools, once the handler has been replaced, and closes
+// the idle connections of their proxies.
+func (bh *BalanceHandler) Stop() {
+	stop := func(s strategy.Strategy) {
+		if stopper, ok := s.(strategy.Stopper); ok {
+			stopper.Stop()
+		}
+	}
+	stop(bh.Strategy())
+	if bh.Proxy != nil {
+		bh.Proxy.CloseIdleConnections()
+	}
+	for _, route := range bh.Routes {
+		stop(route.Strategy)
+		if route.Proxy != nil {
+			route.Proxy.CloseIdleConnections()
+		}
+	}
+	for _, pool := range bh.pools() {
+		pool.Stop()
+	}
+}
+
+// pools returns the handlers of the pools, mirrors, canaries and blue/green
+// pairs of bh's routes.
+func (bh *BalanceHandler) pools() []*BalanceHandler {
+	var pools []*BalanceHandler
+	for _, route := range bh.Routes {
+		if route.Pool != nil {
+			pools = append(pools, route.Pool)
+		}
+		if route.Mirror != nil {
+			pools = append(pools, route.Mirror.Pool)
+		}
+		if route.Canary != nil {
+			pools = append(pools, route.Canary.Pool)
+		}
+		if route.BlueGreen != nil {
+			pools = append(pools, route.BlueGreen.Blue, route.BlueGreen.Green)
+		}
+	}
+	return pools
+}
+
+// candidates lists every backend the strategy may choose from, with backup
+// backends marked by a higher Priority. Ejected outliers are left out, and
+// backends ramping back after failing health checks only sometimes make it.
+func (bh *BalanceHandler) candidates() []discovery.Backend {
+	backends := bh.Health.Ramp(bh.Backends.GetAll())
+	if bh.BackupBackends != nil {
+		backends = append(backends, discovery.WithPriority(bh.BackupHealth.Ramp(bh.BackupBackends.GetAll()), 1)...)
+	}
+	if bh.Outliers != nil {
+		backends = bh.Outliers.Filter(backends)
+	}
+	return backends
+}
+
+// AddRoute sends requests matching route through it. When the route names
+// a LoadbalancerMethod but has no Strategy, it gets its own instance of that
+// strategy. Routes with a Host are tried before those without, more specific
+// hosts first, then longer prefixes, then routes matching more headers.
+func (bh *BalanceHandler) AddRoute(route Route) {
+	if route.LoadbalancerMethod != "" && route.Strategy == nil {
+		route.Strategy = strategy.NewStrategy(route.LoadbalancerMethod, bh.strategyOptions)
+	}
+	bh.Routes = append(bh.Routes, route)
+	sort.SliceStable(bh.Routes, func(i, j int) bool {
+		a, b := bh.Routes[i], bh.Routes[j]
+		if hostRank(a.Host) != hostRank(b.Host) {
+			return hostRank(a.Host) > hostRank(b.Host)
+		}
+		if len(a.PathPrefix) != len(b.PathPrefix) {
+			return len(a.PathPrefix) > len(b.PathPrefix)
+		}
+		return len(a.MatchHeaders) > len(b.MatchHeaders)
+	})
+	logging.Info("Route %s%s uses %s", route.Host, route.PathPrefix, route.LoadbalancerMethod)
+}
+
+// hostRank orders route hosts from the most specific: exact hosts, then
+// wildcards by length, then no host.
+func hostRank(host string) int {
+	switch {
+	case host == "":
+		return 0
+	case strings.HasPrefix(host, "*."):
+		return len(host)
+	default:
+		return 1 << 16
+	}
+}
+
+// route returns the first route with exactly host and pathPrefix, or nil.
+func (bh *BalanceHandler) route(host, pathPrefix string) *Route {
+	for i := range bh.Routes {
+		if bh.Routes[i].Host == host && bh.Routes[i].PathPrefix == pathPrefix {
+			return &bh.Routes[i]
+		}
+	}
+	return nil
+}
+
+// routeFor returns the most specific route matching the request, or nil.
+func (bh *BalanceHandler) routeFor(r *http.Request) *Route {
+	for i := range bh.Routes {
+		if bh.Routes[i].matches(r) {
+			return &bh.Routes[i]
+		}
+	}
+	return nil
+}
+
+// matches reports whether r is for the route's host, under its path prefix
+// and has its headers.
+func (route *Route) matches(r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, route.PathPrefix) {
+		return false
+	}
+	if route.Host != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		if suffix, ok := strings.CutPrefix(route.Host, "*"); ok {
+			if !strings.HasSuffix(host, suffix) || len(host) == len(suffix) {
+				return false
+			}
+		} else if host != route.Host {
+			return false
+		}
+	}
+	for name, value := range route.MatchHeaders {
+		values, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (value != "" && !slices.Contains(values, value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// strategyFor returns the strategy of the longest route matching the
+// request path, or the current strategy.
+func (bh *BalanceHandler) strategyFor(r *http.Request) strategy.Strategy {
+	if route := bh.routeFor(r); route != nil && route.Strategy != nil {
+		return route.Strategy
+	}
+	return bh.Strategy()
+}
+
+// rulesFor returns the handler's header rules followed by those of the
+// longest route matching the request path, along with the route's path
+// rewrite and body settings, or nil when there is nothing to apply.
+func (bh *BalanceHandler) rulesFor(r *http.Request) *proxy.Rules {
+	rules := proxy.Rules{
+		MaxBodySize: bh.MaxBodySize,
+		BufferBody:  bh.BufferBody,
+	}
+	if bh.Headers != nil {
+		rules.Headers = append(rules.Headers, *bh.Headers)
+	}
+	if route := bh.routeFor(r); route != nil {
+		if route.Headers != nil {
+			rules.Headers = append(rules.Headers, *route.Headers)
+		}
+		rules.Path = route.Rewrite
+		if route.MaxBodySize > 0 {
+			rules.MaxBodySize = route.MaxBodySize
+		}
+		rules.BufferBody = rules.BufferBody || route.BufferBody
+	}
+	if len(rules.Headers) == 0 && rules.Path == nil && rules.MaxBodySize == 0 && !rules.BufferBody {
+		return nil
+	}
+	return &rules
 }
 
-func (bh BalanceHandler) Register(mux *http.ServeMux) {
+// proxyFor returns the proxy of the longest route matching the request
+// path, or the handler's proxy.
+func (bh *BalanceHandler) proxyFor(r *http.Request) *proxy.Proxy {
+	if route := bh.routeFor(r); route != nil && route.Proxy != nil {
+		return route.Proxy
+	}
+	return bh.Proxy
+}
+
+func (bh *BalanceHandler) selectBackend(s strategy.Strategy, r *http.Request) (discovery.Backend, error) {
+	return s.Next(r.Context(), r, bh.candidates())
+}
+
+func (bh *BalanceHandler) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/status", bh.status)
+	mux.HandleFunc("/ready", bh.ready)
+	mux.Handle("/metrics", metrics.Default)
+	mux.HandleFunc("/backends", bh.backends)
 	mux.HandleFunc("/next-backend", bh.nextBackend)
-	mux.Handle("/", bh.Proxy)
+	mux.HandleFunc("/", bh.proxy)
 }
 
-func getPodName() string {
+// GetPodName returns this balancer's pod name, falling back to the hostname.
+func GetPodName() string {
 	podname, ok := os.LookupEnv("POD_NAME")
 	if !ok {
 		hostname, err := os.Hostname()
@@ -87,13 +487,21 @@ func getPodName() string {
 	return podname
 }
 
+// nextBackend reports the backend the strategy picks for this request. The
+// pick counts as a real selection, so it advances round robin style
+// strategies just like a proxied request would.
 func (bh *BalanceHandler) nextBackend(w http.ResponseWriter, r *http.Request) {
-	bh.mu.RLock()
-	requests := bh.Requests
-	bh.mu.RUnlock()
-	backend := bh.selectBackend(requests)
+	if !bh.Ready() {
+		http.Error(w, ErrNotReady.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	backend, err := bh.selectBackend(bh.Strategy(), r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 
-	host := fmt.Sprintf("%s:%d", backend.Address, bh.BackendPort)
+	host := backend.HostPort(bh.BackendPort)
 
 	next := NextResponse{
 		NextHost: host,
@@ -101,31 +509,293 @@ func (bh *BalanceHandler) nextBackend(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, next)
 }
 
-func (bh *BalanceHandler) createProxy() {
-	bh.Proxy = &httputil.ReverseProxy{
-		Rewrite: func(pr *httputil.ProxyRequest) {
-			bh.mu.Lock()
-			bh.Requests++
-			requests := bh.Requests
-			bh.mu.Unlock()
-			backend := bh.selectBackend(requests)
-			host := fmt.Sprintf("%s:%d", backend.Address, bh.BackendPort)
-			url, err := url.Parse(fmt.Sprintf("http://%s", host))
-			if err != nil {
-				logging.Error("Failed to parse the url from %v", host)
-				//TODO do something since the next part of the code will fail if we dont break or exit
+// Acquire picks a backend for r and counts it as in flight until the
+// returned release func is called. It is used by the TCP and UDP modes, which
+// hold a backend for a whole connection rather than a single request.
+func (bh *BalanceHandler) Acquire(r *http.Request) (discovery.Backend, func(), error) {
+	if !bh.Ready() {
+		return discovery.Backend{}, nil, ErrNotReady
+	}
+	_, backend, release, err := bh.acquire(r)
+	return backend, release, err
+}
+
+func (bh *BalanceHandler) acquire(r *http.Request) (strategy.Strategy, discovery.Backend, func(), error) {
+	return bh.acquireFrom(r, bh.candidates())
+}
+
+// acquireFrom is acquire limited to candidates, so a retry can leave out the
+// backends that already failed.
+func (bh *BalanceHandler) acquireFrom(r *http.Request, candidates []discovery.Backend) (strategy.Strategy, discovery.Backend, func(), error) {
+	s := bh.strategyFor(r)
+	backend, err := s.Next(r.Context(), r, candidates)
+	if logging.Enabled(logging.DEBUG) {
+		bh.logPick(r, candidates, backend, err)
+	}
+	if err != nil {
+		return s, backend, nil, err
+	}
+
+	bh.strategyOptions.Inflight.Start(backend)
+	tracker, tracked := s.(strategy.ConnectionTracker)
+	if tracked {
+		tracker.Acquire(backend)
+	}
+	release := func() {
+		if tracked {
+			tracker.Release(backend)
+		}
+		bh.strategyOptions.Inflight.Done(backend)
+	}
+	return s, backend, release, nil
+}
+
+// logPick logs the strategy's decision for r among candidates, for debugging
+// why a request went where it did.
+func (bh *BalanceHandler) logPick(r *http.Request, candidates []discovery.Backend, backend discovery.Backend, err error) {
+	method := bh.LoadbalancerMethod()
+	if route := bh.routeFor(r); route != nil && route.Strategy != nil {
+		method = route.LoadbalancerMethod
+	}
+	addresses := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		addresses[i] = candidate.Address
+	}
+	fields := []any{"service", bh.BackendName, "method", r.Method, "path", r.URL.Path,
+		"strategy", method, "candidates", addresses}
+	if err != nil {
+		logging.Logger().Debug("No backend picked", append(fields, "error", err)...)
+		return
+	}
+	logging.Logger().Debug("Picked a backend", append(fields, "backend", backend.Address, "pod", backend.PodName)...)
+}
+
+// proxy picks a backend for the request and hands it to the reverse proxy.
+// When retries are on and the backend fails, the request is tried again on
+// one that has not been tried yet.
+func (bh *BalanceHandler) proxy(w http.ResponseWriter, r *http.Request) {
+	route := bh.routeFor(r)
+	r, span := startSpan(r, route)
+	accessLog := bh.accessLogFor(route)
+	if accessLog != nil || span.IsRecording() {
+		aw := &accessWriter{ResponseWriter: w}
+		w = aw
+		start := time.Now()
+		defer func() {
+			if aw.status == 0 {
+				aw.status = http.StatusOK
+			}
+			if accessLog != nil {
+				accessLog.log(r, aw, start)
+			}
+			endSpan(span, aw)
+		}()
+	} else {
+		defer span.End()
+	}
+	if !bh.Ready() {
+		http.Error(w, ErrNotReady.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	leave, ok := bh.admit(w, r)
+	if !ok {
+		return
+	}
+	defer leave()
+
+	if route != nil {
+		logging.Debug("Request for %s%s matched route %s%s", r.Host, r.URL.Path, route.Host, route.PathPrefix)
+	}
+	switch {
+	case route != nil && route.BlueGreen != nil:
+		route.BlueGreen.pool().forward(w, r)
+	case route != nil && route.Canary != nil && route.Canary.pick():
+		route.Canary.Pool.forward(w, r)
+	case route != nil && route.Pool != nil:
+		route.Pool.forward(w, r)
+	default:
+		bh.forward(w, r)
+	}
+	if route != nil && route.Mirror != nil {
+		route.Mirror.send(r)
+	}
+}
+
+// accessLogFor returns the access log of requests on route, which may be
+// nil, or nil when they are not logged.
+func (bh *BalanceHandler) accessLogFor(route *Route) *AccessLog {
+	switch {
+	case route == nil:
+		return bh.AccessLog
+	case route.NoAccessLog:
+		return nil
+	case route.AccessLog != nil:
+		return route.AccessLog
+	}
+	return bh.AccessLog
+}
+
+// forward sends an admitted request to a backend, retrying on another one
+// when the policy allows.
+func (bh *BalanceHandler) forward(w http.ResponseWriter, r *http.Request) {
+	rules := bh.rulesFor(r)
+	p := bh.proxyFor(r)
+	retries := bh.retriesFor(r, rules)
+	if bh.Retry != nil && bh.Retry.Budget != nil {
+		bh.Retry.Budget.Request()
+	}
+
+	candidates := bh.candidates()
+	for attempt := 0; ; attempt++ {
+		s, backend, release, err := bh.acquireFrom(r, candidates)
+		if err != nil {
+			logging.Warning("Unable to pick a backend for %s: %v", r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		candidates = slices.DeleteFunc(candidates, func(b discovery.Backend) bool {
+			return b.Address == backend.Address
+		})
+
+		retry := attempt < retries && len(candidates) > 0 &&
+			(bh.Retry.Budget == nil || bh.Retry.Budget.Allow())
+		if !bh.attempt(w, r, p, s, backend, release, rules, retry) {
+			return
+		}
+		if bh.Retry.Budget != nil {
+			bh.Retry.Budget.Retry()
+		}
+		if r.GetBody != nil {
+			if r.Body, err = r.GetBody(); err != nil {
+				logging.Error("Unable to replay the body of %s: %v", r.URL.Path, err)
+				w.WriteHeader(http.StatusBadGateway)
+				return
 			}
-			pr.SetURL(url)
-		},
-		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
-			logging.Error("Proxy error: %v", err)
-			w.WriteHeader(http.StatusBadGateway)
-		},
+		}
 	}
 }
 
+// shedRetryAfter is how long shed clients are told to wait, in seconds.
+const shedRetryAfter = "1"
+
+// defaultQueueTimeout bounds the wait for a slot when QueueTimeout is unset.
+const defaultQueueTimeout = time.Second
+
+// admit takes a slot from the handler's limit and the route's limit and
+// returns the func that frees them. When either is full and its queue is full
+// too, or the wait for a slot runs out, it answers 503 and returns false.
+func (bh *BalanceHandler) admit(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	var limits []*Limiter
+	if bh.Limit != nil {
+		limits = append(limits, bh.Limit)
+	}
+	if route := bh.routeFor(r); route != nil && route.Limit != nil {
+		limits = append(limits, route.Limit)
+	}
+	leave := func() {
+		for _, limit := range limits {
+			limit.Release()
+		}
+	}
+	if len(limits) == 0 {
+		return leave, true
+	}
+	timeout := bh.QueueTimeout
+	if timeout <= 0 {
+		timeout = defaultQueueTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	for i, limit := range limits {
+		if !limit.Acquire(ctx) {
+			limits = limits[:i]
+			leave()
+			shed(w, r)
+			return nil, false
+		}
+	}
+	return leave, true
+}
+
+// limits returns the handler's limit followed by those of its routes.
+func (bh *BalanceHandler) limits() []*Limiter {
+	var limits []*Limiter
+	if bh.Limit != nil {
+		limits = append(limits, bh.Limit)
+	}
+	for _, route := range bh.Routes {
+		if route.Limit != nil {
+			limits = append(limits, route.Limit)
+		}
+	}
+	return limits
+}
+
+func shed(w http.ResponseWriter, r *http.Request) {
+	logging.Warning("Too many requests in flight, shedding %s", r.URL.Path)
+	w.Header().Set("Retry-After", shedRetryAfter)
+	http.Error(w, "too many requests in flight", http.StatusServiceUnavailable)
+}
+
+// attempt sends one try of the request to backend, letting strategies that
+// track connections or latency know how it went. It reports whether the try
+// failed and was left unanswered so the caller can retry it.
+func (bh *BalanceHandler) attempt(w http.ResponseWriter, r *http.Request, p *proxy.Proxy, s strategy.Strategy, backend discovery.Backend, release func(), rules *proxy.Rules, retry bool) bool {
+	defer release()
+
+	traced, span := startAttempt(w, r, backend)
+	start := time.Now()
+	var result proxy.Result
+	if retry {
+		result = p.TryServe(w, traced, backend, rules, bh.Retry.Statuses)
+	} else {
+		result = p.Serve(w, traced, backend, rules)
+	}
+	// The proxy buffers the body on the request it is given. Hand it back,
+	// so retries and mirrors can send it again.
+	r.Body, r.GetBody, r.ContentLength = traced.Body, traced.GetBody, traced.ContentLength
+	if bh.Outliers != nil {
+		bh.Outliers.Observe(backend, result.BackendFailed())
+	}
+	for _, checker := range []*healthcheck.Checker{bh.Health, bh.BackupHealth} {
+		if checker != nil {
+			checker.Observe(backend, result.Status, result.Err)
+		}
+	}
+	latency := time.Since(start)
+	endAttempt(span, result)
+	observe(w, backend, latency)
+	logging.Logger().Debug("Proxied request", "method", r.Method, "path", r.URL.Path, "backend", backend.Address,
+		"pod", backend.PodName, "status", result.Status, "latency", latency, "retry", result.Retry)
+	// A websocket holds the backend for as long as it stays open, which says
+	// nothing about how fast the backend answers.
+	if proxy.IsWebSocket(r) {
+		return false
+	}
+	// A backend that could not be reached answered nothing to time.
+	if result.Status != 0 {
+		observeLatency(backend, latency)
+	}
+	if tracker, ok := s.(strategy.LatencyTracker); ok {
+		tracker.ObserveLatency(backend, latency)
+	}
+	return result.Retry
+}
+
+// retriesFor returns how many times r may be retried. Only requests whose
+// body can be sent again are retried, and never websockets.
+func (bh *BalanceHandler) retriesFor(r *http.Request, rules *proxy.Rules) int {
+	if bh.Retry == nil || proxy.IsWebSocket(r) {
+		return 0
+	}
+	if r.Body != nil && r.Body != http.NoBody && (rules == nil || !rules.BufferBody) {
+		return 0
+	}
+	return bh.Retry.Attempts
+}
+
 func (bh *BalanceHandler) status(w http.ResponseWriter, r *http.Request) {
-	podname := getPodName()
+	podname := GetPodName()
 	logging.Debug("Status requsted")
 	podip, ok := os.LookupEnv("POD_IP")
 	if !ok {
@@ -138,14 +808,125 @@ func (bh *BalanceHandler) status(w http.ResponseWriter, r *http.Request) {
 		BackendName:        bh.BackendName,
 		BackendPort:        bh.BackendPort,
 		LoadbalancerPort:   bh.LoadbalancerPort,
-		LoadbalancerMethod: bh.LoadbalancerMethod,
+		LoadbalancerMethod: bh.LoadbalancerMethod(),
 		StartTime:          bh.StartTime,
-		ConnectedHosts:     len(bh.Backends.GetAll()),
+		Backends:           bh.traffic(),
+	}
+	for _, backend := range response.Backends {
+		if backend.Connections > 0 {
+			response.ConnectedHosts++
+		}
+	}
+	for _, limit := range bh.limits() {
+		response.Inflight += limit.Inflight()
+		response.QueueLength += limit.Queued()
 	}
 	writeJSON(w, http.StatusOK, response)
 	logging.Debug("Sent status: %v", response)
 }
 
+// traffic returns the counts of the in-flight tracker for every backend it
+// has seen and every backend discovered now. Route pools share the tracker,
+// so their backends are listed too.
+func (bh *BalanceHandler) traffic() []BackendTraffic {
+	inflight := bh.Inflight().Snapshot()
+	requests := bh.Inflight().Requests()
+	podNames := make(map[string]string)
+	lists := []*discovery.BackendList{bh.Backends, bh.BackupBackends}
+	for _, pool := range bh.pools() {
+		lists = append(lists, pool.Backends)
+	}
+	for _, list := range lists {
+		if list == nil {
+			continue
+		}
+		for _, backend := range list.GetAll() {
+			podNames[backend.Address] = backend.PodName
+		}
+	}
+	// Every backend in flight has been sent a request, so is in requests.
+	addresses := slices.Collect(maps.Keys(podNames))
+	for address := range requests {
+		if _, ok := podNames[address]; !ok {
+			addresses = append(addresses, address)
+		}
+	}
+	slices.Sort(addresses)
+	traffic := make([]BackendTraffic, 0, len(addresses))
+	for _, address := range addresses {
+		traffic = append(traffic, BackendTraffic{
+			Address:     address,
+			PodName:     podNames[address],
+			Connections: inflight[address],
+			Requests:    requests[address],
+		})
+	}
+	return traffic
+}
+
+// backends lists every discovered backend with whether it is in rotation
+// and why not.
+func (bh *BalanceHandler) backends(w http.ResponseWriter, r *http.Request) {
+	response := backendStatuses(bh.Backends, bh.Health, 0)
+	if bh.BackupBackends != nil {
+		response = append(response, backendStatuses(bh.BackupBackends, bh.BackupHealth, 1)...)
+	}
+	inRotation := make(map[string]bool)
+	for _, backend := range bh.candidates() {
+		inRotation[backend.Address] = true
+	}
+	for i := range response {
+		if bh.Outliers != nil {
+			response[i].Ejected = bh.Outliers.Ejected(discovery.Backend{Address: response[i].Address})
+		}
+		response[i].InRotation = inRotation[response[i].Address]
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// backendStatuses lists the backends of list, with their health from
+// checker when there is one, marked with priority.
+func backendStatuses(list *discovery.BackendList, checker *healthcheck.Checker, priority int) []BackendStatus {
+	var health []healthcheck.BackendHealth
+	if checker != nil {
+		health = checker.Health()
+	} else {
+		for _, backend := range list.GetAll() {
+			health = append(health, healthcheck.BackendHealth{Backend: backend, Healthy: true})
+		}
+	}
+	statuses := make([]BackendStatus, 0, len(health))
+	for _, h := range health {
+		status := BackendStatus{
+			Address:             h.Backend.Address,
+			PodName:             h.Backend.PodName,
+			Zone:                h.Backend.Zone,
+			Priority:            h.Backend.Priority + priority,
+			Healthy:             h.Healthy,
+			ConsecutiveFailures: h.ConsecutiveFailures,
+			Latency:             latencyOf(h.Backend),
+		}
+		if !h.LastCheck.IsZero() {
+			status.LastCheck = h.LastCheck.UTC().Format(time.RFC3339)
+		}
+		if h.LastError != nil {
+			status.LastError = h.LastError.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// ready is the readiness probe: 200 once discovery has synced, 503 before.
+func (bh *BalanceHandler) ready(w http.ResponseWriter, r *http.Request) {
+	if !bh.Ready() {
+		http.Error(w, ErrNotReady.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ready")
+}
+
 func writeJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
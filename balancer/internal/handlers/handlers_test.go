@@ -2,16 +2,40 @@ package handlers
 
 import (
 	"encoding/json"
+	"io"
+	"maps"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"balancer/internal/discovery"
+	"balancer/internal/metrics"
+	"balancer/internal/proxy"
+	"balancer/internal/strategy"
 )
 
+func newTestHandler(method string, backends ...discovery.Backend) *BalanceHandler {
+	list := discovery.NewBackendList()
+	list.Replace(backends)
+	return NewBalanceHandler("test", 8080, 8081, method, strategy.Options{}, list, nil)
+}
+
 func TestStatus_NoEnv(t *testing.T) {
-	handler := NewServiceHandler("test")
+	handler := newTestHandler("RoundRobin")
 
 	req := httptest.NewRequest("GET", "/status", nil)
 	rr := httptest.NewRecorder()
@@ -26,8 +50,8 @@ func TestStatus_NoEnv(t *testing.T) {
 	if response.PodIP != "127.0.0.1" {
 		t.Errorf("podIP should be default, was %s", response.PodIP)
 	}
-	if response.ServiceName != "test" {
-		t.Errorf("expected service name 'test' but got %s", response.ServiceName)
+	if response.BackendName != "test" {
+		t.Errorf("expected backend name 'test' but got %s", response.BackendName)
 	}
 	if response.StartTime == "" {
 		t.Errorf("got empty timestamp from response")
@@ -41,7 +65,7 @@ func TestStatus_Env(t *testing.T) {
 		os.Unsetenv("POD_NAME")
 		os.Unsetenv("POD_IP")
 	})
-	handler := NewServiceHandler("test")
+	handler := newTestHandler("RoundRobin")
 
 	req := httptest.NewRequest("GET", "/status", nil)
 	rr := httptest.NewRecorder()
@@ -61,36 +85,118 @@ func TestStatus_Env(t *testing.T) {
 	}
 }
 
-func TestStatus_counter(t *testing.T) {
-	handler := NewServiceHandler("test")
+func TestStatus_Traffic(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(upstream.Close)
+	handler := newTestHandler("RoundRobin",
+		discovery.Backend{Address: "127.0.0.1", PodName: "a"},
+		discovery.Backend{Address: "127.0.0.2", PodName: "b"})
+	handler.Proxy.BackendPort = upstream.Listener.Addr().(*net.TCPAddr).Port
+
+	handler.proxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	backend, release, err := handler.Acquire(httptest.NewRequest("GET", "/", nil))
+	assert.NoError(t, err)
+	defer release()
+
+	rr := httptest.NewRecorder()
+	handler.status(rr, httptest.NewRequest("GET", "/status", nil))
+	var response StatusResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, 1, response.ConnectedHosts)
+	assert.Equal(t, "127.0.0.2", backend.Address)
+	assert.Equal(t, []BackendTraffic{
+		{Address: "127.0.0.1", PodName: "a", Connections: 0, Requests: 1},
+		{Address: "127.0.0.2", PodName: "b", Connections: 1, Requests: 1},
+	}, response.Backends)
+}
+
+func TestStatus_RoutePoolTraffic(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(upstream.Close)
+	handler := newTestHandler("RoundRobin", discovery.Backend{Address: "127.0.0.1", PodName: "web"})
+	list := discovery.NewBackendList()
+	list.Replace([]discovery.Backend{{Address: "127.0.0.2", PodName: "api"}})
+	pool := NewBalanceHandler("api", 8080, 8081, "RoundRobin", strategy.Options{Inflight: handler.Inflight()}, list, nil)
+	pool.Proxy = proxy.New(upstream.Listener.Addr().(*net.TCPAddr).Port)
+	handler.AddRoute(Route{PathPrefix: "/api", Pool: pool})
+
+	handler.proxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/users", nil))
+	_, release, err := pool.Acquire(httptest.NewRequest("GET", "/api/users", nil))
+	assert.NoError(t, err)
+	defer release()
 
-	req := httptest.NewRequest("GET", "/status", nil)
 	rr := httptest.NewRecorder()
+	handler.status(rr, httptest.NewRequest("GET", "/status", nil))
+	var response StatusResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, 1, response.ConnectedHosts)
+	assert.Equal(t, []BackendTraffic{
+		{Address: "127.0.0.1", PodName: "web", Connections: 0, Requests: 0},
+		{Address: "127.0.0.2", PodName: "api", Connections: 1, Requests: 2},
+	}, response.Backends)
+}
 
-	handler.status(rr, req)
+func TestStatus_DoesNotSelect(t *testing.T) {
+	handler := newTestHandler("RoundRobin",
+		discovery.Backend{Address: "10.0.0.1", PodName: "a"},
+		discovery.Backend{Address: "10.0.0.2", PodName: "b"},
+	)
 
-	assert.Equal(t, int64(0), handler.Count)
+	handler.status(httptest.NewRecorder(), httptest.NewRequest("GET", "/status", nil))
+
+	rr := httptest.NewRecorder()
+	handler.nextBackend(rr, httptest.NewRequest("GET", "/next-backend", nil))
+	var response NextResponse
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	assert.Equal(t, "10.0.0.1:8080", response.NextHost)
 }
 
-func TestPing(t *testing.T) {
-	handler := NewServiceHandler("test")
+func TestNextBackend(t *testing.T) {
+	handler := newTestHandler("RoundRobin", discovery.Backend{Address: "10.0.0.1", PodName: "a"})
 
-	req := httptest.NewRequest("GET", "/ping", nil)
+	req := httptest.NewRequest("GET", "/next-backend", nil)
 	rr := httptest.NewRecorder()
 
-	for i := int64(1); i < 10; i++ {
-		handler.ping(rr, req)
-		if rr.Code != http.StatusOK {
-			t.Errorf("expected ok status, got %d", rr.Code)
-		}
-		assert.Equal(t, i, handler.Count)
-	}
+	handler.nextBackend(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response NextResponse
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	assert.Equal(t, "10.0.0.1:8080", response.NextHost)
+}
+
+func TestProxy_LeastConnectionsReleases(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstream.Close)
+
+	handler := newTestHandler("LeastConnections", discovery.Backend{Address: "127.0.0.1", PodName: "a"})
+	handler.Proxy.BackendPort = upstream.Listener.Addr().(*net.TCPAddr).Port
+
+	req := httptest.NewRequest("GET", "/anything", nil)
+	rr := httptest.NewRecorder()
+
+	handler.proxy(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, handler.Strategy().(*strategy.LeastConnections).Active())
+	assert.Empty(t, handler.Inflight().Snapshot())
+}
+
+func TestProxy_NoBackends(t *testing.T) {
+	handler := newTestHandler("RoundRobin")
+
+	rr := httptest.NewRecorder()
+	handler.proxy(rr, httptest.NewRequest("GET", "/anything", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
 }
 
 func TestWriteJSON(t *testing.T) {
 	rr := httptest.NewRecorder()
 	data := struct {
-		Foo string `json:foo`
+		Foo string `json:"foo"`
 	}{
 		Foo: "bar",
 	}
@@ -99,3 +205,770 @@ func TestWriteJSON(t *testing.T) {
 	assert.Equal(t, 169, rr.Code)
 	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
 }
+
+func TestNextBackend_FailsOverToBackup(t *testing.T) {
+	backup := discovery.NewBackendList()
+	backup.Replace([]discovery.Backend{{Address: "10.0.1.1", PodName: "backup"}})
+	handler := NewBalanceHandler("test", 8080, 8081, "RoundRobin", strategy.Options{Failover: true}, discovery.NewBackendList(), backup)
+
+	rr := httptest.NewRecorder()
+	handler.nextBackend(rr, httptest.NewRequest("GET", "/next-backend", nil))
+
+	var response NextResponse
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	assert.Equal(t, "10.0.1.1:8080", response.NextHost)
+}
+
+func TestStrategyFor_LongestPrefix(t *testing.T) {
+	handler := newTestHandler("RoundRobin")
+	handler.AddRoute(Route{PathPrefix: "/api", LoadbalancerMethod: "Random"})
+	handler.AddRoute(Route{PathPrefix: "/api/ws", LoadbalancerMethod: "RingHash"})
+	handler.AddRoute(Route{PathPrefix: "/follow"})
+
+	assert.IsType(t, &strategy.RingHash{}, handler.strategyFor(httptest.NewRequest("GET", "/api/ws/chat", nil)))
+	assert.IsType(t, &strategy.Random{}, handler.strategyFor(httptest.NewRequest("GET", "/api/users", nil)))
+	assert.IsType(t, &strategy.RoundRobin{}, handler.strategyFor(httptest.NewRequest("GET", "/other", nil)))
+	assert.IsType(t, &strategy.RoundRobin{}, handler.strategyFor(httptest.NewRequest("GET", "/follow", nil)))
+}
+
+func TestRouteFor_Matchers(t *testing.T) {
+	handler := newTestHandler("RoundRobin")
+	handler.AddRoute(Route{PathPrefix: "/api/v1"})
+	handler.AddRoute(Route{PathPrefix: "/", Host: "*.example.com"})
+	handler.AddRoute(Route{PathPrefix: "/", Host: "api.example.com"})
+	handler.AddRoute(Route{PathPrefix: "/api", MatchHeaders: map[string]string{"x-version": "2"}})
+	handler.AddRoute(Route{PathPrefix: "/api", MatchHeaders: map[string]string{"X-Debug": ""}})
+	handler.AddRoute(Route{PathPrefix: "/api"})
+
+	routeFor := func(host, path string, headers ...string) string {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Host = host
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		route := handler.routeFor(r)
+		if route == nil {
+			return ""
+		}
+		return route.Host + route.PathPrefix + " " + strings.Join(slices.Sorted(maps.Keys(route.MatchHeaders)), ",")
+	}
+	assert.Equal(t, "api.example.com/ ", routeFor("API.example.com:8080", "/api/v1"))
+	assert.Equal(t, "*.example.com/ ", routeFor("web.example.com", "/api"))
+	assert.Equal(t, "/api/v1 ", routeFor("example.com", "/api/v1/users"))
+	assert.Equal(t, "/api x-version", routeFor("other", "/api", "X-Version", "2"))
+	assert.Equal(t, "/api X-Debug", routeFor("other", "/api", "X-Version", "3", "X-Debug", "on"))
+	assert.Equal(t, "/api ", routeFor("other", "/api", "X-Version", "3"))
+	assert.Equal(t, "", routeFor("other", "/web"))
+}
+
+func TestProxy_RoutePool(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("web"))
+	}))
+	t.Cleanup(web.Close)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("api"))
+	}))
+	t.Cleanup(api.Close)
+
+	handler := newTestHandler("RoundRobin", discovery.Backend{Address: "127.0.0.1", PodName: "web"})
+	handler.Proxy = proxy.New(web.Listener.Addr().(*net.TCPAddr).Port)
+	pool := newTestHandler("RoundRobin", discovery.Backend{Address: "127.0.0.1", PodName: "api"})
+	pool.Proxy = proxy.New(api.Listener.Addr().(*net.TCPAddr).Port)
+	handler.AddRoute(Route{PathPrefix: "/", Host: "api.example.com", Pool: pool})
+
+	get := func(host string) string {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = host
+		handler.proxy(rr, r)
+		return rr.Body.String()
+	}
+	assert.Equal(t, "api", get("api.example.com"))
+	assert.Equal(t, "web", get("www.example.com"))
+}
+
+func TestAdminStrategy_Swap(t *testing.T) {
+	handler := newTestHandler("RoundRobin", discovery.Backend{Address: "10.0.0.1", PodName: "a"})
+	mux := http.NewServeMux()
+	handler.RegisterAdmin(mux)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/strategy", strings.NewReader(`{"loadbalancermethod":"LeastConnections"}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "LeastConnections", handler.LoadbalancerMethod())
+	assert.IsType(t, &strategy.LeastConnections{}, handler.Strategy())
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/strategy", strings.NewReader(`{"loadbalancermethod":"Nope"}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "LeastConnections", handler.LoadbalancerMethod())
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/strategy", nil))
+	var resp StrategyResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Equal(t, "LeastConnections", resp.LoadbalancerMethod)
+}
+
+func TestSetStrategy_KeepsAffinity(t *testing.T) {
+	list := discovery.NewBackendList()
+	list.Replace([]discovery.Backend{
+		{Address: "10.0.0.1", PodName: "a"},
+		{Address: "10.0.0.2", PodName: "b"},
+		{Address: "10.0.0.3", PodName: "c"},
+	})
+	opts := strategy.Options{AffinityTTL: time.Minute}
+	handler := NewBalanceHandler("test", 8080, 8081, "RoundRobin", opts, list, nil)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	first, err := handler.selectBackend(handler.Strategy(), req)
+	assert.NoError(t, err)
+
+	assert.NoError(t, handler.SetStrategy("Random"))
+	for range 10 {
+		got, err := handler.selectBackend(handler.Strategy(), req)
+		assert.NoError(t, err)
+		assert.Equal(t, first.Address, got.Address)
+	}
+}
+
+func TestReady_GatesTraffic(t *testing.T) {
+	handler := newTestHandler("RoundRobin", discovery.Backend{Address: "10.0.0.1", PodName: "a"})
+	handler.SetReady(false)
+
+	rr := httptest.NewRecorder()
+	handler.ready(rr, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	rr = httptest.NewRecorder()
+	handler.proxy(rr, httptest.NewRequest("GET", "/anything", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	_, _, err := handler.Acquire(httptest.NewRequest("GET", "/", nil))
+	assert.ErrorIs(t, err, ErrNotReady)
+
+	handler.SetReady(true)
+	rr = httptest.NewRecorder()
+	handler.ready(rr, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestBackends_ListsRotation(t *testing.T) {
+	handler := newTestHandler("RoundRobin", discovery.Backend{Address: "10.0.0.1", PodName: "a"}, discovery.Backend{Address: "10.0.0.2", PodName: "b"})
+	handler.Outliers = strategy.NewOutlierDetector(strategy.OutlierOptions{ConsecutiveFailures: 1})
+	handler.Outliers.Observe(discovery.Backend{Address: "10.0.0.2"}, true)
+
+	rr := httptest.NewRecorder()
+	handler.backends(rr, httptest.NewRequest("GET", "/backends", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response []BackendStatus
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, []BackendStatus{
+		{Address: "10.0.0.1", PodName: "a", Healthy: true, InRotation: true},
+		{Address: "10.0.0.2", PodName: "b", Healthy: true, Ejected: true},
+	}, response)
+}
+
+func TestAcquire_Releases(t *testing.T) {
+	handler := newTestHandler("LeastConnections", discovery.Backend{Address: "10.0.0.1", PodName: "a"})
+
+	backend, release, err := handler.Acquire(httptest.NewRequest("GET", "/", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, handler.Inflight().Count(backend))
+
+	release()
+	assert.Empty(t, handler.Inflight().Snapshot())
+	assert.Empty(t, handler.Strategy().(*strategy.LeastConnections).Active())
+}
+
+func TestProxy_H2CBalancesEachCall(t *testing.T) {
+	listener, err := net.Listen("tcp", "0.0.0.0:0")
+	assert.NoError(t, err)
+	hosts := make(chan string, 10)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.Host)
+		hosts <- host
+	}))
+	upstream.Listener = listener
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+
+	handler := newTestHandler("RoundRobin",
+		discovery.Backend{Address: "127.0.0.1", PodName: "a"},
+		discovery.Backend{Address: "127.0.0.2", PodName: "b"},
+	)
+	handler.Proxy = proxy.NewH2C(listener.Addr().(*net.TCPAddr).Port)
+	front := httptest.NewUnstartedServer(http.HandlerFunc(handler.proxy))
+	front.Config.Protocols = new(http.Protocols)
+	front.Config.Protocols.SetUnencryptedHTTP2(true)
+	front.Start()
+	t.Cleanup(front.Close)
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 4; i++ {
+		resp, err := client.Post(front.URL+"/pkg.Service/Method", "application/grpc", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, resp.ProtoMajor)
+		resp.Body.Close()
+	}
+
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		seen[<-hosts]++
+	}
+	assert.Equal(t, map[string]int{"127.0.0.1": 2, "127.0.0.2": 2}, seen)
+}
+
+func TestProxyFor_RouteOverride(t *testing.T) {
+	handler := newTestHandler("RoundRobin")
+	h2c := proxy.NewH2C(8080)
+	handler.AddRoute(Route{PathPrefix: "/grpc", Proxy: h2c})
+
+	assert.Same(t, h2c, handler.proxyFor(httptest.NewRequest("GET", "/grpc/Method", nil)))
+	assert.Same(t, handler.Proxy, handler.proxyFor(httptest.NewRequest("GET", "/other", nil)))
+}
+
+func TestRulesFor_GlobalThenRoute(t *testing.T) {
+	handler := newTestHandler("RoundRobin")
+	assert.Nil(t, handler.rulesFor(httptest.NewRequest("GET", "/api", nil)))
+
+	global := &proxy.HeaderRules{Request: proxy.HeaderOps{Set: map[string]string{"X-Global": "1"}}}
+	route := &proxy.HeaderRules{Request: proxy.HeaderOps{Set: map[string]string{"X-Route": "1"}}}
+	handler.Headers = global
+	handler.AddRoute(Route{PathPrefix: "/api", Headers: route})
+
+	rules := handler.rulesFor(httptest.NewRequest("GET", "/api/users", nil))
+	assert.Equal(t, []proxy.HeaderRules{*global, *route}, rules.Headers)
+	rules = handler.rulesFor(httptest.NewRequest("GET", "/other", nil))
+	assert.Equal(t, []proxy.HeaderRules{*global}, rules.Headers)
+}
+
+func TestProxy_RetriesOnAnotherBackend(t *testing.T) {
+	listener, err := net.Listen("tcp", "0.0.0.0:0")
+	assert.NoError(t, err)
+	hosts := make(chan string, 10)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.Host)
+		hosts <- host
+		if host == "127.0.0.1" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	upstream.Listener = listener
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+
+	handler := newTestHandler("RoundRobin",
+		discovery.Backend{Address: "127.0.0.1", PodName: "a"},
+		discovery.Backend{Address: "127.0.0.2", PodName: "b"},
+	)
+	handler.Proxy = proxy.New(listener.Addr().(*net.TCPAddr).Port)
+	handler.Retry = &proxy.RetryPolicy{Attempts: 1, Statuses: []int{http.StatusServiceUnavailable}}
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		handler.proxy(rr, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "ok", rr.Body.String())
+	}
+	// Each request tried the failing backend first and was retried on the
+	// other one.
+	assert.Equal(t, 4, len(hosts))
+}
+
+func TestProxy_NoRetryWithoutBudget(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	t.Cleanup(upstream.Close)
+
+	handler := newTestHandler("RoundRobin",
+		discovery.Backend{Address: "127.0.0.1", PodName: "a"},
+		discovery.Backend{Address: "127.0.0.1", PodName: "b"},
+	)
+	handler.Proxy = proxy.New(upstream.Listener.Addr().(*net.TCPAddr).Port)
+	handler.Retry = &proxy.RetryPolicy{Attempts: 3, Statuses: []int{http.StatusBadGateway}}
+
+	// Both backends share an address, so there is nothing left to retry on
+	// and the failed response goes back to the client.
+	rr := httptest.NewRecorder()
+	handler.proxy(rr, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+}
+
+func TestProxy_NoRetryForStreamedBody(t *testing.T) {
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(upstream.Close)
+
+	handler := newTestHandler("RoundRobin",
+		discovery.Backend{Address: "127.0.0.1", PodName: "a"},
+		discovery.Backend{Address: "127.0.0.2", PodName: "b"},
+	)
+	handler.Proxy = proxy.New(upstream.Listener.Addr().(*net.TCPAddr).Port)
+	handler.Retry = &proxy.RetryPolicy{Attempts: 1, Statuses: []int{http.StatusServiceUnavailable}}
+
+	rr := httptest.NewRecorder()
+	handler.proxy(rr, httptest.NewRequest("POST", "/", strings.NewReader("body")))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, 1, calls)
+}
+
+func TestProxy_EjectsFailingBackend(t *testing.T) {
+	listener, err := net.Listen("tcp", "0.0.0.0:0")
+	assert.NoError(t, err)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.Host)
+		if host == "127.0.0.1" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	upstream.Listener = listener
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+
+	handler := newTestHandler("RoundRobin",
+		discovery.Backend{Address: "127.0.0.1", PodName: "a"},
+		discovery.Backend{Address: "127.0.0.2", PodName: "b"},
+	)
+	handler.Proxy = proxy.New(listener.Addr().(*net.TCPAddr).Port)
+	handler.Outliers = strategy.NewOutlierDetector(strategy.OutlierOptions{ConsecutiveFailures: 2})
+
+	for i := 0; i < 4; i++ {
+		handler.proxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	assert.True(t, handler.Outliers.Ejected(discovery.Backend{Address: "127.0.0.1"}))
+	assert.Equal(t, []discovery.Backend{{Address: "127.0.0.2", PodName: "b"}}, handler.candidates())
+
+	for i := 0; i < 4; i++ {
+		rr := httptest.NewRecorder()
+		handler.proxy(rr, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+}
+
+func TestProxy_ShedsOverLimit(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(upstream.Close)
+
+	handler := newTestHandler("RoundRobin", discovery.Backend{Address: "127.0.0.1", PodName: "a"})
+	handler.Proxy = proxy.New(upstream.Listener.Addr().(*net.TCPAddr).Port)
+	handler.Limit = NewLimiter(1, 0)
+
+	done := make(chan int)
+	go func() {
+		rr := httptest.NewRecorder()
+		handler.proxy(rr, httptest.NewRequest("GET", "/", nil))
+		done <- rr.Code
+	}()
+	assert.Eventually(t, func() bool { return handler.Limit.Inflight() == 1 }, time.Second, 5*time.Millisecond)
+
+	rr := httptest.NewRecorder()
+	handler.proxy(rr, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, 0, handler.Limit.Inflight())
+}
+
+func TestAdmit_RouteLimit(t *testing.T) {
+	handler := newTestHandler("RoundRobin")
+	handler.Limit = NewLimiter(2, 0)
+	handler.AddRoute(Route{PathPrefix: "/api", Limit: NewLimiter(1, 0)})
+
+	leave, ok := handler.admit(httptest.NewRecorder(), httptest.NewRequest("GET", "/api", nil))
+	assert.True(t, ok)
+	rr := httptest.NewRecorder()
+	_, ok = handler.admit(rr, httptest.NewRequest("GET", "/api", nil))
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, 1, handler.Limit.Inflight(), "a shed request must give back the global slot")
+
+	_, ok = handler.admit(httptest.NewRecorder(), httptest.NewRequest("GET", "/other", nil))
+	assert.True(t, ok)
+	leave()
+	assert.Equal(t, 1, handler.Limit.Inflight())
+}
+
+func TestAdmit_QueuesUntilSlotFrees(t *testing.T) {
+	handler := newTestHandler("RoundRobin")
+	handler.Limit = NewLimiter(1, 1)
+	handler.QueueTimeout = time.Second
+
+	leave, ok := handler.admit(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.True(t, ok)
+
+	admitted := make(chan bool)
+	go func() {
+		leave, ok := handler.admit(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if ok {
+			leave()
+		}
+		admitted <- ok
+	}()
+	assert.Eventually(t, func() bool { return handler.Limit.Queued() == 1 }, time.Second, 5*time.Millisecond)
+
+	// The queue is full, so a third request is shed at once.
+	rr := httptest.NewRecorder()
+	_, ok = handler.admit(rr, httptest.NewRequest("GET", "/", nil))
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	rr = httptest.NewRecorder()
+	handler.status(rr, httptest.NewRequest("GET", "/status", nil))
+	var status StatusResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.Equal(t, 1, status.Inflight)
+	assert.Equal(t, 1, status.QueueLength)
+
+	leave()
+	assert.True(t, <-admitted)
+	assert.Equal(t, 0, handler.Limit.Queued())
+}
+
+func TestAdmit_QueueTimeout(t *testing.T) {
+	handler := newTestHandler("RoundRobin")
+	handler.Limit = NewLimiter(1, 1)
+	handler.QueueTimeout = 20 * time.Millisecond
+
+	leave, ok := handler.admit(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.True(t, ok)
+	defer leave()
+
+	rr := httptest.NewRecorder()
+	_, ok = handler.admit(rr, httptest.NewRequest("GET", "/", nil))
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, 0, handler.Limit.Queued())
+}
+
+func TestProxy_MirrorsToShadowPool(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	}))
+	t.Cleanup(primary.Close)
+	bodies := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- r.URL.Path + " " + string(body)
+		w.Write([]byte("shadow"))
+	}))
+	t.Cleanup(shadow.Close)
+
+	handler := newTestHandler("RoundRobin", discovery.Backend{Address: "127.0.0.1", PodName: "a"})
+	handler.Proxy = proxy.New(primary.Listener.Addr().(*net.TCPAddr).Port)
+	pool := newTestHandler("RoundRobin", discovery.Backend{Address: "127.0.0.1", PodName: "shadow"})
+	pool.Proxy = proxy.New(shadow.Listener.Addr().(*net.TCPAddr).Port)
+	handler.AddRoute(Route{
+		PathPrefix: "/api",
+		BufferBody: true,
+		Mirror:     &Mirror{Pool: pool, Percent: 100},
+	})
+
+	rr := httptest.NewRecorder()
+	handler.proxy(rr, httptest.NewRequest("POST", "/api/users", strings.NewReader("payload")))
+	assert.Equal(t, "primary", rr.Body.String())
+	select {
+	case got := <-bodies:
+		assert.Equal(t, "/api/users payload", got)
+	case <-time.After(time.Second):
+		t.Fatal("the shadow pool never saw the request")
+	}
+}
+
+func TestMirror_SkipsStreamedBody(t *testing.T) {
+	pool := newTestHandler("RoundRobin")
+	mirror := &Mirror{Pool: pool, Percent: 100}
+	pool.Limit = NewLimiter(1, 0)
+
+	mirror.send(httptest.NewRequest("POST", "/", strings.NewReader("streamed")))
+	assert.Equal(t, 0, pool.Limit.Inflight())
+}
+
+func TestProxy_CanarySplit(t *testing.T) {
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("stable"))
+	}))
+	t.Cleanup(stable.Close)
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("canary"))
+	}))
+	t.Cleanup(next.Close)
+
+	handler := newTestHandler("RoundRobin", discovery.Backend{Address: "127.0.0.1", PodName: "a"})
+	handler.Proxy = proxy.New(stable.Listener.Addr().(*net.TCPAddr).Port)
+	pool := newTestHandler("RoundRobin", discovery.Backend{Address: "127.0.0.1", PodName: "v2"})
+	pool.Proxy = proxy.New(next.Listener.Addr().(*net.TCPAddr).Port)
+	handler.AddRoute(Route{PathPrefix: "/api", Canary: NewCanary(pool, 0)})
+
+	get := func() string {
+		rr := httptest.NewRecorder()
+		handler.proxy(rr, httptest.NewRequest("GET", "/api", nil))
+		return rr.Body.String()
+	}
+	assert.Equal(t, "stable", get())
+
+	mux := http.NewServeMux()
+	handler.RegisterAdmin(mux)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/canary", strings.NewReader(`{"pathprefix":"/api","percent":100}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "canary", get())
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/canary", nil))
+	var canaries []CanaryResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &canaries))
+	assert.Equal(t, []CanaryResponse{{PathPrefix: "/api", BackendName: "test", Percent: 100}}, canaries)
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/canary", strings.NewReader(`{"pathprefix":"/api","percent":101}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/canary", strings.NewReader(`{"pathprefix":"/other","percent":5}`)))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestProxy_BlueGreenSwitch(t *testing.T) {
+	pool := func(body string) *BalanceHandler {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		t.Cleanup(upstream.Close)
+		h := newTestHandler("RoundRobin", discovery.Backend{Address: "127.0.0.1", PodName: body})
+		h.BackendName = body
+		h.Proxy = proxy.New(upstream.Listener.Addr().(*net.TCPAddr).Port)
+		return h
+	}
+	blueGreen, err := NewBlueGreen(pool("blue"), pool("green"), Blue)
+	assert.NoError(t, err)
+	handler := newTestHandler("RoundRobin")
+	handler.AddRoute(Route{PathPrefix: "/", BlueGreen: blueGreen})
+
+	get := func() string {
+		rr := httptest.NewRecorder()
+		handler.proxy(rr, httptest.NewRequest("GET", "/", nil))
+		return rr.Body.String()
+	}
+	assert.Equal(t, "blue", get())
+
+	mux := http.NewServeMux()
+	handler.RegisterAdmin(mux)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/bluegreen", strings.NewReader(`{"pathprefix":"/","active":"green"}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var status BlueGreenResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.Equal(t, BlueGreenResponse{PathPrefix: "/", Active: Green, Blue: "blue", Green: "green"}, status)
+	assert.Equal(t, "green", get())
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/bluegreen", strings.NewReader(`{"pathprefix":"/","active":"purple"}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "green", get())
+}
+
+func TestSwap_ServesWithLatestHandler(t *testing.T) {
+	old := newTestHandler("RoundRobin", discovery.Backend{Address: "10.0.0.1", PodName: "a"})
+	swap := NewSwap(old)
+
+	next := newTestHandler("LeastConnections", discovery.Backend{Address: "10.0.0.2", PodName: "b"})
+	assert.Same(t, old, swap.Store(next))
+	assert.Same(t, next, swap.Load())
+
+	rr := httptest.NewRecorder()
+	swap.ServeHTTP(rr, httptest.NewRequest("GET", "/next-backend", nil))
+	var response NextResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, "10.0.0.2:8080", response.NextHost)
+
+	rr = httptest.NewRecorder()
+	swap.Admin().ServeHTTP(rr, httptest.NewRequest("GET", "/admin/strategy", nil))
+	assert.Contains(t, rr.Body.String(), "LeastConnections")
+
+	backend, release, err := swap.Acquire(httptest.NewRequest("GET", "/", nil))
+	assert.NoError(t, err)
+	release()
+	assert.Equal(t, "10.0.0.2", backend.Address)
+}
+
+func TestAdmin_Config(t *testing.T) {
+	handler := newTestHandler("RoundRobin")
+	mux := http.NewServeMux()
+	handler.RegisterAdmin(mux)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/config", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	handler.EffectiveConfig = map[string]any{"backendname": "test"}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/config", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"backendname":"test"}`, rr.Body.String())
+
+	// The config is not served to clients.
+	client := http.NewServeMux()
+	handler.Register(client)
+	rr = httptest.NewRecorder()
+	client.ServeHTTP(rr, httptest.NewRequest("GET", "/config", nil))
+	assert.NotEqual(t, http.StatusOK, rr.Code)
+}
+
+func TestProxy_AccessLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	handler := newTestHandler("RoundRobin", discovery.Backend{Address: "127.0.0.1", PodName: "api-0"})
+	handler.Proxy.BackendPort = upstream.Listener.Addr().(*net.TCPAddr).Port
+	handler.AddRoute(Route{PathPrefix: "/quiet", NoAccessLog: true})
+
+	get := func(format, path string) string {
+		var buf strings.Builder
+		handler.AccessLog = NewAccessLog(format, &buf)
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("User-Agent", "curl/8.0")
+		handler.proxy(httptest.NewRecorder(), r)
+		return buf.String()
+	}
+
+	line := get(AccessLogCommon, "/api?q=1")
+	assert.Regexp(t, `^192\.0\.2\.1 - - \[[^]]+\] "GET /api\?q=1 HTTP/1\.1" 201 5 "api-0" \d+ms 0\n$`, line)
+
+	line = get(AccessLogCombined, "/api")
+	assert.Contains(t, line, `201 5 "-" "curl/8.0" "api-0"`)
+
+	var entry map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(get(AccessLogJSON, "/api")), &entry))
+	assert.Equal(t, float64(201), entry["status"])
+	assert.Equal(t, float64(5), entry["bytes_sent"])
+	assert.Equal(t, "api-0", entry["pod"])
+	assert.Equal(t, float64(0), entry["retries"])
+
+	assert.Empty(t, get(AccessLogCommon, "/quiet/path"))
+}
+
+// recordSpans traces requests for the rest of the test and returns the
+// recorder the spans end up in.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+	return spans
+}
+
+func TestProxy_Tracing(t *testing.T) {
+	spans := recordSpans(t)
+
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	t.Cleanup(upstream.Close)
+
+	handler := newTestHandler("RoundRobin", discovery.Backend{Address: "127.0.0.1", PodName: "api-0"})
+	handler.Proxy.BackendPort = upstream.Listener.Addr().(*net.TCPAddr).Port
+	handler.AddRoute(Route{PathPrefix: "/api"})
+
+	r := httptest.NewRequest("GET", "/api/users", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	handler.proxy(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	ended := spans.Ended()
+	if !assert.Len(t, ended, 2) {
+		return
+	}
+	client, server := ended[0], ended[1]
+	assert.Equal(t, "GET /api", server.Name())
+	assert.Equal(t, trace.SpanKindServer, server.SpanKind())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+	attrs := attribute.NewSet(server.Attributes()...)
+	pod, _ := attrs.Value("balancer.backend.pod")
+	assert.Equal(t, "api-0", pod.AsString())
+	retries, _ := attrs.Value("balancer.retries")
+	assert.Equal(t, int64(0), retries.AsInt64())
+
+	assert.Equal(t, trace.SpanKindClient, client.SpanKind())
+	assert.Equal(t, server.SpanContext().SpanID(), client.Parent().SpanID())
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+client.SpanContext().SpanID().String()+"-01", traceparent)
+}
+
+func TestBackends_Latency(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(upstream.Close)
+	handler := newTestHandler("RoundRobin",
+		discovery.Backend{Address: "127.0.0.1", PodName: "latency-a"},
+		discovery.Backend{Address: "127.0.0.3", PodName: "latency-idle"})
+	handler.Proxy.BackendPort = upstream.Listener.Addr().(*net.TCPAddr).Port
+	handler.proxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	rr := httptest.NewRecorder()
+	handler.backends(rr, httptest.NewRequest("GET", "/backends", nil))
+	var response []BackendStatus
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	if assert.Len(t, response, 2) && assert.NotNil(t, response[0].Latency) {
+		assert.Greater(t, response[0].Latency.P50, 0.0)
+		assert.GreaterOrEqual(t, response[0].Latency.P99, response[0].Latency.P50)
+	}
+	assert.Nil(t, response[1].Latency)
+
+	rr = httptest.NewRecorder()
+	metrics.Default.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, rr.Body.String(), `balancer_backend_latency_seconds_count{backend="127.0.0.1",pod="latency-a"}`)
+}
+
+func TestProxy_TracingRetriesBufferedBody(t *testing.T) {
+	recordSpans(t)
+	listener, err := net.Listen("tcp", "0.0.0.0:0")
+	assert.NoError(t, err)
+	bodies := make(map[string]string)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.Host)
+		body, _ := io.ReadAll(r.Body)
+		bodies[host] = string(body)
+		if host == "127.0.0.1" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	upstream.Listener = listener
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+
+	handler := newTestHandler("RoundRobin",
+		discovery.Backend{Address: "127.0.0.1", PodName: "a"},
+		discovery.Backend{Address: "127.0.0.2", PodName: "b"},
+	)
+	handler.Proxy = proxy.New(listener.Addr().(*net.TCPAddr).Port)
+	handler.Retry = &proxy.RetryPolicy{Attempts: 1, Statuses: []int{http.StatusServiceUnavailable}}
+	handler.BufferBody = true
+
+	rr := httptest.NewRecorder()
+	handler.proxy(rr, httptest.NewRequest("POST", "/", strings.NewReader("hello")))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, map[string]string{"127.0.0.1": "hello", "127.0.0.2": "hello"}, bodies)
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Limiter caps how many requests are in flight at once, so the balancer
+// sheds load instead of piling up requests it cannot serve. Requests over the
+// limit can wait in a short queue for a slot to free up.
+type Limiter struct {
+	slots      chan struct{}
+	queueDepth int64
+	queued     atomic.Int64
+}
+
+// NewLimiter creates a Limiter that lets max requests in at once and lets up
+// to queueDepth more wait for a slot. A queueDepth of zero rejects requests
+// over the limit right away.
+func NewLimiter(max, queueDepth int) *Limiter {
+	return &Limiter{
+		slots:      make(chan struct{}, max),
+		queueDepth: int64(queueDepth),
+	}
+}
+
+// Acquire takes a slot and reports whether it did. When every slot is taken
+// it waits in the queue until one frees up or ctx is done, or gives up at
+// once if the queue is full. Every successful Acquire must be paired with a
+// Release.
+func (l *Limiter) Acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.queued.Add(1) > l.queueDepth {
+		l.queued.Add(-1)
+		return false
+	}
+	defer l.queued.Add(-1)
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Release frees a slot taken by Acquire.
+func (l *Limiter) Release() {
+	<-l.slots
+}
+
+// Inflight returns how many slots are taken.
+func (l *Limiter) Inflight() int {
+	return len(l.slots)
+}
+
+// Queued returns how many requests are waiting for a slot.
+func (l *Limiter) Queued() int {
+	return int(l.queued.Load())
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"math"
+	"time"
+
+	"balancer/internal/discovery"
+	"balancer/internal/metrics"
+)
+
+// backendLatency is the time backends take to answer, by backend address
+// and pod, so a single slow pod stands out.
+var backendLatency = metrics.Default.Summary("balancer_backend_latency_seconds",
+	"Time for a backend to answer a proxied request, over the last minute.", "backend", "pod")
+
+// observeLatency records that backend answered in latency.
+func observeLatency(backend discovery.Backend, latency time.Duration) {
+	backendLatency.With(backend.Address, backend.PodName).Observe(latency.Seconds())
+}
+
+// latencyOf returns the recent latency quantiles of backend, or nil when
+// it answered no requests in the last minute.
+func latencyOf(backend discovery.Backend) *Latency {
+	summary, ok := backendLatency.Get(backend.Address, backend.PodName)
+	if !ok {
+		return nil
+	}
+	quantiles := summary.Quantiles(0.5, 0.95, 0.99)
+	if math.IsNaN(quantiles[0]) {
+		return nil
+	}
+	return &Latency{P50: quantiles[0] * 1000, P95: quantiles[1] * 1000, P99: quantiles[2] * 1000}
+}
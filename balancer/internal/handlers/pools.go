@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"pkg/logging"
+)
+
+// mirrorTimeout bounds a mirrored request, so a stuck shadow pool cannot
+// pile up goroutines.
+const mirrorTimeout = 30 * time.Second
+
+// Mirror copies Percent of a route's requests to Pool once they have been
+// answered. The shadow responses are thrown away, so a new backend version
+// can see production traffic without clients noticing. Pool's Limit caps
+// the mirrored requests in flight; copies over it are dropped.
+type Mirror struct {
+	Pool    *BalanceHandler
+	Percent int
+}
+
+// send copies r to the shadow pool in the background if it is sampled. A
+// request with a streamed body is only copied when its body was buffered,
+// since the original has already been read.
+func (m *Mirror) send(r *http.Request) {
+	if m.Percent <= 0 || rand.Intn(100) >= m.Percent { // #nosec G404 -- sampling does not need crypto randomness
+		return
+	}
+	hasBody := r.Body != nil && r.Body != http.NoBody
+	if hasBody && r.GetBody == nil {
+		logging.Debug("Not mirroring %s, its body was streamed", r.URL.Path)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), mirrorTimeout)
+	shadow := r.Clone(ctx)
+	shadow.Body = http.NoBody
+	if hasBody {
+		body, err := r.GetBody()
+		if err != nil {
+			cancel()
+			logging.Warning("Not mirroring %s: %v", r.URL.Path, err)
+			return
+		}
+		shadow.Body = body
+	}
+
+	w := &discardWriter{header: make(http.Header)}
+	leave, ok := m.Pool.admit(w, shadow)
+	if !ok {
+		cancel()
+		return
+	}
+	go func() {
+		defer cancel()
+		defer leave()
+		m.Pool.forward(w, shadow)
+	}()
+}
+
+// Canary sends a share of a route's requests to another pool, typically a
+// new version of the backend, and leaves the rest on the route's own
+// backends. The share can be changed at runtime.
+type Canary struct {
+	Pool    *BalanceHandler
+	percent atomic.Int32
+}
+
+// NewCanary creates a Canary that sends percent of requests to pool.
+func NewCanary(pool *BalanceHandler, percent int) *Canary {
+	c := &Canary{Pool: pool}
+	c.percent.Store(int32(percent))
+	return c
+}
+
+// Percent returns the share of requests sent to the canary pool.
+func (c *Canary) Percent() int {
+	return int(c.percent.Load())
+}
+
+// SetPercent changes the share of requests sent to the canary pool.
+func (c *Canary) SetPercent(percent int) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("canary percent must be between 0 and 100, got %d", percent)
+	}
+	c.percent.Store(int32(percent))
+	return nil
+}
+
+// pick reports whether a request goes to the canary pool.
+func (c *Canary) pick() bool {
+	percent := c.Percent()
+	return percent > 0 && rand.Intn(100) < percent // #nosec G404 -- traffic splitting does not need crypto randomness
+}
+
+// Names of the two BlueGreen pools.
+const (
+	Blue  = "blue"
+	Green = "green"
+)
+
+// BlueGreen sends all of a route's requests to whichever of two pools is
+// active. Switching is atomic, so a cutover takes effect on the next request
+// and can be undone the same way. Requests already in flight finish on the
+// pool they started on.
+type BlueGreen struct {
+	Blue   *BalanceHandler
+	Green  *BalanceHandler
+	active atomic.Pointer[string]
+}
+
+// NewBlueGreen creates a BlueGreen with active, Blue or Green, serving.
+func NewBlueGreen(blue, green *BalanceHandler, active string) (*BlueGreen, error) {
+	bg := &BlueGreen{Blue: blue, Green: green}
+	if err := bg.SetActive(active); err != nil {
+		return nil, err
+	}
+	return bg, nil
+}
+
+// Active returns the name of the pool that is serving.
+func (bg *BlueGreen) Active() string {
+	return *bg.active.Load()
+}
+
+// SetActive makes the named pool serve all new requests.
+func (bg *BlueGreen) SetActive(name string) error {
+	if name != Blue && name != Green {
+		return fmt.Errorf("unknown pool %q, set %s or %s", name, Blue, Green)
+	}
+	bg.active.Store(&name)
+	return nil
+}
+
+// pool returns the handler of the active pool.
+func (bg *BlueGreen) pool() *BalanceHandler {
+	if bg.Active() == Green {
+		return bg.Green
+	}
+	return bg.Blue
+}
+
+// discardWriter is the ResponseWriter for mirrored requests, whose responses
+// nobody reads.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (d *discardWriter) WriteHeader(int) {}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"balancer/internal/discovery"
+)
+
+// Swap serves with the handler it was last given, so a reloaded config can
+// take over without restarting the listeners. Requests already in flight
+// finish on the handler they started on.
+type Swap struct {
+	current atomic.Pointer[swapped]
+}
+
+// swapped is a handler with the muxes it was registered on, so requests do
+// not rebuild them.
+type swapped struct {
+	handler *BalanceHandler
+	mux     *http.ServeMux
+	admin   *http.ServeMux
+}
+
+// NewSwap returns a Swap serving with handler.
+func NewSwap(handler *BalanceHandler) *Swap {
+	s := &Swap{}
+	s.Store(handler)
+	return s
+}
+
+// Load returns the handler currently serving.
+func (s *Swap) Load() *BalanceHandler {
+	return s.current.Load().handler
+}
+
+// Store makes handler serve every new request and returns the handler it
+// replaced, or nil.
+func (s *Swap) Store(handler *BalanceHandler) *BalanceHandler {
+	next := &swapped{handler: handler, mux: http.NewServeMux(), admin: http.NewServeMux()}
+	handler.Register(next.mux)
+	handler.RegisterAdmin(next.admin)
+	old := s.current.Swap(next)
+	if old == nil {
+		return nil
+	}
+	return old.handler
+}
+
+// ServeHTTP serves the endpoints of Register with the current handler.
+func (s *Swap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.current.Load().mux.ServeHTTP(w, r)
+}
+
+// Admin returns a handler serving the endpoints of RegisterAdmin with the
+// current handler.
+func (s *Swap) Admin() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.current.Load().admin.ServeHTTP(w, r)
+	})
+}
+
+// Acquire picks a backend with the current handler, for the tcp and udp
+// proxies.
+func (s *Swap) Acquire(r *http.Request) (discovery.Backend, func(), error) {
+	return s.Load().Acquire(r)
+}
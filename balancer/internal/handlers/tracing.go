@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"balancer/internal/discovery"
+	"balancer/internal/proxy"
+)
+
+// tracerName is the instrumentation scope of the balancer's spans.
+const tracerName = "balancer/internal/handlers"
+
+// Attributes the balancer adds to its spans.
+var (
+	backendPodKey = attribute.Key("balancer.backend.pod")
+	retriesKey    = attribute.Key("balancer.retries")
+)
+
+// startSpan starts the server span of r, continuing the trace of the
+// traceparent it arrived with, and returns r carrying the span. The span is
+// a no-op unless a tracer provider was set with otel.SetTracerProvider.
+func startSpan(r *http.Request, route *Route) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	name := r.Method
+	attrs := []attribute.KeyValue{
+		semconv.HTTPRequestMethodKey.String(r.Method),
+		semconv.URLPath(r.URL.Path),
+		semconv.ServerAddress(r.Host),
+		semconv.ClientAddress(clientAddress(r)),
+	}
+	if route != nil {
+		name += " " + route.PathPrefix
+		attrs = append(attrs, semconv.HTTPRoute(route.PathPrefix))
+	}
+	ctx, span := otel.Tracer(tracerName).Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+	if !span.IsRecording() {
+		return r, span
+	}
+	return r.WithContext(ctx), span
+}
+
+// endSpan records on span the response written through aw and ends it.
+func endSpan(span trace.Span, aw *accessWriter) {
+	span.SetAttributes(
+		semconv.HTTPResponseStatusCode(aw.status),
+		semconv.HTTPResponseBodySize(int(aw.bytes)),
+		retriesKey.Int(max(aw.attempts-1, 0)),
+	)
+	if aw.attempts > 0 {
+		span.SetAttributes(semconv.NetworkPeerAddress(aw.backend.Address), backendPodKey.String(aw.backend.PodName))
+	}
+	if aw.status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(aw.status))
+	}
+	span.End()
+}
+
+// startAttempt starts a client span for one try of r on backend, when r is
+// traced, and returns r carrying it so the proxy sends its traceparent on.
+func startAttempt(w http.ResponseWriter, r *http.Request, backend discovery.Backend) (*http.Request, trace.Span) {
+	if !trace.SpanFromContext(r.Context()).IsRecording() {
+		return r, nil
+	}
+	resends := 0
+	if aw, ok := w.(*accessWriter); ok {
+		resends = aw.attempts
+	}
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), r.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.ServerAddress(backend.Address),
+			backendPodKey.String(backend.PodName),
+			semconv.HTTPRequestResendCount(resends),
+		))
+	return r.WithContext(ctx), span
+}
+
+// endAttempt records how the try went on span and ends it. A nil span, for
+// requests that are not traced, is skipped.
+func endAttempt(span trace.Span, result proxy.Result) {
+	if span == nil {
+		return
+	}
+	if result.Status != 0 {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(result.Status))
+	}
+	switch {
+	case result.Err != nil:
+		span.RecordError(result.Err)
+		span.SetStatus(codes.Error, result.Err.Error())
+	case result.Status >= http.StatusInternalServerError:
+		span.SetStatus(codes.Error, http.StatusText(result.Status))
+	}
+	span.End()
+}
@@ -0,0 +1,101 @@
+package healthcheck
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+const defaultWebhookTimeout = 5 * time.Second
+
+// Event is a backend going in or out of rotation.
+type Event struct {
+	// Pool is the name of the checker the backend belongs to.
+	Pool      string `json:"pool"`
+	Address   string `json:"address"`
+	PodName   string `json:"podname"`
+	Namespace string `json:"namespace,omitempty"`
+	// Healthy is true when the backend came back, false when it was taken
+	// out.
+	Healthy bool   `json:"healthy"`
+	Reason  string `json:"reason"`
+	// Error is the last failure seen, when the backend was taken out.
+	Error string `json:"error,omitempty"`
+	// PassesNeeded is how many probes in a row a backend taken out has to
+	// pass to come back.
+	PassesNeeded int       `json:"passesneeded,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+func (hc *Checker) event(backend discovery.Backend, healthy bool, reason string, err error) Event {
+	event := Event{
+		Pool:      hc.name,
+		Address:   backend.Address,
+		PodName:   backend.PodName,
+		Namespace: backend.Namespace,
+		Healthy:   healthy,
+		Reason:    reason,
+		Time:      time.Now().UTC(),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	return event
+}
+
+// notify logs event as JSON, so it can be picked out of the logs, and hands
+// it to OnChange. hc.mu must not be held.
+func (hc *Checker) notify(event Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		logging.Error("Failed to encode the health event of %s: %v", event.Address, err)
+		return
+	}
+	if event.Healthy {
+		logging.Info("Backend health changed: %s", data)
+	} else {
+		logging.Warning("Backend health changed: %s", data)
+	}
+	if hc.opts.OnChange != nil {
+		hc.opts.OnChange(event)
+	}
+}
+
+// Webhook returns an OnChange func that POSTs every event to url as JSON.
+// Events are sent in the background so probes never wait on the webhook,
+// and one that cannot be delivered is logged and dropped.
+func Webhook(url string, timeout time.Duration) func(Event) {
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+	return func(event Event) {
+		go func() {
+			if err := postEvent(client, url, event); err != nil {
+				logging.Warning("Failed to send the health event of %s to the webhook: %v", event.Address, err)
+			}
+		}()
+	}
+}
+
+func postEvent(client *http.Client, url string, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
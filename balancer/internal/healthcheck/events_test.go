@@ -0,0 +1,58 @@
+package healthcheck
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"balancer/internal/discovery"
+)
+
+func TestWebhook_PostsEvents(t *testing.T) {
+	events := make(chan Event, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var event Event
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		events <- event
+	}))
+	defer server.Close()
+
+	backend := discovery.Backend{Address: "10.0.0.1:8080", PodName: "api-0", Namespace: "prod"}
+	source := discovery.NewBackendList()
+	source.Replace([]discovery.Backend{backend})
+	checker := &Checker{
+		name:    "api",
+		opts:    Options{UnhealthyThreshold: 1, HealthyThreshold: 1, FlapWindow: time.Minute, OnChange: Webhook(server.URL, time.Second)},
+		source:  source,
+		healthy: discovery.NewBackendList(),
+		states:  make(map[string]*state),
+	}
+
+	event, changed := checker.record(backend, errors.New("connection refused"))
+	assert.True(t, changed)
+	checker.notify(event)
+	select {
+	case got := <-events:
+		assert.Equal(t, "api", got.Pool)
+		assert.Equal(t, "api-0", got.PodName)
+		assert.Equal(t, "prod", got.Namespace)
+		assert.False(t, got.Healthy)
+		assert.Equal(t, "failed 1 health checks", got.Reason)
+		assert.Equal(t, "connection refused", got.Error)
+		assert.Equal(t, 1, got.PassesNeeded)
+	case <-time.After(time.Second):
+		t.Fatal("The webhook was not called")
+	}
+
+	event, changed = checker.record(backend, nil)
+	assert.True(t, changed)
+	assert.True(t, event.Healthy)
+	_, changed = checker.record(backend, nil)
+	assert.False(t, changed)
+}
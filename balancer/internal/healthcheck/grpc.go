@@ -0,0 +1,119 @@
+package healthcheck
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// grpcCheckPath is the method of the standard gRPC health service.
+const grpcCheckPath = "/grpc.health.v1.Health/Check"
+
+// grpcServing is the SERVING value of HealthCheckResponse.ServingStatus.
+const grpcServing = 1
+
+// newGRPCClient returns a client speaking HTTP/2 without TLS, which gRPC
+// servers expect from plaintext clients.
+func newGRPCClient() *http.Client {
+	transport := &http.Transport{DisableKeepAlives: true}
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: transport}
+}
+
+// probeGRPC calls the health service's Check on address for the configured
+// service, "" asking about the server as a whole, and fails unless the
+// answer is SERVING.
+func (hc *Checker) probeGRPC(ctx context.Context, address string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+address+grpcCheckPath, bytes.NewReader(grpcCheckRequest(hc.opts.Service)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := hc.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("answered %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return err
+	}
+	// The status comes in the trailers, or in the headers when the server
+	// answers with nothing else.
+	trailer := resp.Trailer
+	if trailer.Get("Grpc-Status") == "" {
+		trailer = resp.Header
+	}
+	if status := trailer.Get("Grpc-Status"); status != "0" {
+		return fmt.Errorf("answered grpc status %q: %s", status, trailer.Get("Grpc-Message"))
+	}
+	serving, err := grpcServingStatus(body)
+	if err != nil {
+		return err
+	}
+	if serving != grpcServing {
+		return fmt.Errorf("serving status is %d", serving)
+	}
+	return nil
+}
+
+// grpcCheckRequest frames a HealthCheckRequest for service. The message
+// has a single string field, so it is encoded by hand.
+func grpcCheckRequest(service string) []byte {
+	var message []byte
+	if service != "" {
+		message = append(message, 0x0a)
+		message = binary.AppendUvarint(message, uint64(len(service)))
+		message = append(message, service...)
+	}
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// grpcServingStatus reads the status out of a framed HealthCheckResponse.
+// A message without the field has the default, UNKNOWN.
+func grpcServingStatus(frame []byte) (uint64, error) {
+	if len(frame) < 5 {
+		return 0, errors.New("answer has no message")
+	}
+	if frame[0] != 0 {
+		return 0, errors.New("answer is compressed")
+	}
+	length := binary.BigEndian.Uint32(frame[1:5])
+	message := frame[5:]
+	if uint32(len(message)) < length {
+		return 0, errors.New("answer is cut short")
+	}
+	message = message[:length]
+	var status uint64
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return 0, errors.New("answer is not a health check response")
+		}
+		message = message[n:]
+		if key&7 != 0 {
+			// Only varints are expected, so anything else is not understood.
+			return 0, fmt.Errorf("unexpected field %d in the answer", key>>3)
+		}
+		value, n := binary.Uvarint(message)
+		if n <= 0 {
+			return 0, errors.New("answer is not a health check response")
+		}
+		message = message[n:]
+		if key>>3 == 1 {
+			status = value
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,60 @@
+package healthcheck
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"balancer/internal/discovery"
+)
+
+// grpcHealthServer answers Check with status for the service "api".
+func grpcHealthServer(t *testing.T, status byte) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, grpcCheckPath, r.URL.Path)
+		assert.Equal(t, "application/grpc", r.Header.Get("Content-Type"))
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, grpcCheckRequest("api"), body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte{0, 0, 0, 0, 2, 0x08, status})
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	return server
+}
+
+func TestBackends_GRPC(t *testing.T) {
+	serving := grpcHealthServer(t, 1)
+	defer serving.Close()
+	notServing := grpcHealthServer(t, 2)
+	defer notServing.Close()
+
+	up := strings.TrimPrefix(serving.URL, "http://")
+	down := strings.TrimPrefix(notServing.URL, "http://")
+	source := discovery.NewBackendList()
+	source.Replace([]discovery.Backend{{Address: up}, {Address: down}})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	list := New("api", source, Options{Type: TypeGRPC, Service: "api", Interval: 10 * time.Millisecond, UnhealthyThreshold: 1}, stopCh).Backends()
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{up}, addresses(list))
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestGRPCServingStatus(t *testing.T) {
+	status, err := grpcServingStatus([]byte{0, 0, 0, 0, 0})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), status)
+
+	_, err = grpcServingStatus([]byte{0, 0, 0, 0, 2, 0x08})
+	assert.Error(t, err)
+}
@@ -0,0 +1,505 @@
+// Package healthcheck probes backends and keeps those failing their probes
+// out of rotation, whatever discovery says about them.
+package healthcheck
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"balancer/internal/discovery"
+)
+
+const (
+	defaultPath               = "/healthz"
+	defaultInterval           = 5 * time.Second
+	defaultTimeout            = 2 * time.Second
+	defaultUnhealthyThreshold = 2
+	defaultHealthyThreshold   = 2
+	defaultFlapWindow         = time.Minute
+	// maxBodySize is how much of an answer is read to match its body.
+	maxBodySize = 64 << 10
+	// maxFlaps caps the doubling of HealthyThreshold for flapping
+	// backends at eight times.
+	maxFlaps = 3
+)
+
+// Probe types.
+const (
+	// TypeHTTP probes ask for a path and pass on an expected status.
+	TypeHTTP = "http"
+	// TypeTCP probes pass when a connection can be opened, for backends
+	// that do not speak HTTP.
+	TypeTCP = "tcp"
+	// TypeGRPC probes call the standard grpc.health.v1 Check and pass on
+	// SERVING.
+	TypeGRPC = "grpc"
+)
+
+// Options set how backends are probed. Zero fields use the defaults.
+type Options struct {
+	// Type is how backends are probed, TypeHTTP, TypeTCP or TypeGRPC.
+	// Defaults to TypeHTTP.
+	Type string
+	// Path is requested on every backend by HTTP probes. Defaults to
+	// "/healthz".
+	Path string
+	// Method of HTTP probes. Defaults to GET.
+	Method string
+	// Host is the Host header of HTTP probes. Defaults to the address
+	// probed.
+	Host string
+	// Headers are set on HTTP probes.
+	Headers map[string]string
+	// StatusCodes are the answers HTTP probes pass on. Defaults to any 2xx
+	// or 3xx status.
+	StatusCodes []int
+	// Body, when set, is the body HTTP probes pass on, ignoring the white
+	// space around it.
+	Body string
+	// JSONField, when set, is a field of the JSON body that has to hold
+	// JSONValue, e.g. "status" for {"status": "ok"}. Nested fields are
+	// separated by dots.
+	JSONField string
+	// JSONValue is compared as a string to JSONField's value, so "ok",
+	// "true" and "1" match the string, boolean and number.
+	JSONValue string
+	// Service is the service gRPC probes ask about. Empty asks about the
+	// server as a whole.
+	Service string
+	// Port is probed on backends without a port of their own. Zero probes
+	// them on the port traffic goes to, which must then be set here too.
+	Port int
+	// Interval is the time between two probes of a backend. Defaults to 5
+	// seconds.
+	Interval time.Duration
+	// Jitter delays each probe by a random time up to this long, so the
+	// backends, and balancers probing the same backends, are not all probed
+	// at the same instant. Zero probes every backend at once.
+	Jitter time.Duration
+	// Timeout is how long a probe may take. Defaults to 2 seconds.
+	Timeout time.Duration
+	// UnhealthyThreshold takes a backend out after this many failed probes
+	// in a row. Defaults to 2.
+	UnhealthyThreshold int
+	// HealthyThreshold puts a backend back after this many passed probes in
+	// a row. Defaults to 2.
+	HealthyThreshold int
+	// FlapWindow is how long a backend has to stay in after coming back
+	// for it to count as recovered. Each time it is taken out sooner, it
+	// needs twice as many passes to come back, up to eight times
+	// HealthyThreshold. Defaults to 1 minute.
+	FlapWindow time.Duration
+	// RampWindow eases a backend that came back into rotation, its share
+	// of traffic growing from nothing to full over this long. Zero puts it
+	// back at full share at once.
+	RampWindow time.Duration
+	// OnChange is called with every backend going in or out of rotation,
+	// after the change is logged. See Webhook.
+	OnChange func(Event)
+	// Passive also takes backends out on failing live requests, reported
+	// with Observe. Nil leaves it to the probes.
+	Passive *PassiveOptions
+	// Client sends HTTP and gRPC probes. Defaults to a client without
+	// keep-alives, so every probe also proves the backend takes new
+	// connections, speaking HTTP/2 without TLS for gRPC.
+	Client *http.Client
+}
+
+// Checker probes the backends of one list.
+type Checker struct {
+	name    string
+	opts    Options
+	probe   func(ctx context.Context, address string) error
+	source  *discovery.BackendList
+	healthy *discovery.BackendList
+
+	mu sync.Mutex
+	// states is keyed by backend address. A backend without a state has
+	// not been probed yet and counts as healthy.
+	states map[string]*state
+	// present holds the addresses of the source as last published.
+	present map[string]bool
+}
+
+// state is what the checker knows about one backend.
+type state struct {
+	failing   bool
+	failures  int
+	successes int
+	lastCheck time.Time
+	lastError error
+	traffic   traffic
+	// recovered is when the backend last came back, and flaps how many
+	// times in a row it was taken out within FlapWindow of that.
+	recovered time.Time
+	flaps     int
+}
+
+// New starts probing the backends of source until stopCh is closed. New
+// backends are in rotation until they fail, so a discovery update is never
+// held back by probes. name is only used in logs.
+func New(name string, source *discovery.BackendList, opts Options, stopCh <-chan struct{}) *Checker {
+	if opts.Type == "" {
+		opts.Type = TypeHTTP
+	}
+	if opts.Path == "" {
+		opts.Path = defaultPath
+	}
+	if opts.Method == "" {
+		opts.Method = http.MethodGet
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultInterval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.UnhealthyThreshold <= 0 {
+		opts.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+	if opts.HealthyThreshold <= 0 {
+		opts.HealthyThreshold = defaultHealthyThreshold
+	}
+	if opts.FlapWindow <= 0 {
+		opts.FlapWindow = defaultFlapWindow
+	}
+	if p := opts.Passive; p != nil {
+		passive := *p
+		if passive.ConsecutiveFailures <= 0 {
+			passive.ConsecutiveFailures = defaultPassiveConsecutiveFailures
+		}
+		if passive.MinRequests <= 0 {
+			passive.MinRequests = defaultPassiveMinRequests
+		}
+		if passive.Window <= 0 {
+			passive.Window = defaultPassiveWindow
+		}
+		opts.Passive = &passive
+	}
+	if opts.Client == nil && opts.Type == TypeGRPC {
+		opts.Client = newGRPCClient()
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	}
+	hc := &Checker{
+		name:    name,
+		opts:    opts,
+		source:  source,
+		healthy: discovery.NewBackendList(),
+		states:  make(map[string]*state),
+	}
+	switch opts.Type {
+	case TypeTCP:
+		hc.probe = probeTCP
+	case TypeGRPC:
+		hc.probe = hc.probeGRPC
+	default:
+		hc.probe = hc.probeHTTP
+	}
+	source.OnReplace(hc.publish)
+	hc.publish()
+	go hc.run(stopCh)
+	return hc
+}
+
+// Backends returns the backends of the source that pass their probes, kept
+// up to date as the source changes and probes come back.
+func (hc *Checker) Backends() *discovery.BackendList {
+	return hc.healthy
+}
+
+// BackendHealth is the probe state of one backend.
+type BackendHealth struct {
+	Backend discovery.Backend
+	// Healthy is false while the backend is out of rotation.
+	Healthy bool
+	// LastCheck is when the last probe came back, zero before the first.
+	LastCheck time.Time
+	// ConsecutiveFailures counts the failed probes since the last pass.
+	ConsecutiveFailures int
+	// LastError is why the last probe failed, nil when it passed.
+	LastError error
+}
+
+// Health returns the health of every backend of the source, in the order
+// of the source.
+func (hc *Checker) Health() []BackendHealth {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	backends := hc.source.GetAll()
+	health := make([]BackendHealth, len(backends))
+	for i, backend := range backends {
+		health[i] = BackendHealth{Backend: backend, Healthy: true}
+		if st, ok := hc.states[backend.Address]; ok {
+			health[i].Healthy = !st.failing
+			health[i].LastCheck = st.lastCheck
+			health[i].ConsecutiveFailures = st.failures
+			health[i].LastError = st.lastError
+		}
+	}
+	return health
+}
+
+func (hc *Checker) run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(hc.opts.Interval)
+	defer ticker.Stop()
+	for {
+		hc.probeAll(stopCh)
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeAll probes every backend of the source, each after its jitter, and
+// publishes the outcome. Probes still waiting when stopCh closes are not
+// sent.
+func (hc *Checker) probeAll(stopCh <-chan struct{}) {
+	backends := hc.source.GetAll()
+	errs := make([]error, len(backends))
+	var wg sync.WaitGroup
+	for i, backend := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if hc.opts.Jitter > 0 {
+				delay := time.NewTimer(time.Duration(rand.Int63n(int64(hc.opts.Jitter)))) // #nosec G404 -- spreading probes does not need crypto randomness
+				defer delay.Stop()
+				select {
+				case <-stopCh:
+					return
+				case <-delay.C:
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), hc.opts.Timeout)
+			defer cancel()
+			errs[i] = hc.probe(ctx, backend.HostPort(hc.opts.Port))
+		}()
+	}
+	wg.Wait()
+
+	var events []Event
+	hc.mu.Lock()
+	for i, backend := range backends {
+		if event, changed := hc.record(backend, errs[i]); changed {
+			events = append(events, event)
+		}
+	}
+	hc.mu.Unlock()
+	hc.publish()
+	for _, event := range events {
+		hc.notify(event)
+	}
+}
+
+// probeHTTP asks address for the health path and fails unless it answers
+// with one of the expected statuses.
+func (hc *Checker) probeHTTP(ctx context.Context, address string) error {
+	url := "http://" + address + hc.opts.Path
+	req, err := http.NewRequestWithContext(ctx, hc.opts.Method, url, nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range hc.opts.Headers {
+		req.Header.Set(name, value)
+	}
+	if hc.opts.Host != "" {
+		req.Host = hc.opts.Host
+	}
+	resp, err := hc.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !hc.expected(resp.StatusCode) {
+		return fmt.Errorf("answered %s", resp.Status)
+	}
+	if hc.opts.Body == "" && hc.opts.JSONField == "" {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return fmt.Errorf("failed to read the answer: %w", err)
+	}
+	return hc.matchBody(body)
+}
+
+// matchBody fails unless body is the expected Body and holds JSONValue in
+// JSONField.
+func (hc *Checker) matchBody(body []byte) error {
+	if hc.opts.Body != "" && strings.TrimSpace(string(body)) != hc.opts.Body {
+		return fmt.Errorf("answered %q, expected %q", truncate(body), hc.opts.Body)
+	}
+	if hc.opts.JSONField == "" {
+		return nil
+	}
+	var value any
+	if err := json.Unmarshal(body, &value); err != nil {
+		return fmt.Errorf("answer is not json: %w", err)
+	}
+	for _, name := range strings.Split(hc.opts.JSONField, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("answer has no field %s", hc.opts.JSONField)
+		}
+		if value, ok = object[name]; !ok {
+			return fmt.Errorf("answer has no field %s", hc.opts.JSONField)
+		}
+	}
+	got, ok := value.(string)
+	if !ok {
+		encoded, _ := json.Marshal(value)
+		got = string(encoded)
+	}
+	if got != hc.opts.JSONValue {
+		return fmt.Errorf("answered %s %q, expected %q", hc.opts.JSONField, got, hc.opts.JSONValue)
+	}
+	return nil
+}
+
+// truncate shortens body for an error message.
+func truncate(body []byte) string {
+	const limit = 64
+	if len(body) > limit {
+		return string(body[:limit]) + "..."
+	}
+	return string(body)
+}
+
+func (hc *Checker) expected(status int) bool {
+	if len(hc.opts.StatusCodes) == 0 {
+		return status >= 200 && status < 400
+	}
+	return slices.Contains(hc.opts.StatusCodes, status)
+}
+
+// probeTCP fails unless a connection to address can be opened.
+func probeTCP(ctx context.Context, address string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// record counts the outcome of a probe of backend and flips it between
+// healthy and failing once a threshold is reached, returning the event
+// when it did. hc.mu must be held.
+func (hc *Checker) record(backend discovery.Backend, err error) (Event, bool) {
+	st := hc.state(backend.Address)
+	st.lastCheck = time.Now()
+	st.lastError = err
+	if err != nil {
+		st.successes = 0
+		st.failures++
+		if st.failing || st.failures < hc.opts.UnhealthyThreshold {
+			return Event{}, false
+		}
+		hc.takeOut(st)
+		event := hc.event(backend, false, fmt.Sprintf("failed %d health checks", st.failures), err)
+		event.PassesNeeded = hc.passesNeeded(st)
+		return event, true
+	}
+	st.failures = 0
+	st.successes++
+	if !st.failing || st.successes < hc.passesNeeded(st) {
+		return Event{}, false
+	}
+	st.failing = false
+	st.recovered = time.Now()
+	st.traffic = traffic{}
+	return hc.event(backend, true, fmt.Sprintf("passed %d health checks", st.successes), nil), true
+}
+
+// takeOut marks st failing, counting a flap when it had come back less than
+// FlapWindow ago. hc.mu must be held.
+func (hc *Checker) takeOut(st *state) {
+	if !st.recovered.IsZero() && time.Since(st.recovered) < hc.opts.FlapWindow {
+		st.flaps = min(st.flaps+1, maxFlaps)
+	} else {
+		st.flaps = 0
+	}
+	st.failing = true
+	st.successes = 0
+}
+
+// passesNeeded is how many probes in a row st has to pass to come back.
+func (hc *Checker) passesNeeded(st *state) int {
+	return hc.opts.HealthyThreshold << st.flaps
+}
+
+// Ramp leaves out each backend that came back less than RampWindow ago with
+// the chance it still has to ramp, so its share of traffic grows back
+// linearly. Other backends, and backends the checker does not know, are
+// kept. If that would leave nothing, backends are returned as they are. A
+// nil checker keeps every backend.
+func (hc *Checker) Ramp(backends []discovery.Backend) []discovery.Backend {
+	if hc == nil || hc.opts.RampWindow <= 0 {
+		return backends
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	admitted := make([]discovery.Backend, 0, len(backends))
+	for _, backend := range backends {
+		if st, ok := hc.states[backend.Address]; ok && !st.recovered.IsZero() {
+			ramp := float64(time.Since(st.recovered)) / float64(hc.opts.RampWindow)
+			if ramp < 1 && rand.Float64() >= ramp { // #nosec G404 -- traffic shaping does not need crypto randomness
+				continue
+			}
+		}
+		admitted = append(admitted, backend)
+	}
+	if len(admitted) == 0 {
+		return backends
+	}
+	return admitted
+}
+
+// state returns the state of address, creating it. hc.mu must be held.
+func (hc *Checker) state(address string) *state {
+	st, ok := hc.states[address]
+	if !ok {
+		st = &state{}
+		hc.states[address] = st
+	}
+	return st
+}
+
+// publish replaces the healthy list with the source's backends that are
+// not failing, and forgets backends that left the source.
+func (hc *Checker) publish() {
+	// Holding the lock over Replace keeps an older view from being
+	// published over a newer one.
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	backends := hc.source.GetAll()
+	present := make(map[string]bool, len(backends))
+	healthy := make([]discovery.Backend, 0, len(backends))
+	for _, backend := range backends {
+		present[backend.Address] = true
+		if st, ok := hc.states[backend.Address]; ok && st.failing {
+			continue
+		}
+		healthy = append(healthy, backend)
+	}
+	for address := range hc.states {
+		if !present[address] {
+			delete(hc.states, address)
+		}
+	}
+	hc.present = present
+	hc.healthy.Replace(healthy)
+}
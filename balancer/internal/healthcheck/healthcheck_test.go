@@ -0,0 +1,205 @@
+package healthcheck
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"balancer/internal/discovery"
+)
+
+func addresses(list *discovery.BackendList) []string {
+	var result []string
+	for _, backend := range list.GetAll() {
+		result = append(result, backend.Address)
+	}
+	return result
+}
+
+func TestBackends_TakesFailingBackendsOut(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/healthz", r.URL.Path)
+	}))
+	defer healthy.Close()
+	var failing atomic.Bool
+	failing.Store(true)
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer flaky.Close()
+
+	good := strings.TrimPrefix(healthy.URL, "http://")
+	bad := strings.TrimPrefix(flaky.URL, "http://")
+	source := discovery.NewBackendList()
+	source.Replace([]discovery.Backend{{Address: good}, {Address: bad}})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	checker := New("api", source, Options{Interval: 10 * time.Millisecond, UnhealthyThreshold: 2, HealthyThreshold: 2}, stopCh)
+	list := checker.Backends()
+
+	// Backends are in until they fail enough probes.
+	assert.ElementsMatch(t, []string{good, bad}, addresses(list))
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{good}, addresses(list))
+	}, time.Second, 5*time.Millisecond)
+	for _, health := range checker.Health() {
+		if health.Backend.Address == bad {
+			assert.False(t, health.Healthy)
+			assert.GreaterOrEqual(t, health.ConsecutiveFailures, 2)
+			assert.ErrorContains(t, health.LastError, "503")
+		}
+	}
+
+	failing.Store(false)
+	assert.Eventually(t, func() bool {
+		return len(addresses(list)) == 2
+	}, time.Second, 5*time.Millisecond)
+
+	// Discovery changes come through without waiting for a probe.
+	source.Replace([]discovery.Backend{{Address: good}})
+	assert.Equal(t, []string{good}, addresses(list))
+}
+
+func TestBackends_TCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	// Nothing listens on a port just given back.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	up, down := listener.Addr().String(), closed.Addr().String()
+	source := discovery.NewBackendList()
+	source.Replace([]discovery.Backend{{Address: up}, {Address: down}})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	list := New("db", source, Options{Type: TypeTCP, Interval: 10 * time.Millisecond, Jitter: 5 * time.Millisecond, UnhealthyThreshold: 1}, stopCh).Backends()
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{up}, addresses(list))
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestBackends_HTTPRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodHead, r.Method)
+		assert.Equal(t, "/ping", r.URL.Path)
+		assert.Equal(t, "admin.internal", r.Host)
+		assert.Equal(t, "balancer", r.Header.Get("X-Probe"))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	address := strings.TrimPrefix(server.URL, "http://")
+	source := discovery.NewBackendList()
+	source.Replace([]discovery.Backend{{Address: address}})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	opts := Options{
+		Path:               "/ping",
+		Method:             http.MethodHead,
+		Host:               "admin.internal",
+		Headers:            map[string]string{"X-Probe": "balancer"},
+		StatusCodes:        []int{http.StatusNoContent},
+		Interval:           time.Hour,
+		UnhealthyThreshold: 1,
+	}
+	checker := New("admin", source, opts, stopCh)
+	checker.probeAll(stopCh)
+	assert.Len(t, checker.Backends().GetAll(), 1)
+
+	// A status that is usually fine fails when it is not expected.
+	opts.StatusCodes = []int{http.StatusOK}
+	checker = New("admin", source, opts, stopCh)
+	checker.probeAll(stopCh)
+	assert.Empty(t, checker.Backends().GetAll())
+}
+
+func TestChecker_FlapsAndRamps(t *testing.T) {
+	var addrs []string
+	for range 2 {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+		addrs = append(addrs, strings.TrimPrefix(server.URL, "http://"))
+	}
+	a, b := discovery.Backend{Address: addrs[0]}, discovery.Backend{Address: addrs[1]}
+	source := discovery.NewBackendList()
+	source.Replace([]discovery.Backend{a, b})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	checker := New("api", source, Options{Interval: time.Hour, UnhealthyThreshold: 1, HealthyThreshold: 1, RampWindow: time.Hour}, stopCh)
+	// Wait out the first round of probes, the next is an hour away.
+	assert.Eventually(t, func() bool {
+		for _, health := range checker.Health() {
+			if health.LastCheck.IsZero() {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 5*time.Millisecond)
+
+	checker.mu.Lock()
+	checker.record(a, errors.New("down"))
+	checker.record(a, nil)
+	checker.mu.Unlock()
+	// a just came back, so it gets next to no traffic unless it is all
+	// there is.
+	assert.Equal(t, []discovery.Backend{b}, checker.Ramp([]discovery.Backend{a, b}))
+	assert.Equal(t, []discovery.Backend{a}, checker.Ramp([]discovery.Backend{a}))
+
+	// Failing again right away doubles the passes it needs.
+	checker.mu.Lock()
+	checker.record(a, errors.New("down"))
+	checker.record(a, nil)
+	assert.True(t, checker.states[a.Address].failing)
+	checker.record(a, nil)
+	assert.False(t, checker.states[a.Address].failing)
+	checker.mu.Unlock()
+}
+
+func TestMatchBody(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		body string
+		ok   bool
+	}{
+		{"exact body", Options{Body: "OK"}, "OK\n", true},
+		{"other body", Options{Body: "OK"}, "DEGRADED", false},
+		{"json string", Options{JSONField: "status", JSONValue: "ok"}, `{"status": "ok"}`, true},
+		{"json mismatch", Options{JSONField: "status", JSONValue: "ok"}, `{"status": "degraded"}`, false},
+		{"nested json", Options{JSONField: "checks.db", JSONValue: "true"}, `{"checks": {"db": true}}`, true},
+		{"missing field", Options{JSONField: "checks.db", JSONValue: "true"}, `{"checks": "db"}`, false},
+		{"not json", Options{JSONField: "status", JSONValue: "ok"}, `ok`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := &Checker{opts: tt.opts}
+			err := checker.matchBody([]byte(tt.body))
+			assert.Equal(t, tt.ok, err == nil, "error: %v", err)
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package healthcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"balancer/internal/discovery"
+)
+
+const (
+	defaultPassiveConsecutiveFailures = 5
+	defaultPassiveMinRequests         = 20
+	defaultPassiveWindow              = 10 * time.Second
+)
+
+// PassiveOptions take backends out on the outcome of live requests, before
+// the next probe would notice. A backend taken out comes back once it
+// passes HealthyThreshold probes. Zero fields use the defaults.
+type PassiveOptions struct {
+	// ConsecutiveFailures takes a backend out after this many failed
+	// requests in a row. Defaults to 5.
+	ConsecutiveFailures int
+	// ErrorRatePercent takes a backend out when this share of its requests
+	// in a Window fail. Zero turns the check off.
+	ErrorRatePercent int
+	// MinRequests is how many requests a backend needs in a Window before
+	// its error rate counts. Defaults to 20.
+	MinRequests int
+	// Window is the time error rates are measured over. Defaults to 10
+	// seconds.
+	Window time.Duration
+	// StatusCodes are the answers that count as failures, besides requests
+	// that got no answer. Defaults to every 5xx status.
+	StatusCodes []int
+}
+
+// failed reports whether a request that ended with status and err counts
+// against the backend. Requests the client gave up on do not.
+func (p *PassiveOptions) failed(status int, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	if len(p.StatusCodes) == 0 {
+		return status >= http.StatusInternalServerError
+	}
+	return slices.Contains(p.StatusCodes, status)
+}
+
+// traffic is what live requests have said about one backend.
+type traffic struct {
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+}
+
+// Observe records how a live request to backend went. With passive checks
+// on, a backend that keeps failing is taken out of rotation at once.
+// Backends that are not in the checker's source are ignored, so every
+// checker of a handler may be told about every request.
+func (hc *Checker) Observe(backend discovery.Backend, status int, err error) {
+	p := hc.opts.Passive
+	if p == nil {
+		return
+	}
+	failed := p.failed(status, err)
+
+	hc.mu.Lock()
+	if !hc.present[backend.Address] {
+		hc.mu.Unlock()
+		return
+	}
+	st := hc.state(backend.Address)
+	if st.failing {
+		// Requests that were in flight when the backend was taken out say
+		// nothing new.
+		hc.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	t := &st.traffic
+	if now.Sub(t.windowStart) >= p.Window {
+		t.windowStart = now
+		t.requests = 0
+		t.failures = 0
+	}
+	t.requests++
+	if !failed {
+		t.consecutive = 0
+		hc.mu.Unlock()
+		return
+	}
+	t.consecutive++
+	t.failures++
+
+	var reason string
+	switch {
+	case t.consecutive >= p.ConsecutiveFailures:
+		reason = fmt.Sprintf("%d failed requests in a row", t.consecutive)
+	case p.ErrorRatePercent > 0 && t.requests >= p.MinRequests && t.failures*100 >= p.ErrorRatePercent*t.requests:
+		reason = fmt.Sprintf("%d of %d requests failed", t.failures, t.requests)
+	default:
+		hc.mu.Unlock()
+		return
+	}
+	hc.takeOut(st)
+	st.lastError = errors.New(reason)
+	if err == nil {
+		err = fmt.Errorf("answered %d", status)
+	}
+	event := hc.event(backend, false, reason, err)
+	event.PassesNeeded = hc.passesNeeded(st)
+	hc.mu.Unlock()
+	hc.publish()
+	hc.notify(event)
+}
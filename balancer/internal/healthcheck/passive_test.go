@@ -0,0 +1,50 @@
+package healthcheck
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"balancer/internal/discovery"
+)
+
+func TestObserve_TakesFailingBackendsOut(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+	backend := discovery.Backend{Address: address}
+	source := discovery.NewBackendList()
+	source.Replace([]discovery.Backend{backend})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	checker := New("api", source, Options{
+		Interval:         time.Hour,
+		HealthyThreshold: 1,
+		Passive:          &PassiveOptions{ConsecutiveFailures: 3, StatusCodes: []int{http.StatusBadGateway}},
+	}, stopCh)
+
+	// A 500 is not one of the failing statuses and a canceled request is
+	// the client's doing.
+	checker.Observe(backend, http.StatusInternalServerError, nil)
+	checker.Observe(backend, 0, context.Canceled)
+	checker.Observe(backend, http.StatusBadGateway, nil)
+	checker.Observe(backend, 0, errors.New("connection refused"))
+	assert.Len(t, checker.Backends().GetAll(), 1)
+
+	checker.Observe(backend, http.StatusBadGateway, nil)
+	assert.Empty(t, checker.Backends().GetAll())
+
+	// The next probe passes and brings it back.
+	checker.probeAll(stopCh)
+	assert.Len(t, checker.Backends().GetAll(), 1)
+
+	// Backends the checker does not know are left alone.
+	checker.Observe(discovery.Backend{Address: "10.9.9.9:80"}, http.StatusBadGateway, nil)
+	assert.Len(t, checker.Health(), 1)
+}
@@ -0,0 +1,222 @@
+// Package metrics keeps counters and gauges and serves them in the
+// Prometheus text format, so the balancer can be scraped without pulling in
+// a client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the registry the balancer's packages record into and /metrics
+// serves.
+var Default = NewRegistry()
+
+// Registry holds metric families by name.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// family is every series of one metric, keyed by their label values.
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*Value
+	// summaries are the series of a summary instead.
+	summaries map[string]*Summary
+}
+
+func (f *family) checkLabels(labelValues []string) {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+}
+
+// Value is one series. Its methods are safe for concurrent use.
+type Value struct {
+	labelValues []string
+	bits        atomic.Uint64
+}
+
+// Set replaces the value. Counters should only be added to.
+func (v *Value) Set(value float64) {
+	v.bits.Store(math.Float64bits(value))
+}
+
+// Add adds delta to the value.
+func (v *Value) Add(delta float64) {
+	for {
+		old := v.bits.Load()
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if v.bits.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// Inc adds one to the value.
+func (v *Value) Inc() {
+	v.Add(1)
+}
+
+// Get returns the current value.
+func (v *Value) Get() float64 {
+	return math.Float64frombits(v.bits.Load())
+}
+
+// Vec hands out the series of a family by label values.
+type Vec struct {
+	family *family
+}
+
+// With returns the series for labelValues, given in the order the labels
+// were declared, creating it at zero the first time.
+func (vec Vec) With(labelValues ...string) *Value {
+	f := vec.family
+	f.checkLabels(labelValues)
+	key := strings.Join(labelValues, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	value, ok := f.series[key]
+	if !ok {
+		value = &Value{labelValues: labelValues}
+		f.series[key] = value
+	}
+	return value
+}
+
+// Counter registers a counter, a value that only goes up, such as events
+// seen. Registering a name again returns the same family.
+func (r *Registry) Counter(name, help string, labels ...string) Vec {
+	return r.register(name, help, "counter", labels)
+}
+
+// Gauge registers a gauge, a value that goes up and down, such as a
+// backend count.
+func (r *Registry) Gauge(name, help string, labels ...string) Vec {
+	return r.register(name, help, "gauge", labels)
+}
+
+func (r *Registry) register(name, help, kind string, labels []string) Vec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.kind != kind || strings.Join(f.labels, ",") != strings.Join(labels, ",") {
+			panic("metrics: " + name + " registered twice with different types or labels")
+		}
+		return Vec{family: f}
+	}
+	f := &family{name: name, help: help, kind: kind, labels: labels,
+		series: make(map[string]*Value), summaries: make(map[string]*Summary)}
+	r.families[name] = f
+	return Vec{family: f}
+}
+
+// WriteTo writes every metric in the Prometheus text format, families and
+// series in sorted order.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	var b strings.Builder
+	for _, f := range families {
+		f.mu.Lock()
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		if f.kind == "summary" {
+			writeSummaries(&b, f)
+			f.mu.Unlock()
+			continue
+		}
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := f.series[key]
+			b.WriteString(f.name)
+			writeLabels(&b, f.labels, value.labelValues)
+			b.WriteByte(' ')
+			b.WriteString(strconv.FormatFloat(value.Get(), 'g', -1, 64))
+			b.WriteByte('\n')
+		}
+		f.mu.Unlock()
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// writeSummaries writes a line per quantile of every series of f, then
+// its sum and count.
+func writeSummaries(b *strings.Builder, f *family) {
+	f.pruneSummaries()
+	keys := make([]string, 0, len(f.summaries))
+	for key := range f.summaries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := append(slices.Clip(f.labels), "quantile")
+	for _, key := range keys {
+		summary := f.summaries[key]
+		for i, value := range summary.Quantiles(Quantiles...) {
+			quantile := strconv.FormatFloat(Quantiles[i], 'g', -1, 64)
+			b.WriteString(f.name)
+			writeLabels(b, labels, append(slices.Clip(summary.labelValues), quantile))
+			b.WriteByte(' ')
+			b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+			b.WriteByte('\n')
+		}
+		count, sum := summary.Count()
+		b.WriteString(f.name + "_sum")
+		writeLabels(b, f.labels, summary.labelValues)
+		b.WriteString(" " + strconv.FormatFloat(sum, 'g', -1, 64) + "\n")
+		b.WriteString(f.name + "_count")
+		writeLabels(b, f.labels, summary.labelValues)
+		b.WriteString(" " + strconv.FormatUint(count, 10) + "\n")
+	}
+}
+
+// labelEscaper escapes label values the way the text format asks.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeLabels(b *strings.Builder, names, values []string) {
+	if len(names) == 0 {
+		return
+	}
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(b, "%s=\"%s\"", name, labelEscaper.Replace(values[i]))
+	}
+	b.WriteByte('}')
+}
+
+// ServeHTTP serves the registry for Prometheus to scrape.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_WritesTextFormat(t *testing.T) {
+	r := NewRegistry()
+	events := r.Counter("test_events_total", "Events seen.", "kind")
+	events.With("update").Inc()
+	events.With("update").Add(2)
+	events.With("add").Inc()
+	r.Gauge("test_backends", "Backends per pool.", "pool").With(`a"b`).Set(4)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, strings.Join([]string{
+		"# HELP test_backends Backends per pool.",
+		"# TYPE test_backends gauge",
+		`test_backends{pool="a\"b"} 4`,
+		"# HELP test_events_total Events seen.",
+		"# TYPE test_events_total counter",
+		`test_events_total{kind="add"} 1`,
+		`test_events_total{kind="update"} 3`,
+		"",
+	}, "\n"), rr.Body.String())
+}
+
+func TestRegistry_RegisterTwice(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test_total", "Things.", "kind").With("a").Inc()
+	assert.Equal(t, 1.0, r.Counter("test_total", "Things.", "kind").With("a").Get())
+	assert.Panics(t, func() { r.Gauge("test_total", "Things.", "kind") })
+}
+
+func TestSummary_Quantiles(t *testing.T) {
+	r := NewRegistry()
+	latency := r.Summary("test_latency_seconds", "Latency.", "pod")
+	summary := latency.With("a")
+	now := time.Unix(1000, 0)
+	summary.now = func() time.Time { return now }
+	for i := 1; i <= 100; i++ {
+		summary.Observe(float64(i))
+	}
+	assert.Equal(t, []float64{50, 95, 99}, summary.Quantiles(Quantiles...))
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, strings.Join([]string{
+		"# HELP test_latency_seconds Latency.",
+		"# TYPE test_latency_seconds summary",
+		`test_latency_seconds{pod="a",quantile="0.5"} 50`,
+		`test_latency_seconds{pod="a",quantile="0.95"} 95`,
+		`test_latency_seconds{pod="a",quantile="0.99"} 99`,
+		`test_latency_seconds_sum{pod="a"} 5050`,
+		`test_latency_seconds_count{pod="a"} 100`,
+		"",
+	}, "\n"), rr.Body.String())
+
+	// Old observations leave the quantiles but stay in the count.
+	now = now.Add(2 * summaryMaxAge)
+	summary.Observe(7)
+	assert.Equal(t, []float64{7, 7, 7}, summary.Quantiles(Quantiles...))
+	count, _ := summary.Count()
+	assert.Equal(t, uint64(101), count)
+
+	_, ok := latency.Get("b")
+	assert.False(t, ok)
+}
+
+func TestSummary_DropsIdleSeries(t *testing.T) {
+	r := NewRegistry()
+	latency := r.Summary("test_latency_seconds", "Latency.", "pod")
+	now := time.Unix(1000, 0)
+	for _, pod := range []string{"a", "b"} {
+		summary := latency.With(pod)
+		summary.now = func() time.Time { return now }
+		summary.Observe(1)
+	}
+
+	// b is gone while a keeps answering.
+	now = now.Add(summaryMaxAge / 2)
+	latency.With("a").Observe(2)
+	now = now.Add(summaryMaxAge)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, rr.Body.String(), `test_latency_seconds_count{pod="a"} 2`)
+	assert.NotContains(t, rr.Body.String(), `pod="b"`)
+	_, ok := latency.Get("b")
+	assert.False(t, ok)
+	_, ok = latency.Get("a")
+	assert.True(t, ok)
+}
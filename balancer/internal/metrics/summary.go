@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quantiles are the quantiles a summary reports, the median and the tail.
+var Quantiles = []float64{0.5, 0.95, 0.99}
+
+const (
+	// summaryMaxAge is how long an observation counts towards the
+	// quantiles, so they follow how a backend is doing now.
+	summaryMaxAge = time.Minute
+	// summarySamples caps the observations a series keeps, the oldest
+	// being dropped first.
+	summarySamples = 1024
+)
+
+// Summary is one series of a summary. Its quantiles are computed from the
+// observations of the last minute, up to the last 1024 of them, while its
+// count and sum cover every observation. A series with nothing observed for
+// a minute is dropped, so those of backends that are gone do not pile up.
+// Its methods are safe for concurrent use.
+type Summary struct {
+	labelValues []string
+	now         func() time.Time
+
+	mu      sync.Mutex
+	samples []sample
+	// next is where the next sample goes once samples is full.
+	next  int
+	count uint64
+	sum   float64
+	// last is when the latest value was observed.
+	last time.Time
+}
+
+type sample struct {
+	value float64
+	at    time.Time
+}
+
+// Observe records value.
+func (s *Summary) Observe(value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sample := sample{value: value, at: s.now()}
+	if len(s.samples) < summarySamples {
+		s.samples = append(s.samples, sample)
+	} else {
+		s.samples[s.next] = sample
+		s.next = (s.next + 1) % summarySamples
+	}
+	s.count++
+	s.sum += value
+	s.last = sample.at
+}
+
+// Quantiles returns the value at each of qs, from 0 to 1, among the recent
+// observations. They are NaN when there are none.
+func (s *Summary) Quantiles(qs ...float64) []float64 {
+	s.mu.Lock()
+	cutoff := s.now().Add(-summaryMaxAge)
+	values := make([]float64, 0, len(s.samples))
+	for _, sample := range s.samples {
+		if !sample.at.Before(cutoff) {
+			values = append(values, sample.value)
+		}
+	}
+	s.mu.Unlock()
+
+	slices.Sort(values)
+	quantiles := make([]float64, len(qs))
+	for i, q := range qs {
+		if len(values) == 0 {
+			quantiles[i] = math.NaN()
+			continue
+		}
+		// The nearest rank: the smallest value with at least q of the
+		// values at or below it.
+		rank := int(math.Ceil(q*float64(len(values)))) - 1
+		quantiles[i] = values[min(max(rank, 0), len(values)-1)]
+	}
+	return quantiles
+}
+
+// stale reports whether nothing was observed since cutoff.
+func (s *Summary) stale(cutoff time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last.Before(cutoff)
+}
+
+// Count returns how many values were observed and their sum.
+func (s *Summary) Count() (uint64, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count, s.sum
+}
+
+// SummaryVec hands out the series of a summary by label values.
+type SummaryVec struct {
+	family *family
+}
+
+// With returns the series for labelValues, given in the order the labels
+// were declared, creating it empty the first time.
+func (vec SummaryVec) With(labelValues ...string) *Summary {
+	f := vec.family
+	f.checkLabels(labelValues)
+	key := strings.Join(labelValues, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	summary, ok := f.summaries[key]
+	if !ok {
+		f.pruneSummaries()
+		summary = &Summary{labelValues: labelValues, now: time.Now}
+		// A series is fresh until its first value, so a scrape between
+		// With and Observe does not drop it.
+		summary.last = summary.now()
+		f.summaries[key] = summary
+	}
+	return summary
+}
+
+// pruneSummaries drops the series of f with nothing observed in the last
+// summaryMaxAge. f.mu must be held.
+func (f *family) pruneSummaries() {
+	for key, summary := range f.summaries {
+		if summary.stale(summary.now().Add(-summaryMaxAge)) {
+			delete(f.summaries, key)
+		}
+	}
+}
+
+// Get returns the series for labelValues, or false when nothing was
+// observed for them yet.
+func (vec SummaryVec) Get(labelValues ...string) (*Summary, bool) {
+	f := vec.family
+	f.checkLabels(labelValues)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	summary, ok := f.summaries[strings.Join(labelValues, "\xff")]
+	return summary, ok
+}
+
+// Summary registers a summary, the Quantiles of values that vary, such as
+// latencies, along with their count and sum. Registering a name again
+// returns the same family.
+func (r *Registry) Summary(name, help string, labels ...string) SummaryVec {
+	return SummaryVec{family: r.register(name, help, "summary", labels).family}
+}
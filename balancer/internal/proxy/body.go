@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"pkg/logging"
+)
+
+// limitBody enforces rules.MaxBodySize and, when rules.BufferBody is set,
+// reads the body into memory so it can be sent again. It answers the client
+// itself and returns false when the body is too large.
+func limitBody(w http.ResponseWriter, r *http.Request, rules *Rules) bool {
+	if rules == nil || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	if rules.MaxBodySize > 0 {
+		if r.ContentLength > rules.MaxBodySize {
+			tooLarge(w, rules.MaxBodySize)
+			return false
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, rules.MaxBodySize)
+	}
+	if !rules.BufferBody {
+		return true
+	}
+
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			tooLarge(w, maxBytes.Limit)
+			return false
+		}
+		logging.Warning("Failed to read the request body for %s: %v", r.URL.Path, err)
+		http.Error(w, "failed to read the request body", http.StatusBadRequest)
+		return false
+	}
+	r.ContentLength = int64(len(body))
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return true
+}
+
+func tooLarge(w http.ResponseWriter, limit int64) {
+	http.Error(w, fmt.Sprintf("request body is larger than %d bytes", limit), http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"balancer/internal/discovery"
+)
+
+func bodyUpstream(t *testing.T) *Proxy {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		w.Header().Set("X-Content-Length", r.Header.Get("Content-Length"))
+		w.Write(body)
+	}))
+	t.Cleanup(upstream.Close)
+	return New(upstream.Listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestServe_MaxBodySize(t *testing.T) {
+	p := bodyUpstream(t)
+	backend := discovery.Backend{Address: "127.0.0.1"}
+	rules := &Rules{MaxBodySize: 4}
+
+	rr := httptest.NewRecorder()
+	p.Serve(rr, httptest.NewRequest("POST", "/", strings.NewReader("12345")), backend, rules)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+	// Without a Content-Length the limit is hit while streaming.
+	req := httptest.NewRequest("POST", "/", io.NopCloser(strings.NewReader("12345")))
+	req.ContentLength = -1
+	rr = httptest.NewRecorder()
+	p.Serve(rr, req, backend, rules)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+	rr = httptest.NewRecorder()
+	p.Serve(rr, httptest.NewRequest("POST", "/", strings.NewReader("1234")), backend, rules)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "1234", rr.Body.String())
+}
+
+func TestServe_BufferBody(t *testing.T) {
+	p := bodyUpstream(t)
+	req := httptest.NewRequest("POST", "/", io.NopCloser(strings.NewReader("hello")))
+	req.ContentLength = -1
+
+	rr := httptest.NewRecorder()
+	p.Serve(rr, req, discovery.Backend{Address: "127.0.0.1"}, &Rules{BufferBody: true})
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "hello", rr.Body.String())
+	// A buffered body has a known length, so it is not sent chunked.
+	assert.Equal(t, "5", rr.Header().Get("X-Content-Length"))
+	assert.NotNil(t, req.GetBody)
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+// Drainer ends the requests and connections still using a backend once it
+// has been gone from discovery for the drain timeout. New traffic stops going
+// to a removed backend straight away, since strategies only see current
+// backends, so draining only has to deal with what was already in flight.
+type Drainer struct {
+	timeout time.Duration
+
+	mu      sync.Mutex
+	nextID  uint64
+	tracked map[string]map[uint64]func()
+	timers  map[string]*time.Timer
+}
+
+// NewDrainer creates a Drainer that gives in-flight work timeout to finish.
+func NewDrainer(timeout time.Duration) *Drainer {
+	return &Drainer{
+		timeout: timeout,
+		tracked: make(map[string]map[uint64]func()),
+		timers:  make(map[string]*time.Timer),
+	}
+}
+
+// Track records work in flight on backend. cancel is called if backend is
+// removed and the work is still running when the drain timeout passes. The
+// returned func must be called when the work ends.
+func (d *Drainer) Track(backend discovery.Backend, cancel func()) func() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nextID++
+	id := d.nextID
+	work, ok := d.tracked[backend.Address]
+	if !ok {
+		work = make(map[uint64]func())
+		d.tracked[backend.Address] = work
+	}
+	work[id] = cancel
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(work, id)
+		if current, ok := d.tracked[backend.Address]; ok && len(current) == 0 {
+			delete(d.tracked, backend.Address)
+		}
+	}
+}
+
+// Update starts draining removed backends and stops draining added ones, in
+// case an address comes back before its timeout. It has the signature of a
+// discovery.BackendList OnChange listener.
+func (d *Drainer) Update(added, removed []discovery.Backend) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, backend := range added {
+		if timer, ok := d.timers[backend.Address]; ok {
+			timer.Stop()
+			delete(d.timers, backend.Address)
+		}
+	}
+	for _, backend := range removed {
+		if _, ok := d.timers[backend.Address]; ok {
+			continue
+		}
+		address := backend.Address
+		logging.Info("Draining %s for up to %s", backend, d.timeout)
+		d.timers[address] = time.AfterFunc(d.timeout, func() { d.expire(address) })
+	}
+}
+
+// Inflight returns how much tracked work is running on backend.
+func (d *Drainer) Inflight(backend discovery.Backend) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.tracked[backend.Address])
+}
+
+// expire cancels whatever is still running on address.
+func (d *Drainer) expire(address string) {
+	d.mu.Lock()
+	delete(d.timers, address)
+	cancels := make([]func(), 0, len(d.tracked[address]))
+	for _, cancel := range d.tracked[address] {
+		cancels = append(cancels, cancel)
+	}
+	delete(d.tracked, address)
+	d.mu.Unlock()
+
+	if len(cancels) == 0 {
+		return
+	}
+	logging.Warning("Drain timeout passed for %s, ending %d requests and connections", address, len(cancels))
+	// The cancels run without the lock, since ending the work untracks it.
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"balancer/internal/discovery"
+)
+
+func TestDrainer_CancelsAfterTimeout(t *testing.T) {
+	d := NewDrainer(20 * time.Millisecond)
+	backend := discovery.Backend{Address: "10.0.0.1"}
+	var cancelled atomic.Int32
+	d.Track(backend, func() { cancelled.Add(1) })
+	done := d.Track(backend, func() { cancelled.Add(1) })
+	done()
+	assert.Equal(t, 1, d.Inflight(backend))
+
+	d.Update(nil, []discovery.Backend{backend})
+	assert.Eventually(t, func() bool { return cancelled.Load() == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, d.Inflight(backend))
+}
+
+func TestDrainer_ReaddedBackendKeepsWork(t *testing.T) {
+	d := NewDrainer(20 * time.Millisecond)
+	backend := discovery.Backend{Address: "10.0.0.1"}
+	var cancelled atomic.Int32
+	d.Track(backend, func() { cancelled.Add(1) })
+
+	d.Update(nil, []discovery.Backend{backend})
+	d.Update([]discovery.Backend{backend}, nil)
+	time.Sleep(60 * time.Millisecond)
+
+	assert.Equal(t, int32(0), cancelled.Load())
+	assert.Equal(t, 1, d.Inflight(backend))
+}
+
+func TestServe_DrainCancelsRequest(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	t.Cleanup(func() { close(release) })
+
+	d := NewDrainer(20 * time.Millisecond)
+	p, err := NewWithOptions(upstream.Listener.Addr().(*net.TCPAddr).Port, Options{Drainer: d})
+	assert.NoError(t, err)
+	backend := discovery.Backend{Address: "127.0.0.1"}
+	go func() {
+		assert.Eventually(t, func() bool { return d.Inflight(backend) == 1 }, time.Second, 5*time.Millisecond)
+		d.Update(nil, []discovery.Backend{backend})
+	}()
+
+	rr := httptest.NewRecorder()
+	result := p.Serve(rr, httptest.NewRequest("GET", "/", nil), backend, nil)
+
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	assert.Error(t, result.Err)
+	assert.Equal(t, 0, d.Inflight(backend))
+}
+
+func TestBackendList_OnChange(t *testing.T) {
+	list := discovery.NewBackendList()
+	var added, removed []discovery.Backend
+	list.OnChange(func(a, r []discovery.Backend) { added, removed = a, r })
+
+	list.Replace([]discovery.Backend{{Address: "10.0.0.1"}, {Address: "10.0.0.2"}})
+	assert.Len(t, added, 2)
+	assert.Empty(t, removed)
+
+	list.Replace([]discovery.Backend{{Address: "10.0.0.2"}, {Address: "10.0.0.3"}})
+	assert.Equal(t, []discovery.Backend{{Address: "10.0.0.3"}}, added)
+	assert.Equal(t, []discovery.Backend{{Address: "10.0.0.1"}}, removed)
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"balancer/internal/discovery"
+)
+
+func TestNewH2C_ForwardsHTTP2AndTrailers(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, 2, r.ProtoMajor)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		io.WriteString(w, "payload")
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+
+	p := NewH2C(upstream.Listener.Addr().(*net.TCPAddr).Port)
+	front := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ServeBackend(w, r, discovery.Backend{Address: "127.0.0.1"})
+	}))
+	front.Config.Protocols = new(http.Protocols)
+	front.Config.Protocols.SetUnencryptedHTTP2(true)
+	front.Start()
+	t.Cleanup(front.Close)
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: transport}
+	resp, err := client.Post(front.URL+"/pkg.Service/Method", "application/grpc", nil)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "payload", string(body))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestNewWithOptions(t *testing.T) {
+	p, err := NewWithOptions(8080, Options{})
+	assert.NoError(t, err)
+	assert.Same(t, p.reverse, p.upgrade)
+
+	p, err = NewWithOptions(8080, Options{Protocol: ProtocolH2C})
+	assert.NoError(t, err)
+	assert.NotSame(t, p.reverse, p.upgrade)
+
+	_, err = NewWithOptions(8080, Options{Protocol: "spdy"})
+	assert.Error(t, err)
+
+	_, err = NewWithOptions(8080, Options{Protocol: ProtocolH2})
+	assert.Error(t, err)
+}
+
+func TestNewTransport_Options(t *testing.T) {
+	transport := newTransport(Options{})
+	assert.Equal(t, 32, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 90*time.Second, transport.IdleConnTimeout)
+
+	transport = newTransport(Options{Transport: TransportOptions{
+		MaxIdleConnsPerBackend: 256,
+		IdleConnTimeout:        time.Minute,
+		TLSHandshakeTimeout:    2 * time.Second,
+		DisableKeepAlives:      true,
+	}})
+	assert.Equal(t, 256, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 0, transport.MaxIdleConns)
+	assert.Equal(t, time.Minute, transport.IdleConnTimeout)
+	assert.Equal(t, 2*time.Second, transport.TLSHandshakeTimeout)
+	assert.True(t, transport.DisableKeepAlives)
+}
+
+func TestNewTransport_Timeouts(t *testing.T) {
+	transport := newTransport(Options{})
+	assert.Equal(t, 30*time.Second, transport.ResponseHeaderTimeout)
+
+	transport = newTransport(Options{Timeouts: TimeoutOptions{ResponseHeader: time.Second}})
+	assert.Equal(t, time.Second, transport.ResponseHeaderTimeout)
+}
@@ -0,0 +1,397 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+type forwardKey struct{}
+
+// errRetryStatus fails a response whose status the caller retries on.
+var errRetryStatus = errors.New("retryable status")
+
+// forward is what rewrite and modifyResponse need to know about a request.
+type forward struct {
+	backend discovery.Backend
+	rules   *Rules
+	vars    *strings.Replacer
+	// retry is set when the caller can send the request elsewhere. A
+	// response with one of retryStatuses, or a failure to reach the backend,
+	// is then not written and failed is set instead.
+	retry         bool
+	retryStatuses []int
+	result        Result
+}
+
+// Result is how a forwarded request went.
+type Result struct {
+	// Status is the code the backend answered with. Zero means no response
+	// was received.
+	Status int
+	// Err is why the backend could not be reached or did not answer.
+	Err error
+	// Retry is set by TryServe when the failure was not written to the
+	// client, so the request can be sent to another backend.
+	Retry bool
+}
+
+// BackendFailed reports whether the backend is to blame: it could not be
+// reached, did not answer in time or answered with a server error.
+func (res Result) BackendFailed() bool {
+	return res.Status >= http.StatusInternalServerError ||
+		(res.Err != nil && !errors.Is(res.Err, context.Canceled))
+}
+
+// Protocols a Proxy can speak to backends.
+const (
+	ProtocolHTTP1 string = "http1"
+	ProtocolH2C   string = "h2c"
+	// ProtocolH2 is HTTP/2 over TLS and needs Options.TLS.
+	ProtocolH2 string = "h2"
+)
+
+// Options configures how a Proxy talks to backends.
+type Options struct {
+	// Protocol is one of the Protocol constants. Empty means HTTP/1.1.
+	Protocol string
+	// TLS, when set, encrypts connections to backends with this client
+	// config, for example one from LoadClientTLS.
+	TLS *tls.Config
+	// Transport tunes connection reuse. Zero fields keep the defaults.
+	Transport TransportOptions
+	// Timeouts bound each stage of a request to a backend. Zero fields keep
+	// the defaults.
+	Timeouts TimeoutOptions
+	// Drainer, when set, cancels requests still running on a backend that
+	// was removed from discovery once the drain timeout passes.
+	Drainer *Drainer
+}
+
+// TimeoutOptions bound how long a request may wait on a backend. A request
+// that runs out of time is answered with a 504.
+type TimeoutOptions struct {
+	// Connect bounds dialing a backend. Defaults to 5 seconds.
+	Connect time.Duration
+	// ResponseHeader bounds the wait for response headers once the request
+	// has been written. Defaults to 30 seconds.
+	ResponseHeader time.Duration
+	// Request bounds the whole exchange, including reading the response
+	// body. Zero means no limit. Websocket upgrades are not bounded.
+	Request time.Duration
+}
+
+// TransportOptions tune how connections to backends are pooled.
+type TransportOptions struct {
+	// MaxIdleConnsPerBackend caps the idle connections kept open to each
+	// backend. Defaults to 32.
+	MaxIdleConnsPerBackend int
+	// IdleConnTimeout closes idle connections after this long. Defaults to
+	// 90 seconds.
+	IdleConnTimeout time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake with a backend. Defaults
+	// to 10 seconds.
+	TLSHandshakeTimeout time.Duration
+	// DisableKeepAlives opens a new connection for every request.
+	DisableKeepAlives bool
+}
+
+// Proxy forwards HTTP requests to a backend that has already been chosen by
+// a strategy. It owns the transport, so idle connections to backends are
+// pooled across requests.
+type Proxy struct {
+	BackendPort int
+	scheme      string
+	reverse     *httputil.ReverseProxy
+	// upgrade forwards websocket handshakes, which need HTTP/1.1 even when
+	// reverse speaks HTTP/2.
+	upgrade *httputil.ReverseProxy
+	// timeout bounds each proxied request. Zero means no limit.
+	timeout time.Duration
+	drainer *Drainer
+}
+
+// New creates a Proxy that sends requests to backends on backendPort.
+func New(backendPort int) *Proxy {
+	p, _ := NewWithOptions(backendPort, Options{})
+	return p
+}
+
+// NewH2C creates a Proxy that speaks HTTP/2 without TLS to backends, as gRPC
+// servers expect. Each request becomes a stream on a shared connection per
+// backend, so the strategy still picks a backend for every call.
+func NewH2C(backendPort int) *Proxy {
+	p, _ := NewWithOptions(backendPort, Options{Protocol: ProtocolH2C})
+	return p
+}
+
+// NewWithOptions creates a Proxy that talks to backends as opts describes.
+func NewWithOptions(backendPort int, opts Options) (*Proxy, error) {
+	protocols := new(http.Protocols)
+	switch opts.Protocol {
+	case "", ProtocolHTTP1:
+		protocols.SetHTTP1(true)
+	case ProtocolH2C:
+		if opts.TLS != nil {
+			return nil, fmt.Errorf("upstream protocol %s cannot be used with tls", opts.Protocol)
+		}
+		protocols.SetUnencryptedHTTP2(true)
+	case ProtocolH2:
+		if opts.TLS == nil {
+			return nil, fmt.Errorf("upstream protocol %s needs tls", opts.Protocol)
+		}
+		protocols.SetHTTP2(true)
+	default:
+		return nil, fmt.Errorf("unknown upstream protocol %s", opts.Protocol)
+	}
+
+	p := &Proxy{BackendPort: backendPort, scheme: "http", timeout: opts.Timeouts.Request, drainer: opts.Drainer}
+	if opts.TLS != nil {
+		p.scheme = "https"
+	}
+	transport := newTransport(opts)
+	transport.Protocols = protocols
+	p.reverse = p.reverseProxy(transport)
+	p.upgrade = p.reverse
+	if !protocols.HTTP1() {
+		upgrade := newTransport(opts)
+		upgrade.Protocols = new(http.Protocols)
+		upgrade.Protocols.SetHTTP1(true)
+		p.upgrade = p.reverseProxy(upgrade)
+	}
+	return p, nil
+}
+
+// CloseIdleConnections closes the keep-alive connections to backends that
+// are not carrying a request, for a proxy that is being replaced. Requests
+// still in flight carry on.
+func (p *Proxy) CloseIdleConnections() {
+	for _, reverse := range []*httputil.ReverseProxy{p.reverse, p.upgrade} {
+		if transport, ok := reverse.Transport.(*http.Transport); ok {
+			transport.CloseIdleConnections()
+		}
+	}
+}
+
+func (p *Proxy) reverseProxy(transport http.RoundTripper) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite:        p.rewrite,
+		Transport:      transport,
+		ModifyResponse: modifyResponse,
+		ErrorHandler:   errorHandler,
+	}
+}
+
+func newTransport(opts Options) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if opts.Timeouts.Connect > 0 {
+		dialer.Timeout = opts.Timeouts.Connect
+	}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableKeepAlives:     opts.Transport.DisableKeepAlives,
+	}
+	if opts.TLS != nil {
+		transport.TLSClientConfig = opts.TLS.Clone()
+	}
+	if opts.Transport.MaxIdleConnsPerBackend > 0 {
+		transport.MaxIdleConnsPerHost = opts.Transport.MaxIdleConnsPerBackend
+		// MaxIdleConns is a total across backends and must not cut the per
+		// backend limit short.
+		transport.MaxIdleConns = 0
+	}
+	if opts.Transport.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = opts.Transport.IdleConnTimeout
+	}
+	if opts.Transport.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = opts.Transport.TLSHandshakeTimeout
+	}
+	if opts.Timeouts.ResponseHeader > 0 {
+		transport.ResponseHeaderTimeout = opts.Timeouts.ResponseHeader
+	}
+	return transport
+}
+
+// ServeBackend forwards r to backend and copies the response to w.
+func (p *Proxy) ServeBackend(w http.ResponseWriter, r *http.Request, backend discovery.Backend) {
+	p.Serve(w, r, backend, nil)
+}
+
+// Serve forwards r to backend like ServeBackend, applying rules to the
+// request and the response. rules may be nil.
+func (p *Proxy) Serve(w http.ResponseWriter, r *http.Request, backend discovery.Backend, rules *Rules) Result {
+	fwd := &forward{backend: backend, rules: rules}
+	p.serve(w, r, fwd)
+	return fwd.result
+}
+
+// TryServe forwards r like Serve, except that when the backend cannot be
+// reached or answers with one of retryStatuses nothing is written to w and
+// the result has Retry set, so the caller can send r to another backend.
+// The caller must make sure the body of r can be sent again.
+func (p *Proxy) TryServe(w http.ResponseWriter, r *http.Request, backend discovery.Backend, rules *Rules, retryStatuses []int) Result {
+	if IsWebSocket(r) {
+		return p.Serve(w, r, backend, rules)
+	}
+	fwd := &forward{backend: backend, rules: rules, retry: true, retryStatuses: retryStatuses}
+	p.serve(w, r, fwd)
+	return fwd.result
+}
+
+func (p *Proxy) serve(w http.ResponseWriter, r *http.Request, fwd *forward) {
+	if fwd.rules != nil {
+		var id string
+		if fwd.rules.needsRequestID() {
+			id = requestID(r)
+		}
+		fwd.vars = ruleVars(r, fwd.backend, id)
+	}
+	if !limitBody(w, r, fwd.rules) {
+		return
+	}
+	ctx := context.WithValue(r.Context(), forwardKey{}, fwd)
+	if p.drainer != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		defer p.drainer.Track(fwd.backend, cancel)()
+	}
+	if IsWebSocket(r) {
+		p.serveWebSocket(w, r.WithContext(ctx), fwd.backend)
+		return
+	}
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	p.reverse.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// Target returns the URL requests for backend are sent to.
+func (p *Proxy) Target(backend discovery.Backend) (*url.URL, error) {
+	host := backend.HostPort(p.BackendPort)
+	target, err := url.Parse(fmt.Sprintf("%s://%s", p.scheme, host))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the url for %s: %w", host, err)
+	}
+	return target, nil
+}
+
+func (p *Proxy) rewrite(pr *httputil.ProxyRequest) {
+	fwd := pr.In.Context().Value(forwardKey{}).(*forward)
+	target, err := p.Target(fwd.backend)
+	if err != nil {
+		// Leave the outbound URL without a host so the transport fails the
+		// request and ErrorHandler answers with a 502.
+		logging.Error("%v", err)
+		pr.Out.URL.Host = ""
+		return
+	}
+	pr.SetURL(target)
+	pr.SetXForwarded()
+	// Send the trace of the request on as a traceparent. Without a tracer
+	// provider the propagator does nothing and the client's is kept.
+	otel.GetTextMapPropagator().Inject(pr.Out.Context(), propagation.HeaderCarrier(pr.Out.Header))
+	if fwd.rules != nil {
+		if fwd.rules.Path != nil {
+			pr.Out.URL.Path = fwd.rules.Path.Rewrite(pr.In.URL.Path)
+			pr.Out.URL.RawPath = ""
+		}
+		for _, headers := range fwd.rules.Headers {
+			headers.Request.apply(pr.Out.Header, fwd.vars)
+		}
+	}
+}
+
+func modifyResponse(resp *http.Response) error {
+	fwd, ok := resp.Request.Context().Value(forwardKey{}).(*forward)
+	if !ok {
+		return nil
+	}
+	fwd.result.Status = resp.StatusCode
+	if fwd.retry && slices.Contains(fwd.retryStatuses, resp.StatusCode) {
+		return fmt.Errorf("%w: backend answered %s", errRetryStatus, resp.Status)
+	}
+	if fwd.rules == nil {
+		return nil
+	}
+	for _, headers := range fwd.rules.Headers {
+		headers.Response.apply(resp.Header, fwd.vars)
+	}
+	return nil
+}
+
+func errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	// A streamed body that goes over the limit fails the upstream request
+	// part way through. That is the client's fault, not the backend's.
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		tooLarge(w, maxBytes.Limit)
+		return
+	}
+	fwd, ok := r.Context().Value(forwardKey{}).(*forward)
+	if ok && !errors.Is(err, errRetryStatus) {
+		fwd.result.Err = err
+	}
+	fields := []any{"method", r.Method, "path", r.URL.Path, "error", err}
+	if ok {
+		fields = append(fields, "backend", fwd.backend.Address, "pod", fwd.backend.PodName)
+	}
+	if ok && fwd.retry && retryable(err) {
+		logging.Logger().Warn("Proxy error, will retry", fields...)
+		fwd.result.Retry = true
+		return
+	}
+	if timedOut(err) {
+		logging.Logger().Error("Upstream timed out", append(fields, "status", http.StatusGatewayTimeout)...)
+		http.Error(w, "upstream timed out", http.StatusGatewayTimeout)
+		return
+	}
+	logging.Logger().Error("Proxy error", append(fields, "status", http.StatusBadGateway)...)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// retryable reports whether err is worth retrying on another backend. A
+// timeout may mean the backend is still working on the request, and a
+// cancelled request has no client left to answer.
+func retryable(err error) bool {
+	if errors.Is(err, errRetryStatus) {
+		return true
+	}
+	return !timedOut(err) && !errors.Is(err, context.Canceled)
+}
+
+// timedOut reports whether err came from one of the upstream timeouts rather
+// than the backend refusing or breaking the connection.
+func timedOut(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"balancer/internal/discovery"
+)
+
+func TestServeBackend_Forwards(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/hello", r.URL.Path)
+		assert.NotEmpty(t, r.Header.Get("X-Forwarded-For"))
+		w.Header().Set("X-Upstream", "yes")
+		io.WriteString(w, "hi")
+	}))
+	t.Cleanup(upstream.Close)
+
+	p := New(upstream.Listener.Addr().(*net.TCPAddr).Port)
+	rr := httptest.NewRecorder()
+	p.ServeBackend(rr, httptest.NewRequest("GET", "/hello", nil), discovery.Backend{Address: "127.0.0.1"})
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "yes", rr.Header().Get("X-Upstream"))
+	assert.Equal(t, "hi", rr.Body.String())
+}
+
+func TestServeBackend_BadGateway(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	p := New(port)
+	rr := httptest.NewRecorder()
+	p.ServeBackend(rr, httptest.NewRequest("GET", "/", nil), discovery.Backend{Address: "127.0.0.1"})
+
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+}
+
+func TestServe_RequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(upstream.Close)
+	t.Cleanup(func() { close(release) })
+
+	p, err := NewWithOptions(upstream.Listener.Addr().(*net.TCPAddr).Port, Options{
+		Timeouts: TimeoutOptions{Request: 50 * time.Millisecond},
+	})
+	assert.NoError(t, err)
+	rr := httptest.NewRecorder()
+	p.ServeBackend(rr, httptest.NewRequest("GET", "/", nil), discovery.Backend{Address: "127.0.0.1"})
+
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	assert.Contains(t, rr.Body.String(), "upstream timed out")
+}
+
+func TestServe_ResponseHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(upstream.Close)
+	t.Cleanup(func() { close(release) })
+
+	p, err := NewWithOptions(upstream.Listener.Addr().(*net.TCPAddr).Port, Options{
+		Timeouts: TimeoutOptions{ResponseHeader: 50 * time.Millisecond},
+	})
+	assert.NoError(t, err)
+	rr := httptest.NewRecorder()
+	p.ServeBackend(rr, httptest.NewRequest("GET", "/", nil), discovery.Backend{Address: "127.0.0.1"})
+
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+}
+
+func TestTarget_IPv6(t *testing.T) {
+	p := New(8080)
+	target, err := p.Target(discovery.Backend{Address: "fd00::1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "[fd00::1]:8080", target.Host)
+}
+
+func TestCloseIdleConnections(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+
+	p := New(upstream.Listener.Addr().(*net.TCPAddr).Port)
+	rr := httptest.NewRecorder()
+	p.ServeBackend(rr, httptest.NewRequest("GET", "/", nil), discovery.Backend{Address: "127.0.0.1"})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	p.CloseIdleConnections()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the idle connection to be closed")
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// RetryPolicy says when a failed request is sent to another backend.
+type RetryPolicy struct {
+	// Attempts is how many times a request may be retried after the first
+	// try.
+	Attempts int
+	// Statuses are the response codes that count as a failure. A backend
+	// that cannot be reached always does.
+	Statuses []int
+	// Budget caps retries across all requests. Nil means no cap.
+	Budget *RetryBudget
+}
+
+const (
+	budgetBuckets = 10
+	// minBudgetRetries are allowed in every window whatever the traffic, so
+	// quiet services can still retry.
+	minBudgetRetries = 3
+)
+
+// RetryBudget allows retries only while they stay under a share of the
+// requests seen in the last ten seconds, so a failing backend does not
+// multiply the load on the others.
+type RetryBudget struct {
+	percent int
+	mu      sync.Mutex
+	buckets [budgetBuckets]budgetBucket
+	now     func() time.Time
+}
+
+// budgetBucket counts one second of traffic.
+type budgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// NewRetryBudget creates a budget that lets retries reach percent of
+// requests.
+func NewRetryBudget(percent int) *RetryBudget {
+	return &RetryBudget{percent: percent, now: time.Now}
+}
+
+// Request counts a request that arrived from a client.
+func (b *RetryBudget) Request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucket().requests++
+}
+
+// Allow reports whether the budget has room for another retry. The retry is
+// only counted once Retry is called, so concurrent requests may overshoot
+// the budget slightly.
+func (b *RetryBudget) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	oldest := b.now().Unix() - budgetBuckets
+	var requests, retries int
+	for _, bucket := range b.buckets {
+		if bucket.second > oldest {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	return retries < minBudgetRetries || retries*100 < requests*b.percent
+}
+
+// Retry counts a retry against the budget.
+func (b *RetryBudget) Retry() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucket().retries++
+}
+
+// bucket returns the bucket for the current second, clearing it if it still
+// holds an older second. b.mu must be held.
+func (b *RetryBudget) bucket() *budgetBucket {
+	second := b.now().Unix()
+	bucket := &b.buckets[second%budgetBuckets]
+	if bucket.second != second {
+		*bucket = budgetBucket{second: second}
+	}
+	return bucket
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"balancer/internal/discovery"
+)
+
+func TestRetryBudget_CapsRetries(t *testing.T) {
+	now := time.Unix(1000, 0)
+	budget := NewRetryBudget(10)
+	budget.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		budget.Request()
+	}
+	retries := 0
+	for budget.Allow() {
+		budget.Retry()
+		retries++
+	}
+	assert.Equal(t, 10, retries)
+
+	// Once the window has passed the old traffic no longer counts.
+	now = now.Add(budgetBuckets * time.Second)
+	assert.True(t, budget.Allow())
+	for i := 0; i < minBudgetRetries; i++ {
+		budget.Retry()
+	}
+	assert.False(t, budget.Allow())
+}
+
+func TestTryServe_LeavesFailuresUnwritten(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(upstream.Close)
+	p := New(upstream.Listener.Addr().(*net.TCPAddr).Port)
+	backend := discovery.Backend{Address: "127.0.0.1"}
+
+	rr := httptest.NewRecorder()
+	result := p.TryServe(rr, httptest.NewRequest("GET", "/", nil), backend, nil, []int{http.StatusServiceUnavailable})
+	assert.True(t, result.Retry)
+	assert.Equal(t, http.StatusServiceUnavailable, result.Status)
+	assert.NoError(t, result.Err)
+	assert.False(t, rr.Flushed)
+	assert.Empty(t, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	assert.False(t, p.TryServe(rr, httptest.NewRequest("GET", "/", nil), backend, nil, []int{http.StatusBadGateway}).Retry)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+}
+
+func TestTryServe_ConnectionError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	rr := httptest.NewRecorder()
+	result := New(port).TryServe(rr, httptest.NewRequest("GET", "/", nil), discovery.Backend{Address: "127.0.0.1"}, nil, nil)
+	assert.True(t, result.Retry)
+	assert.True(t, result.BackendFailed())
+	assert.Empty(t, rr.Body.String())
+}
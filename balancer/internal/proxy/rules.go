@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"balancer/internal/discovery"
+)
+
+// Variables that header values can refer to.
+const (
+	VarClientIP       = "${client_ip}"
+	VarBackendPod     = "${backend_pod}"
+	VarBackendAddress = "${backend_address}"
+	VarRequestID      = "${request_id}"
+)
+
+// requestIDHeader carries the request ID. One is made up when the client
+// did not send it.
+const requestIDHeader = "X-Request-ID"
+
+// Rules are the changes a route makes to the requests it forwards and the
+// responses it returns.
+type Rules struct {
+	// Headers are applied in order, so a route's rules can follow and
+	// override the global ones.
+	Headers []HeaderRules
+	// Path rewrites the request path before it reaches the backend.
+	Path *PathRewrite
+	// MaxBodySize rejects request bodies larger than this many bytes with
+	// 413. Zero means no limit.
+	MaxBodySize int64
+	// BufferBody reads the whole request body before forwarding it, so it
+	// can be replayed. Otherwise the body is streamed to the backend.
+	BufferBody bool
+}
+
+// PathRewrite changes the path sent to the backend. A path that starts with
+// Prefix has it replaced with ReplacePrefix, which may be empty to strip it.
+// Regex, when set, then runs over the result with Replacement, which can
+// refer to capture groups as $1 or ${name}.
+type PathRewrite struct {
+	Prefix        string
+	ReplacePrefix string
+	Regex         *regexp.Regexp
+	Replacement   string
+}
+
+// Rewrite returns the path to send to the backend for path.
+func (pr *PathRewrite) Rewrite(path string) string {
+	if pr.Prefix != "" {
+		if rest, ok := strings.CutPrefix(path, pr.Prefix); ok {
+			path = pr.ReplacePrefix + rest
+		}
+	}
+	if pr.Regex != nil {
+		path = pr.Regex.ReplaceAllString(path, pr.Replacement)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// HeaderRules change request headers before they reach the backend and
+// response headers before they reach the client.
+type HeaderRules struct {
+	Request  HeaderOps
+	Response HeaderOps
+}
+
+// HeaderOps edit a header set. Remove runs first, then Set replaces any
+// existing values, then Add appends. Values may use the Var constants.
+type HeaderOps struct {
+	Add    map[string]string
+	Set    map[string]string
+	Remove []string
+}
+
+func (ops HeaderOps) apply(header http.Header, vars *strings.Replacer) {
+	for _, name := range ops.Remove {
+		header.Del(name)
+	}
+	for name, value := range ops.Set {
+		header.Set(name, vars.Replace(value))
+	}
+	for name, value := range ops.Add {
+		header.Add(name, vars.Replace(value))
+	}
+}
+
+func (ops HeaderOps) uses(variable string) bool {
+	for _, value := range ops.Set {
+		if strings.Contains(value, variable) {
+			return true
+		}
+	}
+	for _, value := range ops.Add {
+		if strings.Contains(value, variable) {
+			return true
+		}
+	}
+	return false
+}
+
+// needsRequestID reports whether any rule refers to the request ID, so one
+// is only generated when it will be used.
+func (rules *Rules) needsRequestID() bool {
+	if rules == nil {
+		return false
+	}
+	for _, headers := range rules.Headers {
+		if headers.Request.uses(VarRequestID) || headers.Response.uses(VarRequestID) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleVars builds the variable replacer for a request once, so request and
+// response rules see the same values.
+func ruleVars(r *http.Request, backend discovery.Backend, requestID string) *strings.Replacer {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	return strings.NewReplacer(
+		VarClientIP, clientIP,
+		VarBackendPod, backend.PodName,
+		VarBackendAddress, backend.Address,
+		VarRequestID, requestID,
+	)
+}
+
+// requestID returns the request ID the client sent, or a new random one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"balancer/internal/discovery"
+)
+
+func TestServe_HeaderRules(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Cookie"))
+		assert.Equal(t, "192.0.2.10", r.Header.Get("X-Client"))
+		assert.Equal(t, "abc", r.Header.Get("X-Request-ID"))
+		assert.Equal(t, []string{"global", "route"}, r.Header.Values("X-Layer"))
+		w.Header().Set("Server", "backend/1.0")
+	}))
+	t.Cleanup(upstream.Close)
+
+	rules := &Rules{Headers: []HeaderRules{
+		{
+			Request: HeaderOps{
+				Remove: []string{"Cookie"},
+				Set:    map[string]string{"X-Client": VarClientIP, "X-Request-ID": VarRequestID},
+				Add:    map[string]string{"X-Layer": "global"},
+			},
+		},
+		{
+			Request:  HeaderOps{Add: map[string]string{"X-Layer": "route"}},
+			Response: HeaderOps{Remove: []string{"Server"}, Set: map[string]string{"X-Served-By": VarBackendPod}},
+		},
+	}}
+
+	p := New(upstream.Listener.Addr().(*net.TCPAddr).Port)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.10:4567"
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-Request-ID", "abc")
+	rr := httptest.NewRecorder()
+	p.Serve(rr, req, discovery.Backend{Address: "127.0.0.1", PodName: "pod-a"}, rules)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Server"))
+	assert.Equal(t, "pod-a", rr.Header().Get("X-Served-By"))
+}
+
+func TestRequestID_Generated(t *testing.T) {
+	id := requestID(httptest.NewRequest("GET", "/", nil))
+	assert.Len(t, id, 32)
+	assert.NotEqual(t, id, requestID(httptest.NewRequest("GET", "/", nil)))
+}
+
+func TestPathRewrite(t *testing.T) {
+	strip := &PathRewrite{Prefix: "/api/v1"}
+	assert.Equal(t, "/users", strip.Rewrite("/api/v1/users"))
+	assert.Equal(t, "/", strip.Rewrite("/api/v1"))
+	assert.Equal(t, "/other", strip.Rewrite("/other"))
+
+	replace := &PathRewrite{Prefix: "/api/v1", ReplacePrefix: "/v2"}
+	assert.Equal(t, "/v2/users", replace.Rewrite("/api/v1/users"))
+
+	regex := &PathRewrite{Regex: regexp.MustCompile(`^/users/(\d+)$`), Replacement: "/user/$1/profile"}
+	assert.Equal(t, "/user/42/profile", regex.Rewrite("/users/42"))
+}
+
+func TestServe_PathRewrite(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/users", r.URL.Path)
+		assert.Equal(t, "page=2", r.URL.RawQuery)
+	}))
+	t.Cleanup(upstream.Close)
+
+	p := New(upstream.Listener.Addr().(*net.TCPAddr).Port)
+	rr := httptest.NewRecorder()
+	rules := &Rules{Path: &PathRewrite{Prefix: "/api/v1"}}
+	p.Serve(rr, httptest.NewRequest("GET", "/api/v1/users?page=2", nil), discovery.Backend{Address: "127.0.0.1"}, rules)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// TCPPool is a set of backends a TCPProxy can send a connection to.
+type TCPPool struct {
+	BackendPort int
+	Select      Selector
+}
+
+// errHelloRead stops the handshake once the ClientHello has been read.
+var errHelloRead = errors.New("client hello read")
+
+// peekServerName reads the TLS ClientHello from conn and returns the server
+// name it asks for, without terminating TLS. The returned conn replays the
+// bytes that were read, so the backend sees the handshake from the start.
+// Connections that are not TLS, or carry no server name, return "".
+func peekServerName(conn net.Conn, timeout time.Duration) (string, net.Conn) {
+	var buf bytes.Buffer
+	var serverName string
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	tls.Server(readOnlyConn{r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+	return serverName, &replayConn{Conn: conn, r: io.MultiReader(&buf, conn)}
+}
+
+// matchPool returns the pool for serverName. Exact names win over wildcards
+// like "*.example.com", which match a single label.
+func matchPool(pools map[string]TCPPool, serverName string) (TCPPool, bool) {
+	if serverName == "" {
+		return TCPPool{}, false
+	}
+	serverName = strings.ToLower(serverName)
+	if pool, ok := pools[serverName]; ok {
+		return pool, true
+	}
+	if _, rest, found := strings.Cut(serverName, "."); found {
+		if pool, ok := pools["*."+rest]; ok {
+			return pool, true
+		}
+	}
+	return TCPPool{}, false
+}
+
+// readOnlyConn feeds the ClientHello to crypto/tls while refusing to send
+// anything back to the client.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// replayConn reads the peeked bytes before the rest of the connection.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite half-closes the underlying connection when it supports it.
+func (c *replayConn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return c.Conn.Close()
+}
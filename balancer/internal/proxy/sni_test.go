@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"balancer/internal/discovery"
+)
+
+func TestMatchPool(t *testing.T) {
+	pools := map[string]TCPPool{
+		"db.example.com": {BackendPort: 1},
+		"*.example.com":  {BackendPort: 2},
+	}
+
+	pool, ok := matchPool(pools, "DB.example.com")
+	assert.True(t, ok)
+	assert.Equal(t, 1, pool.BackendPort)
+
+	pool, ok = matchPool(pools, "cache.example.com")
+	assert.True(t, ok)
+	assert.Equal(t, 2, pool.BackendPort)
+
+	_, ok = matchPool(pools, "a.b.example.com")
+	assert.False(t, ok)
+	_, ok = matchPool(pools, "")
+	assert.False(t, ok)
+}
+
+func TestTCPProxy_RoutesBySNI(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil, x509.ExtKeyUsageAny)
+	server := newTestCert(t, "db.test", ca, x509.ExtKeyUsageServerAuth)
+	upstream, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{server.tlsCertificate()}})
+	assert.NoError(t, err)
+	t.Cleanup(func() { upstream.Close() })
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	local := func(r *http.Request) (discovery.Backend, func(), error) {
+		return discovery.Backend{Address: "127.0.0.1"}, func() {}, nil
+	}
+	// The default pool points at a port nothing listens on, so only the SNI
+	// pool can answer.
+	tp := NewTCPProxy(1, local)
+	tp.SNI = map[string]TCPPool{
+		"db.test": {BackendPort: upstream.Addr().(*net.TCPAddr).Port, Select: local},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go tp.Serve(listener)
+	t.Cleanup(func() { tp.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "db.test"})
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("select 1\n"))
+	assert.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "select 1\n", line)
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+// Selector picks a backend for a new connection and returns a release func
+// that must be called once the connection ends.
+type Selector func(r *http.Request) (discovery.Backend, func(), error)
+
+// TCPProxy balances raw TCP connections. The backend is chosen once, when
+// the client connects, and bytes are streamed both ways until either side
+// closes.
+type TCPProxy struct {
+	BackendPort int
+	Select      Selector
+	DialTimeout time.Duration
+	// SNI sends TLS connections to another pool by the server name in their
+	// ClientHello, without terminating TLS. Keys are lower case host names
+	// or wildcards like "*.example.com". Connections that match no key use
+	// BackendPort and Select.
+	SNI map[string]TCPPool
+	// Drainer, when set, closes connections to a backend that was removed
+	// from discovery once the drain timeout passes.
+	Drainer *Drainer
+
+	active   atomic.Int64
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// NewTCPProxy creates a TCPProxy that connects to backends on backendPort.
+func NewTCPProxy(backendPort int, selector Selector) *TCPProxy {
+	return &TCPProxy{
+		BackendPort: backendPort,
+		Select:      selector,
+		DialTimeout: 5 * time.Second,
+		conns:       make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe accepts connections on addr until Close is called.
+func (tp *TCPProxy) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return tp.Serve(listener)
+}
+
+// Serve accepts connections on listener until Close is called.
+func (tp *TCPProxy) Serve(listener net.Listener) error {
+	tp.mu.Lock()
+	if tp.closed {
+		tp.mu.Unlock()
+		listener.Close()
+		return net.ErrClosed
+	}
+	tp.listener = listener
+	tp.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+		go tp.handle(conn)
+	}
+}
+
+// Close stops accepting connections and closes the ones in flight.
+func (tp *TCPProxy) Close() error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.closed = true
+	for conn := range tp.conns {
+		conn.Close()
+	}
+	if tp.listener != nil {
+		return tp.listener.Close()
+	}
+	return nil
+}
+
+// Active returns the number of client connections being proxied.
+func (tp *TCPProxy) Active() int64 {
+	return tp.active.Load()
+}
+
+func (tp *TCPProxy) track(conn net.Conn) bool {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if tp.closed {
+		return false
+	}
+	tp.conns[conn] = struct{}{}
+	return true
+}
+
+func (tp *TCPProxy) untrack(conn net.Conn) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	delete(tp.conns, conn)
+}
+
+func (tp *TCPProxy) handle(client net.Conn) {
+	defer client.Close()
+	if !tp.track(client) {
+		return
+	}
+	defer tp.untrack(client)
+
+	pool := TCPPool{BackendPort: tp.BackendPort, Select: tp.Select}
+	if len(tp.SNI) > 0 {
+		var serverName string
+		serverName, client = peekServerName(client, tp.DialTimeout)
+		if sniPool, ok := matchPool(tp.SNI, serverName); ok {
+			pool = sniPool
+		}
+		logging.Debug("Connection from %s asked for %q", client.RemoteAddr(), serverName)
+	}
+
+	backend, release, err := pool.Select(AddrRequest(client.RemoteAddr()))
+	if err != nil {
+		logging.Warning("Unable to pick a backend for %s: %v", client.RemoteAddr(), err)
+		return
+	}
+	defer release()
+
+	address := backend.HostPort(pool.BackendPort)
+	upstream, err := net.DialTimeout("tcp", address, tp.DialTimeout)
+	if err != nil {
+		logging.Error("Failed to connect to %s: %v", backend, err)
+		return
+	}
+	defer upstream.Close()
+	if !tp.track(upstream) {
+		return
+	}
+	defer tp.untrack(upstream)
+	if tp.Drainer != nil {
+		defer tp.Drainer.Track(backend, func() {
+			client.Close()
+			upstream.Close()
+		})()
+	}
+
+	tp.active.Add(1)
+	defer tp.active.Add(-1)
+	logging.Debug("Proxying %s to %s", client.RemoteAddr(), backend)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		pipe(upstream, client)
+	}()
+	go func() {
+		defer wg.Done()
+		pipe(client, upstream)
+	}()
+	wg.Wait()
+}
+
+// pipe copies src to dst and then half-closes dst, so the peer sees EOF
+// while the other direction keeps flowing.
+func pipe(dst, src net.Conn) {
+	if _, err := io.Copy(dst, src); err != nil && !errors.Is(err, net.ErrClosed) {
+		logging.Debug("Copy from %s to %s stopped: %v", src.RemoteAddr(), dst.RemoteAddr(), err)
+	}
+	if closer, ok := dst.(interface{ CloseWrite() error }); ok {
+		closer.CloseWrite()
+		return
+	}
+	dst.Close()
+}
+
+// AddrRequest builds the request strategies see for non-HTTP traffic from
+// addr. Only the client address is known, so hashing strategies key on the IP.
+func AddrRequest(addr net.Addr) *http.Request {
+	return &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Path: "/"},
+		Header:     make(http.Header),
+		RemoteAddr: addr.String(),
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"balancer/internal/discovery"
+)
+
+func echoServer(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestTCPProxy_Streams(t *testing.T) {
+	port := echoServer(t)
+	released := make(chan struct{}, 1)
+	remote := make(chan string, 1)
+	tp := NewTCPProxy(port, func(r *http.Request) (discovery.Backend, func(), error) {
+		remote <- r.RemoteAddr
+		return discovery.Backend{Address: "127.0.0.1"}, func() { released <- struct{}{} }, nil
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go tp.Serve(listener)
+	t.Cleanup(func() { tp.Close() })
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte("ping\n"))
+	assert.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+	assert.Equal(t, conn.LocalAddr().String(), <-remote)
+	assert.Equal(t, int64(1), tp.Active())
+
+	conn.Close()
+	select {
+	case <-released:
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend was not released after the client closed")
+	}
+}
+
+func TestTCPProxy_NoBackendClosesClient(t *testing.T) {
+	tp := NewTCPProxy(1, func(r *http.Request) (discovery.Backend, func(), error) {
+		return discovery.Backend{}, nil, io.ErrUnexpectedEOF
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go tp.Serve(listener)
+	t.Cleanup(func() { tp.Close() })
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
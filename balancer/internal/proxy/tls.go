@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// LoadClientTLS builds the client side TLS config for talking to backends.
+// Backend certificates are verified against the PEM bundle in caFile. When
+// certFile and keyFile are set, the balancer presents that certificate so
+// backends can require mutual TLS. serverName overrides the name checked in
+// backend certificates, which is needed because backends are dialled by IP.
+func LoadClientTLS(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the upstream ca %s: %w", caFile, err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in the upstream ca %s", caFile)
+	}
+
+	config := &tls.Config{
+		RootCAs:    roots,
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the upstream client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// TLSMaterial is a CA bundle and a certificate that can be replaced while
+// connections use them, so certificates rotate without a restart.
+// Handshakes after Update use the new material, connections already open
+// keep theirs.
+type TLSMaterial struct {
+	roots atomic.Pointer[x509.CertPool]
+	cert  atomic.Pointer[tls.Certificate]
+}
+
+// Update replaces the material with the PEM CA bundle and certificate and
+// key given, leaving out those that are empty. Nothing is replaced when any
+// of them does not parse.
+func (m *TLSMaterial) Update(caPEM, certPEM, keyPEM []byte) error {
+	var roots *x509.CertPool
+	if len(caPEM) > 0 {
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("no certificates found in the ca")
+		}
+	}
+	var cert *tls.Certificate
+	if len(certPEM) > 0 || len(keyPEM) > 0 {
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("failed to load the certificate: %w", err)
+		}
+		cert = &pair
+	}
+	m.roots.Store(roots)
+	m.cert.Store(cert)
+	return nil
+}
+
+// ServerConfig returns a TLS config for a listener presenting the current
+// certificate.
+func (m *TLSMaterial) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert := m.cert.Load()
+			if cert == nil {
+				return nil, errors.New("no certificate")
+			}
+			return cert, nil
+		},
+	}
+}
+
+// ClientConfig returns a TLS config for talking to backends like
+// LoadClientTLS, verifying them against the current CA bundle and
+// presenting the current certificate, if any.
+func (m *TLSMaterial) ClientConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+		// The roots of a tls.Config are fixed, so the backend certificate
+		// is verified in VerifyConnection against the current ones instead.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			roots := m.roots.Load()
+			if roots == nil {
+				return errors.New("no ca to verify the backend certificate with")
+			}
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("the backend presented no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+				DNSName:       state.ServerName,
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+			return err
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert := m.cert.Load(); cert != nil {
+				return cert, nil
+			}
+			// No certificate lets the backend decide whether it needs one.
+			return &tls.Certificate{}, nil
+		},
+	}
+}
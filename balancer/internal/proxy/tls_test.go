@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"balancer/internal/discovery"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write stores the certificate and key as PEM files and returns their paths.
+func (tc *testCert) write(t *testing.T, name string) (string, string) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	keyDER, err := x509.MarshalECPrivateKey(tc.key)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.der}), 0o600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func (tc *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{tc.der}, PrivateKey: tc.key}
+}
+
+func TestLoadClientTLS_MutualTLS(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil, x509.ExtKeyUsageAny)
+	server := newTestCert(t, "backend.test", ca, x509.ExtKeyUsageServerAuth)
+	client := newTestCert(t, "balancer", ca, x509.ExtKeyUsageClientAuth)
+	caFile, _ := ca.write(t, "ca")
+	certFile, keyFile := client.write(t, "client")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "balancer", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	upstream.TLS = &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+	port := upstream.Listener.Addr().(*net.TCPAddr).Port
+	backend := discovery.Backend{Address: "127.0.0.1"}
+
+	tlsConfig, err := LoadClientTLS(caFile, certFile, keyFile, "backend.test")
+	assert.NoError(t, err)
+	p, err := NewWithOptions(port, Options{TLS: tlsConfig})
+	assert.NoError(t, err)
+	rr := httptest.NewRecorder()
+	p.ServeBackend(rr, httptest.NewRequest("GET", "/", nil), backend)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Without a client certificate the backend refuses the handshake.
+	tlsConfig, err = LoadClientTLS(caFile, "", "", "backend.test")
+	assert.NoError(t, err)
+	p, err = NewWithOptions(port, Options{TLS: tlsConfig})
+	assert.NoError(t, err)
+	rr = httptest.NewRecorder()
+	p.ServeBackend(rr, httptest.NewRequest("GET", "/", nil), backend)
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+}
+
+func TestLoadClientTLS_BadCA(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	assert.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0o600))
+
+	_, err := LoadClientTLS(caFile, "", "", "")
+	assert.Error(t, err)
+}
+
+func (tc *testCert) pem(t *testing.T) ([]byte, []byte) {
+	keyDER, err := x509.MarshalECPrivateKey(tc.key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestTLSMaterial_Rotate(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil, x509.ExtKeyUsageAny)
+	otherCA := newTestCert(t, "other-ca", nil, x509.ExtKeyUsageAny)
+	server := newTestCert(t, "backend.test", ca, x509.ExtKeyUsageServerAuth)
+	client := newTestCert(t, "balancer", ca, x509.ExtKeyUsageClientAuth)
+	caPEM, _ := ca.pem(t)
+	otherCAPEM, _ := otherCA.pem(t)
+	serverCert, serverKey := server.pem(t)
+	clientCert, clientKey := client.pem(t)
+
+	var serverMaterial TLSMaterial
+	assert.NoError(t, serverMaterial.Update(nil, serverCert, serverKey))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "balancer", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	upstream.TLS = serverMaterial.ServerConfig()
+	upstream.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	upstream.TLS.ClientCAs = pool
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+	port := upstream.Listener.Addr().(*net.TCPAddr).Port
+	backend := discovery.Backend{Address: "127.0.0.1"}
+
+	var material TLSMaterial
+	assert.NoError(t, material.Update(caPEM, clientCert, clientKey))
+	serve := func() int {
+		// Keep-alives off so every request makes a new handshake.
+		p, err := NewWithOptions(port, Options{TLS: material.ClientConfig("backend.test"), Transport: TransportOptions{DisableKeepAlives: true}})
+		assert.NoError(t, err)
+		rr := httptest.NewRecorder()
+		p.ServeBackend(rr, httptest.NewRequest("GET", "/", nil), backend)
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusOK, serve())
+
+	// A bad update keeps the material in use.
+	assert.Error(t, material.Update([]byte("not a certificate"), nil, nil))
+	assert.Equal(t, http.StatusOK, serve())
+
+	// The backend certificate is not signed by the rotated ca.
+	assert.NoError(t, material.Update(otherCAPEM, clientCert, clientKey))
+	assert.Equal(t, http.StatusBadGateway, serve())
+
+	// Without a client certificate the backend refuses the handshake.
+	assert.NoError(t, material.Update(caPEM, nil, nil))
+	assert.Equal(t, http.StatusBadGateway, serve())
+}
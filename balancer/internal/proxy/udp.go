@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"pkg/logging"
+)
+
+// maxDatagram is the largest UDP payload that fits in a datagram.
+const maxDatagram = 65535
+
+// UDPProxy balances UDP datagrams. Each client address gets a session bound
+// to one backend, so a client's datagrams and the replies to them all go
+// through the same backend. Sessions idle for SessionTimeout are dropped.
+type UDPProxy struct {
+	BackendPort    int
+	Select         Selector
+	SessionTimeout time.Duration
+	// Drainer, when set, ends sessions bound to a backend that was removed
+	// from discovery once the drain timeout passes. The client's next
+	// datagram picks a new backend.
+	Drainer *Drainer
+
+	mu       sync.Mutex
+	conn     net.PacketConn
+	sessions map[string]*udpSession
+	closed   bool
+	done     chan struct{}
+}
+
+type udpSession struct {
+	client   net.Addr
+	upstream net.Conn
+	release  func()
+	untrack  func()
+	mu       sync.Mutex
+	lastSeen time.Time
+}
+
+func (us *udpSession) touch() {
+	us.mu.Lock()
+	us.lastSeen = time.Now()
+	us.mu.Unlock()
+}
+
+func (us *udpSession) idle(timeout time.Duration) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return time.Since(us.lastSeen) > timeout
+}
+
+// NewUDPProxy creates a UDPProxy that sends datagrams to backends on
+// backendPort. A sessionTimeout of zero uses 30 seconds.
+func NewUDPProxy(backendPort int, selector Selector, sessionTimeout time.Duration) *UDPProxy {
+	if sessionTimeout <= 0 {
+		sessionTimeout = 30 * time.Second
+	}
+	return &UDPProxy{
+		BackendPort:    backendPort,
+		Select:         selector,
+		SessionTimeout: sessionTimeout,
+		sessions:       make(map[string]*udpSession),
+		done:           make(chan struct{}),
+	}
+}
+
+// ListenAndServe reads datagrams on addr until Close is called.
+func (up *UDPProxy) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return up.Serve(conn)
+}
+
+// Serve reads datagrams from conn until Close is called.
+func (up *UDPProxy) Serve(conn net.PacketConn) error {
+	up.mu.Lock()
+	if up.closed {
+		up.mu.Unlock()
+		conn.Close()
+		return net.ErrClosed
+	}
+	up.conn = conn
+	up.mu.Unlock()
+
+	go up.reap()
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to read datagram: %w", err)
+		}
+		session, err := up.session(client)
+		if err != nil {
+			logging.Warning("Dropping datagram from %s: %v", client, err)
+			continue
+		}
+		session.touch()
+		if _, err := session.upstream.Write(buf[:n]); err != nil {
+			logging.Debug("Failed to forward datagram from %s: %v", client, err)
+		}
+	}
+}
+
+// Close stops reading datagrams and ends every session.
+func (up *UDPProxy) Close() error {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.closed {
+		return nil
+	}
+	up.closed = true
+	close(up.done)
+	for key, session := range up.sessions {
+		up.endLocked(key, session)
+	}
+	if up.conn != nil {
+		return up.conn.Close()
+	}
+	return nil
+}
+
+// Sessions returns the number of client sessions currently open.
+func (up *UDPProxy) Sessions() int {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return len(up.sessions)
+}
+
+// session returns the client's session, picking a backend and opening a
+// socket to it the first time the client is seen.
+func (up *UDPProxy) session(client net.Addr) (*udpSession, error) {
+	key := client.String()
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if session, ok := up.sessions[key]; ok {
+		return session, nil
+	}
+
+	backend, release, err := up.Select(AddrRequest(client))
+	if err != nil {
+		return nil, err
+	}
+	address := backend.HostPort(up.BackendPort)
+	upstream, err := net.Dial("udp", address)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("failed to connect to %s: %w", backend, err)
+	}
+	session := &udpSession{
+		client:   client,
+		upstream: upstream,
+		release:  release,
+		lastSeen: time.Now(),
+	}
+	up.sessions[key] = session
+	if up.Drainer != nil {
+		session.untrack = up.Drainer.Track(backend, func() { up.end(key, session) })
+	}
+	go up.replies(session)
+	logging.Debug("New udp session from %s to %s", client, backend)
+	return session, nil
+}
+
+// replies copies datagrams from the backend back to the client until the
+// session's upstream socket is closed.
+func (up *UDPProxy) replies(session *udpSession) {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, err := session.upstream.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logging.Debug("Reading replies for %s stopped: %v", session.client, err)
+			}
+			return
+		}
+		session.touch()
+		if _, err := up.conn.WriteTo(buf[:n], session.client); err != nil {
+			logging.Debug("Failed to send reply to %s: %v", session.client, err)
+		}
+	}
+}
+
+// reap ends sessions that have been idle longer than SessionTimeout.
+func (up *UDPProxy) reap() {
+	ticker := time.NewTicker(up.SessionTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-up.done:
+			return
+		case <-ticker.C:
+			up.mu.Lock()
+			for key, session := range up.sessions {
+				if session.idle(up.SessionTimeout) {
+					up.endLocked(key, session)
+				}
+			}
+			up.mu.Unlock()
+		}
+	}
+}
+
+// end ends session if it is still the client's current one.
+func (up *UDPProxy) end(key string, session *udpSession) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.sessions[key] == session {
+		up.endLocked(key, session)
+	}
+}
+
+func (up *UDPProxy) endLocked(key string, session *udpSession) {
+	delete(up.sessions, key)
+	session.upstream.Close()
+	session.release()
+	if session.untrack != nil {
+		session.untrack()
+	}
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"balancer/internal/discovery"
+)
+
+func udpEchoServer(t *testing.T) int {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestUDPProxy_SessionPerClient(t *testing.T) {
+	port := udpEchoServer(t)
+	var selected, released atomic.Int32
+	up := NewUDPProxy(port, func(r *http.Request) (discovery.Backend, func(), error) {
+		selected.Add(1)
+		return discovery.Backend{Address: "127.0.0.1"}, func() { released.Add(1) }, nil
+	}, 100*time.Millisecond)
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go up.Serve(listener)
+	t.Cleanup(func() { up.Close() })
+
+	client, err := net.Dial("udp", listener.LocalAddr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+
+	buf := make([]byte, 16)
+	for _, msg := range []string{"one", "two"} {
+		_, err = client.Write([]byte(msg))
+		assert.NoError(t, err)
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := client.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, string(buf[:n]))
+	}
+	assert.Equal(t, int32(1), selected.Load())
+
+	assert.Eventually(t, func() bool { return up.Sessions() == 0 }, 2*time.Second, 20*time.Millisecond)
+	assert.Equal(t, int32(1), released.Load())
+}
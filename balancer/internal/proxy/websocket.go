@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+// IsWebSocket reports whether r asks to upgrade the connection to a
+// WebSocket.
+func IsWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveWebSocket forwards a WebSocket handshake to backend. The reverse
+// proxy hijacks the client connection once the backend answers 101 and
+// copies frames both ways until either side closes, so the connection stays
+// on backend for its whole life. Hijacking also clears the server's read and
+// write timeouts, so they do not cut long lived sockets.
+func (p *Proxy) serveWebSocket(w http.ResponseWriter, r *http.Request, backend discovery.Backend) {
+	logging.Debug("Upgrading %s to a websocket on %s", r.RemoteAddr, backend)
+	p.upgrade.ServeHTTP(w, r)
+	logging.Debug("Websocket from %s to %s closed", r.RemoteAddr, backend)
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"balancer/internal/discovery"
+)
+
+func TestIsWebSocket(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	assert.False(t, IsWebSocket(r))
+
+	r.Header.Set("Upgrade", "WebSocket")
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	assert.True(t, IsWebSocket(r))
+
+	r.Header.Set("Connection", "keep-alive")
+	assert.False(t, IsWebSocket(r))
+}
+
+// upgradeEcho answers the handshake with 101 and then echoes raw bytes,
+// which is all the proxy needs to see to treat the connection as upgraded.
+func upgradeEcho(w http.ResponseWriter, r *http.Request) {
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	brw.Flush()
+	io.Copy(conn, brw)
+}
+
+func TestServeBackend_WebSocketOutlivesWriteTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(upgradeEcho))
+	t.Cleanup(upstream.Close)
+
+	p := New(upstream.Listener.Addr().(*net.TCPAddr).Port)
+	front := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ServeBackend(w, r, discovery.Backend{Address: "127.0.0.1"})
+	}))
+	front.Config.WriteTimeout = 100 * time.Millisecond
+	front.Start()
+	t.Cleanup(front.Close)
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	assert.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	time.Sleep(200 * time.Millisecond)
+	_, err = io.WriteString(conn, "frame\n")
+	assert.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "frame\n", line)
+}
@@ -0,0 +1,154 @@
+package strategy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+const (
+	defaultPollInterval = 5 * time.Second
+	// maxAdaptiveWeight is the weight given to the least loaded backend.
+	// Busier backends scale down from here towards 1.
+	maxAdaptiveWeight = 10
+)
+
+type backendStatus struct {
+	Count int64 `json:"count"`
+}
+
+// Adaptive polls each backend's /status counter and turns the number of
+// requests it served since the last poll into a weight: quiet backends get
+// up to maxAdaptiveWeight, the busiest backend gets 1. Requests are then
+// spread with smooth weighted round robin, so traffic drifts away from pods
+// that are receiving more load than their peers (for example from clients
+// that bypass this balancer).
+type Adaptive struct {
+	port     int
+	interval time.Duration
+	client   *http.Client
+	wrr      *WeightedRoundRobin
+	stopCh   chan struct{}
+
+	mu       sync.Mutex
+	backends []discovery.Backend
+	counts   map[string]int64
+}
+
+func NewAdaptive(port int, interval time.Duration) *Adaptive {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	a := &Adaptive{
+		port:     port,
+		interval: interval,
+		client:   &http.Client{Timeout: interval},
+		wrr:      NewWeightedRoundRobin(nil),
+		stopCh:   make(chan struct{}),
+		counts:   make(map[string]int64),
+	}
+	go a.run()
+	return a
+}
+
+// Stop ends the polling loop.
+func (a *Adaptive) Stop() {
+	close(a.stopCh)
+}
+
+func (a *Adaptive) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	a.mu.Lock()
+	a.backends = backends
+	a.mu.Unlock()
+	return a.wrr.Next(ctx, r, backends)
+}
+
+func (a *Adaptive) run() {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stopCh:
+			return
+		case <-ticker.C:
+			a.poll()
+		}
+	}
+}
+
+// poll fetches every known backend's counter and recomputes the weights.
+func (a *Adaptive) poll() {
+	a.mu.Lock()
+	backends := a.backends
+	a.mu.Unlock()
+
+	deltas := make(map[string]int64, len(backends))
+	for _, backend := range backends {
+		count, err := a.fetchCount(backend)
+		if err != nil {
+			logging.Warning("Adaptive poll of %s failed: %v", backend.PodName, err)
+			continue
+		}
+		a.mu.Lock()
+		previous, seen := a.counts[backend.PodName]
+		a.counts[backend.PodName] = count
+		a.mu.Unlock()
+		if !seen {
+			continue
+		}
+		delta := count - previous
+		if delta < 0 {
+			// The counter went backwards, so the pod restarted.
+			delta = count
+		}
+		deltas[backend.PodName] = delta
+	}
+
+	weights := adaptiveWeights(deltas)
+	logging.Debug("Adaptive weights updated: %v", weights)
+	a.wrr.SetWeights(weights)
+}
+
+func (a *Adaptive) fetchCount(backend discovery.Backend) (int64, error) {
+	resp, err := a.client.Get(fmt.Sprintf("http://%s/status", backend.HostPort(a.port)))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var status backendStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return 0, fmt.Errorf("failed to decode status: %w", err)
+	}
+	return status.Count, nil
+}
+
+// adaptiveWeights maps each pod's recent request count onto 1..maxAdaptiveWeight,
+// with the busiest pod at 1.
+func adaptiveWeights(deltas map[string]int64) map[string]int {
+	var busiest int64
+	for _, delta := range deltas {
+		if delta > busiest {
+			busiest = delta
+		}
+	}
+	weights := make(map[string]int, len(deltas))
+	for pod, delta := range deltas {
+		if busiest == 0 {
+			weights[pod] = maxAdaptiveWeight
+			continue
+		}
+		idle := float64(busiest-delta) / float64(busiest)
+		weights[pod] = 1 + int(idle*float64(maxAdaptiveWeight-1))
+	}
+	return weights
+}
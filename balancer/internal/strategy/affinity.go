@@ -0,0 +1,143 @@
+package strategy
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+const defaultAffinityMaxEntries = 10000
+
+type affinityEntry struct {
+	key      string
+	address  string
+	lastUsed time.Time
+}
+
+// AffinityTable remembers which backend each client key was sent to. Entries
+// expire after ttl without use, and once maxEntries is reached the least
+// recently used entry is evicted, so memory stays bounded on long running
+// balancers.
+type AffinityTable struct {
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func NewAffinityTable(ttl time.Duration, maxEntries int) *AffinityTable {
+	if maxEntries < 1 {
+		maxEntries = defaultAffinityMaxEntries
+	}
+	return &AffinityTable{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		now:        time.Now,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the backend address stored for key if the entry is still
+// live, refreshing its expiry.
+func (at *AffinityTable) Get(key string) (string, bool) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	element, ok := at.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := element.Value.(*affinityEntry)
+	now := at.now()
+	if now.Sub(entry.lastUsed) > at.ttl {
+		at.remove(element)
+		return "", false
+	}
+	entry.lastUsed = now
+	at.order.MoveToFront(element)
+	return entry.address, true
+}
+
+// Set pins key to address, evicting the least recently used entry when the
+// table is full.
+func (at *AffinityTable) Set(key, address string) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	now := at.now()
+	if element, ok := at.entries[key]; ok {
+		entry := element.Value.(*affinityEntry)
+		entry.address = address
+		entry.lastUsed = now
+		at.order.MoveToFront(element)
+		return
+	}
+
+	for at.order.Len() >= at.maxEntries {
+		at.remove(at.order.Back())
+	}
+	at.entries[key] = at.order.PushFront(&affinityEntry{key: key, address: address, lastUsed: now})
+}
+
+// Len reports how many entries the table holds.
+func (at *AffinityTable) Len() int {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	return at.order.Len()
+}
+
+// remove drops element from the table. Callers must hold at.mu.
+func (at *AffinityTable) remove(element *list.Element) {
+	at.order.Remove(element)
+	delete(at.entries, element.Value.(*affinityEntry).key)
+}
+
+// Affinity wraps another strategy and keeps sending a client to the backend
+// it was first given, for as long as the client stays active and that
+// backend is still a candidate. Clients are told apart by hashKey, the same
+// request attribute the hashing strategies use.
+type Affinity struct {
+	wrapped
+	hashKey string
+	table   *AffinityTable
+}
+
+func NewAffinity(inner Strategy, hashKey string, table *AffinityTable) *Affinity {
+	if hashKey == "" {
+		hashKey = hashKeyIP
+	}
+	return &Affinity{
+		wrapped: wrapped{inner: inner},
+		hashKey: hashKey,
+		table:   table,
+	}
+}
+
+func (a *Affinity) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	key := requestKey(r, a.hashKey)
+	if address, ok := a.table.Get(key); ok {
+		for _, backend := range backends {
+			if backend.Address == address {
+				logging.Debug("Sticky backend for %s is %s", key, backend)
+				return backend, nil
+			}
+		}
+	}
+
+	next, err := a.inner.Next(ctx, r, backends)
+	if err != nil {
+		return next, err
+	}
+	a.table.Set(key, next.Address)
+	return next, nil
+}
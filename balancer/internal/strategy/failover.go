@@ -0,0 +1,49 @@
+package strategy
+
+import (
+	"context"
+	"net/http"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+// Failover wraps another strategy and only offers it the backends with the
+// best (lowest) Priority. Backup backends are therefore used only while no
+// primary backend is available, and traffic fails back on its own as soon
+// as a primary returns.
+type Failover struct {
+	wrapped
+}
+
+func NewFailover(inner Strategy) *Failover {
+	return &Failover{wrapped: wrapped{inner: inner}}
+}
+
+func (f *Failover) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	return f.inner.Next(ctx, r, bestPriority(backends))
+}
+
+// bestPriority returns the backends that share the lowest Priority value.
+func bestPriority(backends []discovery.Backend) []discovery.Backend {
+	if len(backends) == 0 {
+		return backends
+	}
+	best := backends[0].Priority
+	for _, backend := range backends {
+		if backend.Priority < best {
+			best = backend.Priority
+		}
+	}
+	if best > 0 {
+		logging.Debug("No primary backends available, failing over to priority %d", best)
+	}
+	result := make([]discovery.Backend, 0, len(backends))
+	for _, backend := range backends {
+		if backend.Priority == best {
+			result = append(result, backend)
+		}
+	}
+	return result
+}
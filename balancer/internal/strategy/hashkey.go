@@ -0,0 +1,45 @@
+package strategy
+
+import (
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	hashKeyIP     = "ip"
+	hashKeyHeader = "header:"
+	hashKeyCookie = "cookie:"
+)
+
+// requestKey pulls the attribute named by hashKey out of the request. When
+// the header or cookie is missing the client IP is used instead so the
+// request still gets a stable backend.
+func requestKey(r *http.Request, hashKey string) string {
+	switch {
+	case strings.HasPrefix(hashKey, hashKeyHeader):
+		if value := r.Header.Get(strings.TrimPrefix(hashKey, hashKeyHeader)); value != "" {
+			return value
+		}
+	case strings.HasPrefix(hashKey, hashKeyCookie):
+		if cookie, err := r.Cookie(strings.TrimPrefix(hashKey, hashKeyCookie)); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	return clientIP(r)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
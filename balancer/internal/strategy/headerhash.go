@@ -0,0 +1,39 @@
+package strategy
+
+import (
+	"context"
+	"net/http"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+const defaultHashHeader = "X-Tenant-ID"
+
+// HeaderHash pins every value of a request header to one backend, so all
+// requests for a tenant reach the same pod. Requests without the header are
+// hashed on the client IP instead.
+type HeaderHash struct {
+	Header string
+}
+
+func NewHeaderHash(header string) *HeaderHash {
+	if header == "" {
+		header = defaultHashHeader
+	}
+	return &HeaderHash{Header: header}
+}
+
+func (hh *HeaderHash) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	if len(backends) == 0 {
+		return discovery.Backend{}, ErrNoBackends
+	}
+	key := r.Header.Get(hh.Header)
+	if key == "" {
+		key = clientIP(r)
+	}
+	next := rendezvous(key, backends)
+	logging.Debug("Backend requested for %s %s, sending %s", hh.Header, key, next)
+	return next, nil
+}
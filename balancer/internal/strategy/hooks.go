@@ -0,0 +1,67 @@
+package strategy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"balancer/internal/discovery"
+)
+
+// Decision describes a single backend pick.
+type Decision struct {
+	// Method is the LoadbalancerMethod that made the pick.
+	Method string
+	// Backend is the chosen backend. It is the zero Backend when Err is set.
+	Backend discovery.Backend
+	// Candidates is how many backends were offered to the strategy.
+	Candidates int
+	// Latency is how long the pick took.
+	Latency time.Duration
+	Err     error
+}
+
+// Hook is called after every pick so metrics code can record distribution
+// and decision cost in one place instead of inside each strategy. Hooks run
+// on the request path and should return quickly.
+type Hook interface {
+	OnDecision(d Decision)
+}
+
+// HookFunc lets a plain function be used as a Hook.
+type HookFunc func(d Decision)
+
+func (f HookFunc) OnDecision(d Decision) {
+	f(d)
+}
+
+// Observed wraps a strategy and reports each of its picks to hooks.
+type Observed struct {
+	wrapped
+	method string
+	hooks  []Hook
+}
+
+func NewObserved(inner Strategy, method string, hooks []Hook) *Observed {
+	return &Observed{
+		wrapped: wrapped{inner: inner},
+		method:  method,
+		hooks:   hooks,
+	}
+}
+
+func (o *Observed) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	start := time.Now()
+	next, err := o.inner.Next(ctx, r, backends)
+	decision := Decision{
+		Method:     o.method,
+		Backend:    next,
+		Candidates: len(backends),
+		Latency:    time.Since(start),
+		Err:        err,
+	}
+	for _, hook := range o.hooks {
+		hook.OnDecision(decision)
+	}
+	return next, err
+}
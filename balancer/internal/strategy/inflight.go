@@ -0,0 +1,94 @@
+package strategy
+
+import (
+	"sync"
+
+	"balancer/internal/discovery"
+)
+
+// InflightTracker counts outstanding requests per backend address, and the
+// requests sent to each since it was created. One tracker is shared by the
+// handler and every strategy it builds, so the counts stay correct when a
+// route or a runtime switch uses a new strategy. In tcp and udp mode a
+// request is a connection or a session.
+type InflightTracker struct {
+	mu       sync.Mutex
+	inflight map[string]int
+	requests map[string]uint64
+	// gone holds the addresses forgotten while requests were in flight,
+	// whose counts go once the last one is done.
+	gone map[string]bool
+}
+
+func NewInflightTracker() *InflightTracker {
+	return &InflightTracker{
+		inflight: make(map[string]int),
+		requests: make(map[string]uint64),
+		gone:     make(map[string]bool),
+	}
+}
+
+// Start records a request sent to backend.
+func (it *InflightTracker) Start(backend discovery.Backend) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.inflight[backend.Address]++
+	it.requests[backend.Address]++
+	delete(it.gone, backend.Address)
+}
+
+// Done records that a request to backend finished.
+func (it *InflightTracker) Done(backend discovery.Backend) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.inflight[backend.Address]--
+	if it.inflight[backend.Address] <= 0 {
+		delete(it.inflight, backend.Address)
+		if it.gone[backend.Address] {
+			delete(it.gone, backend.Address)
+			delete(it.requests, backend.Address)
+		}
+	}
+}
+
+// Forget drops the counts of backend, which has left discovery, so the
+// addresses of old pods do not pile up. Requests still in flight keep them
+// until they are done.
+func (it *InflightTracker) Forget(backend discovery.Backend) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if it.inflight[backend.Address] > 0 {
+		it.gone[backend.Address] = true
+		return
+	}
+	delete(it.requests, backend.Address)
+}
+
+// Count returns the outstanding requests for backend.
+func (it *InflightTracker) Count(backend discovery.Backend) int {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return it.inflight[backend.Address]
+}
+
+// Requests returns a copy of the requests sent per backend address.
+func (it *InflightTracker) Requests() map[string]uint64 {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	requests := make(map[string]uint64, len(it.requests))
+	for address, count := range it.requests {
+		requests[address] = count
+	}
+	return requests
+}
+
+// Snapshot returns a copy of the outstanding requests per backend address.
+func (it *InflightTracker) Snapshot() map[string]int {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	inflight := make(map[string]int, len(it.inflight))
+	for address, count := range it.inflight {
+		inflight[address] = count
+	}
+	return inflight
+}
@@ -0,0 +1,64 @@
+package strategy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+// IPHash gives each client IP a stable backend without needing cookies. It
+// uses rendezvous hashing: every backend is scored by hashing it together
+// with the client IP and the highest score wins, so removing a backend only
+// moves the clients that were on it.
+type IPHash struct {
+	// TrustForwardedFor takes the client IP from X-Forwarded-For. Only turn
+	// this on when the balancer sits behind a proxy that sets the header,
+	// otherwise clients can pick their own backend.
+	TrustForwardedFor bool
+}
+
+func NewIPHash(trustForwardedFor bool) *IPHash {
+	return &IPHash{TrustForwardedFor: trustForwardedFor}
+}
+
+func (ih *IPHash) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	if len(backends) == 0 {
+		return discovery.Backend{}, ErrNoBackends
+	}
+	ip := ih.clientIP(r)
+	next := rendezvous(ip, backends)
+	logging.Debug("Backend requested for client %s, sending %s", ip, next)
+	return next, nil
+}
+
+func (ih *IPHash) clientIP(r *http.Request) string {
+	if ih.TrustForwardedFor {
+		// The left-most entry is the original client, later entries are
+		// proxies it passed through.
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			if ip := strings.TrimSpace(first); ip != "" {
+				return ip
+			}
+		}
+	}
+	return clientIP(r)
+}
+
+// rendezvous picks the backend with the highest hash of key and address.
+func rendezvous(key string, backends []discovery.Backend) discovery.Backend {
+	best := backends[0]
+	var bestScore uint64
+	for i, backend := range backends {
+		score := hashString(key + "|" + backend.Address)
+		if i == 0 || score > bestScore {
+			best = backend
+			bestScore = score
+		}
+	}
+	return best
+}
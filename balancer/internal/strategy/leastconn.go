@@ -0,0 +1,76 @@
+package strategy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+// LeastConnections sends each request to the backend with the fewest
+// requests currently in flight. The handler reports request start and end
+// through Acquire and Release.
+type LeastConnections struct {
+	mu     sync.Mutex
+	active map[string]int
+	// rotation moves the starting point of each scan so ties are spread
+	// across backends instead of always landing on the first one.
+	rotation int
+}
+
+func NewLeastConnections() *LeastConnections {
+	return &LeastConnections{
+		active: make(map[string]int),
+	}
+}
+
+func (lc *LeastConnections) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	if len(backends) == 0 {
+		return discovery.Backend{}, ErrNoBackends
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	start := lc.rotation % len(backends)
+	lc.rotation++
+	next := backends[start]
+	fewest := lc.active[next.Address]
+	for i := 1; i < len(backends); i++ {
+		backend := backends[(start+i)%len(backends)]
+		if lc.active[backend.Address] < fewest {
+			next = backend
+			fewest = lc.active[backend.Address]
+		}
+	}
+	logging.Debug("Backend requested, sending %s with %d active connections", next, fewest)
+	return next, nil
+}
+
+func (lc *LeastConnections) Acquire(backend discovery.Backend) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.active[backend.Address]++
+}
+
+func (lc *LeastConnections) Release(backend discovery.Backend) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.active[backend.Address]--
+	if lc.active[backend.Address] <= 0 {
+		delete(lc.active, backend.Address)
+	}
+}
+
+// Active returns a snapshot of in-flight requests per backend address.
+func (lc *LeastConnections) Active() map[string]int {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	active := make(map[string]int, len(lc.active))
+	for address, count := range lc.active {
+		active[address] = count
+	}
+	return active
+}
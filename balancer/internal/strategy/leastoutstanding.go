@@ -0,0 +1,60 @@
+package strategy
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+// LeastOutstanding sends each request to the backend with the fewest
+// outstanding requests in a shared InflightTracker. Unlike LeastConnections
+// it keeps no counts of its own, so it sees every request the handler is
+// proxying, including those picked by other strategies. Ties are broken at
+// random.
+type LeastOutstanding struct {
+	tracker *InflightTracker
+	mu      sync.Mutex
+	rng     *rand.Rand
+}
+
+// NewLeastOutstanding reads counts from tracker. A nil tracker gets a
+// private one, which only stays accurate if the caller updates it.
+func NewLeastOutstanding(tracker *InflightTracker) *LeastOutstanding {
+	if tracker == nil {
+		tracker = NewInflightTracker()
+	}
+	return &LeastOutstanding{
+		tracker: tracker,
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())), // #nosec G404 -- tie breaking does not need crypto randomness
+	}
+}
+
+func (lo *LeastOutstanding) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	if len(backends) == 0 {
+		return discovery.Backend{}, ErrNoBackends
+	}
+	inflight := lo.tracker.Snapshot()
+
+	fewest := inflight[backends[0].Address]
+	for _, backend := range backends[1:] {
+		fewest = min(fewest, inflight[backend.Address])
+	}
+	tied := make([]discovery.Backend, 0, len(backends))
+	for _, backend := range backends {
+		if inflight[backend.Address] == fewest {
+			tied = append(tied, backend)
+		}
+	}
+
+	lo.mu.Lock()
+	next := tied[lo.rng.Intn(len(tied))]
+	lo.mu.Unlock()
+	logging.Debug("Backend requested, sending %s with %d outstanding requests", next, fewest)
+	return next, nil
+}
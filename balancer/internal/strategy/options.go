@@ -0,0 +1,212 @@
+package strategy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// OptionsDecoder sets the options a strategy takes of its own on opts, from
+// its entry in the config's strategyoptions. decode reads them into a
+// struct like json.Unmarshal, failing on fields the struct does not have.
+// Values the strategy cannot use are errors too.
+type OptionsDecoder func(decode func(v any) error, opts *Options) error
+
+var decoders = make(map[string]OptionsDecoder)
+
+func init() {
+	RegisterOptions("RingHash", func(decode func(any) error, opts *Options) error {
+		params := struct {
+			HashKey      string `json:"hashkey"`
+			VirtualNodes int    `json:"virtualnodes"`
+		}{opts.HashKey, opts.VirtualNodes}
+		if err := decode(&params); err != nil {
+			return err
+		}
+		if err := checkHashKey(params.HashKey); err != nil {
+			return err
+		}
+		if params.VirtualNodes < 0 {
+			return fmt.Errorf("virtualnodes must not be negative, got %d", params.VirtualNodes)
+		}
+		opts.HashKey, opts.VirtualNodes = params.HashKey, params.VirtualNodes
+		return nil
+	})
+	RegisterOptions("Sharded", func(decode func(any) error, opts *Options) error {
+		params := struct {
+			HashKey string `json:"hashkey"`
+			Shards  int    `json:"shards"`
+		}{opts.HashKey, opts.Shards}
+		if err := decode(&params); err != nil {
+			return err
+		}
+		if err := checkHashKey(params.HashKey); err != nil {
+			return err
+		}
+		if params.Shards < 0 {
+			return fmt.Errorf("shards must not be negative, got %d", params.Shards)
+		}
+		opts.HashKey, opts.Shards = params.HashKey, params.Shards
+		return nil
+	})
+	RegisterOptions("HeaderHash", func(decode func(any) error, opts *Options) error {
+		params := struct {
+			Header string `json:"header"`
+		}{opts.HashHeader}
+		if err := decode(&params); err != nil {
+			return err
+		}
+		opts.HashHeader = params.Header
+		return nil
+	})
+	RegisterOptions("IPHash", func(decode func(any) error, opts *Options) error {
+		params := struct {
+			TrustForwardedFor bool `json:"trustforwardedfor"`
+		}{opts.TrustForwardedFor}
+		if err := decode(&params); err != nil {
+			return err
+		}
+		opts.TrustForwardedFor = params.TrustForwardedFor
+		return nil
+	})
+	RegisterOptions("Adaptive", func(decode func(any) error, opts *Options) error {
+		params := struct {
+			PollInterval duration `json:"pollinterval"`
+		}{duration(opts.PollInterval)}
+		if err := decode(&params); err != nil {
+			return err
+		}
+		if params.PollInterval < 0 {
+			return fmt.Errorf("pollinterval must not be negative, got %s", time.Duration(params.PollInterval))
+		}
+		opts.PollInterval = time.Duration(params.PollInterval)
+		return nil
+	})
+	RegisterOptions("PeakEWMA", func(decode func(any) error, opts *Options) error {
+		params := struct {
+			Decay duration `json:"decay"`
+		}{duration(opts.EWMADecay)}
+		if err := decode(&params); err != nil {
+			return err
+		}
+		if params.Decay < 0 {
+			return fmt.Errorf("decay must not be negative, got %s", time.Duration(params.Decay))
+		}
+		opts.EWMADecay = time.Duration(params.Decay)
+		return nil
+	})
+	weights := func(decode func(any) error, opts *Options) error {
+		params := struct {
+			Weights map[string]int `json:"weights"`
+		}{opts.Weights}
+		if err := decode(&params); err != nil {
+			return err
+		}
+		for _, pod := range slices.Sorted(maps.Keys(params.Weights)) {
+			if weight := params.Weights[pod]; weight < 1 {
+				return fmt.Errorf("weight for %s must be at least 1, got %d", pod, weight)
+			}
+		}
+		opts.Weights = params.Weights
+		return nil
+	}
+	RegisterOptions("WeightedRoundRobin", weights)
+	RegisterOptions("WeightedLeastConnections", weights)
+}
+
+// RegisterOptions lets the strategy registered as name take options of its
+// own, read by decode. Strategies without one only take the options every
+// strategy has, slowstartwindow. It panics if name already has a decoder or
+// decode is nil.
+func RegisterOptions(name string, decode OptionsDecoder) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if decode == nil {
+		panic("strategy: RegisterOptions decoder is nil for " + name)
+	}
+	if _, exists := decoders[name]; exists {
+		panic("strategy: RegisterOptions called twice for " + name)
+	}
+	decoders[name] = decode
+}
+
+// ApplyOptions sets the options params gives the strategy method on opts,
+// and returns an error for any it does not take or cannot use. Every
+// strategy takes slowstartwindow, a duration like "30s".
+func ApplyOptions(method string, params json.RawMessage, opts *Options) error {
+	if len(params) == 0 {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(params, &fields); err != nil {
+		return fmt.Errorf("options of %s must be a table: %w", method, err)
+	}
+	if window, ok := fields["slowstartwindow"]; ok {
+		var d duration
+		if err := json.Unmarshal(window, &d); err != nil {
+			return fmt.Errorf("invalid slowstartwindow of %s: %w", method, err)
+		}
+		if d < 0 {
+			return fmt.Errorf("slowstartwindow of %s must not be negative, got %s", method, time.Duration(d))
+		}
+		opts.SlowStartWindow = time.Duration(d)
+		delete(fields, "slowstartwindow")
+	}
+
+	registryMu.RLock()
+	decoder := decoders[method]
+	registryMu.RUnlock()
+	if decoder == nil {
+		if len(fields) > 0 {
+			return fmt.Errorf("%s takes no options but slowstartwindow, got %s", method, strings.Join(slices.Sorted(maps.Keys(fields)), ", "))
+		}
+		return nil
+	}
+	rest, err := json.Marshal(fields)
+	if err != nil {
+		return fmt.Errorf("invalid options of %s: %w", method, err)
+	}
+	decode := func(v any) error {
+		decoder := json.NewDecoder(bytes.NewReader(rest))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(v)
+	}
+	if err := decoder(decode, opts); err != nil {
+		return fmt.Errorf("invalid options of %s: %w", method, err)
+	}
+	return nil
+}
+
+// duration reads Go duration strings such as "30s" from JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %w", s, err)
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// checkHashKey reports a hash key that is not "ip", "header:<name>" or
+// "cookie:<name>". Empty keeps the default, the client IP.
+func checkHashKey(key string) error {
+	switch {
+	case key == "", key == hashKeyIP:
+		return nil
+	case strings.HasPrefix(key, hashKeyHeader) && len(key) > len(hashKeyHeader):
+		return nil
+	case strings.HasPrefix(key, hashKeyCookie) && len(key) > len(hashKeyCookie):
+		return nil
+	}
+	return fmt.Errorf("invalid hashkey %q, use ip, header:<name> or cookie:<name>", key)
+}
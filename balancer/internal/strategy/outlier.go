@@ -0,0 +1,172 @@
+package strategy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+const (
+	defaultConsecutiveFailures = 5
+	defaultOutlierMinRequests  = 20
+	defaultOutlierInterval     = 10 * time.Second
+	defaultBaseEjectionTime    = 30 * time.Second
+	defaultMaxEjectionTime     = 5 * time.Minute
+)
+
+// OutlierOptions set when a backend is ejected. Zero fields use the
+// defaults.
+type OutlierOptions struct {
+	// ConsecutiveFailures ejects a backend after this many failed requests
+	// in a row. Defaults to 5.
+	ConsecutiveFailures int
+	// ErrorRatePercent ejects a backend whose share of failed requests in
+	// an Interval reaches this percentage. Zero turns the check off.
+	ErrorRatePercent int
+	// MinRequests is how many requests a backend needs in an Interval before
+	// its error rate counts. Defaults to 20.
+	MinRequests int
+	// Interval is the window error rates are measured over. Defaults to 10
+	// seconds.
+	Interval time.Duration
+	// BaseEjectionTime is how long the first ejection lasts. Every further
+	// ejection doubles it. Defaults to 30 seconds.
+	BaseEjectionTime time.Duration
+	// MaxEjectionTime caps an ejection. A backend that stays in this long
+	// after being readmitted starts again from BaseEjectionTime. Defaults to
+	// 5 minutes.
+	MaxEjectionTime time.Duration
+}
+
+// OutlierDetector watches the outcome of requests to each backend and
+// ejects backends that keep failing, whatever Kubernetes thinks of their
+// readiness. Ejected backends are readmitted once their ejection runs out.
+type OutlierDetector struct {
+	opts     OutlierOptions
+	mu       sync.Mutex
+	backends map[string]*outlierState
+	now      func() time.Time
+}
+
+// outlierState is what the detector knows about one backend address.
+type outlierState struct {
+	consecutive  int
+	windowStart  time.Time
+	requests     int
+	failures     int
+	ejections    int
+	ejectedUntil time.Time
+}
+
+func NewOutlierDetector(opts OutlierOptions) *OutlierDetector {
+	if opts.ConsecutiveFailures <= 0 {
+		opts.ConsecutiveFailures = defaultConsecutiveFailures
+	}
+	if opts.MinRequests <= 0 {
+		opts.MinRequests = defaultOutlierMinRequests
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultOutlierInterval
+	}
+	if opts.BaseEjectionTime <= 0 {
+		opts.BaseEjectionTime = defaultBaseEjectionTime
+	}
+	if opts.MaxEjectionTime <= 0 {
+		opts.MaxEjectionTime = defaultMaxEjectionTime
+	}
+	return &OutlierDetector{
+		opts:     opts,
+		backends: make(map[string]*outlierState),
+		now:      time.Now,
+	}
+}
+
+// Observe records how a request to backend went.
+func (od *OutlierDetector) Observe(backend discovery.Backend, failed bool) {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	now := od.now()
+	state, ok := od.backends[backend.Address]
+	if !ok {
+		state = &outlierState{windowStart: now}
+		od.backends[backend.Address] = state
+	}
+	if now.Before(state.ejectedUntil) {
+		// Requests that were already in flight when the backend was ejected
+		// say nothing new.
+		return
+	}
+	if now.Sub(state.windowStart) >= od.opts.Interval {
+		state.windowStart = now
+		state.requests = 0
+		state.failures = 0
+	}
+
+	state.requests++
+	if !failed {
+		state.consecutive = 0
+		return
+	}
+	state.consecutive++
+	state.failures++
+
+	if state.consecutive >= od.opts.ConsecutiveFailures {
+		od.eject(backend, state, now, fmt.Sprintf("%d failures in a row", state.consecutive))
+		return
+	}
+	if od.opts.ErrorRatePercent > 0 && state.requests >= od.opts.MinRequests &&
+		state.failures*100 >= state.requests*od.opts.ErrorRatePercent {
+		od.eject(backend, state, now, fmt.Sprintf("%d of %d requests failed", state.failures, state.requests))
+	}
+}
+
+// eject takes backend out of rotation, doubling the time on every ejection
+// since it last stayed in for MaxEjectionTime. od.mu must be held.
+func (od *OutlierDetector) eject(backend discovery.Backend, state *outlierState, now time.Time, reason string) {
+	if state.ejections > 0 && now.Sub(state.ejectedUntil) >= od.opts.MaxEjectionTime {
+		state.ejections = 0
+	}
+	ejection := od.opts.BaseEjectionTime << state.ejections
+	if ejection > od.opts.MaxEjectionTime || ejection <= 0 {
+		ejection = od.opts.MaxEjectionTime
+	}
+	state.ejections++
+	state.ejectedUntil = now.Add(ejection)
+	state.consecutive = 0
+	state.windowStart = state.ejectedUntil
+	state.requests = 0
+	state.failures = 0
+	logging.Warning("Ejecting backend %s for %s after %s", backend.Address, ejection, reason)
+}
+
+// Ejected reports whether backend is currently ejected.
+func (od *OutlierDetector) Ejected(backend discovery.Backend) bool {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	state, ok := od.backends[backend.Address]
+	return ok && od.now().Before(state.ejectedUntil)
+}
+
+// Filter returns the backends that are not ejected. When every backend is
+// ejected they are all returned, since sending traffic to a failing backend
+// beats sending it nowhere.
+func (od *OutlierDetector) Filter(backends []discovery.Backend) []discovery.Backend {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	now := od.now()
+	result := make([]discovery.Backend, 0, len(backends))
+	for _, backend := range backends {
+		if state, ok := od.backends[backend.Address]; ok && now.Before(state.ejectedUntil) {
+			continue
+		}
+		result = append(result, backend)
+	}
+	if len(result) == 0 {
+		return backends
+	}
+	return result
+}
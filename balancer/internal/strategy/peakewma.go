@@ -0,0 +1,136 @@
+package strategy
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+const (
+	defaultEWMADecay = 10 * time.Second
+	// unprobedPenalty is the latency assumed for a backend that has requests
+	// in flight but has not answered one yet.
+	unprobedPenalty = time.Second
+)
+
+type ewmaState struct {
+	cost        float64
+	lastUpdate  time.Time
+	outstanding int
+}
+
+// PeakEWMA estimates each backend's latency with an exponentially weighted
+// moving average that jumps straight up to any slower observation (the
+// "peak") and only decays slowly afterwards. The estimate is multiplied by
+// the number of outstanding requests plus one, and two random backends are
+// compared on that score (power of two choices). This reacts to a slow or
+// stalled pod much faster than plain latency balancing.
+type PeakEWMA struct {
+	decay time.Duration
+	now   func() time.Time
+
+	mu     sync.Mutex
+	rng    *rand.Rand
+	states map[string]*ewmaState
+}
+
+func NewPeakEWMA(decay time.Duration) *PeakEWMA {
+	if decay <= 0 {
+		decay = defaultEWMADecay
+	}
+	return &PeakEWMA{
+		decay:  decay,
+		now:    time.Now,
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())), // #nosec G404 -- backend selection does not need crypto randomness
+		states: make(map[string]*ewmaState),
+	}
+}
+
+func (pe *PeakEWMA) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	if len(backends) == 0 {
+		return discovery.Backend{}, ErrNoBackends
+	}
+	if len(backends) == 1 {
+		return backends[0], nil
+	}
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	i := pe.rng.Intn(len(backends))
+	j := pe.rng.Intn(len(backends) - 1)
+	if j >= i {
+		j++
+	}
+	first, second := backends[i], backends[j]
+	next := first
+	if pe.score(second) < pe.score(first) {
+		next = second
+	}
+	logging.Debug("Backend requested, sending %s", next)
+	return next, nil
+}
+
+// score is the decayed latency estimate scaled by the requests in flight.
+// Callers must hold pe.mu.
+func (pe *PeakEWMA) score(backend discovery.Backend) float64 {
+	state, ok := pe.states[backend.Address]
+	if !ok {
+		return 0
+	}
+	cost := state.cost
+	if cost == 0 && state.outstanding > 0 {
+		cost = float64(unprobedPenalty)
+	}
+	return cost * float64(state.outstanding+1)
+}
+
+// state returns the tracking state for backend, creating it if needed.
+// Callers must hold pe.mu.
+func (pe *PeakEWMA) state(backend discovery.Backend) *ewmaState {
+	state, ok := pe.states[backend.Address]
+	if !ok {
+		state = &ewmaState{lastUpdate: pe.now()}
+		pe.states[backend.Address] = state
+	}
+	return state
+}
+
+func (pe *PeakEWMA) Acquire(backend discovery.Backend) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.state(backend).outstanding++
+}
+
+func (pe *PeakEWMA) Release(backend discovery.Backend) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	state := pe.state(backend)
+	if state.outstanding > 0 {
+		state.outstanding--
+	}
+}
+
+func (pe *PeakEWMA) ObserveLatency(backend discovery.Backend, latency time.Duration) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	state := pe.state(backend)
+	now := pe.now()
+	rtt := float64(latency)
+	if rtt > state.cost {
+		state.cost = rtt
+	} else {
+		elapsed := now.Sub(state.lastUpdate)
+		w := math.Exp(-float64(elapsed) / float64(pe.decay))
+		state.cost = state.cost*w + rtt*(1-w)
+	}
+	state.lastUpdate = now
+}
@@ -0,0 +1,46 @@
+package strategy
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+// Random picks a backend uniformly at random. The generator is guarded by a
+// mutex because *rand.Rand is not safe for concurrent use.
+type Random struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// NewRandom creates a Random strategy seeded from the clock.
+func NewRandom() *Random {
+	return NewRandomWithSeed(time.Now().UnixNano())
+}
+
+// NewRandomWithSeed creates a Random strategy with a fixed seed so the
+// sequence of picks is repeatable, which is mostly useful in tests.
+func NewRandomWithSeed(seed int64) *Random {
+	return &Random{
+		rng: rand.New(rand.NewSource(seed)), // #nosec G404 -- backend selection does not need crypto randomness
+	}
+}
+
+func (rnd *Random) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	if len(backends) == 0 {
+		return discovery.Backend{}, ErrNoBackends
+	}
+	rnd.mu.Lock()
+	index := rnd.rng.Intn(len(backends))
+	rnd.mu.Unlock()
+
+	next := backends[index]
+	logging.Debug("Backend requested, sending %s", next)
+	return next, nil
+}
@@ -0,0 +1,101 @@
+package strategy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+const defaultVirtualNodes = 100
+
+type ringPoint struct {
+	hash    uint64
+	backend discovery.Backend
+}
+
+// RingHash places every backend on a hash ring many times (virtual nodes) and
+// sends each request to the first point clockwise of the request key's
+// hash. When a backend joins or leaves only the keys next to its points move,
+// so most clients keep landing on the same pod.
+type RingHash struct {
+	hashKey      string
+	virtualNodes int
+
+	mu      sync.Mutex
+	members string
+	ring    []ringPoint
+}
+
+func NewRingHash(hashKey string, virtualNodes int) *RingHash {
+	if hashKey == "" {
+		hashKey = hashKeyIP
+	}
+	if virtualNodes < 1 {
+		virtualNodes = defaultVirtualNodes
+	}
+	return &RingHash{
+		hashKey:      hashKey,
+		virtualNodes: virtualNodes,
+	}
+}
+
+func (rh *RingHash) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	if len(backends) == 0 {
+		return discovery.Backend{}, ErrNoBackends
+	}
+	key := requestKey(r, rh.hashKey)
+	next := rh.lookup(hashString(key), backends)
+	logging.Debug("Backend requested for key %s, sending %s", key, next)
+	return next, nil
+}
+
+func (rh *RingHash) lookup(hash uint64, backends []discovery.Backend) discovery.Backend {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	rh.rebuild(backends)
+	i := sort.Search(len(rh.ring), func(i int) bool {
+		return rh.ring[i].hash >= hash
+	})
+	if i == len(rh.ring) {
+		i = 0
+	}
+	return rh.ring[i].backend
+}
+
+// rebuild recomputes the ring when the set of backends has changed since the
+// last lookup. Callers must hold rh.mu.
+func (rh *RingHash) rebuild(backends []discovery.Backend) {
+	addresses := make([]string, len(backends))
+	for i, backend := range backends {
+		addresses[i] = backend.Address
+	}
+	sort.Strings(addresses)
+	members := strings.Join(addresses, ",")
+	if members == rh.members {
+		return
+	}
+
+	ring := make([]ringPoint, 0, len(backends)*rh.virtualNodes)
+	for _, backend := range backends {
+		for i := 0; i < rh.virtualNodes; i++ {
+			ring = append(ring, ringPoint{
+				hash:    hashString(fmt.Sprintf("%s#%d", backend.Address, i)),
+				backend: backend,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	rh.ring = ring
+	rh.members = members
+	logging.Debug("Rebuilt hash ring with %d backends", len(backends))
+}
@@ -0,0 +1,56 @@
+package strategy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+// Sharded sends each request to the StatefulSet pod owning its shard: the
+// request key's hash modulo the shard count picks the ordinal. A key always
+// lands on the same ordinal, so sharded backends only see their own keys.
+// Backends without an ordinal are never picked.
+type Sharded struct {
+	hashKey string
+	shards  int
+}
+
+// NewSharded keys requests on hashKey like RingHash. With shards 0 the count
+// is one more than the highest ordinal present, which moves keys whenever
+// the last pod is missing, so a fixed count is better for real shards.
+func NewSharded(hashKey string, shards int) *Sharded {
+	if hashKey == "" {
+		hashKey = hashKeyIP
+	}
+	return &Sharded{hashKey: hashKey, shards: shards}
+}
+
+func (s *Sharded) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	shards := s.shards
+	if shards == 0 {
+		for _, backend := range backends {
+			if backend.HasOrdinal && backend.Ordinal >= shards {
+				shards = backend.Ordinal + 1
+			}
+		}
+	}
+	if shards == 0 {
+		return discovery.Backend{}, ErrNoBackends
+	}
+
+	key := requestKey(r, s.hashKey)
+	shard := int(hashString(key) % uint64(shards))
+	for _, backend := range backends {
+		if backend.HasOrdinal && backend.Ordinal == shard {
+			logging.Debug("Backend requested for key %s, sending shard %d to %s", key, shard, backend)
+			return backend, nil
+		}
+	}
+	// Another pod would not have the shard's data, so the request fails
+	// until the shard's pod is back.
+	return discovery.Backend{}, fmt.Errorf("no backend for shard %d", shard)
+}
@@ -0,0 +1,91 @@
+package strategy
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+// SlowStart wraps another strategy and eases newly discovered backends into
+// rotation. A backend's share of traffic grows linearly from 0 to full over
+// window after it first shows up. Backends present on the very first pick
+// are treated as already warm so a balancer restart does not ramp the whole
+// pool. A backend is forgotten, and ramps again should it come back, once
+// it has been left out of the candidates for a whole window: picks that
+// leave it out for a while, like a retry after it failed, do not reset it.
+type SlowStart struct {
+	wrapped
+	window time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	rng     *rand.Rand
+	started bool
+	added   map[string]slowStartEntry
+}
+
+// slowStartEntry is when a backend showed up and when it was last among
+// the candidates.
+type slowStartEntry struct {
+	added time.Time
+	seen  time.Time
+}
+
+func NewSlowStart(inner Strategy, window time.Duration) *SlowStart {
+	return &SlowStart{
+		wrapped: wrapped{inner: inner},
+		window:  window,
+		now:     time.Now,
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())), // #nosec G404 -- traffic shaping does not need crypto randomness
+		added:   make(map[string]slowStartEntry),
+	}
+}
+
+func (ss *SlowStart) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	return ss.inner.Next(ctx, r, ss.admit(backends))
+}
+
+// admit drops each warming backend from the candidates with probability
+// equal to how far it still has to ramp. If that would leave nothing, the
+// full list is used.
+func (ss *SlowStart) admit(backends []discovery.Backend) []discovery.Backend {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	now := ss.now()
+	admitted := make([]discovery.Backend, 0, len(backends))
+	for _, backend := range backends {
+		entry, ok := ss.added[backend.Address]
+		if !ok {
+			entry.added = now
+			if !ss.started {
+				entry.added = now.Add(-ss.window)
+			}
+			logging.Debug("Slow start tracking %s", backend)
+		}
+		entry.seen = now
+		ss.added[backend.Address] = entry
+		ramp := float64(now.Sub(entry.added)) / float64(ss.window)
+		if ramp >= 1 || ss.rng.Float64() < ramp {
+			admitted = append(admitted, backend)
+		}
+	}
+	ss.started = true
+
+	for address, entry := range ss.added {
+		if now.Sub(entry.seen) > ss.window {
+			delete(ss.added, address)
+		}
+	}
+
+	if len(admitted) == 0 {
+		return backends
+	}
+	return admitted
+}
@@ -1,28 +1,220 @@
 package strategy
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"balancer/internal/discovery"
 
 	"pkg/logging"
 )
 
+// ErrNoBackends is returned by Next when there is nothing to pick from.
+var ErrNoBackends = errors.New("no backends available")
+
+// Strategy picks the backend for a request. Implementations keep whatever
+// state they need (counters, per-backend maps) themselves and must be safe
+// for concurrent use.
 type Strategy interface {
-	Next(backends []discovery.Backend, requests int) discovery.Backend
+	Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error)
+}
+
+// ConnectionTracker is implemented by strategies that need to know when a
+// request to a backend starts and finishes.
+type ConnectionTracker interface {
+	Acquire(backend discovery.Backend)
+	Release(backend discovery.Backend)
+}
+
+// LatencyTracker is implemented by strategies that learn from how long each
+// backend takes to answer.
+type LatencyTracker interface {
+	ObserveLatency(backend discovery.Backend, latency time.Duration)
+}
+
+// Stopper is implemented by strategies that run background work which has
+// to be shut down when the strategy is replaced.
+type Stopper interface {
+	Stop()
+}
+
+// Options carries the settings that only some strategies care about.
+type Options struct {
+	// Weights maps pod names to weights for weighted strategies.
+	Weights map[string]int
+	// HashKey names the request attribute hashing strategies key on, one of
+	// "ip", "header:<name>" or "cookie:<name>".
+	HashKey string
+	// VirtualNodes is the number of points each backend gets on a hash ring.
+	VirtualNodes int
+	// Shards is how many shards Sharded splits keys into. Zero counts the
+	// StatefulSet ordinals present.
+	Shards int
+	// HashHeader is the header HeaderHash pins requests on.
+	HashHeader string
+	// TrustForwardedFor lets IP based strategies read the client address
+	// from X-Forwarded-For.
+	TrustForwardedFor bool
+	// BackendPort is where strategies that talk to backends reach them.
+	BackendPort int
+	// PollInterval is how often Adaptive polls backend counters.
+	PollInterval time.Duration
+	// EWMADecay is how quickly PeakEWMA forgets old latency observations.
+	EWMADecay time.Duration
+	// SlowStartWindow ramps new backends up to full traffic over this long.
+	// Zero turns slow start off.
+	SlowStartWindow time.Duration
+	// Zone is the balancer's own zone. When set, backends in the same zone
+	// are preferred.
+	Zone string
+	// ZoneMinBackends is how many local backends are needed before traffic
+	// stays in Zone. Defaults to 1.
+	ZoneMinBackends int
+	// SubsetSize limits this balancer to a stable subset of this many
+	// backends. Zero uses every backend.
+	SubsetSize int
+	// SubsetID identifies this balancer replica when choosing its subset.
+	SubsetID string
+	// AffinityTTL keeps clients on the same backend until they have been
+	// idle this long. Zero turns affinity off.
+	AffinityTTL time.Duration
+	// AffinityMaxEntries caps the affinity table size.
+	AffinityMaxEntries int
+	// AffinityTable, when set, is used instead of a new table so several
+	// strategies can share sticky assignments.
+	AffinityTable *AffinityTable
+	// Inflight is the handler's shared count of outstanding requests, read
+	// by LeastOutstanding.
+	Inflight *InflightTracker
+	// Failover only offers the lowest Priority backends to the strategy.
+	Failover bool
+	// Hooks are told about every pick the strategy makes.
+	Hooks []Hook
+	// Params holds the options of each strategy by name, from the config's
+	// strategyoptions, see ApplyOptions. Those of the strategy being built
+	// win over the fields above.
+	Params map[string]json.RawMessage
+}
+
+// StrategyFactory builds a fresh Strategy from the shared options.
+type StrategyFactory func(opts Options) Strategy
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]StrategyFactory)
+)
+
+func init() {
+	Register("RoundRobin", func(opts Options) Strategy { return &RoundRobin{} })
+	Register("LeastConnections", func(opts Options) Strategy { return NewLeastConnections() })
+	Register("WeightedRoundRobin", func(opts Options) Strategy { return NewWeightedRoundRobin(opts.Weights) })
+	Register("WeightedLeastConnections", func(opts Options) Strategy { return NewWeightedLeastConnections(opts.Weights) })
+	Register("Random", func(opts Options) Strategy { return NewRandom() })
+	Register("RingHash", func(opts Options) Strategy { return NewRingHash(opts.HashKey, opts.VirtualNodes) })
+	Register("IPHash", func(opts Options) Strategy { return NewIPHash(opts.TrustForwardedFor) })
+	Register("HeaderHash", func(opts Options) Strategy { return NewHeaderHash(opts.HashHeader) })
+	Register("Adaptive", func(opts Options) Strategy { return NewAdaptive(opts.BackendPort, opts.PollInterval) })
+	Register("PeakEWMA", func(opts Options) Strategy { return NewPeakEWMA(opts.EWMADecay) })
+	Register("LeastOutstanding", func(opts Options) Strategy { return NewLeastOutstanding(opts.Inflight) })
+	Register("Sharded", func(opts Options) Strategy { return NewSharded(opts.HashKey, opts.Shards) })
+}
+
+// Register makes a strategy available under name, so it can be selected
+// with LoadbalancerMethod. Custom strategies call this from an init function
+// in their own package. It panics if name is already taken or factory is
+// nil, since both are programming errors.
+func Register(name string, factory StrategyFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic("strategy: Register factory is nil for " + name)
+	}
+	if _, exists := registry[name]; exists {
+		panic("strategy: Register called twice for " + name)
+	}
+	registry[name] = factory
 }
 
-func NewStrategy(method string) Strategy {
-	switch method {
-	case "RoundRobin":
-		return &RoundRobin{}
-	default:
-		return &RoundRobin{}
+// Names lists every registered strategy in sorted order.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
 }
 
-type RoundRobin struct{}
+// NewStrategy builds the strategy registered as method, falling back to
+// RoundRobin for unknown names, with its Params applied. It is wrapped in
+// SlowStart when a window is set, in ZoneAware when a zone is set, in
+// Subset when a subset size is set, in Affinity when an affinity TTL is set
+// and in Failover when backup pools are in use. When hooks are given the
+// result is finally wrapped in Observed, so hooks see the pick that is
+// actually used.
+func NewStrategy(method string, opts Options) Strategy {
+	registryMu.RLock()
+	factory, ok := registry[method]
+	registryMu.RUnlock()
 
-func (rr RoundRobin) Next(backends []discovery.Backend, requests int) discovery.Backend {
-	next := backends[requests%len(backends)]
+	applied := opts
+	if err := ApplyOptions(method, opts.Params[method], &applied); err != nil {
+		logging.Warning("Ignoring the options of %s: %v", method, err)
+	} else {
+		opts = applied
+	}
+
+	var s Strategy
+	if ok {
+		s = factory(opts)
+	} else {
+		logging.Warning("Unknown strategy %s, using RoundRobin", method)
+		s = &RoundRobin{}
+	}
+
+	if opts.SlowStartWindow > 0 {
+		s = NewSlowStart(s, opts.SlowStartWindow)
+	}
+	if opts.Zone != "" {
+		s = NewZoneAware(s, opts.Zone, opts.ZoneMinBackends)
+	}
+	if opts.SubsetSize > 0 {
+		s = NewSubset(s, opts.SubsetID, opts.SubsetSize)
+	}
+	if opts.AffinityTTL > 0 {
+		table := opts.AffinityTable
+		if table == nil {
+			table = NewAffinityTable(opts.AffinityTTL, opts.AffinityMaxEntries)
+		}
+		s = NewAffinity(s, opts.HashKey, table)
+	}
+	if opts.Failover {
+		s = NewFailover(s)
+	}
+	if len(opts.Hooks) > 0 {
+		s = NewObserved(s, method, opts.Hooks)
+	}
+	return s
+}
+
+type RoundRobin struct {
+	next atomic.Uint64
+}
+
+func (rr *RoundRobin) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	if len(backends) == 0 {
+		return discovery.Backend{}, ErrNoBackends
+	}
+	index := (rr.next.Add(1) - 1) % uint64(len(backends))
+	next := backends[index]
 	logging.Debug("Backend requested, sending %s", next)
-	return next
+	return next, nil
 }
@@ -0,0 +1,705 @@
+package strategy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"balancer/internal/discovery"
+)
+
+func mustNext(t *testing.T, s Strategy, r *http.Request, backends []discovery.Backend) discovery.Backend {
+	t.Helper()
+	if r == nil {
+		r = httptest.NewRequest("GET", "/", nil)
+	}
+	next, err := s.Next(context.Background(), r, backends)
+	if err != nil {
+		t.Fatalf("Next returned an error: %v", err)
+	}
+	return next
+}
+
+func testBackends() []discovery.Backend {
+	return []discovery.Backend{
+		{Address: "10.0.0.1", PodName: "a"},
+		{Address: "10.0.0.2", PodName: "b"},
+		{Address: "10.0.0.3", PodName: "c"},
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	backends := testBackends()
+	rr := &RoundRobin{}
+
+	for i := 0; i < 6; i++ {
+		assert.Equal(t, backends[i%3], mustNext(t, rr, nil, backends))
+	}
+}
+
+func TestLeastConnections_PicksFewest(t *testing.T) {
+	backends := testBackends()
+	lc := NewLeastConnections()
+
+	lc.Acquire(backends[0])
+	lc.Acquire(backends[0])
+	lc.Acquire(backends[1])
+
+	assert.Equal(t, backends[2], mustNext(t, lc, nil, backends))
+}
+
+func TestLeastConnections_Release(t *testing.T) {
+	backends := testBackends()
+	lc := NewLeastConnections()
+
+	lc.Acquire(backends[0])
+	lc.Acquire(backends[1])
+	lc.Acquire(backends[2])
+	lc.Release(backends[1])
+
+	assert.Equal(t, backends[1], mustNext(t, lc, nil, backends))
+}
+
+func TestLeastConnections_SpreadsTies(t *testing.T) {
+	backends := testBackends()
+	lc := NewLeastConnections()
+
+	assert.Equal(t, backends[0], mustNext(t, lc, nil, backends))
+	assert.Equal(t, backends[1], mustNext(t, lc, nil, backends))
+	assert.Equal(t, backends[2], mustNext(t, lc, nil, backends))
+}
+
+func TestLeastOutstanding_PicksFewest(t *testing.T) {
+	backends := testBackends()
+	tracker := NewInflightTracker()
+	lo := NewLeastOutstanding(tracker)
+
+	tracker.Start(backends[0])
+	tracker.Start(backends[2])
+	assert.Equal(t, backends[1], mustNext(t, lo, nil, backends))
+
+	tracker.Done(backends[0])
+	assert.Empty(t, tracker.Snapshot()[backends[0].Address])
+	assert.NotEqual(t, backends[2], mustNext(t, lo, nil, backends))
+}
+
+func TestInflightTracker_Forget(t *testing.T) {
+	backends := testBackends()
+	tracker := NewInflightTracker()
+	tracker.Start(backends[0])
+	tracker.Done(backends[0])
+	tracker.Start(backends[1])
+
+	tracker.Forget(backends[0])
+	tracker.Forget(backends[1])
+	_, ok := tracker.Requests()[backends[0].Address]
+	assert.False(t, ok)
+	// An address forgotten mid-request keeps its counts until it is done.
+	assert.Equal(t, uint64(1), tracker.Requests()[backends[1].Address])
+	tracker.Done(backends[1])
+	assert.Empty(t, tracker.Requests())
+}
+
+func TestLeastOutstanding_BreaksTiesRandomly(t *testing.T) {
+	backends := testBackends()
+	lo := NewLeastOutstanding(nil)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		seen[mustNext(t, lo, nil, backends).PodName] = true
+	}
+	assert.Len(t, seen, len(backends))
+}
+
+func TestWeightedRoundRobin_Smooth(t *testing.T) {
+	backends := testBackends()[:2]
+	wrr := NewWeightedRoundRobin(map[string]int{"a": 3})
+
+	var picks []string
+	for i := 0; i < 4; i++ {
+		picks = append(picks, mustNext(t, wrr, nil, backends).PodName)
+	}
+
+	assert.Equal(t, []string{"a", "a", "b", "a"}, picks)
+}
+
+func TestWeightedRoundRobin_DefaultWeight(t *testing.T) {
+	backends := testBackends()
+	wrr := NewWeightedRoundRobin(nil)
+
+	counts := map[string]int{}
+	for i := 0; i < 9; i++ {
+		counts[mustNext(t, wrr, nil, backends).PodName]++
+	}
+
+	assert.Equal(t, map[string]int{"a": 3, "b": 3, "c": 3}, counts)
+}
+
+func TestRandom_Seeded(t *testing.T) {
+	backends := testBackends()
+	first := NewRandomWithSeed(42)
+	second := NewRandomWithSeed(42)
+
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, mustNext(t, first, nil, backends), mustNext(t, second, nil, backends))
+	}
+}
+
+func TestRandom_UsesAllBackends(t *testing.T) {
+	backends := testBackends()
+	r := NewRandomWithSeed(1)
+
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		seen[mustNext(t, r, nil, backends).PodName] = true
+	}
+
+	assert.Len(t, seen, 3)
+}
+
+func TestRingHash_SameKeySameBackend(t *testing.T) {
+	backends := testBackends()
+	rh := NewRingHash("header:X-User", 50)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-User", "alice")
+
+	first := mustNext(t, rh, req, backends)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, first, mustNext(t, rh, req, backends))
+	}
+}
+
+func TestRingHash_MinimalMovement(t *testing.T) {
+	backends := testBackends()
+	rh := NewRingHash("cookie:session", 100)
+
+	assigned := map[string]discovery.Backend{}
+	for i := 0; i < 200; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: fmt.Sprintf("user-%d", i)})
+		assigned[fmt.Sprintf("user-%d", i)] = mustNext(t, rh, req, backends)
+	}
+
+	// Drop backend c; only the keys that were on c should move.
+	remaining := backends[:2]
+	for key, before := range assigned {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: key})
+		after := mustNext(t, rh, req, remaining)
+		if before.PodName != "c" {
+			assert.Equal(t, before, after, "key %s moved", key)
+		}
+	}
+}
+
+func TestSharded_RoutesByOrdinal(t *testing.T) {
+	backends := []discovery.Backend{
+		{Address: "10.0.0.9", PodName: "web-abcde"},
+		{Address: "10.0.0.2", PodName: "db-2", Ordinal: 2, HasOrdinal: true},
+		{Address: "10.0.0.0", PodName: "db-0", Ordinal: 0, HasOrdinal: true},
+		{Address: "10.0.0.1", PodName: "db-1", Ordinal: 1, HasOrdinal: true},
+	}
+	s := NewSharded("header:X-Tenant", 3)
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("tenant-%d", i)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Tenant", key)
+		backend := mustNext(t, s, req, backends)
+		assert.Equal(t, int(hashString(key)%3), backend.Ordinal)
+	}
+
+	// A shard whose pod is gone fails instead of landing elsewhere.
+	req := httptest.NewRequest("GET", "/", nil)
+	for i := 0; ; i++ {
+		req.Header.Set("X-Tenant", fmt.Sprintf("tenant-%d", i))
+		if hashString(req.Header.Get("X-Tenant"))%3 == 2 {
+			break
+		}
+	}
+	_, err := s.Next(context.Background(), req, backends[2:])
+	assert.Error(t, err)
+
+	_, err = NewSharded("", 0).Next(context.Background(), req, backends[:1])
+	assert.ErrorIs(t, err, ErrNoBackends)
+}
+
+func TestRingHash_FallsBackToClientIP(t *testing.T) {
+	backends := testBackends()
+	rh := NewRingHash("header:X-Missing", 10)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.1.10:5555"
+	other := httptest.NewRequest("GET", "/", nil)
+	other.RemoteAddr = "192.168.1.10:6666"
+
+	assert.Equal(t, mustNext(t, rh, req, backends), mustNext(t, rh, other, backends))
+}
+
+func TestIPHash_StablePerClient(t *testing.T) {
+	backends := testBackends()
+	ih := NewIPHash(false)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.16.0.5:1000"
+	first := mustNext(t, ih, req, backends)
+
+	req.RemoteAddr = "172.16.0.5:2000"
+	assert.Equal(t, first, mustNext(t, ih, req, backends))
+}
+
+func TestIPHash_ForwardedFor(t *testing.T) {
+	backends := testBackends()
+	trusted := NewIPHash(true)
+	untrusted := NewIPHash(false)
+
+	direct := httptest.NewRequest("GET", "/", nil)
+	direct.RemoteAddr = "203.0.113.7:1000"
+
+	proxied := httptest.NewRequest("GET", "/", nil)
+	proxied.RemoteAddr = "10.1.1.1:1000"
+	proxied.Header.Set("X-Forwarded-For", "203.0.113.7, 10.1.1.1")
+
+	assert.Equal(t, mustNext(t, trusted, direct, backends), mustNext(t, trusted, proxied, backends))
+	assert.Equal(t, "10.1.1.1", untrusted.clientIP(proxied))
+}
+
+func TestHeaderHash_PinsTenant(t *testing.T) {
+	backends := testBackends()
+	hh := NewHeaderHash("")
+
+	first := httptest.NewRequest("GET", "/orders", nil)
+	first.RemoteAddr = "10.9.0.1:1000"
+	first.Header.Set("X-Tenant-ID", "acme")
+	second := httptest.NewRequest("GET", "/invoices", nil)
+	second.RemoteAddr = "10.9.0.2:1000"
+	second.Header.Set("X-Tenant-ID", "acme")
+
+	assert.Equal(t, mustNext(t, hh, first, backends), mustNext(t, hh, second, backends))
+}
+
+func TestAdaptiveWeights(t *testing.T) {
+	weights := adaptiveWeights(map[string]int64{"a": 100, "b": 50, "c": 0})
+
+	assert.Equal(t, map[string]int{"a": 1, "b": 5, "c": 10}, weights)
+}
+
+func TestAdaptive_PollShiftsTraffic(t *testing.T) {
+	counts := map[string]int64{"127.0.0.1": 0, "127.0.0.2": 0}
+	listener, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.Host)
+		fmt.Fprintf(w, `{"count": %d}`, counts[host])
+	}))
+	upstream.Listener = listener
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+
+	a := NewAdaptive(listener.Addr().(*net.TCPAddr).Port, time.Hour)
+	t.Cleanup(a.Stop)
+
+	backends := []discovery.Backend{
+		{Address: "127.0.0.1", PodName: "busy"},
+		{Address: "127.0.0.2", PodName: "quiet"},
+	}
+	mustNext(t, a, nil, backends)
+	a.poll()
+	counts["127.0.0.1"] = 90
+	counts["127.0.0.2"] = 10
+	a.poll()
+
+	assert.Equal(t, map[string]int{"busy": 1, "quiet": 9}, a.wrr.weights)
+}
+
+func TestWeightedLeastConnections_Proportional(t *testing.T) {
+	backends := testBackends()[:2]
+	wlc := NewWeightedLeastConnections(map[string]int{"a": 2})
+
+	counts := map[string]int{}
+	for i := 0; i < 6; i++ {
+		next := mustNext(t, wlc, nil, backends)
+		wlc.Acquire(next)
+		counts[next.PodName]++
+	}
+
+	assert.Equal(t, map[string]int{"a": 4, "b": 2}, counts)
+}
+
+type firstBackend struct{}
+
+func (firstBackend) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	return backends[0], nil
+}
+
+func TestRegister_CustomStrategy(t *testing.T) {
+	Register("TestFirstBackend", func(opts Options) Strategy { return firstBackend{} })
+
+	assert.Contains(t, Names(), "TestFirstBackend")
+	assert.Equal(t, testBackends()[0], mustNext(t, NewStrategy("TestFirstBackend", Options{}), nil, testBackends()))
+}
+
+func TestRegister_DuplicatePanics(t *testing.T) {
+	assert.Panics(t, func() {
+		Register("RoundRobin", func(opts Options) Strategy { return &RoundRobin{} })
+	})
+}
+
+func TestNext_NoBackends(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, name := range Names() {
+		if name == "Adaptive" || name == "TestFirstBackend" {
+			continue
+		}
+		_, err := NewStrategy(name, Options{}).Next(context.Background(), req, nil)
+		assert.ErrorIs(t, err, ErrNoBackends, name)
+	}
+}
+
+func TestSlowStart_RampsNewBackend(t *testing.T) {
+	backends := testBackends()[:2]
+	now := time.Now()
+	ss := NewSlowStart(&RoundRobin{}, 10*time.Second)
+	ss.now = func() time.Time { return now }
+
+	// a is present from the start and so is warm.
+	mustNext(t, ss, nil, backends[:1])
+
+	countB := func() int {
+		count := 0
+		for i := 0; i < 1000; i++ {
+			if mustNext(t, ss, nil, backends).PodName == "b" {
+				count++
+			}
+		}
+		return count
+	}
+
+	assert.Equal(t, 0, countB())
+	now = now.Add(5 * time.Second)
+	assert.InDelta(t, 250, countB(), 60)
+	now = now.Add(5 * time.Second)
+	assert.Equal(t, 500, countB())
+}
+
+func TestSlowStart_RetryKeepsWarmBackend(t *testing.T) {
+	backends := testBackends()[:2]
+	now := time.Now()
+	ss := NewSlowStart(&RoundRobin{}, time.Hour)
+	ss.now = func() time.Time { return now }
+	mustNext(t, ss, nil, backends)
+
+	// A retry leaves a out, having failed on it.
+	assert.Equal(t, "b", mustNext(t, ss, nil, backends[1:]).PodName)
+	now = now.Add(time.Second)
+	count := 0
+	for i := 0; i < 100; i++ {
+		if mustNext(t, ss, nil, backends).PodName == "a" {
+			count++
+		}
+	}
+	assert.Equal(t, 50, count)
+
+	// Gone for longer than the window, a ramps again when it returns.
+	now = now.Add(2 * time.Hour)
+	mustNext(t, ss, nil, backends[1:])
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, "b", mustNext(t, ss, nil, backends).PodName)
+	}
+}
+
+func TestSlowStart_OnlyWarmingBackends(t *testing.T) {
+	ss := NewSlowStart(&RoundRobin{}, time.Minute)
+	// Nothing is known at start up, so b arrives later and is still cold.
+	ss.admit(nil)
+
+	assert.Equal(t, "b", mustNext(t, ss, nil, testBackends()[1:2]).PodName)
+}
+
+func TestZoneAware_PrefersLocal(t *testing.T) {
+	backends := []discovery.Backend{
+		{Address: "10.0.0.1", PodName: "a", Zone: "us-east-1a"},
+		{Address: "10.0.0.2", PodName: "b", Zone: "us-east-1b"},
+		{Address: "10.0.0.3", PodName: "c", Zone: "us-east-1a"},
+	}
+	za := NewZoneAware(&RoundRobin{}, "us-east-1a", 1)
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "us-east-1a", mustNext(t, za, nil, backends).Zone)
+	}
+}
+
+func TestZoneAware_SpillsOver(t *testing.T) {
+	backends := []discovery.Backend{
+		{Address: "10.0.0.1", PodName: "a", Zone: "us-east-1a"},
+		{Address: "10.0.0.2", PodName: "b", Zone: "us-east-1b"},
+	}
+	za := NewZoneAware(&RoundRobin{}, "us-east-1a", 2)
+
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		seen[mustNext(t, za, nil, backends).PodName] = true
+	}
+	assert.Len(t, seen, 2)
+}
+
+func TestFailover_UsesBackupOnlyWhenPrimaryEmpty(t *testing.T) {
+	primary := []discovery.Backend{{Address: "10.0.0.1", PodName: "a"}}
+	backup := discovery.WithPriority([]discovery.Backend{{Address: "10.0.1.1", PodName: "backup"}}, 1)
+	f := NewFailover(&RoundRobin{})
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "a", mustNext(t, f, nil, append(primary, backup...)).PodName)
+	}
+	assert.Equal(t, "backup", mustNext(t, f, nil, backup).PodName)
+	assert.Equal(t, "a", mustNext(t, f, nil, append(primary, backup...)).PodName)
+}
+
+func TestSubset_StableAndSized(t *testing.T) {
+	var backends []discovery.Backend
+	for i := 0; i < 20; i++ {
+		backends = append(backends, discovery.Backend{Address: fmt.Sprintf("10.0.0.%d", i), PodName: fmt.Sprintf("pod-%d", i)})
+	}
+	s := NewSubset(&RoundRobin{}, "balancer-0", 5)
+
+	subset := s.pick(backends)
+	assert.Len(t, subset, 5)
+
+	// Removing a backend outside the subset leaves the subset unchanged.
+	var outside int
+	for i, backend := range backends {
+		if !containsBackend(subset, backend) {
+			outside = i
+			break
+		}
+	}
+	shrunk := append(append([]discovery.Backend{}, backends[:outside]...), backends[outside+1:]...)
+	assert.ElementsMatch(t, subset, s.pick(shrunk))
+
+	other := NewSubset(&RoundRobin{}, "balancer-1", 5)
+	assert.NotEqual(t, subset, other.pick(backends))
+}
+
+func containsBackend(backends []discovery.Backend, want discovery.Backend) bool {
+	for _, backend := range backends {
+		if backend.Address == want.Address {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWeightFor_Precedence(t *testing.T) {
+	annotated := discovery.Backend{Address: "10.0.0.1", PodName: "a", Weight: 30}
+	plain := discovery.Backend{Address: "10.0.0.2", PodName: "b"}
+
+	assert.Equal(t, 30, weightFor(nil, annotated))
+	assert.Equal(t, 5, weightFor(map[string]int{"a": 5}, annotated))
+	assert.Equal(t, 1, weightFor(nil, plain))
+}
+
+func TestPeakEWMA_AvoidsSlowBackend(t *testing.T) {
+	backends := testBackends()[:2]
+	pe := NewPeakEWMA(time.Second)
+
+	pe.ObserveLatency(backends[0], 500*time.Millisecond)
+	pe.ObserveLatency(backends[1], 10*time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "b", mustNext(t, pe, nil, backends).PodName)
+	}
+}
+
+func TestPeakEWMA_OutstandingPenalty(t *testing.T) {
+	backends := testBackends()[:2]
+	pe := NewPeakEWMA(time.Second)
+
+	pe.ObserveLatency(backends[0], 10*time.Millisecond)
+	pe.ObserveLatency(backends[1], 15*time.Millisecond)
+	for i := 0; i < 5; i++ {
+		pe.Acquire(backends[0])
+	}
+
+	assert.Equal(t, "b", mustNext(t, pe, nil, backends).PodName)
+}
+
+func TestPeakEWMA_DecaysAfterPeak(t *testing.T) {
+	backend := testBackends()[0]
+	now := time.Now()
+	pe := NewPeakEWMA(time.Second)
+	pe.now = func() time.Time { return now }
+
+	pe.ObserveLatency(backend, time.Second)
+	now = now.Add(10 * time.Second)
+	pe.ObserveLatency(backend, 10*time.Millisecond)
+
+	assert.InDelta(t, float64(10*time.Millisecond), pe.states[backend.Address].cost, float64(time.Millisecond))
+}
+
+func TestAffinityTable_ExpiresAndEvicts(t *testing.T) {
+	now := time.Now()
+	at := NewAffinityTable(time.Minute, 2)
+	at.now = func() time.Time { return now }
+
+	at.Set("a", "10.0.0.1")
+	at.Set("b", "10.0.0.2")
+	at.Get("a")
+	at.Set("c", "10.0.0.3")
+
+	_, ok := at.Get("b")
+	assert.False(t, ok, "least recently used entry should be evicted")
+	assert.Equal(t, 2, at.Len())
+
+	now = now.Add(2 * time.Minute)
+	_, ok = at.Get("a")
+	assert.False(t, ok, "idle entry should expire")
+}
+
+func TestAffinity_StickyUntilBackendLeaves(t *testing.T) {
+	backends := testBackends()
+	a := NewAffinity(&RoundRobin{}, "header:X-Session", NewAffinityTable(time.Minute, 10))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Session", "s1")
+	first := mustNext(t, a, req, backends)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, first, mustNext(t, a, req, backends))
+	}
+
+	var remaining []discovery.Backend
+	for _, backend := range backends {
+		if backend.Address != first.Address {
+			remaining = append(remaining, backend)
+		}
+	}
+	assert.NotEqual(t, first, mustNext(t, a, req, remaining))
+}
+
+func TestObserved_CallsHooks(t *testing.T) {
+	var decisions []Decision
+	hook := HookFunc(func(d Decision) { decisions = append(decisions, d) })
+	s := NewStrategy("RoundRobin", Options{Hooks: []Hook{hook}})
+
+	next := mustNext(t, s, nil, testBackends())
+	_, err := s.Next(context.Background(), httptest.NewRequest("GET", "/", nil), nil)
+
+	assert.Len(t, decisions, 2)
+	assert.Equal(t, "RoundRobin", decisions[0].Method)
+	assert.Equal(t, next, decisions[0].Backend)
+	assert.Equal(t, 3, decisions[0].Candidates)
+	assert.ErrorIs(t, decisions[1].Err, ErrNoBackends)
+	assert.ErrorIs(t, err, ErrNoBackends)
+}
+
+func TestOutlierDetector_EjectsAndReadmits(t *testing.T) {
+	now := time.Unix(1000, 0)
+	detector := NewOutlierDetector(OutlierOptions{ConsecutiveFailures: 3, BaseEjectionTime: time.Minute})
+	detector.now = func() time.Time { return now }
+	backends := testBackends()
+	bad := backends[0]
+
+	detector.Observe(bad, true)
+	detector.Observe(bad, true)
+	detector.Observe(bad, false)
+	detector.Observe(bad, true)
+	detector.Observe(bad, true)
+	assert.False(t, detector.Ejected(bad), "a success should reset the run of failures")
+
+	detector.Observe(bad, true)
+	assert.True(t, detector.Ejected(bad))
+	assert.NotContains(t, detector.Filter(backends), bad)
+	assert.Len(t, detector.Filter(backends), len(backends)-1)
+
+	now = now.Add(time.Minute)
+	assert.False(t, detector.Ejected(bad))
+	assert.Contains(t, detector.Filter(backends), bad)
+
+	// The second ejection lasts twice as long.
+	for i := 0; i < 3; i++ {
+		detector.Observe(bad, true)
+	}
+	now = now.Add(time.Minute)
+	assert.True(t, detector.Ejected(bad))
+	now = now.Add(time.Minute)
+	assert.False(t, detector.Ejected(bad))
+}
+
+func TestOutlierDetector_ErrorRate(t *testing.T) {
+	detector := NewOutlierDetector(OutlierOptions{ErrorRatePercent: 50, MinRequests: 10})
+	backend := testBackends()[0]
+
+	for i := 0; i < 9; i++ {
+		detector.Observe(backend, i%2 == 0)
+	}
+	assert.False(t, detector.Ejected(backend), "too few requests to judge")
+	detector.Observe(backend, true)
+	assert.True(t, detector.Ejected(backend))
+}
+
+func TestOutlierDetector_NeverEjectsEveryone(t *testing.T) {
+	detector := NewOutlierDetector(OutlierOptions{ConsecutiveFailures: 1})
+	backends := testBackends()
+	for _, backend := range backends {
+		detector.Observe(backend, true)
+	}
+	assert.Equal(t, backends, detector.Filter(backends))
+}
+
+func TestApplyOptions(t *testing.T) {
+	opts := Options{HashKey: "ip", VirtualNodes: 50}
+	assert.NoError(t, ApplyOptions("RingHash", json.RawMessage(`{"virtualnodes": 200, "slowstartwindow": "30s"}`), &opts))
+	assert.Equal(t, 200, opts.VirtualNodes)
+	assert.Equal(t, "ip", opts.HashKey, "options left out keep their value")
+	assert.Equal(t, 30*time.Second, opts.SlowStartWindow)
+
+	assert.NoError(t, ApplyOptions("PeakEWMA", json.RawMessage(`{"decay": "5s"}`), &opts))
+	assert.Equal(t, 5*time.Second, opts.EWMADecay)
+	assert.NoError(t, ApplyOptions("RoundRobin", json.RawMessage(`{"slowstartwindow": "1m"}`), &opts))
+	assert.NoError(t, ApplyOptions("RoundRobin", nil, &opts))
+
+	for method, params := range map[string]string{
+		"RingHash":   `{"virtualnodes": -1}`,
+		"Sharded":    `{"hashkey": "header:"}`,
+		"HeaderHash": `{"hashheader": "X-User"}`,
+		"PeakEWMA":   `{"decay": 5}`,
+		"RoundRobin": `{"virtualnodes": 10}`,
+		"Random":     `{"slowstartwindow": "-1s"}`,
+		"IPHash":     `[]`,
+		// backendweights rejects a weight of 0 too, which weightFor
+		// would otherwise take as unset.
+		"WeightedRoundRobin":       `{"weights": {"a": 0}}`,
+		"WeightedLeastConnections": `{"weights": {"a": -1}}`,
+	} {
+		assert.Error(t, ApplyOptions(method, json.RawMessage(params), &Options{}), "%s with %s", method, params)
+	}
+}
+
+func TestNewStrategy_Params(t *testing.T) {
+	opts := Options{
+		VirtualNodes: 50,
+		Params: map[string]json.RawMessage{
+			"RingHash":   json.RawMessage(`{"hashkey": "header:X-User", "virtualnodes": 10, "slowstartwindow": "1m"}`),
+			"RoundRobin": json.RawMessage(`{"virtualnodes": 10}`),
+		},
+	}
+	slowStart, ok := NewStrategy("RingHash", opts).(*SlowStart)
+	assert.True(t, ok, "slowstartwindow wraps the strategy in SlowStart")
+	assert.Equal(t, time.Minute, slowStart.window)
+	ringHash := slowStart.inner.(*RingHash)
+	assert.Equal(t, "header:X-User", ringHash.hashKey)
+	assert.Equal(t, 10, ringHash.virtualNodes)
+
+	// Options that do not apply are ignored rather than failing the build.
+	_, ok = NewStrategy("RoundRobin", opts).(*RoundRobin)
+	assert.True(t, ok)
+}
@@ -0,0 +1,69 @@
+package strategy
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+// Subset wraps another strategy and limits each balancer replica to a
+// stable subset of size backends. Every backend is scored by hashing it
+// with the replica's id and the highest scores are kept, so different
+// replicas spread across the pool while each one keeps the same subset as
+// backends come and go.
+type Subset struct {
+	wrapped
+	id   string
+	size int
+
+	mu      sync.Mutex
+	members string
+	subset  []discovery.Backend
+}
+
+func NewSubset(inner Strategy, id string, size int) *Subset {
+	return &Subset{
+		wrapped: wrapped{inner: inner},
+		id:      id,
+		size:    size,
+	}
+}
+
+func (s *Subset) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	return s.inner.Next(ctx, r, s.pick(backends))
+}
+
+func (s *Subset) pick(backends []discovery.Backend) []discovery.Backend {
+	if len(backends) <= s.size {
+		return backends
+	}
+
+	addresses := make([]string, len(backends))
+	for i, backend := range backends {
+		addresses[i] = backend.Address
+	}
+	sort.Strings(addresses)
+	members := strings.Join(addresses, ",")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if members == s.members {
+		return s.subset
+	}
+
+	scored := make([]discovery.Backend, len(backends))
+	copy(scored, backends)
+	sort.Slice(scored, func(i, j int) bool {
+		return hashString(s.id+"|"+scored[i].Address) > hashString(s.id+"|"+scored[j].Address)
+	})
+	s.subset = scored[:s.size]
+	s.members = members
+	logging.Debug("Subset for %s is now %v", s.id, s.subset)
+	return s.subset
+}
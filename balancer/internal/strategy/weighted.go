@@ -0,0 +1,85 @@
+package strategy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+// WeightedRoundRobin uses smooth weighted round robin (the algorithm nginx
+// uses) so a backend with weight 3 next to one with weight 1 is picked
+// a, a, b, a rather than a, a, a, b. Weights are keyed by pod name; backends
+// missing from the table use their discovered Weight, or 1.
+type WeightedRoundRobin struct {
+	mu      sync.Mutex
+	weights map[string]int
+	current map[string]int
+}
+
+func NewWeightedRoundRobin(weights map[string]int) *WeightedRoundRobin {
+	return &WeightedRoundRobin{
+		weights: weights,
+		current: make(map[string]int),
+	}
+}
+
+// SetWeights replaces the weight table, keeping the in-progress rotation.
+func (wrr *WeightedRoundRobin) SetWeights(weights map[string]int) {
+	wrr.mu.Lock()
+	defer wrr.mu.Unlock()
+	wrr.weights = weights
+}
+
+func (wrr *WeightedRoundRobin) weight(backend discovery.Backend) int {
+	return weightFor(wrr.weights, backend)
+}
+
+// weightFor looks up a backend's weight by pod name, then falls back to the
+// weight discovery found on the pod, and finally to 1.
+func weightFor(weights map[string]int, backend discovery.Backend) int {
+	if weight, ok := weights[backend.PodName]; ok && weight >= 1 {
+		return weight
+	}
+	if backend.Weight >= 1 {
+		return backend.Weight
+	}
+	return 1
+}
+
+func (wrr *WeightedRoundRobin) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	if len(backends) == 0 {
+		return discovery.Backend{}, ErrNoBackends
+	}
+	wrr.mu.Lock()
+	defer wrr.mu.Unlock()
+
+	total := 0
+	best := -1
+	seen := make(map[string]bool, len(backends))
+	for i, backend := range backends {
+		weight := wrr.weight(backend)
+		total += weight
+		wrr.current[backend.Address] += weight
+		seen[backend.Address] = true
+		if best == -1 || wrr.current[backend.Address] > wrr.current[backends[best].Address] {
+			best = i
+		}
+	}
+
+	// Forget backends that have left the list so they start fresh if they
+	// come back.
+	for address := range wrr.current {
+		if !seen[address] {
+			delete(wrr.current, address)
+		}
+	}
+
+	next := backends[best]
+	wrr.current[next.Address] -= total
+	logging.Debug("Backend requested, sending %s with weight %d", next, wrr.weight(next))
+	return next, nil
+}
@@ -0,0 +1,46 @@
+package strategy
+
+import (
+	"context"
+	"net/http"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+// WeightedLeastConnections picks the backend with the lowest ratio of active
+// connections to weight, so a pod with weight 2 carries twice the
+// concurrent requests of a pod with weight 1.
+type WeightedLeastConnections struct {
+	*LeastConnections
+	weights map[string]int
+}
+
+func NewWeightedLeastConnections(weights map[string]int) *WeightedLeastConnections {
+	return &WeightedLeastConnections{
+		LeastConnections: NewLeastConnections(),
+		weights:          weights,
+	}
+}
+
+func (wlc *WeightedLeastConnections) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	if len(backends) == 0 {
+		return discovery.Backend{}, ErrNoBackends
+	}
+	wlc.mu.Lock()
+	defer wlc.mu.Unlock()
+
+	start := wlc.rotation % len(backends)
+	wlc.rotation++
+	next := backends[start]
+	for i := 1; i < len(backends); i++ {
+		backend := backends[(start+i)%len(backends)]
+		// Compare active/weight ratios by cross multiplying to stay in ints.
+		if wlc.active[backend.Address]*weightFor(wlc.weights, next) < wlc.active[next.Address]*weightFor(wlc.weights, backend) {
+			next = backend
+		}
+	}
+	logging.Debug("Backend requested, sending %s with %d active connections", next, wlc.active[next.Address])
+	return next, nil
+}
@@ -0,0 +1,38 @@
+package strategy
+
+import (
+	"time"
+
+	"balancer/internal/discovery"
+)
+
+// wrapped is embedded by strategies that decorate another strategy. It
+// passes connection and latency tracking through to the inner strategy when
+// it wants them.
+type wrapped struct {
+	inner Strategy
+}
+
+func (w wrapped) Acquire(backend discovery.Backend) {
+	if tracker, ok := w.inner.(ConnectionTracker); ok {
+		tracker.Acquire(backend)
+	}
+}
+
+func (w wrapped) Release(backend discovery.Backend) {
+	if tracker, ok := w.inner.(ConnectionTracker); ok {
+		tracker.Release(backend)
+	}
+}
+
+func (w wrapped) ObserveLatency(backend discovery.Backend, latency time.Duration) {
+	if tracker, ok := w.inner.(LatencyTracker); ok {
+		tracker.ObserveLatency(backend, latency)
+	}
+}
+
+func (w wrapped) Stop() {
+	if stopper, ok := w.inner.(Stopper); ok {
+		stopper.Stop()
+	}
+}
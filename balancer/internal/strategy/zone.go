@@ -0,0 +1,44 @@
+package strategy
+
+import (
+	"context"
+	"net/http"
+
+	"balancer/internal/discovery"
+
+	"pkg/logging"
+)
+
+// ZoneAware wraps another strategy and keeps traffic inside the balancer's
+// own zone. It only spills over to the whole pool when fewer than
+// minBackends backends are available locally.
+type ZoneAware struct {
+	wrapped
+	zone        string
+	minBackends int
+}
+
+func NewZoneAware(inner Strategy, zone string, minBackends int) *ZoneAware {
+	if minBackends < 1 {
+		minBackends = 1
+	}
+	return &ZoneAware{
+		wrapped:     wrapped{inner: inner},
+		zone:        zone,
+		minBackends: minBackends,
+	}
+}
+
+func (za *ZoneAware) Next(ctx context.Context, r *http.Request, backends []discovery.Backend) (discovery.Backend, error) {
+	local := make([]discovery.Backend, 0, len(backends))
+	for _, backend := range backends {
+		if backend.Zone == za.zone {
+			local = append(local, backend)
+		}
+	}
+	if len(local) < za.minBackends {
+		logging.Debug("Only %d backends in zone %s, spilling over to all %d", len(local), za.zone, len(backends))
+		return za.inner.Next(ctx, r, backends)
+	}
+	return za.inner.Next(ctx, r, local)
+}
@@ -1,3 +1,5 @@
 module pkg
 
 go 1.22.2
+
+require github.com/pelletier/go-toml/v2 v2.4.3
@@ -1,12 +1,15 @@
 package logging
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
 )
 
-var Level int = INFO
-
 const (
 	DEBUG  = 0
 	INFO   = 1
@@ -15,34 +18,131 @@ const (
 	SILENT = 4
 )
 
-func Debug(input string, args ...any) {
-	if Level > DEBUG {
-		return
+// Formats of the log lines, set with SetFormat.
+const (
+	// FormatText writes key=value pairs, the default.
+	FormatText = "text"
+	// FormatJSON writes one JSON object per line.
+	FormatJSON = "json"
+)
+
+var (
+	logger atomic.Pointer[slog.Logger]
+	level  atomic.Int32
+)
+
+func init() {
+	logger.Store(newLogger(FormatText, os.Stderr))
+	level.Store(INFO)
+}
+
+// SetLevel logs the lines at level and above from now on, one of DEBUG,
+// INFO, WARN, ERROR or SILENT. It defaults to INFO.
+func SetLevel(l int) {
+	level.Store(int32(l))
+}
+
+// GetLevel returns the level set with SetLevel.
+func GetLevel() int {
+	return int(level.Load())
+}
+
+// Enabled reports whether lines at l are logged, to skip building the
+// details of those that are not.
+func Enabled(l int) bool {
+	return GetLevel() <= l
+}
+
+// ParseLevel returns the level named debug, info, warn or error. Empty is
+// INFO.
+func ParseLevel(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return DEBUG, nil
+	case "", "info":
+		return INFO, nil
+	case "warn", "warning":
+		return WARN, nil
+	case "error":
+		return ERROR, nil
 	}
-	msg := fmt.Sprintf(input, args...)
-	log.Printf("[DEBUG] - %s", msg)
+	return 0, fmt.Errorf("unknown log level %q, use debug, info, warn or error", name)
 }
 
-func Info(input string, args ...any) {
-	if Level > INFO {
-		return
+// leveler hands slog the level set with SetLevel, so changing it takes
+// effect on the next line logged.
+type leveler struct{}
+
+func (leveler) Level() slog.Level {
+	switch GetLevel() {
+	case DEBUG:
+		return slog.LevelDebug
+	case INFO:
+		return slog.LevelInfo
+	case WARN:
+		return slog.LevelWarn
+	case ERROR:
+		return slog.LevelError
 	}
-	msg := fmt.Sprintf(input, args...)
-	log.Printf("[INFO] - %s", msg)
+	return slog.LevelError + 4
 }
 
-func Warning(input string, args ...any) {
-	if Level > WARN {
-		return
+func newLogger(format string, w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: leveler{}}
+	if format == FormatJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
 	}
-	msg := fmt.Sprintf(input, args...)
-	log.Printf("[WARN] - %s", msg)
+	return slog.New(slog.NewTextHandler(w, opts))
 }
 
-func Error(input string, args ...any) {
-	if Level > ERROR {
+// ValidFormat reports whether format is one SetFormat takes. Empty is the
+// default, FormatText.
+func ValidFormat(format string) bool {
+	return format == "" || format == FormatText || format == FormatJSON
+}
+
+// SetFormat writes the lines logged from now on to stderr in format,
+// FormatText or FormatJSON. Empty uses FormatText.
+func SetFormat(format string) error {
+	return setup(format, os.Stderr)
+}
+
+func setup(format string, w io.Writer) error {
+	if !ValidFormat(format) {
+		return fmt.Errorf("unknown log format %q, use %s or %s", format, FormatText, FormatJSON)
+	}
+	logger.Store(newLogger(format, w))
+	return nil
+}
+
+// Logger returns the logger the functions below write to, for lines with
+// fields of their own:
+//
+//	logging.Logger().Debug("Proxied request", "backend", pod, "status", 200)
+func Logger() *slog.Logger {
+	return logger.Load()
+}
+
+func logf(level slog.Level, input string, args ...any) {
+	l := logger.Load()
+	if !l.Enabled(context.Background(), level) {
 		return
 	}
-	msg := fmt.Sprintf(input, args...)
-	log.Printf("[ERROR] - %s", msg)
+	l.Log(context.Background(), level, fmt.Sprintf(input, args...))
+}
+
+func Debug(input string, args ...any) {
+	logf(slog.LevelDebug, input, args...)
+}
+
+func Info(input string, args ...any) {
+	logf(slog.LevelInfo, input, args...)
+}
+
+func Warning(input string, args ...any) {
+	logf(slog.LevelWarn, input, args...)
+}
+
+func Error(input string, args ...any) {
+	logf(slog.LevelError, input, args...)
 }
@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSetup_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := setup(FormatJSON, &buf); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	t.Cleanup(func() { setup(FormatText, os.Stderr) })
+
+	Info("Serving %s", "api")
+	Logger().Warn("Proxy error", "backend", "api-0", "status", 502)
+	Debug("Not logged at the info level")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", lines)
+	}
+	var first, second map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatalf("Expected a JSON line, got %q: %v", lines[0], err)
+	}
+	if first["level"] != "INFO" || first["msg"] != "Serving api" {
+		t.Errorf("Expected the formatted message at INFO, got %v", first)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &second); err != nil {
+		t.Fatalf("Expected a JSON line, got %q: %v", lines[1], err)
+	}
+	if second["backend"] != "api-0" || second["status"] != float64(502) {
+		t.Errorf("Expected the fields on the line, got %v", second)
+	}
+}
+
+func TestSetup_Text(t *testing.T) {
+	var buf bytes.Buffer
+	if err := setup("", &buf); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	t.Cleanup(func() { setup(FormatText, os.Stderr) })
+
+	Error("Failed to listen on %s", ":8080")
+	if got := buf.String(); !strings.Contains(got, `level=ERROR msg="Failed to listen on :8080"`) {
+		t.Errorf("Expected a text line, got %q", got)
+	}
+	if err := setup("xml", &buf); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	var buf bytes.Buffer
+	if err := setup(FormatText, &buf); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	t.Cleanup(func() {
+		setup(FormatText, os.Stderr)
+		SetLevel(INFO)
+	})
+
+	level, err := ParseLevel("warn")
+	if err != nil || level != WARN {
+		t.Fatalf("Expected WARN, got %d, %v", level, err)
+	}
+	SetLevel(level)
+	Info("Dropped")
+	Logger().Info("Dropped too")
+	Warning("Kept")
+	if got := buf.String(); strings.Contains(got, "Dropped") || !strings.Contains(got, "Kept") {
+		t.Errorf("Expected only the warning, got %q", got)
+	}
+	if Enabled(DEBUG) || !Enabled(ERROR) {
+		t.Error("Expected only WARN and up to be enabled")
+	}
+
+	SetLevel(DEBUG)
+	Debug("Now logged")
+	if !strings.Contains(buf.String(), "level=DEBUG") {
+		t.Errorf("Expected the debug line, got %q", buf.String())
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+}
@@ -0,0 +1,84 @@
+// Package toml reads TOML documents into plain Go values, so TOML configs
+// can be decoded into the same structs as JSON ones.
+package toml
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// ToJSON converts a TOML document to JSON. Tables become objects and dates
+// and times become RFC 3339 strings.
+func ToJSON(data []byte) ([]byte, error) {
+	doc, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// Parse reads a TOML document. Tables are map[string]any, arrays are []any,
+// integers are int64, floats are float64 and dates and times are strings.
+// Floats that JSON cannot hold, inf and nan, are rejected.
+func Parse(data []byte) (map[string]any, error) {
+	var doc map[string]any
+	if err := toml.Unmarshal(data, &doc); err != nil {
+		var derr *toml.DecodeError
+		if errors.As(err, &derr) {
+			line, _ := derr.Position()
+			return nil, fmt.Errorf("line %d: %s", line, strings.TrimPrefix(derr.Error(), "toml: "))
+		}
+		return nil, err
+	}
+	if doc == nil {
+		doc = map[string]any{}
+	}
+	root, err := plain(nil, doc)
+	if err != nil {
+		return nil, err
+	}
+	return root.(map[string]any), nil
+}
+
+// plain converts value, found at key, from what the decoder gives to the
+// types Parse documents.
+func plain(key []string, value any) (any, error) {
+	switch value := value.(type) {
+	case map[string]any:
+		table := make(map[string]any, len(value))
+		for k, v := range value {
+			v, err := plain(append(key, k), v)
+			if err != nil {
+				return nil, err
+			}
+			table[k] = v
+		}
+		return table, nil
+	case []any:
+		array := make([]any, len(value))
+		for i, v := range value {
+			v, err := plain(key, v)
+			if err != nil {
+				return nil, err
+			}
+			array[i] = v
+		}
+		return array, nil
+	case float64:
+		if math.IsInf(value, 0) || math.IsNaN(value) {
+			return nil, fmt.Errorf("key %q: %v is not a number a config can hold", strings.Join(key, "."), value)
+		}
+		return value, nil
+	case time.Time:
+		return value.Format(time.RFC3339Nano), nil
+	case toml.LocalDate, toml.LocalTime, toml.LocalDateTime:
+		return fmt.Sprint(value), nil
+	}
+	return value, nil
+}
@@ -0,0 +1,77 @@
+package toml
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestToJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		toml string
+		json string
+	}{
+		{"key values", "name = \"api\" # the pool\nport = 8_080\nratio = 0.5\ntls = false\n", `{"name":"api","port":8080,"ratio":0.5,"tls":false}`},
+		{"tables", "[upstream]\ntimeout = '5s'\n\n[upstream.retry]\nattempts = 3\n", `{"upstream":{"retry":{"attempts":3},"timeout":"5s"}}`},
+		{"dotted keys", "health.path = \"/healthz\"\n\"quoted.key\" = 1\n", `{"health":{"path":"/healthz"},"quoted.key":1}`},
+		{"arrays", "codes = [\n  200,\n  204, # no content\n]\nempty = []\n", `{"codes":[200,204],"empty":[]}`},
+		{"inline tables", "headers = { X-Probe = \"balancer\", Host = 'admin' }\n", `{"headers":{"Host":"admin","X-Probe":"balancer"}}`},
+		{"arrays of tables", "[[routes]]\npath = \"/a\"\n[routes.match]\nhost = \"a\"\n\n[[routes]]\npath = \"/b\"\n", `{"routes":[{"match":{"host":"a"},"path":"/a"},{"path":"/b"}]}`},
+		{"escapes", `s = "tab\there \"quoted\" \u00e9"` + "\n", `{"s":"tab\there \"quoted\" é"}`},
+		{"multiline strings", "a = \"\"\"\nline one\nline \\\n   two\"\"\"\nb = '''\nC:\\raw'''\n", `{"a":"line one\nline two","b":"C:\\raw"}`},
+		{"integers", "hex = 0xff\noct = 0o17\nbin = 0b101\nneg = -3\n", `{"bin":5,"hex":255,"neg":-3,"oct":15}`},
+		{"dates", "at = 1979-05-27T07:32:00Z\nday = 1979-05-27\nspaced = 1979-05-27 07:32:00\n", `{"at":"1979-05-27T07:32:00Z","day":"1979-05-27","spaced":"1979-05-27T07:32:00"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ToJSON([]byte(tt.toml))
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			if string(got) != tt.json {
+				t.Errorf("Expected %s, got %s", tt.json, got)
+			}
+		})
+	}
+}
+
+func TestToJSON_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		toml string
+	}{
+		{"duplicate key", "a = 1\na = 2\n"},
+		{"missing value", "a =\n"},
+		{"missing equals", "a 1\n"},
+		{"unclosed string", "a = \"open\n"},
+		{"unclosed array", "a = [1, 2\n"},
+		{"trailing garbage", "a = 1 2\n"},
+		{"key is not a table", "a = 1\n[a]\n"},
+		{"bad escape", `a = "\q"` + "\n"},
+		{"table defined twice", "[a]\nb = 1\n[a]\nc = 2\n"},
+		{"table over an array of tables", "[[a]]\nb = 1\n[a]\nc = 2\n"},
+		{"array of tables over an array", "a = [1]\n[[a]]\nb = 1\n"},
+		{"dotted key into an inline table", "a = { b = 1 }\na.c = 2\n"},
+		{"table over an inline table", "a = { b = 1 }\n[a.c]\n"},
+		{"inf", "a = inf\n"},
+		{"nan", "[pool]\nweight = -nan\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ToJSON([]byte(tt.toml)); err == nil {
+				t.Error("Expected an error, but the document parsed?")
+			}
+		})
+	}
+}
+
+func TestToJSON_ErrorLine(t *testing.T) {
+	_, err := ToJSON([]byte("a = 1\n\nb = \"open\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3: ") {
+		t.Errorf("Expected an error on line 3, got: %v", err)
+	}
+	_, err = ToJSON([]byte("[pool]\nweight = inf\n"))
+	if err == nil || !strings.Contains(err.Error(), `"pool.weight"`) {
+		t.Errorf("Expected an error naming pool.weight, got: %v", err)
+	}
+}